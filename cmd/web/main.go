@@ -5,42 +5,124 @@ import (
 	"bookings/internal/driver"
 	"bookings/internal/handlers"
 	"bookings/internal/helpers"
+	"bookings/internal/icalsync"
+	"bookings/internal/mailer"
+	"bookings/internal/migrate"
 	"bookings/internal/models"
 	"bookings/internal/render"
+	"bookings/internal/scheduler"
+	"context"
 	"encoding/gob"
-	"flag"
 	"fmt"
 	"github.com/alexedwards/scs/v2"
-	"github.com/fatih/color"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
-const port = ":8080"
-
 var app config.AppConfig
 var session *scs.SessionManager
-var infoLog *log.Logger
-var errorLog *log.Logger
+
+// shutdownTimeout is how long in-flight requests and queued mail get to finish once asked to stop
+const shutdownTimeout = 30 * time.Second
 
 func main() {
-	db, err := run()
+	db, err := run(os.Args[1:])
 	errFatal(err)
-	defer db.SQL.Close()
 
-	defer close(app.MailChan)
-	color.Cyan("Starting mail listener...")
-	listenForMail()
+	if len(app.Args) > 0 {
+		m, err := migrate.New(db.SQL, db.Driver, app.Logger)
+		if err == nil {
+			err = command(context.Background(), m, app.Args, os.Stdout)
+		}
+		db.SQL.Close()
+		errFatal(err)
+		return
+	}
 
-	color.Green("Application has started on port %s", port)
-	srv := &http.Server{Addr: port, Handler: routes(&app)}
-	err = srv.ListenAndServe()
-	errFatal(err)
+	// the background work stops when ctx is done, on the first interrupt or SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	app.Logger.Info("starting mailer")
+	mail := mailer.New(handlers.Repo.DB, smtpSender{SMTP: app.SMTP}, app.Logger)
+	app.Mail = mail
+	mail.Start()
+
+	app.Logger.Info("starting guest email scheduler")
+	scheduled := scheduler.New(&app, handlers.Repo.DB).Start(ctx, time.Hour)
+
+	app.Logger.Info("starting calendar sync", "interval", app.ICalSyncInterval)
+	synced := icalsync.New(handlers.Repo.DB, app.Logger).Start(ctx, app.ICalSyncInterval)
+
+	srv := &http.Server{
+		Addr:              app.Addr,
+		Handler:           routes(&app),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	serveErr := make(chan error, 2)
+	go func() {
+		app.Logger.Info("application has started", "addr", app.Addr)
+		serveErr <- srv.ListenAndServe()
+	}()
+
+	var metricsSrv *http.Server
+	if app.MetricsAddr != "" {
+		metricsSrv = &http.Server{
+			Addr:              app.MetricsAddr,
+			Handler:           metricsRoutes(),
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		go func() {
+			app.Logger.Info("serving metrics", "addr", app.MetricsAddr)
+			serveErr <- metricsSrv.ListenAndServe()
+		}()
+	}
+
+	select {
+	case err := <-serveErr:
+		db.SQL.Close()
+		errFatal(err)
+	case <-ctx.Done():
+	}
+	// a second signal kills the process straight away
+	stop()
+
+	app.Logger.Info("shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	// stop accepting connections and wait for the requests in progress, then send the mail they queued
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		app.Logger.Error("stopped before all requests finished", "error", err)
+	}
+	if metricsSrv != nil {
+		if err := metricsSrv.Shutdown(shutdownCtx); err != nil {
+			app.Logger.Error("stopped before all scrapes finished", "error", err)
+		}
+	}
+	if err := mail.Shutdown(shutdownCtx); err != nil {
+		app.Logger.Error("stopped before all mail was sent, the rest is sent on the next start", "error", err)
+	}
+	// the scheduler and calendar sync saw ctx end with the signal, and stop once their queries give up
+	for _, done := range []<-chan struct{}{scheduled, synced} {
+		select {
+		case <-done:
+		case <-shutdownCtx.Done():
+		}
+	}
+	if err := db.SQL.Close(); err != nil {
+		app.Logger.Error("closing database", "error", err)
+	}
+	app.Logger.Info("stopped")
 }
 
-func run() (*driver.DB, error) {
+// run loads the configuration from args and the environment, and connects to the database
+func run(args []string) (*driver.DB, error) {
 	//what am I going to put in the session?
 	gob.Register(models.Reservation{})
 	gob.Register(models.User{})
@@ -48,52 +130,45 @@ func run() (*driver.DB, error) {
 	gob.Register(models.Restriction{})
 	gob.Register(map[string]int{})
 
-	//read flags
-	inProduction := flag.Bool("production", true, "Application is in production")
-	useCache := flag.Bool("cache", true, "Use template cache")
-	dbHost := flag.String("dbhost", "localhost", "Database host")
-	dbName := flag.String("dbname", "", "Database name")
-	dbUser := flag.String("dbuser", "", "Database user")
-	dbPass := flag.String("dbpass", "", "Database password")
-	dbPort := flag.String("dbport", "5432", "Database port")
-	dbSSL := flag.String("dbssl", "disable", "Database ssl settings (disable, prefer, required)")
-
-	flag.Parse()
-
-	if *dbName == "" || *dbUser == "" {
-		fmt.Println("Missing required flags")
-		os.Exit(1)
+	err := config.Load(&app, args, os.Getenv)
+	if err != nil {
+		return nil, err
 	}
 
-	mailChan := make(chan models.MailData)
-	app.MailChan = mailChan
-
-	app.InProduction = *inProduction
-	app.UseCache = *useCache
-
-	infoLog = log.New(os.Stdout, "INFO:\t", log.Ldate|log.Ltime)
-	app.InfoLog = infoLog
-
-	errorLog = log.New(os.Stdout, "ERROR\t", log.Ldate|log.Ldate|log.Lshortfile)
-	app.ErrorLog = errorLog
+	app.Logger = app.NewLogger(os.Stdout)
+	slog.SetDefault(app.Logger)
 
 	session = scs.New()
-	session.Lifetime = 24 * time.Hour
+	session.Lifetime = app.SessionLifetime
 	session.Cookie.Persist = true
 	session.Cookie.SameSite = http.SameSiteLaxMode
 	session.Cookie.Secure = app.InProduction
 	app.Session = session
 
 	//connect to database
-	color.Cyan("Connecting to database...")
-	connectionString := fmt.Sprintf("host=%s port=%s dbname=%s user=%s password=%s sslmode=%s ",
-		*dbHost, *dbPort, *dbName, *dbUser, *dbPass, *dbSSL)
-	db, err := driver.ConnectSQL(connectionString)
+	app.Logger.Info("connecting to database")
+	db, err := driver.ConnectSQL(app.DBDriver, app.DSN)
 	if err != nil {
-		log.Fatalln("Cannot connect to the database. Dying.")
+		return nil, fmt.Errorf("cannot connect to the database: %w", err)
+	}
+
+	// commands such as migrate only need the database
+	if len(app.Args) > 0 {
+		return db, nil
+	}
+
+	if app.AutoMigrate {
+		m, err := migrate.New(db.SQL, db.Driver, app.Logger)
+		if err != nil {
+			return nil, err
+		}
+		n, err := m.Up(context.Background())
+		if err != nil {
+			return nil, fmt.Errorf("cannot migrate the database: %w", err)
+		}
+		app.Logger.Info("database is up to date", "applied", n)
 	}
 
-	color.Green("Connected to database")
 	templateCache, err := render.CreateTemplateCache()
 	returnError(err)
 
@@ -1,13 +1,15 @@
 package main
 
 import (
+	"path/filepath"
 	"testing"
 )
 
 func TestRun(t *testing.T) {
-	var err error
-	_, err = run()
+	db, err := run([]string{"-dbdriver", "sqlite", "-dsn", filepath.Join(t.TempDir(), "bookings.db"),
+		"-mail-from", "me@here.com", "-owner-email", "owner@here.com"})
 	if err != nil {
-		t.Error("Failed Run!")
+		t.Fatalf("Failed Run! %v", err)
 	}
+	db.SQL.Close()
 }
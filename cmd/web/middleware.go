@@ -1,9 +1,18 @@
 package main
 
 import (
+	"bookings/internal/handlers"
 	"bookings/internal/helpers"
+	"bookings/internal/metrics"
+	"database/sql"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
 	"github.com/justinas/nosurf"
+	"log/slog"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 //func WriteToConsole(next http.Handler) http.Handler {
@@ -25,11 +34,83 @@ func NoSurf(next http.Handler) http.Handler {
 	return csrfHandler
 }
 
-// SessionLoad loads and saves the session on every request
+// RequestLog gives every request an id, which is sent back in the X-Request-ID header, and logs the request once it
+// has been handled
+func RequestLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		id, err := helpers.RandomToken(8)
+		if err != nil {
+			id = strconv.FormatInt(start.UnixNano(), 36)
+		}
+		info := &helpers.RequestInfo{ID: id}
+		w.Header().Set("X-Request-ID", id)
+
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r.WithContext(helpers.WithRequestInfo(r.Context(), info)))
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		level := slog.LevelInfo
+		switch {
+		case status >= http.StatusInternalServerError:
+			level = slog.LevelError
+		case r.URL.Path == "/healthz" || r.URL.Path == "/readyz":
+			// probes would drown out everything else
+			level = slog.LevelDebug
+		}
+
+		attrs := []slog.Attr{
+			slog.String("request_id", id),
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", status),
+			slog.Duration("latency", time.Since(start)),
+			slog.Int("bytes", ww.BytesWritten()),
+			slog.String("ip", helpers.ClientIP(r)),
+		}
+		if info.UserID != 0 {
+			attrs = append(attrs, slog.Int("user_id", info.UserID))
+		}
+		app.Logger.LogAttrs(r.Context(), level, "request", attrs...)
+	})
+}
+
+// Metrics records how long each request took in metrics.HTTPDuration, labelled with the chi route pattern it
+// matched, or "unmatched" for 404s, so that every reservation code doesn't get its own series
+func Metrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		// chi fills in the pattern while routing, so it is only known once the request has been handled
+		route := "unmatched"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+		metrics.HTTPDuration.WithLabelValues(r.Method, route, strconv.Itoa(status)).
+			Observe(time.Since(start).Seconds())
+	})
+}
+
+// SessionLoad loads and saves the session on every request, and notes the logged in user for the request log
 func SessionLoad(next http.Handler) http.Handler {
-	return session.LoadAndSave(next)
+	return session.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		helpers.SetRequestUser(r.Context(), session.GetInt(r.Context(), "user_id"))
+		next.ServeHTTP(w, r)
+	}))
 }
 
+// Auth sends visitors who aren't logged in to the login page. Owners can disable or demote a user while they are
+// logged in, so the user is looked up again on every request rather than trusting what the session remembers
 func Auth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if !helpers.IsAuthenticated(r) {
@@ -37,6 +118,36 @@ func Auth(next http.Handler) http.Handler {
 			http.Redirect(w, r, "/user/login", http.StatusSeeOther)
 			return
 		}
+
+		user, err := handlers.Repo.DB.GetUserById(r.Context(), session.GetInt(r.Context(), "user_id"))
+		if errors.Is(err, sql.ErrNoRows) || err == nil && user.Disabled {
+			_ = session.RenewToken(r.Context())
+			session.Remove(r.Context(), "user_id")
+			session.Remove(r.Context(), "access_level")
+			session.Put(r.Context(), "error", "Your account has been disabled")
+			http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+			return
+		}
+		if err != nil {
+			helpers.ServerError(w, r, err)
+			return
+		}
+		if user.AccessLevel != session.GetInt(r.Context(), "access_level") {
+			session.Put(r.Context(), "access_level", user.AccessLevel)
+		}
 		next.ServeHTTP(w, r)
 	})
 }
+
+// RequireAccess only lets through users whose access level is at least level, everyone else gets a 403 page
+func RequireAccess(level int) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !helpers.HasAccess(r, level) {
+				handlers.Repo.Forbidden(w, r)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -1,8 +1,25 @@
 package main
 
 import (
+	"bookings/internal/handlers"
+	"bookings/internal/helpers"
+	"bookings/internal/metrics"
+	"bookings/internal/models"
+	"bookings/internal/repository/dbrepo"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/alexedwards/scs/v2"
+	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"log/slog"
 	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"strings"
 	"testing"
 )
 
@@ -29,3 +46,177 @@ func TestSessionLoad(t *testing.T) {
 		t.Error(fmt.Sprintf("The type is not an http.Handler but a %T", v))
 	}
 }
+
+func TestRequireAccess(t *testing.T) {
+	var myH myHandler
+	h := RequireAccess(models.AccessStaff)(&myH)
+
+	switch v := h.(type) {
+	case http.Handler:
+	//do nothing
+	default:
+		t.Error(fmt.Sprintf("The type is not an http.Handler but a %T", v))
+	}
+}
+
+// TestAuth logs a user in, then disables and demotes them from under their session
+func TestAuth(t *testing.T) {
+	oldSession, oldRepo := session, handlers.Repo
+	defer func() { session, app.Session, handlers.Repo = oldSession, oldSession, oldRepo }()
+	session = scs.New()
+	app.Session = session
+	helpers.NewHelpers(&app)
+	db := dbrepo.NewMemoryRepo(&app)
+	handlers.NewHandlers(&handlers.Repository{App: &app, DB: db})
+
+	ctx := context.Background()
+	id, err := db.InsertUser(ctx, models.User{FirstName: "Sam", LastName: "Staff", Email: "sam@here.com",
+		Password: "not a bcrypt hash", AccessLevel: models.AccessOwner})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := chi.NewRouter()
+	mux.Use(SessionLoad)
+	mux.Get("/login", func(w http.ResponseWriter, r *http.Request) {
+		session.Put(r.Context(), "user_id", id)
+		session.Put(r.Context(), "access_level", models.AccessOwner)
+	})
+	mux.With(Auth).Get("/admin", func(w http.ResponseWriter, r *http.Request) {
+		if !helpers.HasAccess(r, models.AccessOwner) {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar, CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	get := func(path string) int {
+		t.Helper()
+		resp, err := client.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	get("/login")
+	if code := get("/admin"); code != http.StatusOK {
+		t.Fatalf("expected an owner to be let in but got %d", code)
+	}
+
+	user, _ := db.GetUserById(ctx, id)
+	user.AccessLevel = models.AccessStaff
+	if err := db.UpdateUser(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	if code := get("/admin"); code != http.StatusForbidden {
+		t.Errorf("expected a demoted user to lose owner access but got %d", code)
+	}
+
+	if err := db.SetUserDisabled(ctx, id, true); err != nil {
+		t.Fatal(err)
+	}
+	if code := get("/admin"); code != http.StatusSeeOther {
+		t.Errorf("expected a disabled user's session to be refused but got %d", code)
+	}
+	if err := db.SetUserDisabled(ctx, id, false); err != nil {
+		t.Fatal(err)
+	}
+	if code := get("/admin"); code != http.StatusSeeOther {
+		t.Errorf("expected the session to stay logged out once refused but got %d", code)
+	}
+}
+
+func TestRequestLog(t *testing.T) {
+	var logs bytes.Buffer
+	app.Logger = slog.New(slog.NewJSONHandler(&logs, nil))
+	helpers.NewHelpers(&app)
+	defer func() { app.Logger = nil }()
+
+	h := RequestLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		helpers.SetRequestUser(r.Context(), 7)
+		helpers.ServerError(w, r, errors.New("database on fire"))
+	}))
+
+	req := httptest.NewRequest("GET", "/admin/dashboard", nil)
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	id := rr.Header().Get("X-Request-ID")
+	if id == "" {
+		t.Fatal("expected an X-Request-ID header")
+	}
+	if !strings.Contains(rr.Body.String(), "Request ID: "+id) {
+		t.Errorf("expected the request id on the error page but got %q", rr.Body.String())
+	}
+	if strings.Contains(rr.Body.String(), "database on fire") {
+		t.Error("error details shown to the user")
+	}
+
+	var lines []map[string]interface{}
+	dec := json.NewDecoder(&logs)
+	for dec.More() {
+		var line map[string]interface{}
+		if err := dec.Decode(&line); err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) != 2 {
+		t.Fatalf("expected an error and a request log line but got %v", lines)
+	}
+	if lines[0]["msg"] != "database on fire" || lines[0]["request_id"] != id {
+		t.Errorf("expected the error logged with the request id but got %v", lines[0])
+	}
+	expected := map[string]interface{}{
+		"msg":        "request",
+		"level":      "ERROR",
+		"request_id": id,
+		"method":     "GET",
+		"path":       "/admin/dashboard",
+		"status":     float64(500),
+		"user_id":    float64(7),
+	}
+	for k, v := range expected {
+		if lines[1][k] != v {
+			t.Errorf("expected %s to be %v in the request log but got %v", k, v, lines[1][k])
+		}
+	}
+	if _, ok := lines[1]["latency"]; !ok {
+		t.Error("expected the latency in the request log")
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	mux := chi.NewRouter()
+	mux.Use(Metrics)
+	mux.Get("/reservations/{code}", func(w http.ResponseWriter, r *http.Request) {})
+
+	before := requestCount(t, "GET", "/reservations/{code}", "200")
+	unmatched := requestCount(t, "GET", "unmatched", "404")
+	for _, path := range []string{"/reservations/abc", "/reservations/def", "/nowhere"} {
+		mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	if n := requestCount(t, "GET", "/reservations/{code}", "200") - before; n != 2 {
+		t.Errorf("expected 2 requests recorded against the route pattern but got %d", n)
+	}
+	if n := requestCount(t, "GET", "unmatched", "404") - unmatched; n != 1 {
+		t.Errorf("expected 1 unmatched request recorded but got %d", n)
+	}
+}
+
+// requestCount returns how many requests the latency histogram has seen for a route
+func requestCount(t *testing.T, method, route, status string) uint64 {
+	var m dto.Metric
+	err := metrics.HTTPDuration.WithLabelValues(method, route, status).(prometheus.Histogram).Write(&m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
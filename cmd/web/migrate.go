@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bookings/internal/migrate"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+)
+
+var errMigrateUsage = errors.New("usage: bookings [flags] migrate up | down [steps] | status")
+
+// command runs the command named by the arguments left after the flags, instead of starting the server
+func command(ctx context.Context, m *migrate.Migrator, args []string, out io.Writer) error {
+	if args[0] != "migrate" {
+		return fmt.Errorf("unknown command %q\n%w", args[0], errMigrateUsage)
+	}
+	args = args[1:]
+	if len(args) == 0 {
+		return errMigrateUsage
+	}
+
+	switch args[0] {
+	case "up":
+		n, err := m.Up(ctx)
+		fmt.Fprintf(out, "applied %d migrations\n", n)
+		return err
+
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			var err error
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				return errMigrateUsage
+			}
+		}
+		n, err := m.Down(ctx, steps)
+		fmt.Fprintf(out, "undid %d migrations\n", n)
+		return err
+
+	case "status":
+		statuses, err := m.Status(ctx)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "VERSION\tNAME\tSTATUS")
+		for _, s := range statuses {
+			status := "pending"
+			if s.Applied {
+				status = "applied"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", s.Version, s.Name, status)
+		}
+		return tw.Flush()
+	}
+	return errMigrateUsage
+}
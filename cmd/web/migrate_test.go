@@ -0,0 +1,29 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestCommand_Usage(t *testing.T) {
+	var tests = []struct {
+		name string
+		args []string
+	}{
+		{"unknown command", []string{"serve"}},
+		{"no migrate action", []string{"migrate"}},
+		{"unknown migrate action", []string{"migrate", "sideways"}},
+		{"steps not a number", []string{"migrate", "down", "all"}},
+		{"no steps", []string{"migrate", "down", "0"}},
+	}
+
+	for _, e := range tests {
+		// none of these get as far as the database, so there is no migrator
+		err := command(context.Background(), nil, e.args, io.Discard)
+		if !errors.Is(err, errMigrateUsage) {
+			t.Errorf("%s: expected the usage but got %v", e.name, err)
+		}
+	}
+}
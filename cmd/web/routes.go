@@ -3,6 +3,8 @@ package main
 import (
 	"bookings/internal/config"
 	"bookings/internal/handlers"
+	"bookings/internal/metrics"
+	"bookings/internal/models"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"net/http"
@@ -10,43 +12,109 @@ import (
 
 func routes(app *config.AppConfig) http.Handler {
 	mux := chi.NewRouter()
+	mux.Use(RequestLog)
+	mux.Use(Metrics)
 	mux.Use(middleware.Recoverer)
-	mux.Use(NoSurf)
-	mux.Use(SessionLoad)
-	mux.Get("/", handlers.Repo.Home)
-	mux.Get("/about", handlers.Repo.About)
-	mux.Get("/contact", handlers.Repo.Contact)
-	mux.Get("/colonels-suite", handlers.Repo.ColonelsSuite)
-	mux.Get("/generals-quarters", handlers.Repo.GeneralsQuarters)
-	mux.Get("/choose-room/{id}", handlers.Repo.ChooseRoom)
-	mux.Get("/book-room", handlers.Repo.BookRoom)
-
-	mux.Get("/make-reservation", handlers.Repo.MakeReservation)
-	mux.Post("/make-reservation", handlers.Repo.PostReservation)
-
-	mux.Get("/user/login", handlers.Repo.ShowLogin)
-	mux.Post("/user/login", handlers.Repo.PostShowLogin)
-	mux.Get("/user/logout", handlers.Repo.Logout)
-
-	mux.Get("/reservation-summary", handlers.Repo.ReservationSummary)
-
-	mux.Get("/search-availability", handlers.Repo.SearchAvailability)
-	mux.Post("/search-availability", handlers.Repo.PostAvailability)
-	mux.Post("/search-availability-json", handlers.Repo.AvailabilityJSON)
-
-	mux.Route("/admin", func(mux chi.Router) {
-		//mux.Use(Auth)
-		mux.Get("/dashboard", handlers.Repo.AdminDashboard)
-		mux.Get("/reservations-new", handlers.Repo.AdminNewReservations)
-		mux.Get("/reservations-all", handlers.Repo.AdminAllReservations)
-		mux.Get("/reservations-calendar", handlers.Repo.AdminCalendarReservations)
-		mux.Post("/reservations-calendar", handlers.Repo.AdminCalendarPostReservations)
-
-		mux.Get("/reservations/{src}/{id}/show", handlers.Repo.AdminShowReservation)
-		mux.Post("/reservations/{src}/{id}", handlers.Repo.AdminPostShowReservation)
-		mux.Get("/process-reservation/{src}/{id}/do", handlers.Repo.AdminProcessReservation)
-		mux.Get("/delete-reservation/{src}/{id}/do", handlers.Repo.AdminDeleteReservation)
+	// the json api authenticates with bearer tokens, so it sits outside the session and CSRF middleware
+	mux.Mount("/api/v1", apiRoutes())
+	// calendar apps fetch room feeds without cookies, so the token in the url is all the protection they get
+	mux.Get("/rooms/{slug}/calendar.ics", handlers.Repo.RoomCalendar)
+	// health checks come from load balancers and orchestrators, which have no session
+	mux.Get("/healthz", handlers.Repo.Healthz)
+	mux.Get("/readyz", handlers.Repo.Readyz)
 
+	mux.Group(func(mux chi.Router) {
+		mux.Use(NoSurf)
+		mux.Use(SessionLoad)
+		mux.Get("/", handlers.Repo.Home)
+		mux.Get("/about", handlers.Repo.About)
+		mux.Get("/contact", handlers.Repo.Contact)
+		mux.Get("/colonels-suite", handlers.Repo.ColonelsSuite)
+		mux.Get("/generals-quarters", handlers.Repo.GeneralsQuarters)
+		mux.Get("/rooms", handlers.Repo.Rooms)
+		mux.Get("/rooms/{slug}", handlers.Repo.Room)
+		mux.Get("/choose-room/{id}", handlers.Repo.ChooseRoom)
+		mux.Get("/book-room", handlers.Repo.BookRoom)
+
+		mux.Get("/make-reservation", handlers.Repo.MakeReservation)
+		mux.Post("/make-reservation", handlers.Repo.PostReservation)
+
+		mux.Get("/user/login", handlers.Repo.ShowLogin)
+		mux.Post("/user/login", handlers.Repo.PostShowLogin)
+		mux.Get("/user/logout", handlers.Repo.Logout)
+		mux.Get("/user/forgot-password", handlers.Repo.ShowForgotPassword)
+		mux.Post("/user/forgot-password", handlers.Repo.PostForgotPassword)
+		mux.Get("/user/set-password/{token}", handlers.Repo.ShowSetPassword)
+		mux.Post("/user/set-password/{token}", handlers.Repo.PostSetPassword)
+		mux.With(Auth).Get("/user/password", handlers.Repo.ShowChangePassword)
+		mux.With(Auth).Post("/user/password", handlers.Repo.PostChangePassword)
+
+		mux.Get("/reservation-summary", handlers.Repo.ReservationSummary)
+
+		mux.Get("/reservations/{code}", handlers.Repo.ManageReservation)
+		mux.Post("/reservations/{code}", handlers.Repo.PostManageReservation)
+		mux.Post("/reservations/{code}/cancel", handlers.Repo.CancelReservation)
+
+		mux.Get("/search-availability", handlers.Repo.SearchAvailability)
+		mux.Post("/search-availability", handlers.Repo.PostAvailability)
+		mux.Post("/search-availability-json", handlers.Repo.AvailabilityJSON)
+
+		mux.Route("/admin", func(mux chi.Router) {
+			mux.Use(Auth)
+			mux.Use(RequireAccess(models.AccessReadOnly))
+			mux.Get("/dashboard", handlers.Repo.AdminDashboard)
+			mux.Get("/reservations-new", handlers.Repo.AdminNewReservations)
+			mux.Get("/reservations-all", handlers.Repo.AdminAllReservations)
+			mux.Get("/reservations-export", handlers.Repo.AdminExportReservations)
+			mux.Get("/occupancy-export", handlers.Repo.AdminExportOccupancy)
+			mux.Get("/reservations-calendar", handlers.Repo.AdminCalendarReservations)
+			mux.Get("/reservations/{src}/{id}/show", handlers.Repo.AdminShowReservation)
+			mux.Get("/rooms", handlers.Repo.AdminRooms)
+			mux.Get("/rooms/{id}", handlers.Repo.AdminShowRoom)
+
+			// staff look after the day to day running of reservations
+			mux.Group(func(mux chi.Router) {
+				mux.Use(RequireAccess(models.AccessStaff))
+				mux.Post("/reservations/{src}/{id}", handlers.Repo.AdminPostShowReservation)
+				mux.Get("/process-reservation/{src}/{id}/do", handlers.Repo.AdminProcessReservation)
+			})
+
+			// only owners can remove reservations, block out rooms and change what is for sale
+			mux.Group(func(mux chi.Router) {
+				mux.Use(RequireAccess(models.AccessOwner))
+				mux.Get("/delete-reservation/{src}/{id}/do", handlers.Repo.AdminDeleteReservation)
+
+				mux.Get("/blocks/{id}", handlers.Repo.AdminShowBlock)
+				mux.Post("/blocks/{id}", handlers.Repo.AdminPostBlock)
+				mux.Get("/blocks/{id}/delete/do", handlers.Repo.AdminDeleteBlock)
+				mux.Get("/mail", handlers.Repo.AdminMail)
+				mux.Get("/mail/{id}/resend/do", handlers.Repo.AdminResendMail)
+				mux.Get("/restrictions", handlers.Repo.AdminRestrictions)
+				mux.Post("/restrictions/{id}", handlers.Repo.AdminPostRestriction)
+				mux.Get("/restrictions/{id}/delete/do", handlers.Repo.AdminDeleteRestriction)
+
+				mux.Post("/rooms/{id}", handlers.Repo.AdminPostRoom)
+				mux.Get("/rooms/{id}/delete/do", handlers.Repo.AdminDeleteRoom)
+				mux.Post("/rooms/{id}/seasons", handlers.Repo.AdminPostSeasonalRate)
+				mux.Get("/rooms/{id}/seasons/{season}/delete/do", handlers.Repo.AdminDeleteSeasonalRate)
+				mux.Get("/rooms/{id}/ical-token/do", handlers.Repo.AdminRegenerateICalToken)
+				mux.Post("/rooms/{id}/feeds", handlers.Repo.AdminPostICalFeed)
+				mux.Get("/rooms/{id}/feeds/{feed}/sync/do", handlers.Repo.AdminSyncICalFeed)
+				mux.Get("/rooms/{id}/feeds/{feed}/delete/do", handlers.Repo.AdminDeleteICalFeed)
+
+				mux.Get("/api-tokens", handlers.Repo.AdminAPITokens)
+				mux.Post("/api-tokens", handlers.Repo.AdminPostAPIToken)
+				mux.Get("/api-tokens/{id}/delete/do", handlers.Repo.AdminDeleteAPIToken)
+
+				mux.Get("/users", handlers.Repo.AdminUsers)
+				mux.Post("/users", handlers.Repo.AdminPostUser)
+				mux.Post("/users/{id}", handlers.Repo.AdminPostUserAccess)
+				mux.Get("/users/{id}/disable/do", handlers.Repo.AdminDisableUser)
+				mux.Get("/users/{id}/enable/do", handlers.Repo.AdminEnableUser)
+				mux.Get("/users/{id}/unlock/do", handlers.Repo.AdminUnlockUser)
+				mux.Get("/login-attempts", handlers.Repo.AdminLoginAttempts)
+			})
+		})
 	})
 
 	fileServer := http.FileServer(http.Dir("./static/"))
@@ -54,3 +122,39 @@ func routes(app *config.AppConfig) http.Handler {
 
 	return mux
 }
+
+// apiRoutes returns the routes for version 1 of the json api
+func apiRoutes() http.Handler {
+	mux := chi.NewRouter()
+	mux.NotFound(handlers.Repo.APINotFound)
+	mux.MethodNotAllowed(handlers.Repo.APIMethodNotAllowed)
+
+	mux.Get("/rooms", handlers.Repo.APIRooms)
+	mux.Get("/rooms/{id}", handlers.Repo.APIRoom)
+	mux.Get("/rooms/{id}/availability", handlers.Repo.APIRoomAvailability)
+	mux.Get("/rooms/{id}/quote", handlers.Repo.APIRoomQuote)
+	mux.Get("/availability", handlers.Repo.APIAvailability)
+
+	mux.Group(func(mux chi.Router) {
+		mux.Use(handlers.Repo.APIAuth)
+		mux.Post("/reservations", handlers.Repo.APICreateReservation)
+		mux.Get("/reservations/{id}", handlers.Repo.APIReservation)
+		// partners' tokens need the access the admin pages would ask of their users
+		mux.Group(func(mux chi.Router) {
+			mux.Use(handlers.Repo.APIRequireAccess(models.AccessStaff))
+			mux.Delete("/reservations/{id}", handlers.Repo.APICancelReservation)
+			mux.Get("/admin/reservations", handlers.Repo.APIAdminReservations)
+		})
+	})
+
+	return mux
+}
+
+// metricsRoutes is served on its own address, so scrapes never pass through the public site
+func metricsRoutes() http.Handler {
+	mux := chi.NewRouter()
+	mux.Use(middleware.Recoverer)
+	mux.Handle("/metrics", metrics.Handler())
+
+	return mux
+}
@@ -4,6 +4,8 @@ import (
 	"bookings/internal/config"
 	"fmt"
 	"github.com/go-chi/chi/v5"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
 	"testing"
 )
@@ -19,3 +21,23 @@ func TestRoutes(t *testing.T) {
 		t.Error(fmt.Sprintf("returned type is not of type %T but a %T", reflect.TypeOf(mux), v))
 	}
 }
+
+func TestMetricsRoutes(t *testing.T) {
+	tests := []struct {
+		name           string
+		url            string
+		expectedStatus int
+	}{
+		{"metrics", "/metrics", http.StatusOK},
+		{"site", "/", http.StatusNotFound},
+	}
+
+	srv := metricsRoutes()
+	for _, e := range tests {
+		rr := httptest.NewRecorder()
+		srv.ServeHTTP(rr, httptest.NewRequest("GET", e.url, nil))
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: expected status %d but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+	}
+}
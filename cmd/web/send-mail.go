@@ -1,57 +1,43 @@
 package main
 
 import (
+	"bookings/internal/config"
 	"bookings/internal/models"
-	"fmt"
 	mail "github.com/xhit/go-simple-mail/v2"
-	"log"
-	"os"
-	"strings"
 	"time"
 )
 
-func listenForMail() {
-	go func() {
-		for {
-			msg := <-app.MailChan
-			sendMsg(msg)
-		}
-	}()
-
+// smtpSender sends email through the configured mail server
+type smtpSender struct {
+	SMTP config.SMTPConfig
 }
 
-func sendMsg(m models.MailData) {
+// Send delivers a message, with its plain text alternative if it has one
+func (s smtpSender) Send(m models.MailData) error {
 	server := mail.NewSMTPClient()
-	server.Host = "localhost"
-	server.Port = 1025
+	server.Host = s.SMTP.Host
+	server.Port = s.SMTP.Port
+	server.Username = s.SMTP.Username
+	server.Password = s.SMTP.Password
 	server.KeepAlive = false
 	server.ConnectTimeout = time.Second * 10
 	server.SendTimeout = time.Second * 10
 
-	client, err := server.Connect()
-	if err != nil {
-		errorLog.Println(err)
-	}
 	email := mail.NewMSG()
-
 	email.SetFrom(m.From).AddTo(m.To).SetSubject(m.Subject)
-	if m.Template == "" {
+	if m.Text == "" {
 		email.SetBody(mail.TextHTML, m.Content)
 	} else {
-		data, err := os.ReadFile(fmt.Sprintf("./email-templates/%s", m.Template))
-		if err != nil {
-			app.ErrorLog.Println(err)
-		}
-		mailTemplate := string(data)
-		msgToSend := strings.Replace(mailTemplate, "[%body%]", m.Content, 1)
-		email.SetBody(mail.TextHTML, msgToSend)
+		email.SetBody(mail.TextPlain, m.Text)
+		email.AddAlternative(mail.TextHTML, m.Content)
+	}
+	if email.Error != nil {
+		return email.Error
 	}
 
-	err = email.Send(client)
+	client, err := server.Connect()
 	if err != nil {
-		errorLog.Println(err)
-	} else {
-		log.Println("email sent")
+		return err
 	}
-
+	return email.Send(client)
 }
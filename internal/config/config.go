@@ -2,18 +2,73 @@ package config
 
 import (
 	"bookings/internal/models"
+	"context"
 	"github.com/alexedwards/scs/v2"
 	"html/template"
-	"log"
+	"log/slog"
+	"time"
 )
 
 // AppConfig holds the application configuration
 type AppConfig struct {
 	UseCache      bool
 	TemplateCache map[string]*template.Template
-	InfoLog       *log.Logger
-	ErrorLog      *log.Logger
-	InProduction  bool
-	Session       *scs.SessionManager
-	MailChan      chan models.MailData
+	// Logger is the structured logger everything logs through
+	Logger       *slog.Logger
+	InProduction bool
+	Session      *scs.SessionManager
+	// Mail queues emails to be sent
+	Mail Mailer
+	// BaseURL is the public address of the site, used to build links in emails
+	BaseURL string
+	// ICalSyncInterval is how often external room calendars are fetched again
+	ICalSyncInterval time.Duration
+	// Addr is the address the web server listens on
+	Addr string
+	// MetricsAddr is where Prometheus metrics are served, apart from the site; empty serves none
+	MetricsAddr string
+	// DBDriver is the kind of database, postgres or sqlite
+	DBDriver string
+	// DSN is the database connection string, or for SQLite the path of the database file
+	DSN string
+	// DBTimeout is the longest a single database query may take
+	DBTimeout time.Duration
+	// SMTP is the mail server emails are sent through
+	SMTP SMTPConfig
+	// MailFrom is the sender address of every email
+	MailFrom string
+	// OwnerEmail is where notifications for the property owner are sent
+	OwnerEmail string
+	// LogFormat is how log lines are written, text or json
+	LogFormat string
+	// LogLevel is the least important level that is logged
+	LogLevel slog.Level
+	// SessionLifetime is how long a session lasts
+	SessionLifetime time.Duration
+	// ReminderDays is how many days before arrival guests are sent a reminder, or zero for none
+	ReminderDays int
+	// ThankYouDays is how many days after leaving guests are sent a thank you, or zero for none
+	ThankYouDays int
+	// ReviewURL is where the thank you asks guests to leave a review, if anywhere
+	ReviewURL string
+	// AutoMigrate applies any new database migrations when the server starts
+	AutoMigrate bool
+	// Args are the command-line arguments left after the flags, naming a command such as migrate up
+	Args []string
+}
+
+// Mailer queues emails in the outbox
+type Mailer interface {
+	// Queue stores an email to be sent as soon as possible
+	Queue(ctx context.Context, m models.MailData) error
+	// Notify wakes the mailer to send messages that have been put back in the queue
+	Notify()
+}
+
+// SMTPConfig holds the settings of the mail server
+type SMTPConfig struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
 }
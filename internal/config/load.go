@@ -0,0 +1,244 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// EnvPrefix starts the name of every environment variable the application reads
+const EnvPrefix = "BOOKINGS_"
+
+// ValidationError lists every problem found with the configuration, so they can all be fixed at once
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid configuration:\n  - " + strings.Join(e.Problems, "\n  - ")
+}
+
+// Load fills in the settings of app from, in increasing order of precedence, their defaults, a YAML file, the
+// environment and the command-line arguments. Every setting has a flag; its environment variable is the flag name
+// in capitals with EnvPrefix in front and underscores for dashes, and its key in the file is the flag name, with
+// nested keys joined by dashes, so smtp: {host: ...} sets -smtp-host and BOOKINGS_SMTP_HOST. The file is named by
+// -config or BOOKINGS_CONFIG
+func Load(app *AppConfig, args []string, getenv func(string) string) error {
+	fs := flag.NewFlagSet("bookings", flag.ContinueOnError)
+
+	configFile := fs.String("config", "", "Path of a YAML configuration file")
+
+	fs.StringVar(&app.Addr, "addr", ":8080", "Address to listen on")
+	fs.StringVar(&app.MetricsAddr, "metrics-addr", "", "Address to serve Prometheus metrics on, none when empty")
+	fs.StringVar(&app.BaseURL, "baseurl", "http://localhost:8080", "Public address of the site, used in email links")
+	fs.BoolVar(&app.InProduction, "production", true, "Application is in production")
+	fs.BoolVar(&app.UseCache, "cache", true, "Use template cache")
+	fs.StringVar(&app.LogFormat, "log-format", "text", "How log lines are written, text or json")
+	fs.TextVar(&app.LogLevel, "log-level", slog.LevelInfo, "Least important level logged, debug, info, warn or error")
+	fs.DurationVar(&app.SessionLifetime, "session-lifetime", 24*time.Hour, "How long a session lasts")
+	fs.DurationVar(&app.ICalSyncInterval, "icalsync", 15*time.Minute, "How often to sync external room calendars")
+
+	fs.IntVar(&app.ReminderDays, "reminder-days", 3, "Days before arrival to remind guests, 0 for never")
+	fs.IntVar(&app.ThankYouDays, "thankyou-days", 1, "Days after departure to thank guests, 0 for never")
+	fs.StringVar(&app.ReviewURL, "review-url", "", "Where guests are asked to leave a review")
+
+	fs.BoolVar(&app.AutoMigrate, "auto-migrate", false, "Apply any new database migrations on startup")
+	fs.StringVar(&app.DBDriver, "dbdriver", "postgres", "Database to use, postgres or sqlite")
+	fs.StringVar(&app.DSN, "dsn", "",
+		"Database connection string, instead of the separate database settings, or for sqlite the database file")
+	fs.DurationVar(&app.DBTimeout, "db-timeout", 3*time.Second, "Longest a single database query may take")
+	dbHost := fs.String("dbhost", "localhost", "Database host")
+	dbName := fs.String("dbname", "", "Database name")
+	dbUser := fs.String("dbuser", "", "Database user")
+	dbPass := fs.String("dbpass", "", "Database password")
+	dbPort := fs.String("dbport", "5432", "Database port")
+	dbSSL := fs.String("dbssl", "disable", "Database ssl settings (disable, prefer, required)")
+
+	fs.StringVar(&app.SMTP.Host, "smtp-host", "localhost", "Mail server host")
+	fs.IntVar(&app.SMTP.Port, "smtp-port", 1025, "Mail server port")
+	fs.StringVar(&app.SMTP.Username, "smtp-user", "", "Mail server user")
+	fs.StringVar(&app.SMTP.Password, "smtp-pass", "", "Mail server password")
+	fs.StringVar(&app.MailFrom, "mail-from", "", "Sender address of emails")
+	fs.StringVar(&app.OwnerEmail, "owner-email", "", "Address notifications for the property owner are sent to")
+
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	app.Args = fs.Args()
+
+	// remember what was on the command line, as nothing else may change it
+	onCommandLine := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		onCommandLine[f.Name] = true
+	})
+
+	var problems []string
+
+	if *configFile == "" {
+		*configFile = getenv(EnvPrefix + "CONFIG")
+	}
+	if *configFile != "" {
+		values, err := readFile(*configFile)
+		if err != nil {
+			return err
+		}
+		problems = append(problems, apply(fs, values, onCommandLine, *configFile)...)
+	}
+
+	values := map[string]string{}
+	fs.VisitAll(func(f *flag.Flag) {
+		if v := getenv(envName(f.Name)); v != "" && f.Name != "config" {
+			values[f.Name] = v
+		}
+	})
+	problems = append(problems, apply(fs, values, onCommandLine, "environment")...)
+
+	app.BaseURL = strings.TrimSuffix(app.BaseURL, "/")
+	if app.DSN == "" && app.DBDriver == "postgres" && *dbName != "" && *dbUser != "" {
+		app.DSN = fmt.Sprintf("host=%s port=%s dbname=%s user=%s password=%s sslmode=%s",
+			dsnValue(*dbHost), dsnValue(*dbPort), dsnValue(*dbName), dsnValue(*dbUser), dsnValue(*dbPass),
+			dsnValue(*dbSSL))
+	}
+
+	required := []struct {
+		name  string
+		value string
+	}{
+		{"addr", app.Addr},
+		{"baseurl", app.BaseURL},
+		{"dsn (or dbname and dbuser)", app.DSN},
+		{"smtp-host", app.SMTP.Host},
+		{"mail-from", app.MailFrom},
+		{"owner-email", app.OwnerEmail},
+	}
+	for _, s := range required {
+		if s.value == "" {
+			problems = append(problems, fmt.Sprintf("%s is required", s.name))
+		}
+	}
+	if app.SMTP.Port <= 0 || app.SMTP.Port > 65535 {
+		problems = append(problems, fmt.Sprintf("smtp-port %d is not a port number", app.SMTP.Port))
+	}
+	if app.ReminderDays < 0 || app.ThankYouDays < 0 {
+		problems = append(problems, "reminder-days and thankyou-days cannot be negative")
+	}
+	if app.DBDriver != "postgres" && app.DBDriver != "sqlite" {
+		problems = append(problems, fmt.Sprintf("dbdriver %q is not postgres or sqlite", app.DBDriver))
+	}
+	if app.LogFormat != "text" && app.LogFormat != "json" {
+		problems = append(problems, fmt.Sprintf("log-format %q is not text or json", app.LogFormat))
+	}
+	if app.SessionLifetime <= 0 {
+		problems = append(problems, "session-lifetime must be longer than zero")
+	}
+	if app.ICalSyncInterval <= 0 {
+		problems = append(problems, "icalsync must be longer than zero")
+	}
+	if app.DBTimeout <= 0 {
+		problems = append(problems, "db-timeout must be longer than zero")
+	}
+
+	if app.MetricsAddr != "" && app.MetricsAddr == app.Addr {
+		problems = append(problems, "metrics-addr must differ from addr")
+	}
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// dsnValue quotes a value for a postgres keyword/value connection string, so that a password with spaces or quotes
+// in it can't run into the next setting
+func dsnValue(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
+
+// apply sets the flags named in values, leaving alone the ones given on the command line, and describes any it
+// could not set
+func apply(fs *flag.FlagSet, values map[string]string, onCommandLine map[string]bool, source string) []string {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var problems []string
+	for _, name := range names {
+		if name == "config" || fs.Lookup(name) == nil {
+			problems = append(problems, fmt.Sprintf("%s: unknown setting %s", source, name))
+			continue
+		}
+		if onCommandLine[name] {
+			continue
+		}
+		if err := fs.Set(name, values[name]); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s: %v", source, name, err))
+		}
+	}
+	return problems
+}
+
+// readFile reads a YAML configuration file into flag names and values
+func readFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc map[string]interface{}
+	err = yaml.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	values := map[string]string{}
+	err = flatten("", doc, values)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return values, nil
+}
+
+// flatten joins the keys of nested mappings with dashes
+func flatten(prefix string, doc map[string]interface{}, values map[string]string) error {
+	for k, v := range doc {
+		name := strings.ReplaceAll(k, "_", "-")
+		if prefix != "" {
+			name = prefix + "-" + name
+		}
+		switch v := v.(type) {
+		case map[string]interface{}:
+			if err := flatten(name, v, values); err != nil {
+				return err
+			}
+		case []interface{}:
+			return errors.New(name + ": lists are not allowed")
+		case nil:
+		default:
+			values[name] = fmt.Sprint(v)
+		}
+	}
+	return nil
+}
+
+// envName is the environment variable for a flag
+func envName(flagName string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// NewLogger returns a logger that writes to w in the configured format, leaving out levels below LogLevel
+func (a *AppConfig) NewLogger(w io.Writer) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: a.LogLevel}
+	if a.LogFormat == "json" {
+		return slog.New(slog.NewJSONHandler(w, opts))
+	}
+	return slog.New(slog.NewTextHandler(w, opts))
+}
@@ -0,0 +1,135 @@
+package config
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func env(values map[string]string) func(string) string {
+	return func(name string) string {
+		return values[name]
+	}
+}
+
+func writeConfig(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "bookings.yml")
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoad_Precedence(t *testing.T) {
+	path := writeConfig(t, `
+dsn: host=file
+mail_from: file@here.com
+owner-email: owner@here.com
+session-lifetime: 2h
+log-level: debug
+smtp:
+  host: mail.file
+  port: 2525
+`)
+
+	var app AppConfig
+	err := Load(&app, []string{"-config", path, "-smtp-port", "587"}, env(map[string]string{
+		"BOOKINGS_MAIL_FROM": "env@here.com",
+		"BOOKINGS_SMTP_PORT": "465",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if app.DSN != "host=file" {
+		t.Errorf("expected the dsn from the file but got %q", app.DSN)
+	}
+	if app.MailFrom != "env@here.com" {
+		t.Errorf("expected the environment to override the file but got %q", app.MailFrom)
+	}
+	if app.SMTP.Port != 587 {
+		t.Errorf("expected the command line to override the environment but got %d", app.SMTP.Port)
+	}
+	if app.SMTP.Host != "mail.file" || app.SessionLifetime != 2*time.Hour {
+		t.Errorf("expected nested and duration settings from the file but got %q and %s", app.SMTP.Host, app.SessionLifetime)
+	}
+	if app.LogLevel != slog.LevelDebug || app.LogFormat != "text" {
+		t.Errorf("expected debug level text logs but got %s %s", app.LogLevel, app.LogFormat)
+	}
+	if app.Addr != ":8080" {
+		t.Errorf("expected the default address but got %q", app.Addr)
+	}
+}
+
+func TestLoad_ConfigFromEnvironment(t *testing.T) {
+	path := writeConfig(t, "owner-email: owner@here.com\n")
+
+	var app AppConfig
+	err := Load(&app, []string{"-dbname", "bookings", "-dbuser", "bookings", "-mail-from", "me@here.com",
+		"migrate", "down", "2"}, env(map[string]string{"BOOKINGS_CONFIG": path}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if app.OwnerEmail != "owner@here.com" {
+		t.Errorf("expected the owner address from the file but got %q", app.OwnerEmail)
+	}
+	if !strings.Contains(app.DSN, "dbname='bookings'") {
+		t.Errorf("expected a dsn built from the database flags but got %q", app.DSN)
+	}
+	if strings.Join(app.Args, " ") != "migrate down 2" {
+		t.Errorf("expected the command after the flags but got %q", app.Args)
+	}
+}
+
+func TestLoad_DSNQuoting(t *testing.T) {
+	var app AppConfig
+	err := Load(&app, []string{"-dbname", "bookings", "-dbuser", "bookings", "-dbpass", `it's a \ secret`,
+		"-mail-from", "me@here.com", "-owner-email", "owner@here.com"}, env(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `host='localhost' port='5432' dbname='bookings' user='bookings' password='it\'s a \\ secret' sslmode='disable'`
+	if app.DSN != expected {
+		t.Errorf("expected %s but got %s", expected, app.DSN)
+	}
+}
+
+func TestLoad_Validation(t *testing.T) {
+	path := writeConfig(t, "colour: blue\nsmtp:\n  port: 0\n")
+
+	var app AppConfig
+	err := Load(&app, []string{"-config", path}, env(map[string]string{
+		"BOOKINGS_SESSION_LIFETIME": "soon",
+		"BOOKINGS_LOG_FORMAT":       "xml",
+		"BOOKINGS_DBDRIVER":         "mysql",
+		"BOOKINGS_DB_TIMEOUT":       "0s",
+		"BOOKINGS_METRICS_ADDR":     ":8080",
+	}))
+
+	var verr *ValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("expected a ValidationError but got %v", err)
+	}
+
+	expected := []string{
+		"unknown setting colour",
+		"session-lifetime",
+		"dsn (or dbname and dbuser) is required",
+		"mail-from is required",
+		"owner-email is required",
+		"smtp-port 0 is not a port number",
+		`log-format "xml" is not text or json`,
+		`dbdriver "mysql" is not postgres or sqlite`,
+		"db-timeout must be longer than zero",
+		"metrics-addr must differ from addr",
+	}
+	for _, e := range expected {
+		if !strings.Contains(err.Error(), e) {
+			t.Errorf("expected %q in\n%s", e, err)
+		}
+	}
+}
@@ -1,16 +1,23 @@
 package driver
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
+	"fmt"
 	_ "github.com/jackc/pgconn"
 	_ "github.com/jackc/pgx/v4"
 	_ "github.com/jackc/pgx/v4/stdlib"
+	"modernc.org/sqlite"
+	"strings"
 	"time"
 )
 
 // DB holds the database connection pool
 type DB struct {
 	SQL *sql.DB
+	// Driver is the kind of database, postgres or sqlite
+	Driver string
 }
 
 var dbConn = &DB{}
@@ -19,17 +26,34 @@ const maxOpenDbConn = 10
 const maxIdleDbConn = 5
 const maxDbLifetime = 5 * time.Minute
 
-// ConnectSQL creates database pool for Postgres
-func ConnectSQL(dsn string) (*DB, error) {
-	d, err := NewDatabase(dsn)
+// sqliteDriverName is the name the SQLite driver is registered under, wrapped so that it stores times in UTC
+const sqliteDriverName = "bookings-sqlite"
+
+func init() {
+	sql.Register(sqliteDriverName, utcDriver{&sqlite.Driver{}})
+}
+
+// ConnectSQL creates the database pool, for Postgres or, when driverName is sqlite, for the SQLite file named by dsn
+func ConnectSQL(driverName, dsn string) (*DB, error) {
+	var d *sql.DB
+	var err error
+	switch driverName {
+	case "postgres":
+		d, err = NewDatabase(dsn)
+	case "sqlite":
+		d, err = NewSQLiteDatabase(dsn)
+	default:
+		err = fmt.Errorf("unknown database driver %q", driverName)
+	}
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	d.SetMaxOpenConns(maxOpenDbConn)
 	d.SetConnMaxIdleTime(maxIdleDbConn)
 	d.SetConnMaxLifetime(maxDbLifetime)
 
 	dbConn.SQL = d
+	dbConn.Driver = driverName
 	err = testDB(d)
 	if err != nil {
 		return nil, err
@@ -59,3 +83,73 @@ func NewDatabase(dsn string) (*sql.DB, error) {
 
 	return db, nil
 }
+
+// NewSQLiteDatabase opens the SQLite database in the file at path, creating it if need be. Foreign keys are
+// enforced, readers don't wait for writers, and transactions take the write lock as they begin, so that two of them
+// can't both read and then both try to write, which SQLite would fail rather than wait for
+func NewSQLiteDatabase(path string) (*sql.DB, error) {
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	dsn := path + sep + "_pragma=foreign_keys(1)&_pragma=journal_mode(WAL)&_pragma=busy_timeout(10000)" +
+		"&_txlock=immediate&_time_format=sqlite"
+
+	db, err := sql.Open(sqliteDriverName, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = db.Ping(); err != nil {
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// Ping checks the database can still be reached
+func (d *DB) Ping(ctx context.Context) error {
+	return d.SQL.PingContext(ctx)
+}
+
+// utcDriver opens SQLite connections that store every time in UTC. SQLite keeps times as text, and compares them as
+// text, which only puts them in order when they all have the same offset
+type utcDriver struct {
+	driver.Driver
+}
+
+// sqliteConn is the part of the SQLite driver's connection the database/sql package uses
+type sqliteConn interface {
+	driver.Conn
+	driver.ConnBeginTx
+	driver.ConnPrepareContext
+	driver.ExecerContext
+	driver.QueryerContext
+	driver.Pinger
+}
+
+func (d utcDriver) Open(name string) (driver.Conn, error) {
+	c, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return utcConn{c.(sqliteConn)}, nil
+}
+
+type utcConn struct {
+	sqliteConn
+}
+
+// CheckNamedValue converts arguments as database/sql would, including sql.NullTime and other Valuers, and then
+// converts times to UTC
+func (utcConn) CheckNamedValue(nv *driver.NamedValue) error {
+	v, err := driver.DefaultParameterConverter.ConvertValue(nv.Value)
+	if err != nil {
+		return err
+	}
+	if t, ok := v.(time.Time); ok {
+		v = t.UTC()
+	}
+	nv.Value = v
+	return nil
+}
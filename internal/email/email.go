@@ -0,0 +1,156 @@
+// Package email renders the emails the site sends. Each kind of email has its own data type and a template in
+// templates/ that defines its "subject", its "html" body, which is wrapped in the shared layout, and a "text" body
+// that is sent alongside it as the plain text alternative
+package email
+
+import (
+	"bookings/internal/models"
+	"bookings/internal/pricing"
+	"bytes"
+	"embed"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+//go:embed templates
+var templateFS embed.FS
+
+// Message is a rendered email
+type Message struct {
+	Subject string
+	HTML    string
+	Text    string
+}
+
+// Data is the content of one kind of email
+type Data interface {
+	templateName() string
+}
+
+// Confirmation is sent to a guest when they make a reservation
+type Confirmation struct {
+	Reservation models.Reservation
+	ManageURL   string
+}
+
+// the changes to a reservation the property owner is told about
+const (
+	ReservationMade      = "made"
+	ReservationChanged   = "changed"
+	ReservationCancelled = "cancelled"
+)
+
+// OwnerNotification tells the property owner a reservation was made, changed or cancelled. PreviousStart and
+// PreviousEnd are the dates a changed reservation had before
+type OwnerNotification struct {
+	Change        string
+	Reservation   models.Reservation
+	PreviousStart time.Time
+	PreviousEnd   time.Time
+}
+
+// Cancellation confirms to a guest that their reservation was cancelled
+type Cancellation struct {
+	Reservation models.Reservation
+}
+
+// Reminder is sent to a guest a few days before they arrive
+type Reminder struct {
+	Reservation models.Reservation
+	ManageURL   string
+}
+
+// ThankYou is sent to a guest after they leave, asking for a review if there is somewhere to leave one
+type ThankYou struct {
+	Reservation models.Reservation
+	ReviewURL   string
+}
+
+// Invitation invites a new user to choose their password
+type Invitation struct {
+	User models.User
+	Link string
+	Days int
+}
+
+// PasswordReset sends a user a link to choose a new password
+type PasswordReset struct {
+	User models.User
+	Link string
+}
+
+func (Confirmation) templateName() string      { return "confirmation" }
+func (OwnerNotification) templateName() string { return "owner-notification" }
+func (Cancellation) templateName() string      { return "cancellation" }
+func (Reminder) templateName() string          { return "reminder" }
+func (ThankYou) templateName() string          { return "thank-you" }
+func (Invitation) templateName() string        { return "invitation" }
+func (PasswordReset) templateName() string     { return "password-reset" }
+
+var functions = map[string]interface{}{
+	"money": pricing.Format,
+	// date is the format used for the dates of a stay, e.g. Friday 7 January 2050
+	"date": func(t time.Time) string {
+		return t.Format("Monday 2 January 2006")
+	},
+	"nights": func(start, end time.Time) int {
+		return int(end.Sub(start).Hours() / 24)
+	},
+}
+
+// set is the parsed templates for one kind of email
+type set struct {
+	html *htmltemplate.Template
+	text *texttemplate.Template
+}
+
+var sets = map[string]set{}
+
+func init() {
+	for _, d := range []Data{Confirmation{}, OwnerNotification{}, Cancellation{}, Reminder{}, ThankYou{}, Invitation{},
+		PasswordReset{}} {
+		file := "templates/" + d.templateName() + ".tmpl"
+		sets[d.templateName()] = set{
+			html: htmltemplate.Must(htmltemplate.New("").Funcs(functions).
+				ParseFS(templateFS, "templates/layout.html.tmpl", file)),
+			text: texttemplate.Must(texttemplate.New("").Funcs(functions).ParseFS(templateFS, file)),
+		}
+	}
+}
+
+// Render renders an email
+func Render(d Data) (Message, error) {
+	s, ok := sets[d.templateName()]
+	if !ok {
+		return Message{}, fmt.Errorf("no email template %s", d.templateName())
+	}
+
+	var msg Message
+	var err error
+	if msg.Subject, err = execute(s.text, "subject", d); err != nil {
+		return msg, err
+	}
+	if msg.HTML, err = execute(s.html, "layout", d); err != nil {
+		return msg, err
+	}
+	if msg.Text, err = execute(s.text, "text", d); err != nil {
+		return msg, err
+	}
+	return msg, nil
+}
+
+type executor interface {
+	ExecuteTemplate(w io.Writer, name string, data interface{}) error
+}
+
+func execute(t executor, name string, d Data) (string, error) {
+	var b bytes.Buffer
+	if err := t.ExecuteTemplate(&b, name, d); err != nil {
+		return "", fmt.Errorf("rendering %s of %s email: %w", name, d.templateName(), err)
+	}
+	return strings.TrimSpace(b.String()), nil
+}
@@ -0,0 +1,109 @@
+package email
+
+import (
+	"bookings/internal/models"
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files with the current output")
+
+var reservation = models.Reservation{
+	FirstName:        "Jane",
+	LastName:         "O'Brien",
+	Email:            "jane@example.com",
+	Phone:            "555-1234",
+	StartDate:        time.Date(2050, 1, 7, 0, 0, 0, 0, time.UTC),
+	EndDate:          time.Date(2050, 1, 10, 0, 0, 0, 0, time.UTC),
+	TotalPrice:       45000,
+	ConfirmationCode: "ABCD2345",
+	Room:             models.Room{RoomName: "General's Quarters"},
+}
+
+var goldenTests = []struct {
+	name string
+	data Data
+}{
+	{"confirmation", Confirmation{Reservation: reservation, ManageURL: "https://example.com/reservations/ABCD2345"}},
+	{"owner-made", OwnerNotification{Change: ReservationMade, Reservation: reservation}},
+	{"owner-changed", OwnerNotification{Change: ReservationChanged, Reservation: reservation,
+		PreviousStart: time.Date(2050, 1, 3, 0, 0, 0, 0, time.UTC),
+		PreviousEnd:   time.Date(2050, 1, 5, 0, 0, 0, 0, time.UTC)}},
+	{"owner-cancelled", OwnerNotification{Change: ReservationCancelled, Reservation: reservation}},
+	{"cancellation", Cancellation{Reservation: reservation}},
+	{"reminder", Reminder{Reservation: reservation, ManageURL: "https://example.com/reservations/ABCD2345"}},
+	{"thank-you", ThankYou{Reservation: reservation, ReviewURL: "https://reviews.example.com/fort-smythe"}},
+	{"thank-you-no-review", ThankYou{Reservation: reservation}},
+	{"invitation", Invitation{User: models.User{FirstName: "Sam"}, Link: "https://example.com/user/set-password/x",
+		Days: 7}},
+	{"password-reset", PasswordReset{User: models.User{FirstName: "Sam"},
+		Link: "https://example.com/user/set-password/y"}},
+}
+
+// TestRender_Golden compares each email's subject, text and html body, without the layout, with
+// testdata/<name>.golden. Run go test -update to accept changes
+func TestRender_Golden(t *testing.T) {
+	for _, e := range goldenTests {
+		msg, err := Render(e.data)
+		if err != nil {
+			t.Fatalf("%s: %v", e.name, err)
+		}
+		body, err := execute(sets[e.data.templateName()].html, "html", e.data)
+		if err != nil {
+			t.Fatalf("%s: %v", e.name, err)
+		}
+
+		got := "Subject: " + msg.Subject + "\n\n" + msg.Text + "\n\n----\n\n" + body + "\n"
+		path := filepath.Join("testdata", e.name+".golden")
+		if *update {
+			if err := os.WriteFile(path, []byte(got), 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+
+		expected, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(expected, []byte(got)) {
+			t.Errorf("%s: expected\n%s\nbut got\n%s", e.name, expected, got)
+		}
+	}
+}
+
+func TestRender_Layout(t *testing.T) {
+	msg, err := Render(Cancellation{Reservation: reservation})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(msg.HTML, "<!DOCTYPE html") ||
+		!strings.Contains(msg.HTML, "<title>Reservation Cancelled ABCD2345</title>") ||
+		!strings.Contains(msg.HTML, "has been cancelled") {
+		t.Error("expected the body and subject inside the layout")
+	}
+}
+
+func TestRender_Escaping(t *testing.T) {
+	res := reservation
+	res.FirstName = `<script>alert("hi")</script>`
+
+	msg, err := Render(Confirmation{Reservation: res, ManageURL: "javascript:alert(1)"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(msg.HTML, "<script>") {
+		t.Error("expected the guest's name to be escaped in the html")
+	}
+	if strings.Contains(msg.HTML, `href="javascript:`) {
+		t.Error("expected an unsafe link to be filtered out of the html")
+	}
+	if !strings.Contains(msg.Text, res.FirstName) {
+		t.Error("expected the guest's name as typed in the text")
+	}
+}
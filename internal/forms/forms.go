@@ -4,9 +4,12 @@ import (
 	"fmt"
 	"github.com/asaskevich/govalidator"
 	"net/url"
+	"regexp"
 	"strings"
 )
 
+var slugRegexp = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
 // Form creates a custom form struct, embeds a url.Values object
 type Form struct {
 	url.Values
@@ -63,3 +66,18 @@ func (f *Form) IsEmail(field string) {
 		f.Errors.Add(field, "invalid email address")
 	}
 }
+
+// IsSlug checks that a field only holds lowercase letters and digits separated by single hyphens,
+// so it can be used as part of a url
+func (f *Form) IsSlug(field string) {
+	if !slugRegexp.MatchString(f.Get(field)) {
+		f.Errors.Add(field, "only lowercase letters, numbers and hyphens are allowed")
+	}
+}
+
+// Matches checks that a field holds the same value as another, such as a password and its confirmation
+func (f *Form) Matches(field, otherField string) {
+	if f.Get(field) != f.Get(otherField) {
+		f.Errors.Add(field, "the values do not match")
+	}
+}
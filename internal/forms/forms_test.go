@@ -115,3 +115,41 @@ func TestForm_IsEmail(t *testing.T) {
 		t.Error("form shows a valid value when the email is invalid")
 	}
 }
+
+func TestForm_IsSlug(t *testing.T) {
+	postedValue := url.Values{}
+	postedValue.Add("slug", "colonels-suite-2")
+	form := New(postedValue)
+	form.IsSlug("slug")
+	if !form.Valid() {
+		t.Error("form shows invalid slug when value is indeed valid")
+	}
+
+	for _, bad := range []string{"", "Colonels Suite", "colonels--suite", "-colonels", "suite/2"} {
+		postedValue = url.Values{}
+		postedValue.Add("slug", bad)
+		form = New(postedValue)
+		form.IsSlug("slug")
+		if form.Valid() {
+			t.Errorf("form shows valid slug for %q", bad)
+		}
+	}
+}
+
+func TestForm_Matches(t *testing.T) {
+	postedValue := url.Values{}
+	postedValue.Add("password", "correct horse")
+	postedValue.Add("password_confirm", "correct horse")
+	form := New(postedValue)
+	form.Matches("password_confirm", "password")
+	if !form.Valid() {
+		t.Error("form shows fields do not match when they do")
+	}
+
+	postedValue.Set("password_confirm", "battery staple")
+	form = New(postedValue)
+	form.Matches("password_confirm", "password")
+	if form.Valid() {
+		t.Error("form shows fields match when they do not")
+	}
+}
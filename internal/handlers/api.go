@@ -0,0 +1,570 @@
+package handlers
+
+import (
+	"bookings/internal/forms"
+	"bookings/internal/helpers"
+	"bookings/internal/metrics"
+	"bookings/internal/models"
+	"bookings/internal/pricing"
+	"bookings/internal/repository"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type apiContextKey string
+
+// apiUserKey is the request context key holding the user an api token belongs to
+const apiUserKey apiContextKey = "api_user"
+
+const apiDateLayout = "2006-01-02"
+
+// apiPerPage is how many reservations the admin listing returns when per_page is not given, and apiMaxPerPage the
+// most it returns whatever is asked for
+const (
+	apiPerPage    = 50
+	apiMaxPerPage = 100
+)
+
+// apiEnvelope wraps every json api response, so clients always find either data or error at the top level
+type apiEnvelope struct {
+	Data  interface{} `json:"data,omitempty"`
+	Error *apiError   `json:"error,omitempty"`
+}
+
+type apiError struct {
+	Status  int               `json:"status"`
+	Message string            `json:"message"`
+	Fields  map[string]string `json:"fields,omitempty"`
+}
+
+type apiRoom struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+type apiRange struct {
+	StartDate string `json:"start_date"`
+	EndDate   string `json:"end_date"`
+	Type      string `json:"type"`
+	// Reason is only given for restriction types the owners chose to show guests
+	Reason string `json:"reason,omitempty"`
+}
+
+type apiAvailability struct {
+	RoomID      int        `json:"room_id"`
+	StartDate   string     `json:"start_date"`
+	EndDate     string     `json:"end_date"`
+	Available   bool       `json:"available"`
+	Unavailable []apiRange `json:"unavailable"`
+}
+
+type apiReservation struct {
+	ID         int    `json:"id"`
+	FirstName  string `json:"first_name"`
+	LastName   string `json:"last_name"`
+	Email      string `json:"email"`
+	Phone      string `json:"phone"`
+	RoomID     int    `json:"room_id"`
+	RoomName   string `json:"room_name,omitempty"`
+	StartDate  string `json:"start_date"`
+	EndDate    string `json:"end_date"`
+	Processed  bool   `json:"processed"`
+	TotalPrice int    `json:"total_price"`
+}
+
+type apiReservationPage struct {
+	Reservations []apiReservation `json:"reservations"`
+	Page         int              `json:"page"`
+	PerPage      int              `json:"per_page"`
+	Total        int              `json:"total"`
+}
+
+type apiNight struct {
+	Date      string `json:"date"`
+	Rate      int    `json:"rate"`
+	Surcharge int    `json:"surcharge"`
+	Season    string `json:"season,omitempty"`
+	Total     int    `json:"total"`
+}
+
+type apiQuote struct {
+	RoomID    int        `json:"room_id"`
+	StartDate string     `json:"start_date"`
+	EndDate   string     `json:"end_date"`
+	MinStay   int        `json:"min_stay"`
+	Nights    []apiNight `json:"nights"`
+	Total     int        `json:"total"`
+}
+
+func toAPIRoom(r models.Room) apiRoom {
+	return apiRoom{ID: r.ID, Name: r.RoomName}
+}
+
+func toAPIReservation(r models.Reservation) apiReservation {
+	return apiReservation{
+		ID:         r.ID,
+		FirstName:  r.FirstName,
+		LastName:   r.LastName,
+		Email:      r.Email,
+		Phone:      r.Phone,
+		RoomID:     r.RoomID,
+		RoomName:   r.Room.RoomName,
+		StartDate:  r.StartDate.Format(apiDateLayout),
+		EndDate:    r.EndDate.Format(apiDateLayout),
+		Processed:  r.Processed == 1,
+		TotalPrice: r.TotalPrice,
+	}
+}
+
+func toAPIQuote(q pricing.Quote) apiQuote {
+	out := apiQuote{
+		RoomID:    q.RoomID,
+		StartDate: q.StartDate.Format(apiDateLayout),
+		EndDate:   q.EndDate.Format(apiDateLayout),
+		MinStay:   q.MinStay,
+		Nights:    make([]apiNight, 0, len(q.Nights)),
+		Total:     q.Total,
+	}
+	for _, n := range q.Nights {
+		out.Nights = append(out.Nights, apiNight{
+			Date:      n.Date.Format(apiDateLayout),
+			Rate:      n.Rate,
+			Surcharge: n.Surcharge,
+			Season:    n.Season,
+			Total:     n.Total,
+		})
+	}
+	return out
+}
+
+// writeJSON writes data inside the api envelope with the given status code
+func writeJSON(w http.ResponseWriter, status int, data interface{}) {
+	out, err := json.Marshal(apiEnvelope{Data: data})
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "cannot encode response")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(out)
+}
+
+// writeJSONError writes an api error envelope with the given status code
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSONFieldErrors(w, status, message, nil)
+}
+
+func writeJSONFieldErrors(w http.ResponseWriter, status int, message string, fields map[string]string) {
+	out, _ := json.Marshal(apiEnvelope{Error: &apiError{Status: status, Message: message, Fields: fields}})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(out)
+}
+
+// parseAPIDates reads the start and end query parameters
+func parseAPIDates(r *http.Request) (time.Time, time.Time, error) {
+	startDate, err := time.Parse(apiDateLayout, r.URL.Query().Get("start"))
+	if err != nil {
+		return startDate, startDate, errors.New("start must be a date in YYYY-MM-DD format")
+	}
+	endDate, err := time.Parse(apiDateLayout, r.URL.Query().Get("end"))
+	if err != nil {
+		return startDate, endDate, errors.New("end must be a date in YYYY-MM-DD format")
+	}
+	if !endDate.After(startDate) {
+		return startDate, endDate, errors.New("end must be after start")
+	}
+	return startDate, endDate, nil
+}
+
+// APIAuth only lets requests through that carry a valid api token in the Authorization header
+func (rep *Repository) APIAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" || token == r.Header.Get("Authorization") {
+			writeJSONError(w, http.StatusUnauthorized, "missing bearer token")
+			return
+		}
+
+		user, err := rep.DB.GetUserByAPITokenHash(r.Context(), helpers.HashToken(token))
+		if err != nil {
+			writeJSONError(w, http.StatusUnauthorized, "invalid api token")
+			return
+		}
+
+		helpers.SetRequestUser(r.Context(), user.ID)
+		ctx := context.WithValue(r.Context(), apiUserKey, user)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// APIRequireAccess only lets through api tokens whose user's access level is at least level, the same levels the
+// admin pages ask for
+func (rep *Repository) APIRequireAccess(level int) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, ok := r.Context().Value(apiUserKey).(models.User)
+			if !ok || user.AccessLevel < level {
+				writeJSONError(w, http.StatusForbidden, "api token does not allow this")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// APINotFound is the json api's response for unknown endpoints
+func (rep *Repository) APINotFound(w http.ResponseWriter, r *http.Request) {
+	writeJSONError(w, http.StatusNotFound, "resource not found")
+}
+
+// APIMethodNotAllowed is the json api's response for unsupported methods
+func (rep *Repository) APIMethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+}
+
+// APIRooms lists all rooms
+func (rep *Repository) APIRooms(w http.ResponseWriter, r *http.Request) {
+	rooms, err := rep.DB.AllRooms(r.Context())
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "cannot get rooms")
+		return
+	}
+
+	out := make([]apiRoom, 0, len(rooms))
+	for _, x := range rooms {
+		out = append(out, toAPIRoom(x))
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// APIRoom returns one room
+func (rep *Repository) APIRoom(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid room id")
+		return
+	}
+
+	room, err := rep.DB.GetRoomById(r.Context(), id)
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, "room not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, toAPIRoom(room))
+}
+
+// APIAvailability lists the rooms that are free between the start and end query parameters
+func (rep *Repository) APIAvailability(w http.ResponseWriter, r *http.Request) {
+	startDate, endDate, err := parseAPIDates(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	rooms, err := rep.DB.SearchAvailabilityForAllRooms(r.Context(), startDate, endDate)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "cannot search availability")
+		return
+	}
+	metrics.Search("api", len(rooms) > 0)
+
+	out := make([]apiRoom, 0, len(rooms))
+	for _, x := range rooms {
+		out = append(out, toAPIRoom(x))
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// APIRoomAvailability returns whether a room is free between the start and end query parameters,
+// along with the ranges in that window when it is not
+func (rep *Repository) APIRoomAvailability(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid room id")
+		return
+	}
+
+	startDate, endDate, err := parseAPIDates(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if _, err := rep.DB.GetRoomById(r.Context(), id); err != nil {
+		writeJSONError(w, http.StatusNotFound, "room not found")
+		return
+	}
+
+	restrictions, err := rep.DB.GetRestrictionsForRoomByDate(r.Context(), id, startDate, endDate)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "cannot search availability")
+		return
+	}
+
+	out := apiAvailability{
+		RoomID:      id,
+		StartDate:   startDate.Format(apiDateLayout),
+		EndDate:     endDate.Format(apiDateLayout),
+		Unavailable: []apiRange{},
+	}
+	for _, x := range restrictions {
+		if !x.Restriction.BlocksBooking {
+			continue
+		}
+		kind := "block"
+		if x.ReservationID > 0 {
+			kind = "reservation"
+		}
+		unavailable := apiRange{
+			StartDate: x.StartDate.Format(apiDateLayout),
+			EndDate:   x.EndDate.Format(apiDateLayout),
+			Type:      kind,
+		}
+		if x.Restriction.GuestVisible {
+			unavailable.Reason = x.Restriction.RestrictionName
+		}
+		out.Unavailable = append(out.Unavailable, unavailable)
+	}
+	out.Available = len(out.Unavailable) == 0
+
+	writeJSON(w, http.StatusOK, out)
+}
+
+// APIRoomQuote prices a stay in a room between the start and end query parameters
+func (rep *Repository) APIRoomQuote(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid room id")
+		return
+	}
+
+	startDate, endDate, err := parseAPIDates(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	room, err := rep.DB.GetRoomById(r.Context(), id)
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, "room not found")
+		return
+	}
+
+	quote, err := rep.quoteStay(r.Context(), room, startDate, endDate)
+	var minStay pricing.MinimumStayError
+	if errors.As(err, &minStay) {
+		writeJSONError(w, http.StatusUnprocessableEntity, minStay.Error())
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "cannot price stay")
+		return
+	}
+	writeJSON(w, http.StatusOK, toAPIQuote(quote))
+}
+
+// APICreateReservation books a room from a json request body
+func (rep *Repository) APICreateReservation(w http.ResponseWriter, r *http.Request) {
+	var in apiReservation
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "request body must be a json reservation")
+		return
+	}
+
+	form := forms.New(url.Values{
+		"first_name": {in.FirstName},
+		"last_name":  {in.LastName},
+		"email":      {in.Email},
+		"phone":      {in.Phone},
+		"start_date": {in.StartDate},
+		"end_date":   {in.EndDate},
+	})
+	form.Required("first_name", "last_name", "email", "phone", "start_date", "end_date")
+	form.MinLength("first_name", 3)
+	form.MinLength("last_name", 2)
+	form.IsEmail("email")
+
+	startDate, err := time.Parse(apiDateLayout, in.StartDate)
+	if err != nil {
+		form.Errors.Add("start_date", "must be a date in YYYY-MM-DD format")
+	}
+	endDate, err := time.Parse(apiDateLayout, in.EndDate)
+	if err != nil {
+		form.Errors.Add("end_date", "must be a date in YYYY-MM-DD format")
+	} else if !endDate.After(startDate) {
+		form.Errors.Add("end_date", "must be after the start date")
+	}
+
+	if !form.Valid() {
+		fields := make(map[string]string)
+		for field := range form.Errors {
+			fields[field] = form.Errors.Get(field)
+		}
+		writeJSONFieldErrors(w, http.StatusUnprocessableEntity, "invalid reservation", fields)
+		return
+	}
+
+	room, err := rep.DB.GetRoomById(r.Context(), in.RoomID)
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, "room not found")
+		return
+	}
+
+	reservation := models.Reservation{
+		FirstName: in.FirstName,
+		LastName:  in.LastName,
+		Email:     in.Email,
+		Phone:     in.Phone,
+		StartDate: startDate,
+		EndDate:   endDate,
+		RoomID:    room.ID,
+		Room:      room,
+	}
+
+	quote, err := rep.quoteStay(r.Context(), room, startDate, endDate)
+	var minStay pricing.MinimumStayError
+	if errors.As(err, &minStay) {
+		writeJSONFieldErrors(w, http.StatusUnprocessableEntity, "invalid reservation",
+			map[string]string{"end_date": minStay.Error()})
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "cannot price stay")
+		return
+	}
+	reservation.TotalPrice = quote.Total
+
+	reservation.ConfirmationCode, err = helpers.RandomToken(16)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "cannot save reservation")
+		return
+	}
+
+	reservation.ID, err = rep.DB.BookRoom(r.Context(), reservation)
+	if errors.Is(err, repository.ErrRoomUnavailable) {
+		writeJSONError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "cannot save reservation")
+		return
+	}
+	metrics.ReservationsCreated.WithLabelValues("api").Inc()
+
+	rep.sendReservationNotifications(r, reservation)
+
+	w.Header().Set("Location", "/api/v1/reservations/"+strconv.Itoa(reservation.ID))
+	writeJSON(w, http.StatusCreated, toAPIReservation(reservation))
+}
+
+// APIReservation returns one reservation
+func (rep *Repository) APIReservation(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid reservation id")
+		return
+	}
+
+	res, err := rep.DB.GetReservationById(r.Context(), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeJSONError(w, http.StatusNotFound, "reservation not found")
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "cannot get reservation")
+		return
+	}
+	writeJSON(w, http.StatusOK, toAPIReservation(res))
+}
+
+// APICancelReservation cancels a reservation and frees up its dates. Stays that have begun are the business's
+// record of what was let, so only owners can remove them, from the admin pages
+func (rep *Repository) APICancelReservation(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid reservation id")
+		return
+	}
+
+	res, err := rep.DB.GetReservationById(r.Context(), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeJSONError(w, http.StatusNotFound, "reservation not found")
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "cannot get reservation")
+		return
+	}
+	if stayStarted(res) {
+		writeJSONError(w, http.StatusConflict, "reservations cannot be cancelled once the stay has begun")
+		return
+	}
+
+	if err := rep.DB.DeleteReservation(r.Context(), id); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "cannot cancel reservation")
+		return
+	}
+	metrics.ReservationsCancelled.WithLabelValues("api").Inc()
+	// the reservation is gone, so the log is what is left to say who cancelled what
+	user, _ := r.Context().Value(apiUserKey).(models.User)
+	helpers.Logger(r.Context()).Info("reservation cancelled", "reservation_id", res.ID, "room_id", res.RoomID,
+		"start_date", res.StartDate.Format(apiDateLayout), "end_date", res.EndDate.Format(apiDateLayout),
+		"email", res.Email, "api_user_id", user.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// APIAdminReservations lists a page of reservations, or of only unprocessed ones when called with ?processed=0,
+// along with how many there are in all
+func (rep *Repository) APIAdminReservations(w http.ResponseWriter, r *http.Request) {
+	filter := models.ReservationFilter{Page: 1, PerPage: apiPerPage}
+	for _, p := range []struct {
+		name  string
+		value *int
+	}{{"page", &filter.Page}, {"per_page", &filter.PerPage}} {
+		v := r.URL.Query().Get(p.name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			writeJSONError(w, http.StatusBadRequest, p.name+" must be a whole number above zero")
+			return
+		}
+		*p.value = n
+	}
+	filter.PerPage = min(filter.PerPage, apiMaxPerPage)
+
+	switch r.URL.Query().Get("processed") {
+	case "0":
+		filter.Processed = models.ReservationsNew
+	case "":
+	default:
+		writeJSONError(w, http.StatusBadRequest, "processed must be 0 or omitted")
+		return
+	}
+	reservations, total, err := rep.DB.SearchReservations(r.Context(), filter)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "cannot get reservations")
+		return
+	}
+
+	out := apiReservationPage{
+		Reservations: make([]apiReservation, 0, len(reservations)),
+		Page:         filter.Page,
+		PerPage:      filter.PerPage,
+		Total:        total,
+	}
+	for _, x := range reservations {
+		out.Reservations = append(out.Reservations, toAPIReservation(x))
+	}
+	writeJSON(w, http.StatusOK, out)
+}
@@ -0,0 +1,352 @@
+package handlers
+
+import (
+	"bookings/internal/helpers"
+	"bookings/internal/models"
+	"bookings/internal/repository"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var apiTests = []struct {
+	name               string
+	method             string
+	url                string
+	token              string
+	body               string
+	expectedStatusCode int
+}{
+	{"rooms", "GET", "/api/v1/rooms", "", "", http.StatusOK},
+	{"room", "GET", "/api/v1/rooms/1", "", "", http.StatusOK},
+	{"room-not-found", "GET", "/api/v1/rooms/3", "", "", http.StatusNotFound},
+	{"room-availability", "GET", "/api/v1/rooms/1/availability?start=2050-01-01&end=2050-01-05", "", "", http.StatusOK},
+	{"room-quote", "GET", "/api/v1/rooms/1/quote?start=2050-01-01&end=2050-01-05", "", "", http.StatusOK},
+	{"room-quote-min-stay", "GET", "/api/v1/rooms/1/quote?start=2070-01-01&end=2070-01-02", "", "", http.StatusUnprocessableEntity},
+	{"availability", "GET", "/api/v1/availability?start=2050-01-01&end=2050-01-05", "", "", http.StatusOK},
+	{"availability-bad-dates", "GET", "/api/v1/availability?start=2050-01-05&end=2050-01-01", "", "", http.StatusBadRequest},
+	{"unknown-endpoint", "GET", "/api/v1/green/eggs", "", "", http.StatusNotFound},
+	{"reservation-no-token", "GET", "/api/v1/reservations/1", "", "", http.StatusUnauthorized},
+	{"reservation-bad-token", "GET", "/api/v1/reservations/1", "nope", "", http.StatusUnauthorized},
+	{"reservation", "GET", "/api/v1/reservations/1", "valid-token", "", http.StatusOK},
+	{"reservation-not-found", "GET", "/api/v1/reservations/1001", "valid-token", "", http.StatusNotFound},
+	{"reservation-read-only", "GET", "/api/v1/reservations/1", "read-only-token", "", http.StatusOK},
+	{"cancel-reservation", "DELETE", "/api/v1/reservations/1", "valid-token", "", http.StatusNoContent},
+	{"cancel-reservation-over", "DELETE", "/api/v1/reservations/2", "valid-token", "", http.StatusConflict},
+	{"cancel-reservation-read-only", "DELETE", "/api/v1/reservations/1", "read-only-token", "", http.StatusForbidden},
+	{"admin-reservations", "GET", "/api/v1/admin/reservations?processed=0", "valid-token", "", http.StatusOK},
+	{"admin-reservations-read-only", "GET", "/api/v1/admin/reservations", "read-only-token", "", http.StatusForbidden},
+	{"admin-reservations-bad-page", "GET", "/api/v1/admin/reservations?page=0", "valid-token", "", http.StatusBadRequest},
+	{"admin-reservations-bad-per-page", "GET", "/api/v1/admin/reservations?per_page=all", "valid-token", "",
+		http.StatusBadRequest},
+	{"create-reservation", "POST", "/api/v1/reservations", "valid-token",
+		`{"room_id":1,"start_date":"2050-01-01","end_date":"2050-01-02","first_name":"John","last_name":"Smith","email":"john@smith.com","phone":"555-555-5555"}`,
+		http.StatusCreated},
+	{"create-reservation-taken", "POST", "/api/v1/reservations", "valid-token",
+		`{"room_id":1,"start_date":"2060-01-01","end_date":"2060-01-02","first_name":"John","last_name":"Smith","email":"john@smith.com","phone":"555-555-5555"}`,
+		http.StatusConflict},
+	{"create-reservation-invalid", "POST", "/api/v1/reservations", "valid-token",
+		`{"room_id":1,"start_date":"2050-01-01","end_date":"2050-01-02","first_name":"J","last_name":"Smith","email":"john","phone":"555-555-5555"}`,
+		http.StatusUnprocessableEntity},
+	{"create-reservation-min-stay", "POST", "/api/v1/reservations", "valid-token",
+		`{"room_id":1,"start_date":"2070-01-01","end_date":"2070-01-02","first_name":"John","last_name":"Smith","email":"john@smith.com","phone":"555-555-5555"}`,
+		http.StatusUnprocessableEntity},
+	{"create-reservation-bad-json", "POST", "/api/v1/reservations", "valid-token", `{`, http.StatusBadRequest},
+}
+
+func TestAPI(t *testing.T) {
+	useFixtures(t)
+	routes := getRoutes()
+	ts := httptest.NewServer(routes)
+	defer ts.Close()
+
+	for _, e := range apiTests {
+		req, _ := http.NewRequest(e.method, ts.URL+e.url, strings.NewReader(e.body))
+		if e.token != "" {
+			req.Header.Set("Authorization", "Bearer "+e.token)
+		}
+
+		resp, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.StatusCode != e.expectedStatusCode {
+			t.Errorf("for %s, expected %d but got %d", e.name, e.expectedStatusCode, resp.StatusCode)
+		}
+
+		if resp.StatusCode == http.StatusNoContent {
+			resp.Body.Close()
+			continue
+		}
+
+		// every response uses the envelope, with error set exactly when the status is not a success
+		var envelope apiEnvelope
+		err = json.NewDecoder(resp.Body).Decode(&envelope)
+		resp.Body.Close()
+		if err != nil {
+			t.Errorf("for %s, response is not a json envelope: %s", e.name, err)
+			continue
+		}
+		if (resp.StatusCode >= 400) != (envelope.Error != nil) {
+			t.Errorf("for %s, status %d does not match error %v", e.name, resp.StatusCode, envelope.Error)
+		}
+	}
+}
+
+// TestAPI_Booking books, searches and cancels through the api, checking each step changes what the next one sees
+func TestAPI_Booking(t *testing.T) {
+	useMemoryRepo(t)
+
+	userID, err := Repo.DB.InsertUser(context.Background(), models.User{FirstName: "Pat", LastName: "Partner", Email: "partner@here.com",
+		Password: "not a bcrypt hash", AccessLevel: models.AccessStaff})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Repo.DB.InsertAPIToken(context.Background(), models.APIToken{UserID: userID, Name: "partner",
+		TokenHash: helpers.HashToken("partner-token")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(getRoutes())
+	defer ts.Close()
+
+	do := func(method, url, body string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(method, ts.URL+url, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer partner-token")
+		resp, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+	available := func() []apiRoom {
+		t.Helper()
+		var envelope struct{ Data []apiRoom }
+		resp := do("GET", "/api/v1/availability?start=2050-01-02&end=2050-01-03", "")
+		if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+			t.Fatal(err)
+		}
+		return envelope.Data
+	}
+
+	booking := `{"room_id":1,"start_date":"2050-01-01","end_date":"2050-01-04","first_name":"John","last_name":"Smith","email":"john@smith.com","phone":"555-555-5555"}`
+	resp := do("POST", "/api/v1/reservations", booking)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected the booking to be created but got %d", resp.StatusCode)
+	}
+	location := resp.Header.Get("Location")
+
+	if resp := do("POST", "/api/v1/reservations", booking); resp.StatusCode != http.StatusConflict {
+		t.Errorf("expected the same dates to be refused but got %d", resp.StatusCode)
+	}
+	if rooms := available(); len(rooms) != 1 || rooms[0].Name != "Colonel's Suite" {
+		t.Errorf("expected only the other room to be free but got %+v", rooms)
+	}
+
+	if resp := do("DELETE", location, ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected the booking to be cancelled but got %d", resp.StatusCode)
+	}
+	if rooms := available(); len(rooms) != 2 {
+		t.Errorf("expected cancelling to free the room but got %+v", rooms)
+	}
+	if resp := do("GET", location, ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected the cancelled booking to be gone but got %d", resp.StatusCode)
+	}
+}
+
+func TestAPI_AdminReservations(t *testing.T) {
+	useMemoryRepo(t)
+
+	ctx := context.Background()
+	userID, err := Repo.DB.InsertUser(ctx, models.User{FirstName: "Pat", LastName: "Partner", Email: "partner@here.com",
+		Password: "not a bcrypt hash", AccessLevel: models.AccessStaff})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Repo.DB.InsertAPIToken(ctx, models.APIToken{UserID: userID, Name: "partner",
+		TokenHash: helpers.HashToken("partner-token")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < apiMaxPerPage+5; i++ {
+		_, err := Repo.DB.InsertReservation(ctx, models.Reservation{FirstName: "John", LastName: "Smith",
+			Email: "john@smith.com", RoomID: 1, StartDate: start.AddDate(0, 0, 2*i), EndDate: start.AddDate(0, 0, 2*i+1),
+			ConfirmationCode: strconv.Itoa(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ts := httptest.NewServer(getRoutes())
+	defer ts.Close()
+
+	tests := []struct {
+		name            string
+		query           string
+		expectedCount   int
+		expectedPerPage int
+	}{
+		{"default", "", apiPerPage, apiPerPage},
+		{"second page", "?page=2&per_page=60", 45, 60},
+		{"last page", "?page=3&per_page=50", 5, 50},
+		{"capped", "?per_page=1000", apiMaxPerPage, apiMaxPerPage},
+		{"past the end", "?page=10", 0, apiPerPage},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", ts.URL+"/api/v1/admin/reservations"+e.query, nil)
+		req.Header.Set("Authorization", "Bearer partner-token")
+		resp, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var envelope struct{ Data apiReservationPage }
+		err = json.NewDecoder(resp.Body).Decode(&envelope)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", e.name, err)
+		}
+
+		if len(envelope.Data.Reservations) != e.expectedCount {
+			t.Errorf("%s: expected %d reservations but got %d", e.name, e.expectedCount, len(envelope.Data.Reservations))
+		}
+		if envelope.Data.PerPage != e.expectedPerPage {
+			t.Errorf("%s: expected per_page %d but got %d", e.name, e.expectedPerPage, envelope.Data.PerPage)
+		}
+		if envelope.Data.Total != apiMaxPerPage+5 {
+			t.Errorf("%s: expected a total of %d but got %d", e.name, apiMaxPerPage+5, envelope.Data.Total)
+		}
+	}
+}
+
+func TestAPI_TokenAccess(t *testing.T) {
+	useMemoryRepo(t)
+
+	ctx := context.Background()
+	users := make(map[int]int)
+	for _, level := range []int{models.AccessReadOnly, models.AccessStaff, models.AccessOwner} {
+		id, err := Repo.DB.InsertUser(ctx, models.User{FirstName: "Pat", LastName: "Partner",
+			Email: fmt.Sprintf("user%d@here.com", level), Password: "not a bcrypt hash", AccessLevel: level})
+		if err != nil {
+			t.Fatal(err)
+		}
+		users[level] = id
+	}
+	resID, err := Repo.DB.BookRoom(ctx, models.Reservation{FirstName: "John", LastName: "Smith",
+		Email: "john@smith.com", RoomID: 1, StartDate: time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC),
+		EndDate: time.Date(2050, 1, 2, 0, 0, 0, 0, time.UTC), ConfirmationCode: "valid-code"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the owner issues each token from the admin page, which shows it once
+	issue := func(userID int) string {
+		t.Helper()
+		postedData := url.Values{}
+		postedData.Add("name", "widget")
+		postedData.Add("user_id", strconv.Itoa(userID))
+		req, _ := http.NewRequest("POST", "/admin/api-tokens", strings.NewReader(postedData.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		session.Put(ctx, "user_id", users[models.AccessOwner])
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(Repo.AdminPostAPIToken).ServeHTTP(rr, req)
+		if rr.Code != http.StatusSeeOther {
+			t.Fatalf("expected a redirect after issuing a token but got %d", rr.Code)
+		}
+		return session.GetString(ctx, "new_api_token")
+	}
+
+	if token := issue(1000); token != "" {
+		t.Errorf("expected no token for a user that doesn't exist but got %q", token)
+	}
+	readOnly := issue(users[models.AccessReadOnly])
+	staff := issue(users[models.AccessStaff])
+
+	tokens, err := Repo.DB.AllAPITokens(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuedTo := make(map[int]bool)
+	for _, tk := range tokens {
+		issuedTo[tk.UserID] = true
+	}
+	if len(tokens) != 2 || !issuedTo[users[models.AccessReadOnly]] || !issuedTo[users[models.AccessStaff]] {
+		t.Errorf("expected a token for each chosen user but got %+v", tokens)
+	}
+
+	ts := httptest.NewServer(getRoutes())
+	defer ts.Close()
+
+	reservation := fmt.Sprintf("/api/v1/reservations/%d", resID)
+	tests := []struct {
+		name           string
+		method         string
+		url            string
+		token          string
+		expectedStatus int
+	}{
+		{"read only can read", "GET", reservation, readOnly, http.StatusOK},
+		{"read only cannot cancel", "DELETE", reservation, readOnly, http.StatusForbidden},
+		{"read only cannot list", "GET", "/api/v1/admin/reservations", readOnly, http.StatusForbidden},
+		{"staff can list", "GET", "/api/v1/admin/reservations", staff, http.StatusOK},
+		{"staff can cancel", "DELETE", reservation, staff, http.StatusNoContent},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest(e.method, ts.URL+e.url, nil)
+		req.Header.Set("Authorization", "Bearer "+e.token)
+		resp, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != e.expectedStatus {
+			t.Errorf("%s: expected %d but got %d", e.name, e.expectedStatus, resp.StatusCode)
+		}
+	}
+}
+
+func TestAPI_CancelReservationErrors(t *testing.T) {
+	db := useFixtures(t)
+
+	tests := []struct {
+		name           string
+		repo           repository.DatabaseRepo
+		expectedStatus int
+	}{
+		{"not found", db, http.StatusNotFound},
+		{"database down", brokenRepo{db}, http.StatusInternalServerError},
+	}
+
+	ts := httptest.NewServer(getRoutes())
+	defer ts.Close()
+
+	for _, e := range tests {
+		Repo.DB = e.repo
+		req, _ := http.NewRequest("DELETE", ts.URL+"/api/v1/reservations/1001", nil)
+		req.Header.Set("Authorization", "Bearer valid-token")
+		resp, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != e.expectedStatus {
+			t.Errorf("%s: expected %d but got %d", e.name, e.expectedStatus, resp.StatusCode)
+		}
+	}
+}
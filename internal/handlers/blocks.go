@@ -0,0 +1,214 @@
+package handlers
+
+import (
+	"bookings/internal/forms"
+	"bookings/internal/helpers"
+	"bookings/internal/models"
+	"bookings/internal/render"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// blockReasons are offered when filling in a block's note, any other note is fine too
+var blockReasons = []string{"Maintenance", "Owner stay", "Cleaning"}
+
+// AdminShowBlock shows the form for blocking out a room, or changing an existing block.
+// A new block can be started from a room and day picked on the calendar
+func (rep *Repository) AdminShowBlock(w http.ResponseWriter, r *http.Request) {
+	var block models.RoomRestriction
+
+	if chi.URLParam(r, "id") == "new" {
+		block.RoomID, _ = strconv.Atoi(r.URL.Query().Get("room"))
+		block.Restriction.SystemKey = models.RestrictionOwnerBlock
+		start, err := time.Parse("2006-01-02", r.URL.Query().Get("start"))
+		if err == nil {
+			block.StartDate = start
+			block.EndDate = start.AddDate(0, 0, 1)
+		}
+	} else {
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			helpers.ServerError(w, r, err)
+			return
+		}
+		block, err = rep.DB.GetBlockByID(r.Context(), id)
+		if errors.Is(err, sql.ErrNoRows) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			helpers.ServerError(w, r, err)
+			return
+		}
+	}
+
+	rep.renderBlock(w, r, block, forms.New(nil))
+}
+
+// AdminPostBlock creates or changes a block. Blocks that keep guests out can't be put over a reservation
+func (rep *Repository) AdminPostBlock(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	var block models.RoomRestriction
+	if chi.URLParam(r, "id") != "new" {
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			helpers.ServerError(w, r, err)
+			return
+		}
+		block, err = rep.DB.GetBlockByID(r.Context(), id)
+		if errors.Is(err, sql.ErrNoRows) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			helpers.ServerError(w, r, err)
+			return
+		}
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("room_id", "restriction_id", "start_date", "end_date")
+
+	block.RestrictionID, _ = strconv.Atoi(form.Get("restriction_id"))
+	restriction, err := rep.DB.GetRestrictionByID(r.Context(), block.RestrictionID)
+	if err != nil || !isBlockType(restriction) {
+		form.Errors.Add("restriction_id", "Choose what kind of block this is")
+	}
+
+	block.Note = strings.TrimSpace(form.Get("note"))
+	block.RoomID, _ = strconv.Atoi(form.Get("room_id"))
+	if _, err := rep.DB.GetRoomById(r.Context(), block.RoomID); err != nil {
+		form.Errors.Add("room_id", "Choose a room")
+	}
+
+	layout := "2006-01-02"
+	block.StartDate, err = time.Parse(layout, form.Get("start_date"))
+	if err != nil {
+		form.Errors.Add("start_date", "Enter the first day the room is blocked")
+	}
+	block.EndDate, err = time.Parse(layout, form.Get("end_date"))
+	if err != nil || !block.EndDate.After(block.StartDate) {
+		form.Errors.Add("end_date", "The block must end after it starts")
+	}
+
+	// a type that doesn't block booking is only a note on the calendar, so it can sit alongside guests
+	if form.Valid() && restriction.BlocksBooking {
+		restrictions, err := rep.DB.GetRestrictionsForRoomByDate(r.Context(), block.RoomID, block.StartDate, block.EndDate)
+		if err != nil {
+			helpers.ServerError(w, r, err)
+			return
+		}
+		for _, x := range restrictions {
+			if x.ReservationID > 0 && x.StartDate.Before(block.EndDate) && block.StartDate.Before(x.EndDate) {
+				form.Errors.Add("start_date", fmt.Sprintf("A guest is booked in from %s to %s",
+					x.StartDate.Format(layout), x.EndDate.Format(layout)))
+				break
+			}
+		}
+	}
+
+	if !form.Valid() {
+		rep.renderBlock(w, r, block, form)
+		return
+	}
+
+	if block.ID == 0 {
+		_, err = rep.DB.InsertBlock(r.Context(), block)
+	} else {
+		err = rep.DB.UpdateBlock(r.Context(), block)
+	}
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	rep.App.Session.Put(r.Context(), "flash", "Block saved")
+	http.Redirect(w, r, calendarURL(block.StartDate), http.StatusSeeOther)
+}
+
+// AdminDeleteBlock removes a block, freeing the room up again
+func (rep *Repository) AdminDeleteBlock(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	block, err := rep.DB.GetBlockByID(r.Context(), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	err = rep.DB.DeleteBlockById(r.Context(), block.ID)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	rep.App.Session.Put(r.Context(), "flash", "Block removed")
+	http.Redirect(w, r, calendarURL(block.StartDate), http.StatusSeeOther)
+}
+
+// renderBlock renders the block form
+func (rep *Repository) renderBlock(w http.ResponseWriter, r *http.Request, block models.RoomRestriction,
+	form *forms.Form) {
+	rooms, err := rep.DB.AllRooms(r.Context())
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	restrictions, err := rep.DB.AllRestrictions(r.Context())
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+	var types []models.Restriction
+	for _, x := range restrictions {
+		if isBlockType(x) {
+			types = append(types, x)
+			// a new block starts out as a plain owner block
+			if block.RestrictionID == 0 && x.SystemKey == block.Restriction.SystemKey {
+				block.RestrictionID = x.ID
+			}
+		}
+	}
+
+	data := make(map[string]interface{})
+	data["block"] = block
+	data["rooms"] = rooms
+	data["types"] = types
+	data["reasons"] = blockReasons
+
+	render.Template(w, r, "admin-block.page.tmpl", &models.TemplateData{
+		Data: data,
+		Form: form,
+	})
+}
+
+// isBlockType reports whether owners can block rooms with a restriction type. Reservations and external bookings
+// come about their own way
+func isBlockType(r models.Restriction) bool {
+	return r.SystemKey == "" || r.SystemKey == models.RestrictionOwnerBlock
+}
+
+// calendarURL returns the address of the admin calendar for the month of day
+func calendarURL(day time.Time) string {
+	return fmt.Sprintf("/admin/reservations-calendar?y=%d&m=%02d", day.Year(), day.Month())
+}
@@ -0,0 +1,201 @@
+package handlers
+
+import (
+	"bookings/internal/helpers"
+	"bookings/internal/models"
+	"bookings/internal/occupancy"
+	"bookings/internal/xlsx"
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxExportMonths is the most months an occupancy export may cover
+const maxExportMonths = 120
+
+// exportWriter writes the rows of an export, as csv or as an Excel sheet
+type exportWriter interface {
+	WriteHeader(headings ...string) error
+	Write(cells ...interface{}) error
+	Close() error
+}
+
+// csvExport writes the cells an xlsx.Writer takes as csv, dates as 2006-01-02 and money with two decimal places
+type csvExport struct {
+	w *csv.Writer
+}
+
+func (c csvExport) WriteHeader(headings ...string) error {
+	return c.w.Write(headings)
+}
+
+func (c csvExport) Write(cells ...interface{}) error {
+	record := make([]string, len(cells))
+	for i, cell := range cells {
+		switch v := cell.(type) {
+		case nil:
+		case string:
+			// spreadsheets run text that looks like a formula, and guests choose their own names
+			if v != "" && strings.ContainsRune("=+-@\t\r", rune(v[0])) {
+				v = "'" + v
+			}
+			record[i] = v
+		case int:
+			record[i] = strconv.Itoa(v)
+		case xlsx.Money:
+			record[i] = strconv.FormatFloat(float64(v)/100, 'f', 2, 64)
+		case xlsx.Percent:
+			record[i] = strconv.FormatFloat(float64(v)*100, 'f', 1, 64) + "%"
+		case time.Time:
+			if !v.IsZero() {
+				record[i] = v.Format("2006-01-02")
+			}
+		default:
+			return fmt.Errorf("cannot write a %T to csv", cell)
+		}
+	}
+	return c.w.Write(record)
+}
+
+func (c csvExport) Close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// exportFormat reads which format an export is asked for in, csv unless ?format says xlsx, and answers with a bad
+// request if it is neither
+func exportFormat(w http.ResponseWriter, r *http.Request) (string, bool) {
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "csv":
+		return "csv", true
+	case "xlsx":
+		return format, true
+	default:
+		http.Error(w, "format must be csv or xlsx", http.StatusBadRequest)
+		return "", false
+	}
+}
+
+// AdminExportReservations sends every reservation the admin lists' query string picks out, not just a page of them,
+// as csv or as an Excel sheet. Reservations are written as they are read, so that a long export isn't held in memory
+func (rep *Repository) AdminExportReservations(w http.ResponseWriter, r *http.Request) {
+	format, ok := exportFormat(w, r)
+	if !ok {
+		return
+	}
+	filter := reservationFilter(r)
+	filter.Page, filter.PerPage = 0, 0
+
+	err := exportRows(w, format, "reservations", func(out exportWriter) error {
+		err := out.WriteHeader("ID", "First Name", "Last Name", "Email", "Phone", "Room", "Arrival", "Departure",
+			"Nights", "Total", "Processed", "Booked")
+		if err != nil {
+			return err
+		}
+		return rep.DB.EachReservation(r.Context(), filter, func(res models.Reservation) error {
+			processed := "No"
+			if res.Processed != 0 {
+				processed = "Yes"
+			}
+			return out.Write(res.ID, res.FirstName, res.LastName, res.Email, res.Phone, res.Room.RoomName,
+				res.StartDate, res.EndDate, int(res.EndDate.Sub(res.StartDate).Hours()/24), xlsx.Money(res.TotalPrice),
+				processed, res.CreatedAt)
+		})
+	})
+	if err != nil {
+		// the download has started, so all that can be done is to cut it short
+		helpers.Logger(r.Context()).Error("exporting reservations", "error", err)
+	}
+}
+
+// AdminExportOccupancy sends, for each room and month from ?from to ?to, given as 2006-01 and this year by default,
+// the nights that were reserved and blocked and the share of the nights that could be let that were, as csv or as
+// an Excel sheet. Room restrictions are counted as they are read rather than all loaded first
+func (rep *Repository) AdminExportOccupancy(w http.ResponseWriter, r *http.Request) {
+	format, ok := exportFormat(w, r)
+	if !ok {
+		return
+	}
+
+	year := time.Now().Year()
+	from := time.Date(year, time.January, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(year, time.December, 1, 0, 0, 0, 0, time.UTC)
+	for _, month := range []struct {
+		param string
+		value *time.Time
+	}{{"from", &from}, {"to", &to}} {
+		s := r.URL.Query().Get(month.param)
+		if s == "" {
+			continue
+		}
+		t, err := time.Parse("2006-01", s)
+		if err != nil {
+			http.Error(w, month.param+" must be a month, such as 2050-01", http.StatusBadRequest)
+			return
+		}
+		*month.value = t
+	}
+	months := (to.Year()-from.Year())*12 + int(to.Month()-from.Month()) + 1
+	if months < 1 || months > maxExportMonths {
+		http.Error(w, fmt.Sprintf("to must be from 1 to %d months after from", maxExportMonths), http.StatusBadRequest)
+		return
+	}
+
+	rooms, err := rep.DB.AllRooms(r.Context())
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+	tally := occupancy.New(rooms, from, to)
+	err = rep.DB.EachRoomRestriction(r.Context(), tally.Start(), tally.End(), func(rr models.RoomRestriction) error {
+		tally.Add(rr)
+		return nil
+	})
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	err = exportRows(w, format, "occupancy", func(out exportWriter) error {
+		if err := out.WriteHeader("Room", "Month", "Nights", "Reserved", "Blocked", "Occupancy"); err != nil {
+			return err
+		}
+		for _, m := range tally.Months() {
+			err := out.Write(m.Room.RoomName, m.Month.Format("2006-01"), m.Nights, m.Reserved, m.Blocked,
+				xlsx.Percent(m.Rate()))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		helpers.Logger(r.Context()).Error("exporting occupancy", "error", err)
+	}
+}
+
+// exportRows sends the headers of a download named after what it holds and the day, has rows write it, and then
+// finishes it
+func exportRows(w http.ResponseWriter, format, name string, rows func(out exportWriter) error) error {
+	filename := fmt.Sprintf("%s-%s.%s", name, time.Now().Format("2006-01-02"), format)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+
+	var out exportWriter = csvExport{csv.NewWriter(w)}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	if format == "xlsx" {
+		w.Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+		x, err := xlsx.NewWriter(w, strings.ToUpper(name[:1])+name[1:])
+		if err != nil {
+			return err
+		}
+		out = x
+	}
+
+	if err := rows(out); err != nil {
+		return err
+	}
+	return out.Close()
+}
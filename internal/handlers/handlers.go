@@ -3,17 +3,21 @@ package handlers
 import (
 	"bookings/internal/config"
 	"bookings/internal/driver"
+	"bookings/internal/email"
 	"bookings/internal/forms"
 	"bookings/internal/helpers"
+	"bookings/internal/metrics"
 	"bookings/internal/models"
+	"bookings/internal/pricing"
 	"bookings/internal/render"
 	"bookings/internal/repository"
 	"bookings/internal/repository/dbrepo"
+	"context"
+	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/go-chi/chi/v5"
-	"log"
 	"net/http"
 	"strconv"
 	"strings"
@@ -26,21 +30,29 @@ var Repo *Repository
 type Repository struct {
 	App *config.AppConfig
 	DB  repository.DatabaseRepo
+	// Conn is the connection pool behind DB, which the readiness check pings
+	Conn Pinger
 }
 
 // NewRepository creates a new Repository
 func NewRepository(a *config.AppConfig, db *driver.DB) *Repository {
+	repo := dbrepo.NewPostgresRepo(db.SQL, a)
+	if db.Driver == "sqlite" {
+		repo = dbrepo.NewSQLiteRepo(db.SQL, a)
+	}
 	return &Repository{
 		a,
-		dbrepo.NewPostgresRepo(db.SQL, a),
+		dbrepo.NewMetricsRepo(repo),
+		db,
 	}
 }
 
-// NewTestRepo creates a new Testing Repository
+// NewTestRepo creates a new Testing Repository, which has no connection to ping
 func NewTestRepo(a *config.AppConfig) *Repository {
 	return &Repository{
 		a,
 		dbrepo.NewTestingRepo(a),
+		nil,
 	}
 }
 
@@ -63,12 +75,46 @@ func (rep *Repository) Contact(w http.ResponseWriter, r *http.Request) {
 	_ = render.Template(w, r, "contact.page.tmpl", &models.TemplateData{})
 }
 
+// ColonelsSuite redirects the old Colonel's Suite url to its room page
 func (rep *Repository) ColonelsSuite(w http.ResponseWriter, r *http.Request) {
-	_ = render.Template(w, r, "colonels-suite.page.tmpl", &models.TemplateData{})
+	http.Redirect(w, r, "/rooms/colonels-suite", http.StatusMovedPermanently)
 }
 
+// GeneralsQuarters redirects the old General's Quarters url to its room page
 func (rep *Repository) GeneralsQuarters(w http.ResponseWriter, r *http.Request) {
-	_ = render.Template(w, r, "generals-quarters.page.tmpl", &models.TemplateData{})
+	http.Redirect(w, r, "/rooms/generals-quarters", http.StatusMovedPermanently)
+}
+
+// Rooms lists all rooms
+func (rep *Repository) Rooms(w http.ResponseWriter, r *http.Request) {
+	rooms, err := rep.DB.AllRooms(r.Context())
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["rooms"] = rooms
+
+	_ = render.Template(w, r, "rooms.page.tmpl", &models.TemplateData{
+		Data: data,
+	})
+}
+
+// Room displays a room's page by its slug
+func (rep *Repository) Room(w http.ResponseWriter, r *http.Request) {
+	room, err := rep.DB.GetRoomBySlug(r.Context(), chi.URLParam(r, "slug"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["room"] = room
+
+	_ = render.Template(w, r, "room.page.tmpl", &models.TemplateData{
+		Data: data,
+	})
 }
 
 // PostReservation handles the posting of a reservation form
@@ -109,7 +155,7 @@ func (rep *Repository) PostReservation(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// add this to fix invalid data error
-	room, err := rep.DB.GetRoomById(roomID)
+	room, err := rep.DB.GetRoomById(r.Context(), roomID)
 	if err != nil {
 		rep.App.Session.Put(r.Context(), "error", "can't find room!")
 		http.Redirect(w, r, "/", http.StatusSeeOther)
@@ -127,6 +173,26 @@ func (rep *Repository) PostReservation(w http.ResponseWriter, r *http.Request) {
 		Room:      room, // add this to fix invalid data error
 	}
 
+	quote, err := rep.quoteStay(r.Context(), room, startDate, endDate)
+	var minStay pricing.MinimumStayError
+	if errors.As(err, &minStay) {
+		rep.App.Session.Put(r.Context(), "error", fmt.Sprintf("Sorry, %s", minStay))
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		rep.App.Session.Put(r.Context(), "error", "can't price the stay!")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	reservation.TotalPrice = quote.Total
+
+	reservation.ConfirmationCode, err = helpers.RandomToken(16)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
 	form := forms.New(r.PostForm)
 
 	form.Required("first_name", "last_name", "email", "phone")
@@ -137,6 +203,7 @@ func (rep *Repository) PostReservation(w http.ResponseWriter, r *http.Request) {
 	if !form.Valid() {
 		data := make(map[string]interface{})
 		data["reservation"] = reservation
+		data["quote"] = quote
 
 		// add these lines to fix bad data error
 		stringMap := make(map[string]string)
@@ -151,64 +218,63 @@ func (rep *Repository) PostReservation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	newReservationID, err := rep.DB.InsertReservation(reservation)
-	if err != nil {
-		rep.App.Session.Put(r.Context(), "error", "can't insert reservation into database!")
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+	newReservationID, err := rep.DB.BookRoom(r.Context(), reservation)
+	if errors.Is(err, repository.ErrRoomUnavailable) {
+		rep.App.Session.Put(r.Context(), "error", "Sorry, that room has just been booked for those dates. Please choose other dates.")
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
 		return
 	}
-
-	restriction := models.RoomRestriction{
-		StartDate:     startDate,
-		EndDate:       endDate,
-		RoomID:        roomID,
-		ReservationID: newReservationID,
-		RestrictionID: 1,
-	}
-
-	err = rep.DB.InsertRoomRestriction(restriction)
 	if err != nil {
-		rep.App.Session.Put(r.Context(), "error", "can't insert room restriction!")
+		rep.App.Session.Put(r.Context(), "error", "can't insert reservation into database!")
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
 	}
+	reservation.ID = newReservationID
+	metrics.ReservationsCreated.WithLabelValues("web").Inc()
 
-	// send notifications - first to guest
-	htmlMessage := fmt.Sprintf(`
-		<strong>Reservation Confirmation</strong><br>
-		Dear %s: <br>
-		This is confirm your reservation from %s to %s.
-`, reservation.FirstName, reservation.StartDate.Format("2006-01-02"), reservation.EndDate.Format("2006-01-02"))
+	rep.sendReservationNotifications(r, reservation)
 
-	msg := models.MailData{
-		To:       reservation.Email,
-		From:     "me@here.com",
-		Subject:  "Reservation Confirmation",
-		Content:  htmlMessage,
-		Template: "basic.html",
-	}
-
-	rep.App.MailChan <- msg
+	rep.App.Session.Put(r.Context(), "reservation", reservation)
 
-	// send notification to property owner
-	htmlMessage = fmt.Sprintf(`
-		<strong>Reservation Notification</strong><br>
-		A reservation has been made for %s from %s to %s.
-`, reservation.Room.RoomName, reservation.StartDate.Format("2006-01-02"), reservation.EndDate.Format("2006-01-02"))
+	http.Redirect(w, r, "/reservation-summary", http.StatusSeeOther)
 
-	msg = models.MailData{
-		To:      "me@here.com",
-		From:    "me@here.com",
-		Subject: "Reservation Notification",
-		Content: htmlMessage,
-	}
+}
 
-	rep.App.MailChan <- msg
+// sendReservationNotifications emails the reservation confirmation to the guest and notifies the property owner
+func (rep *Repository) sendReservationNotifications(r *http.Request, reservation models.Reservation) {
+	rep.queueMail(r, reservation.Email, email.Confirmation{
+		Reservation: reservation,
+		ManageURL:   rep.App.BaseURL + "/reservations/" + reservation.ConfirmationCode,
+	})
+	rep.notifyOwner(r, email.OwnerNotification{Change: email.ReservationMade, Reservation: reservation})
+}
 
-	rep.App.Session.Put(r.Context(), "reservation", reservation)
+// notifyOwner emails the property owner
+func (rep *Repository) notifyOwner(r *http.Request, n email.OwnerNotification) {
+	rep.queueMail(r, rep.App.OwnerEmail, n)
+}
 
-	http.Redirect(w, r, "/reservation-summary", http.StatusSeeOther)
+// sendMail renders an email and puts it in the outbox
+func (rep *Repository) sendMail(ctx context.Context, to string, d email.Data) error {
+	msg, err := email.Render(d)
+	if err != nil {
+		return err
+	}
+	return rep.App.Mail.Queue(ctx, models.MailData{
+		To:      to,
+		From:    rep.App.MailFrom,
+		Subject: msg.Subject,
+		Content: msg.HTML,
+		Text:    msg.Text,
+	})
+}
 
+// queueMail sends an email about something that has already been saved, so a failure is logged rather than shown
+// to the user
+func (rep *Repository) queueMail(r *http.Request, to string, d email.Data) {
+	if err := rep.sendMail(r.Context(), to, d); err != nil {
+		helpers.Logger(r.Context()).Error("queueing email", "to", to, "error", err)
+	}
 }
 
 func (rep *Repository) MakeReservation(w http.ResponseWriter, r *http.Request) {
@@ -219,7 +285,7 @@ func (rep *Repository) MakeReservation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	room, err := rep.DB.GetRoomById(res.RoomID)
+	room, err := rep.DB.GetRoomById(r.Context(), res.RoomID)
 	if err != nil {
 		rep.App.Session.Put(r.Context(), "error", "can't find room")
 		http.Redirect(w, r, "/", http.StatusSeeOther)
@@ -227,6 +293,20 @@ func (rep *Repository) MakeReservation(w http.ResponseWriter, r *http.Request) {
 	}
 	res.Room.RoomName = room.RoomName
 
+	quote, err := rep.quoteStay(r.Context(), room, res.StartDate, res.EndDate)
+	var minStay pricing.MinimumStayError
+	if errors.As(err, &minStay) {
+		rep.App.Session.Put(r.Context(), "error", fmt.Sprintf("Sorry, %s", minStay))
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		rep.App.Session.Put(r.Context(), "error", "can't price the stay")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	res.TotalPrice = quote.Total
+
 	rep.App.Session.Put(r.Context(), "reservation", res)
 
 	layout := "2006-01-02"
@@ -239,6 +319,7 @@ func (rep *Repository) MakeReservation(w http.ResponseWriter, r *http.Request) {
 
 	data := make(map[string]interface{})
 	data["reservation"] = res
+	data["quote"] = quote
 
 	_ = render.Template(w, r, "make-reservation.page.tmpl", &models.TemplateData{
 		Form:      forms.New(nil),
@@ -252,24 +333,55 @@ func (rep *Repository) SearchAvailability(w http.ResponseWriter, r *http.Request
 }
 
 func (rep *Repository) PostAvailability(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
 	start := r.Form.Get("start")
 	end := r.Form.Get("end")
 
 	layout := "2006-01-02"
 	startDate, err := time.Parse(layout, start)
-	checkServerError(w, err)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
 	endDate, err := time.Parse(layout, end)
-	checkServerError(w, err)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
 
-	rooms, err := rep.DB.SearchAvailabilityForAllRooms(startDate, endDate)
-	checkServerError(w, err)
+	rooms, err := rep.DB.SearchAvailabilityForAllRooms(r.Context(), startDate, endDate)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+	metrics.Search("web", len(rooms) > 0)
 
 	if len(rooms) == 0 {
 		rep.App.Session.Put(r.Context(), "error", "No rooms available")
 		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
+	}
+
+	var choices []roomChoice
+	for _, room := range rooms {
+		choice := roomChoice{Room: room}
+		choice.Quote, err = rep.quoteStay(r.Context(), room, startDate, endDate)
+		var minStay pricing.MinimumStayError
+		if errors.As(err, &minStay) {
+			choice.Unavailable = minStay.Error()
+		} else if err != nil {
+			helpers.ServerError(w, r, err)
+			return
+		}
+		choices = append(choices, choice)
 	}
+
 	data := make(map[string]interface{})
-	data["rooms"] = rooms
+	data["rooms"] = choices
 
 	res := models.Reservation{
 		StartDate: startDate,
@@ -282,6 +394,22 @@ func (rep *Repository) PostAvailability(w http.ResponseWriter, r *http.Request)
 	})
 }
 
+// roomChoice is an available room with the price of the stay, or the reason it cannot be booked
+type roomChoice struct {
+	Room        models.Room
+	Quote       pricing.Quote
+	Unavailable string
+}
+
+// quoteStay prices a stay in a room, taking its seasonal rates into account
+func (rep *Repository) quoteStay(ctx context.Context, room models.Room, start, end time.Time) (pricing.Quote, error) {
+	seasons, err := rep.DB.GetSeasonalRatesForRoom(ctx, room.ID, start, end)
+	if err != nil {
+		return pricing.Quote{}, err
+	}
+	return pricing.Calculate(room, seasons, start, end)
+}
+
 type jsonResponse struct {
 	OK        bool   `json:"ok"`
 	Message   string `json:"message"`
@@ -295,46 +423,46 @@ func (rep *Repository) AvailabilityJSON(w http.ResponseWriter, r *http.Request)
 	err := r.ParseForm()
 	if err != nil {
 		//can't parse form, so return appropriate json
-		resp := jsonResponse{
-			OK:      false,
-			Message: "Internal server error",
-		}
-
-		out, _ := json.MarshalIndent(resp, "", "    ")
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(out)
+		writeAvailabilityJSON(w, jsonResponse{OK: false, Message: "Internal server error"})
 		return
 	}
 
 	sd := r.Form.Get("start")
 	ed := r.Form.Get("end")
 	layout := "2006-01-02"
-	startDate, _ := time.Parse(layout, sd)
-	endDate, _ := time.Parse(layout, ed)
+	startDate, err := time.Parse(layout, sd)
+	if err != nil {
+		writeAvailabilityJSON(w, jsonResponse{OK: false, Message: "Invalid start date"})
+		return
+	}
+	endDate, err := time.Parse(layout, ed)
+	if err != nil {
+		writeAvailabilityJSON(w, jsonResponse{OK: false, Message: "Invalid end date"})
+		return
+	}
 
 	roomId, err := strconv.Atoi(r.Form.Get("room_id"))
-	checkParseError(err)
-	available, err := rep.DB.SearchAvailabilityByDatesByRoomID(startDate, endDate, roomId)
 	if err != nil {
-		//can't parse form, so return appropriate json
-		resp := jsonResponse{
-			OK:      false,
-			Message: "Error connecting to database",
-		}
-
-		out, _ := json.MarshalIndent(resp, "", "    ")
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(out)
+		writeAvailabilityJSON(w, jsonResponse{OK: false, Message: "Invalid room"})
 		return
 	}
-	resp := jsonResponse{
+	available, err := rep.DB.SearchAvailabilityByDatesByRoomID(r.Context(), startDate, endDate, roomId)
+	if err != nil {
+		writeAvailabilityJSON(w, jsonResponse{OK: false, Message: "Error connecting to database"})
+		return
+	}
+	metrics.Search("web", available)
+	writeAvailabilityJSON(w, jsonResponse{
 		OK:        available,
 		Message:   "",
 		StartDate: sd,
 		EndDate:   ed,
 		RoomId:    strconv.Itoa(roomId),
-	}
+	})
+}
 
+// writeAvailabilityJSON sends the answer to an availability check, or why there isn't one
+func writeAvailabilityJSON(w http.ResponseWriter, resp jsonResponse) {
 	//error check removed since data is handled with json
 	out, _ := json.MarshalIndent(resp, "", "     ")
 
@@ -366,13 +494,186 @@ func (rep *Repository) ReservationSummary(w http.ResponseWriter, r *http.Request
 	})
 }
 
+// today returns the start of the current day. Reservation dates have no time of day, and are kept in UTC
+func today() time.Time {
+	now := time.Now()
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// stayStarted reports whether a reservation's guests are due to have arrived, after which its dates are a record of
+// what happened rather than a plan
+func stayStarted(res models.Reservation) bool {
+	return !res.StartDate.After(today())
+}
+
+// ManageReservation shows a guest their reservation, found by the confirmation code from their email
+func (rep *Repository) ManageReservation(w http.ResponseWriter, r *http.Request) {
+	res, err := rep.DB.GetReservationByCode(r.Context(), chi.URLParam(r, "code"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["reservation"] = res
+	data["started"] = stayStarted(res)
+
+	stringMap := make(map[string]string)
+	stringMap["start_date"] = res.StartDate.Format("2006-01-02")
+	stringMap["end_date"] = res.EndDate.Format("2006-01-02")
+
+	_ = render.Template(w, r, "manage-reservation.page.tmpl", &models.TemplateData{
+		Data:      data,
+		StringMap: stringMap,
+		Form:      forms.New(nil),
+	})
+}
+
+// PostManageReservation moves a guest's reservation to new dates, if the room is free and the stay long enough.
+// Once the stay has begun its dates are what happened, and only the owners can change them
+func (rep *Repository) PostManageReservation(w http.ResponseWriter, r *http.Request) {
+	code := chi.URLParam(r, "code")
+	res, err := rep.DB.GetReservationByCode(r.Context(), code)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	manageURL := "/reservations/" + code
+	if stayStarted(res) {
+		rep.App.Session.Put(r.Context(), "error", "Sorry, reservations cannot be changed once the stay has begun")
+		http.Redirect(w, r, manageURL, http.StatusSeeOther)
+		return
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("start_date", "end_date")
+
+	layout := "2006-01-02"
+	startDate, err := time.Parse(layout, r.Form.Get("start_date"))
+	if err != nil {
+		form.Errors.Add("start_date", "Please enter a valid arrival date")
+	} else if startDate.Before(today()) {
+		form.Errors.Add("start_date", "Arrival cannot be in the past")
+	}
+	endDate, err := time.Parse(layout, r.Form.Get("end_date"))
+	if err != nil {
+		form.Errors.Add("end_date", "Please enter a valid departure date")
+	} else if !endDate.After(startDate) {
+		form.Errors.Add("end_date", "Departure must be after arrival")
+	}
+
+	if !form.Valid() {
+		data := make(map[string]interface{})
+		data["reservation"] = res
+		data["started"] = false
+
+		stringMap := make(map[string]string)
+		stringMap["start_date"] = r.Form.Get("start_date")
+		stringMap["end_date"] = r.Form.Get("end_date")
+
+		_ = render.Template(w, r, "manage-reservation.page.tmpl", &models.TemplateData{
+			Data:      data,
+			StringMap: stringMap,
+			Form:      form,
+		})
+		return
+	}
+
+	room, err := rep.DB.GetRoomById(r.Context(), res.RoomID)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	quote, err := rep.quoteStay(r.Context(), room, startDate, endDate)
+	var minStay pricing.MinimumStayError
+	if errors.As(err, &minStay) {
+		rep.App.Session.Put(r.Context(), "error", fmt.Sprintf("Sorry, %s", minStay))
+		http.Redirect(w, r, manageURL, http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	oldStart, oldEnd := res.StartDate, res.EndDate
+	res.StartDate = startDate
+	res.EndDate = endDate
+	res.TotalPrice = quote.Total
+
+	err = rep.DB.ChangeReservationDates(r.Context(), res)
+	if errors.Is(err, repository.ErrRoomUnavailable) {
+		rep.App.Session.Put(r.Context(), "error", "Sorry, the room is not available for those dates")
+		http.Redirect(w, r, manageURL, http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	rep.notifyOwner(r, email.OwnerNotification{
+		Change:        email.ReservationChanged,
+		Reservation:   res,
+		PreviousStart: oldStart,
+		PreviousEnd:   oldEnd,
+	})
+
+	rep.App.Session.Put(r.Context(), "flash", "Your reservation has been changed")
+	http.Redirect(w, r, manageURL, http.StatusSeeOther)
+}
+
+// CancelReservation lets a guest cancel their reservation, which frees up its dates. Stays that have begun are the
+// business's record of what was let, so they can't be cancelled
+func (rep *Repository) CancelReservation(w http.ResponseWriter, r *http.Request) {
+	code := chi.URLParam(r, "code")
+	res, err := rep.DB.GetReservationByCode(r.Context(), code)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if stayStarted(res) {
+		rep.App.Session.Put(r.Context(), "error", "Sorry, reservations cannot be cancelled once the stay has begun")
+		http.Redirect(w, r, "/reservations/"+code, http.StatusSeeOther)
+		return
+	}
+
+	// deleting the reservation cascades to its room restriction
+	err = rep.DB.DeleteReservation(r.Context(), res.ID)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+	metrics.ReservationsCancelled.WithLabelValues("web").Inc()
+
+	rep.queueMail(r, res.Email, email.Cancellation{Reservation: res})
+	rep.notifyOwner(r, email.OwnerNotification{Change: email.ReservationCancelled, Reservation: res})
+
+	rep.App.Session.Put(r.Context(), "flash", "Your reservation has been cancelled")
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
 // ChooseRoom displays available rooms
 func (rep *Repository) ChooseRoom(w http.ResponseWriter, r *http.Request) {
 	roomId, err := strconv.Atoi(chi.URLParam(r, "id"))
-	checkServerError(w, err)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
 
 	res, ok := rep.App.Session.Get(r.Context(), "reservation").(models.Reservation)
-	checkErrorOk(w, ok, "cannot get session data")
+	if !ok {
+		helpers.ServerError(w, r, errors.New("cannot get session data"))
+		return
+	}
 
 	res.RoomID = roomId
 	rep.App.Session.Put(r.Context(), "reservation", res)
@@ -388,10 +689,11 @@ func (rep *Repository) BookRoom(w http.ResponseWriter, r *http.Request) {
 
 	format := "2006-01-02"
 	var res models.Reservation
-	room, err := rep.DB.GetRoomById(roomId)
+	room, err := rep.DB.GetRoomById(r.Context(), roomId)
 	if err != nil {
 		rep.App.Session.Put(r.Context(), "error", "cannot get room from db")
 		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
 	}
 	res.Room.RoomName = room.RoomName
 	res.RoomID = roomId
@@ -416,7 +718,7 @@ func (rep *Repository) PostShowLogin(w http.ResponseWriter, r *http.Request) {
 	_ = rep.App.Session.RenewToken(r.Context())
 	err := r.ParseForm()
 	if err != nil {
-		log.Println(err)
+		helpers.ParseError(r, err)
 	}
 	email := r.Form.Get("email")
 	password := r.Form.Get("password")
@@ -432,15 +734,69 @@ func (rep *Repository) PostShowLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	id, _, err := rep.DB.Authenticate(email, password)
+	ip := helpers.ClientIP(r)
+	now := time.Now()
+
+	// locked accounts, and anyone with too many recent failures, are turned away without checking the password
+	user, lookupErr := rep.DB.GetUserByEmail(r.Context(), email)
+	if lookupErr == nil && user.LockedUntil.After(now) {
+		rep.recordLogin(r, email, ip, models.LoginLocked)
+		rep.App.Session.Put(r.Context(), "error", "This account is locked after too many failed logins. Try again later, or ask an owner to unlock it")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	failures, err := rep.DB.GetLoginFailures(r.Context(), email, ip, now.Add(-loginWindow))
 	if err != nil {
-		log.Println(err)
+		helpers.ServerError(w, r, err)
+		return
+	}
+	if wait := loginWait(failures, now); wait > 0 {
+		rep.recordLogin(r, email, ip, models.LoginThrottled)
+		rep.App.Session.Put(r.Context(), "error", fmt.Sprintf("Too many failed logins, please wait %s before trying again", wait.Round(time.Second)))
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	id, hashedPassword, err := rep.DB.Authenticate(r.Context(), email, password)
+	if err != nil {
+		helpers.Logger(r.Context()).Info("login failed", "email", email, "error", err)
+		rep.recordLogin(r, email, ip, models.LoginFailed)
+
+		if lookupErr == nil && failures.ByEmail+1 >= lockoutFailures {
+			if err := rep.DB.LockUser(r.Context(), user.ID, now.Add(lockoutDuration)); err != nil {
+				helpers.Logger(r.Context()).Error("locking account", "user_id", user.ID, "error", err)
+			}
+			rep.App.Session.Put(r.Context(), "error", "Too many failed logins, this account is now locked for a while")
+			http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+			return
+		}
+
 		rep.App.Session.Put(r.Context(), "error", "Invalid login credentials")
 		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
 		return
 	}
+	rep.recordLogin(r, email, ip, models.LoginSucceeded)
+
+	user, err = rep.DB.GetUserById(r.Context(), id)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	// the password is only ever in plain text here, so this is when old hashes get brought up to the current cost
+	if helpers.NeedsRehash(hashedPassword) {
+		newHash, err := helpers.HashPassword(password)
+		if err == nil {
+			err = rep.DB.UpdatePassword(r.Context(), id, newHash)
+		}
+		if err != nil {
+			helpers.Logger(r.Context()).Error("upgrading password hash", "user_id", id, "error", err)
+		}
+	}
 
 	rep.App.Session.Put(r.Context(), "user_id", id)
+	rep.App.Session.Put(r.Context(), "access_level", user.AccessLevel)
 	rep.App.Session.Put(r.Context(), "flash", "Logged in successfully")
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
@@ -453,36 +809,14 @@ func (rep *Repository) Logout(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
-func (rep *Repository) AdminDashboard(w http.ResponseWriter, r *http.Request) {
-	render.Template(w, r, "admin-dashboard.page.tmpl", &models.TemplateData{})
-}
-
-// AdminNewReservations shows all new reservations in admin tool
-func (rep *Repository) AdminNewReservations(w http.ResponseWriter, r *http.Request) {
-
-	reservations, err := rep.DB.AllNewReservations()
-	if err != nil {
-		helpers.ServerError(w, err)
-	}
-	data := make(map[string]interface{})
-	data["reservations"] = reservations
-
-	render.Template(w, r, "admin-new-reservations.page.tmpl", &models.TemplateData{
-		Data: data,
-	})
+// Forbidden tells a logged in user that their access level doesn't allow what they tried to do
+func (rep *Repository) Forbidden(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusForbidden)
+	_ = render.Template(w, r, "forbidden.page.tmpl", &models.TemplateData{})
 }
 
-// AdminAllReservations shows all reservations in admin tool
-func (rep *Repository) AdminAllReservations(w http.ResponseWriter, r *http.Request) {
-	reservations, err := rep.DB.AllReservations()
-	if err != nil {
-		helpers.ServerError(w, err)
-	}
-	data := make(map[string]interface{})
-	data["reservations"] = reservations
-	render.Template(w, r, "admin-all-reservations.page.tmpl", &models.TemplateData{
-		Data: data,
-	})
+func (rep *Repository) AdminDashboard(w http.ResponseWriter, r *http.Request) {
+	render.Template(w, r, "admin-dashboard.page.tmpl", &models.TemplateData{})
 }
 
 // AdminShowReservation shows the reservation in the admin tool
@@ -490,7 +824,7 @@ func (rep *Repository) AdminShowReservation(w http.ResponseWriter, r *http.Reque
 	exploded := strings.Split(r.RequestURI, "/")
 	id, err := strconv.Atoi(exploded[4])
 	if err != nil {
-		helpers.ServerError(w, err)
+		helpers.ServerError(w, r, err)
 		return
 	}
 	src := exploded[3]
@@ -504,9 +838,9 @@ func (rep *Repository) AdminShowReservation(w http.ResponseWriter, r *http.Reque
 	stringMap["year"] = year
 	stringMap["month"] = month
 
-	res, err := rep.DB.GetReservationById(id)
+	res, err := rep.DB.GetReservationById(r.Context(), id)
 	if err != nil {
-		helpers.ServerError(w, err)
+		helpers.ServerError(w, r, err)
 		return
 	}
 
@@ -524,13 +858,13 @@ func (rep *Repository) AdminShowReservation(w http.ResponseWriter, r *http.Reque
 func (rep *Repository) AdminProcessReservation(w http.ResponseWriter, r *http.Request) {
 	id, err := strconv.Atoi(chi.URLParam(r, "id"))
 	if err != nil {
-		helpers.ParseError(err)
+		helpers.ParseError(r, err)
 	}
 	src := chi.URLParam(r, "src")
 
-	err = rep.DB.UpdateProcessedForReservation(id, 1)
+	err = rep.DB.UpdateProcessedForReservation(r.Context(), id, 1)
 	if err != nil {
-		helpers.ServerError(w, err)
+		helpers.ServerError(w, r, err)
 	}
 
 	year := r.URL.Query().Get("y")
@@ -549,14 +883,16 @@ func (rep *Repository) AdminProcessReservation(w http.ResponseWriter, r *http.Re
 func (rep *Repository) AdminDeleteReservation(w http.ResponseWriter, r *http.Request) {
 	id, err := strconv.Atoi(chi.URLParam(r, "id"))
 	if err != nil {
-		helpers.ParseError(err)
+		helpers.ParseError(r, err)
 	}
 	src := chi.URLParam(r, "src")
 
-	err = rep.DB.DeleteReservation(id)
+	err = rep.DB.DeleteReservation(r.Context(), id)
 	if err != nil {
-		helpers.ServerError(w, err)
+		helpers.ServerError(w, r, err)
+		return
 	}
+	metrics.ReservationsCancelled.WithLabelValues("admin").Inc()
 	year := r.URL.Query().Get("y")
 	month := r.URL.Query().Get("m")
 
@@ -573,14 +909,14 @@ func (rep *Repository) AdminDeleteReservation(w http.ResponseWriter, r *http.Req
 func (rep *Repository) AdminPostShowReservation(w http.ResponseWriter, r *http.Request) {
 	err := r.ParseForm()
 	if err != nil {
-		helpers.ServerError(w, err)
+		helpers.ServerError(w, r, err)
 	}
 
 	exploded := strings.Split(r.RequestURI, "/")
 	id, err := strconv.Atoi(exploded[4])
 
 	if err != nil {
-		helpers.ServerError(w, err)
+		helpers.ServerError(w, r, err)
 		return
 	}
 
@@ -589,9 +925,9 @@ func (rep *Repository) AdminPostShowReservation(w http.ResponseWriter, r *http.R
 	stringMap := make(map[string]string)
 	stringMap["src"] = src
 
-	res, err := rep.DB.GetReservationById(id)
+	res, err := rep.DB.GetReservationById(r.Context(), id)
 	if err != nil {
-		helpers.ServerError(w, err)
+		helpers.ServerError(w, r, err)
 		return
 	}
 
@@ -600,9 +936,9 @@ func (rep *Repository) AdminPostShowReservation(w http.ResponseWriter, r *http.R
 	res.Email = r.Form.Get("email")
 	res.Phone = r.Form.Get("phone")
 
-	err = rep.DB.UpdateReservation(res)
+	err = rep.DB.UpdateReservation(r.Context(), res)
 	if err != nil {
-		helpers.ServerError(w, err)
+		helpers.ServerError(w, r, err)
 		return
 	}
 
@@ -627,11 +963,11 @@ func (rep *Repository) AdminCalendarReservations(w http.ResponseWriter, r *http.
 	if r.URL.Query().Get("y") != "" {
 		year, err := strconv.Atoi(r.URL.Query().Get("y"))
 		if err != nil {
-			helpers.ParseError(err)
+			helpers.ParseError(r, err)
 		}
 		month, err := strconv.Atoi(r.URL.Query().Get("m"))
 		if err != nil {
-			helpers.ParseError(err)
+			helpers.ParseError(r, err)
 		}
 		now = time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.UTC)
 	}
@@ -659,144 +995,452 @@ func (rep *Repository) AdminCalendarReservations(w http.ResponseWriter, r *http.
 
 	//get the first and last days of the month
 	currentYear, currentMonth, _ := now.Date()
-	currentLocation := now.Location()
-	firstOfMonth := time.Date(currentYear, currentMonth, 1, 0, 0, 0, 0, currentLocation)
+	firstOfMonth := time.Date(currentYear, currentMonth, 1, 0, 0, 0, 0, time.UTC)
 	lastOfMonth := firstOfMonth.AddDate(0, 1, -1)
 
 	intMap := make(map[string]int)
 	intMap["days_in_month"] = lastOfMonth.Day()
 
-	rooms, err := rep.DB.AllRooms()
+	rooms, err := rep.DB.AllRooms(r.Context())
 	if err != nil {
-		helpers.ServerError(w, err)
+		helpers.ServerError(w, r, err)
+		return
 	}
 
 	data["rooms"] = rooms
 
 	for _, x := range rooms {
-		// create maps
-		reservationMap := make(map[string]int)
-		blockMap := make(map[string]int)
-
-		for d := firstOfMonth; d.After(lastOfMonth) == false; d = d.AddDate(0, 0, 1) {
-			reservationMap[d.Format("2006-01-02")] = 0
-			blockMap[d.Format("2006-01-02")] = 0
-		}
-
 		// get all the restrictions for the current room
-		restrictions, err := rep.DB.GetRestrictionsForRoomByDate(x.ID, firstOfMonth, lastOfMonth)
+		restrictions, err := rep.DB.GetRestrictionsForRoomByDate(r.Context(), x.ID, firstOfMonth, lastOfMonth)
 		if err != nil {
-			helpers.ServerError(w, err)
+			helpers.ServerError(w, r, err)
 			return
 		}
 
-		for _, y := range restrictions {
-			if y.ReservationID > 0 {
-				// it's a reservation
-				for d := y.StartDate; d.After(y.EndDate) == false; d = d.AddDate(0, 0, 1) {
-					reservationMap[d.Format("2006-01-02")] = y.ReservationID
+		data[fmt.Sprintf("cells_%d", x.ID)] = calendarRow(firstOfMonth, lastOfMonth, restrictions)
+	}
+
+	render.Template(w, r, "admin-reservations-calendar.page.tmpl", &models.TemplateData{
+		StringMap: stringMap,
+		Data:      data,
+		IntMap:    intMap,
+	})
+}
+
+// calendarCell is one cell of a room's row in the admin calendar. The days taken by a reservation or block share
+// a single cell, so that each one shows as a bar
+type calendarCell struct {
+	Start time.Time
+	Days  int
+	// Kind is "reservation", "block" or "external", or empty for a free day
+	Kind string
+	// ID is the reservation, block or external calendar the cell shows
+	ID int
+	// Label is the block's note, or the name of its restriction type
+	Label  string
+	Colour string
+}
+
+// calendarRow lays a room's restrictions out over the days from first to last. Restrictions hold the room for
+// the nights from their start date up to, but not including, their end date
+func calendarRow(first, last time.Time, restrictions []models.RoomRestriction) []calendarCell {
+	days := dayIndex(first, last) + 1
+	taken := make([]calendarCell, days)
+
+	// where restrictions overlap the later kinds win, so a reservation is never hidden behind a block
+	for _, kind := range []string{"external", "block", "reservation"} {
+		for _, x := range restrictions {
+			c := calendarCell{Kind: "block", ID: x.ID, Label: x.Note, Colour: x.Restriction.Colour}
+			if x.ReservationID > 0 {
+				c.Kind, c.ID = "reservation", x.ReservationID
+			} else if x.Restriction.SystemKey == models.RestrictionExternal {
+				c.Kind, c.ID = "external", x.ICalFeedID
+			}
+			if c.Label == "" {
+				c.Label = x.Restriction.RestrictionName
+			}
+			if c.Kind != kind {
+				continue
+			}
+
+			for d := x.StartDate; d.Before(x.EndDate); d = d.AddDate(0, 0, 1) {
+				if i := dayIndex(first, d); i >= 0 && i < days {
+					taken[i] = c
 				}
-			} else {
-				// it's a block
-				blockMap[y.StartDate.Format("2006-01-02")] = y.ID
 			}
 		}
-		data[fmt.Sprintf("reservation_map_%d", x.ID)] = reservationMap
-		data[fmt.Sprintf("block_map_%d", x.ID)] = blockMap
+	}
 
-		rep.App.Session.Put(r.Context(), fmt.Sprintf("block_map_%d", x.ID), blockMap)
+	var cells []calendarCell
+	for i, c := range taken {
+		if n := len(cells); n > 0 && c.Kind != "" && cells[n-1].Kind == c.Kind && cells[n-1].ID == c.ID {
+			cells[n-1].Days++
+			continue
+		}
+		c.Start = first.AddDate(0, 0, i)
+		c.Days = 1
+		cells = append(cells, c)
 	}
+	return cells
+}
 
-	render.Template(w, r, "admin-reservations-calendar.page.tmpl", &models.TemplateData{
-		StringMap: stringMap,
+// dayIndex returns how many days after first the date of d is, whatever time zones they are in
+func dayIndex(first, d time.Time) int {
+	day := time.Date(d.Year(), d.Month(), d.Day(), 0, 0, 0, 0, time.UTC)
+	return int(day.Sub(first).Hours() / 24)
+}
+
+// AdminAPITokens lists the api tokens issued to partners and the booking widget
+func (rep *Repository) AdminAPITokens(w http.ResponseWriter, r *http.Request) {
+	tokens, err := rep.DB.AllAPITokens(r.Context())
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+	users, err := rep.DB.AllUsers(r.Context())
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["tokens"] = tokens
+	data["users"] = users
+
+	// a freshly created token is only ever shown once
+	stringMap := make(map[string]string)
+	stringMap["new_token"] = rep.App.Session.PopString(r.Context(), "new_api_token")
+
+	intMap := make(map[string]int)
+	intMap["user_id"] = rep.App.Session.GetInt(r.Context(), "user_id")
+
+	render.Template(w, r, "admin-api-tokens.page.tmpl", &models.TemplateData{
 		Data:      data,
+		StringMap: stringMap,
 		IntMap:    intMap,
+		Form:      forms.New(nil),
 	})
 }
 
-// AdminCalendarPostReservations handles post of reservation calendar
-func (rep *Repository) AdminCalendarPostReservations(w http.ResponseWriter, r *http.Request) {
-	//log.Println("works")
+// AdminPostAPIToken issues a new api token to the chosen user. The token can do what that user could in the admin
+// area, so a partner gets a read only user of their own rather than a token of the owner's
+func (rep *Repository) AdminPostAPIToken(w http.ResponseWriter, r *http.Request) {
 	err := r.ParseForm()
 	if err != nil {
-		helpers.ServerError(w, err)
+		helpers.ServerError(w, r, err)
 		return
 	}
 
-	year, err := strconv.Atoi(r.Form.Get("y"))
-	checkParseError(err)
-	month, err := strconv.Atoi(r.Form.Get("m"))
-	checkParseError(err)
+	form := forms.New(r.PostForm)
+	form.Required("name")
+	if !form.Valid() {
+		rep.App.Session.Put(r.Context(), "error", "Give the token a name")
+		http.Redirect(w, r, "/admin/api-tokens", http.StatusSeeOther)
+		return
+	}
 
-	//process blocks
-	rooms, err := rep.DB.AllRooms()
+	userID, _ := strconv.Atoi(form.Get("user_id"))
+	user, err := rep.DB.GetUserById(r.Context(), userID)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && user.Disabled) {
+		rep.App.Session.Put(r.Context(), "error", "Choose an active user to issue the token to")
+		http.Redirect(w, r, "/admin/api-tokens", http.StatusSeeOther)
+		return
+	}
 	if err != nil {
-		helpers.ServerError(w, err)
+		helpers.ServerError(w, r, err)
 		return
 	}
 
-	form := forms.New(r.Form)
+	token, err := helpers.RandomToken(32)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
 
-	for _, x := range rooms {
-		//Get the block map from session. Loop through the entire map, if we have an entry in the entire map
-		//that does not exist in our posted data, and if the restriction id> 0, then it is a block we need to remove.
-		currMap := rep.App.Session.Get(r.Context(), fmt.Sprintf("block_map_%d", x.ID)).(map[string]int)
-		for name, value := range currMap {
-			// ok will be false if the value is not in the map
-			if val, ok := currMap[name]; ok {
-				// only pay attention to values > 0, and that are not in the form post
-				// the rest are just placeholders for days without blocks
-				if val > 0 {
-					if !form.Has(fmt.Sprintf("remove_block_%d_%s", x.ID, name)) {
-						// delete the restriction by id
-						err := rep.DB.DeleteBlockById(value)
-						if err != nil {
-							log.Println(err)
-						}
-					}
-				}
-			}
+	_, err = rep.DB.InsertAPIToken(r.Context(), models.APIToken{
+		UserID:    user.ID,
+		Name:      form.Get("name"),
+		TokenHash: helpers.HashToken(token),
+	})
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	rep.App.Session.Put(r.Context(), "new_api_token", token)
+	rep.App.Session.Put(r.Context(), "flash", "Token created")
+	http.Redirect(w, r, "/admin/api-tokens", http.StatusSeeOther)
+}
+
+// AdminDeleteAPIToken revokes an api token
+func (rep *Repository) AdminDeleteAPIToken(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	err = rep.DB.DeleteAPIToken(r.Context(), id)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	rep.App.Session.Put(r.Context(), "flash", "Token revoked")
+	http.Redirect(w, r, "/admin/api-tokens", http.StatusSeeOther)
+}
+
+// AdminRooms lists the rooms in the admin tool
+func (rep *Repository) AdminRooms(w http.ResponseWriter, r *http.Request) {
+	rooms, err := rep.DB.AllRooms(r.Context())
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["rooms"] = rooms
+
+	render.Template(w, r, "admin-rooms.page.tmpl", &models.TemplateData{
+		Data: data,
+	})
+}
+
+// AdminShowRoom shows the form for adding a room, or editing an existing one
+func (rep *Repository) AdminShowRoom(w http.ResponseWriter, r *http.Request) {
+	room := models.Room{Capacity: 2}
+
+	if chi.URLParam(r, "id") != "new" {
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			helpers.ServerError(w, r, err)
+			return
+		}
+		room, err = rep.DB.GetRoomById(r.Context(), id)
+		if err != nil {
+			helpers.ServerError(w, r, err)
+			return
 		}
 	}
 
-	//now handle new blocks
-	for name, _ := range r.PostForm {
-		if strings.HasPrefix(name, "add_block") {
-			exploded := strings.Split(name, "_")
-			roomID, _ := strconv.Atoi(exploded[2])
-			date, err := time.Parse("2006-01-02", exploded[3])
-			if err != nil {
-				log.Println(err)
-			}
-			//insert a new block
-			err = rep.DB.InsertBlockForRoom(roomID, date)
-			if err != nil {
-				log.Println(err)
-			}
+	data := make(map[string]interface{})
+	data["room"] = room
+
+	if room.ID > 0 {
+		seasons, err := rep.DB.GetSeasonalRatesForRoom(r.Context(), room.ID, time.Now(), time.Now().AddDate(100, 0, 0))
+		if err != nil {
+			helpers.ServerError(w, r, err)
+			return
+		}
+		data["seasons"] = seasons
+		data["icalURL"] = rep.roomCalendarURL(room)
+
+		feeds, err := rep.DB.GetICalFeedsForRoom(r.Context(), room.ID)
+		if err != nil {
+			helpers.ServerError(w, r, err)
+			return
 		}
+		data["feeds"] = feeds
 	}
 
-	// now handle new blocks
+	render.Template(w, r, "admin-room.page.tmpl", &models.TemplateData{
+		Data: data,
+		Form: forms.New(nil),
+	})
+}
 
-	rep.App.Session.Put(r.Context(), "flash", "Changes Saved")
-	http.Redirect(w, r, fmt.Sprintf("/admin/reservations-calendar?y=%d&m=%d", year, month), http.StatusSeeOther)
+// AdminPostRoom inserts or updates a room
+func (rep *Repository) AdminPostRoom(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	var room models.Room
+	if chi.URLParam(r, "id") != "new" {
+		room.ID, err = strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			helpers.ServerError(w, r, err)
+			return
+		}
+	}
+
+	room.RoomName = r.Form.Get("room_name")
+	room.Slug = r.Form.Get("slug")
+	room.Description = r.Form.Get("description")
+	for _, p := range strings.Split(r.Form.Get("photos"), "\n") {
+		if p = strings.TrimSpace(p); p != "" {
+			room.Photos = append(room.Photos, p)
+		}
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("room_name", "slug", "capacity")
+	form.IsSlug("slug")
+
+	room.Capacity, err = strconv.Atoi(r.Form.Get("capacity"))
+	if err != nil || room.Capacity < 1 {
+		form.Errors.Add("capacity", "capacity must be a whole number of at least 1")
+	}
+
+	room.BaseRate, err = pricing.ParseAmount(r.Form.Get("base_rate"))
+	if err != nil {
+		form.Errors.Add("base_rate", "enter an amount such as 120.00")
+	}
+	room.WeekendSurcharge, err = pricing.ParseAmount(r.Form.Get("weekend_surcharge"))
+	if err != nil {
+		form.Errors.Add("weekend_surcharge", "enter an amount such as 25.00")
+	}
+	room.MinStay, err = strconv.Atoi(r.Form.Get("min_stay"))
+	if err != nil || room.MinStay < 1 {
+		form.Errors.Add("min_stay", "minimum stay must be a whole number of at least 1")
+	}
+
+	if form.Valid() {
+		// slugs are unique, so make sure the url is not already taken by another room
+		existing, err := rep.DB.GetRoomBySlug(r.Context(), room.Slug)
+		if err == nil && existing.ID != room.ID {
+			form.Errors.Add("slug", "another room already uses this slug")
+		}
+	}
+
+	if !form.Valid() {
+		data := make(map[string]interface{})
+		data["room"] = room
+
+		render.Template(w, r, "admin-room.page.tmpl", &models.TemplateData{
+			Data: data,
+			Form: form,
+		})
+		return
+	}
+
+	if room.ID == 0 {
+		room.ICalToken, err = helpers.RandomToken(16)
+		if err != nil {
+			helpers.ServerError(w, r, err)
+			return
+		}
+		_, err = rep.DB.InsertRoom(r.Context(), room)
+	} else {
+		err = rep.DB.UpdateRoom(r.Context(), room)
+	}
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	rep.App.Session.Put(r.Context(), "flash", "Room saved")
+	http.Redirect(w, r, "/admin/rooms", http.StatusSeeOther)
 }
 
-func checkServerError(w http.ResponseWriter, err error) {
+// AdminDeleteRoom deletes a room, as long as no guests have ever been booked into it
+func (rep *Repository) AdminDeleteRoom(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	err = rep.DB.DeleteRoom(r.Context(), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.NotFound(w, r)
+		return
+	}
+	if errors.Is(err, repository.ErrRoomHasReservations) {
+		rep.App.Session.Put(r.Context(), "error", "This room has reservations and cannot be deleted")
+		http.Redirect(w, r, "/admin/rooms", http.StatusSeeOther)
+		return
+	}
 	if err != nil {
-		helpers.ServerError(w, err)
+		helpers.ServerError(w, r, err)
 		return
 	}
+
+	rep.App.Session.Put(r.Context(), "flash", "Room deleted")
+	http.Redirect(w, r, "/admin/rooms", http.StatusSeeOther)
 }
 
-func checkErrorOk(w http.ResponseWriter, ok bool, errDesc string) {
-	if !ok {
-		helpers.ServerError(w, errors.New(errDesc))
+// AdminPostSeasonalRate adds a seasonal rate to a room
+func (rep *Repository) AdminPostSeasonalRate(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	roomID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
 	}
+	redirect := fmt.Sprintf("/admin/rooms/%d", roomID)
+
+	form := forms.New(r.PostForm)
+	form.Required("name", "start_date", "end_date", "nightly_rate")
+	if !form.Valid() {
+		rep.App.Session.Put(r.Context(), "error", "Name, dates and nightly rate are required")
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	}
+
+	season := models.SeasonalRate{
+		RoomID: roomID,
+		Name:   form.Get("name"),
+	}
+
+	layout := "2006-01-02"
+	season.StartDate, err = time.Parse(layout, form.Get("start_date"))
+	if err == nil {
+		season.EndDate, err = time.Parse(layout, form.Get("end_date"))
+	}
+	if err != nil || !season.EndDate.After(season.StartDate) {
+		rep.App.Session.Put(r.Context(), "error", "The season must end after it starts")
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	}
+
+	season.NightlyRate, err = pricing.ParseAmount(form.Get("nightly_rate"))
+	if err != nil {
+		rep.App.Session.Put(r.Context(), "error", err.Error())
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	}
+
+	if form.Has("min_stay") {
+		season.MinStay, err = strconv.Atoi(form.Get("min_stay"))
+		if err != nil || season.MinStay < 0 {
+			rep.App.Session.Put(r.Context(), "error", "Minimum stay must be a whole number")
+			http.Redirect(w, r, redirect, http.StatusSeeOther)
+			return
+		}
+	}
+
+	_, err = rep.DB.InsertSeasonalRate(r.Context(), season)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	rep.App.Session.Put(r.Context(), "flash", "Seasonal rate added")
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
 }
 
-func checkParseError(err error) {
+// AdminDeleteSeasonalRate removes a seasonal rate from a room
+func (rep *Repository) AdminDeleteSeasonalRate(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "season"))
 	if err != nil {
-		helpers.ParseError(err)
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	err = rep.DB.DeleteSeasonalRate(r.Context(), id)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
 	}
+
+	rep.App.Session.Put(r.Context(), "flash", "Seasonal rate removed")
+	http.Redirect(w, r, fmt.Sprintf("/admin/rooms/%s", chi.URLParam(r, "id")), http.StatusSeeOther)
 }
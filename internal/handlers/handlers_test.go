@@ -1,16 +1,21 @@
 package handlers
 
 import (
+	"bookings/internal/metrics"
 	"bookings/internal/models"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"strings"
 	"testing"
+	"time"
 )
 
 type postData struct {
@@ -29,7 +34,16 @@ var theTests = []struct {
 	{"contact", "/contact", "GET", http.StatusOK},
 	{"colonels-suite", "/colonels-suite", "GET", http.StatusOK},
 	{"generals-quarters", "/generals-quarters", "GET", http.StatusOK},
+	{"rooms", "/rooms", "GET", http.StatusOK},
+	{"room", "/rooms/colonels-suite", "GET", http.StatusOK},
+	{"room-not-found", "/rooms/green-eggs", "GET", http.StatusNotFound},
+	{"room calendar wrong token", "/rooms/generals-quarters/calendar.ics?token=green-eggs", "GET", http.StatusNotFound},
+	{"room calendar no token", "/rooms/generals-quarters/calendar.ics", "GET", http.StatusNotFound},
+	{"room calendar not found", "/rooms/green-eggs/calendar.ics?token=valid-ical-token", "GET", http.StatusNotFound},
 	{"search", "/search-availability", "GET", http.StatusOK},
+	{"manage reservation", "/reservations/valid-code", "GET", http.StatusOK},
+	{"manage reservation not found", "/reservations/green-eggs", "GET", http.StatusNotFound},
+	{"manage reservation that is over", "/reservations/past-code", "GET", http.StatusOK},
 	{"non-existent", "/green/eggs/and/ham", "GET", http.StatusNotFound},
 	{"login", "/user/login", "GET", http.StatusOK},
 	{"logout", "/user/logout", "GET", http.StatusOK},
@@ -37,9 +51,30 @@ var theTests = []struct {
 	{"new reservations", "/admin/reservations-new", "GET", http.StatusOK},
 	{"show reservations", "/admin/reservations-all", "GET", http.StatusOK},
 	{"show reservation", "/admin/reservations/new/1/show", "GET", http.StatusOK},
+	{"admin rooms", "/admin/rooms", "GET", http.StatusOK},
+	{"admin new room", "/admin/rooms/new", "GET", http.StatusOK},
+	{"admin edit room", "/admin/rooms/1", "GET", http.StatusOK},
+	{"reservations calendar", "/admin/reservations-calendar?y=2050&m=1", "GET", http.StatusOK},
+	{"admin new block", "/admin/blocks/new?room=1&start=2050-01-01", "GET", http.StatusOK},
+	{"admin edit block", "/admin/blocks/1", "GET", http.StatusOK},
+	{"admin block not found", "/admin/blocks/99", "GET", http.StatusNotFound},
+	{"admin delete block", "/admin/blocks/1/delete/do", "GET", http.StatusOK},
+	{"healthz", "/healthz", "GET", http.StatusOK},
+	{"admin mail", "/admin/mail", "GET", http.StatusOK},
+	{"admin resend mail not found", "/admin/mail/99/resend/do", "GET", http.StatusNotFound},
+	{"admin restrictions", "/admin/restrictions", "GET", http.StatusOK},
+	{"admin delete restriction", "/admin/restrictions/4/delete/do", "GET", http.StatusOK},
+	{"admin delete system restriction", "/admin/restrictions/1/delete/do", "GET", http.StatusOK},
+	{"admin users", "/admin/users", "GET", http.StatusOK},
+	{"admin api tokens", "/admin/api-tokens", "GET", http.StatusOK},
+	{"admin login attempts", "/admin/login-attempts", "GET", http.StatusOK},
+	{"forgot password", "/user/forgot-password", "GET", http.StatusOK},
+	{"set password", "/user/set-password/valid-token", "GET", http.StatusOK},
+	{"change password", "/user/password", "GET", http.StatusOK},
 }
 
 func TestNewHandlers(t *testing.T) {
+	useFixtures(t)
 	routes := getRoutes()
 	ts := httptest.NewServer(routes)
 	defer ts.Close()
@@ -59,8 +94,11 @@ func TestNewHandlers(t *testing.T) {
 }
 
 func Test_MakeReservation(t *testing.T) {
+	useFixtures(t)
 	reservation := models.Reservation{
-		RoomID: 1,
+		RoomID:    1,
+		StartDate: time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC),
+		EndDate:   time.Date(2050, 1, 2, 0, 0, 0, 0, time.UTC),
 		Room: models.Room{
 			ID:       1,
 			RoomName: "General's Quarters",
@@ -107,208 +145,126 @@ func Test_MakeReservation(t *testing.T) {
 }
 
 func TestRepository_PostReservation(t *testing.T) {
-	reqBody := "start_date=2100-01-01"
-	reqBody = fmt.Sprintf("%s&%s", reqBody, "end_date=2100-01-02")
-	reqBody = fmt.Sprintf("%s&%s", reqBody, "first_name=John")
-	reqBody = fmt.Sprintf("%s&%s", reqBody, "last_name=Smith")
-	reqBody = fmt.Sprintf("%s&%s", reqBody, "email=js@testemail.com")
-	reqBody = fmt.Sprintf("%s&%s", reqBody, "phone=123456789")
-	reqBody = fmt.Sprintf("%s&%s", reqBody, "room_id=1")
-
-	req, _ := http.NewRequest("POST", "/make-reservation", strings.NewReader(reqBody))
-	ctx := getCtx(req)
-	req = req.WithContext(ctx)
-
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(Repo.PostReservation)
-	handler.ServeHTTP(rr, req)
-	if rr.Code != http.StatusSeeOther {
-		t.Errorf("Reservation hander returned incorrect response code: got %d, wanted %d", rr.Code, http.StatusSeeOther)
-	}
-
-	//Test for missing post body
-	req, _ = http.NewRequest("POST", "/make-reservation", nil)
-	ctx = getCtx(req)
-	req = req.WithContext(ctx)
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	rr = httptest.NewRecorder()
-	handler = http.HandlerFunc(Repo.PostReservation)
-	handler.ServeHTTP(rr, req)
-
-	if rr.Code != http.StatusSeeOther {
-		t.Errorf("Reservation hander returned for missing response body: got %d, wanted %d", rr.Code, http.StatusSeeOther)
-	}
+	db := useFixtures(t)
 
-	//Test for invalid start date
-	reqBody = "start_date=invalid"
-	reqBody = fmt.Sprintf("%s&%s", reqBody, "end_date=2100-01-02")
-	reqBody = fmt.Sprintf("%s&%s", reqBody, "first_name=John")
-	reqBody = fmt.Sprintf("%s&%s", reqBody, "last_name=Smith")
-	reqBody = fmt.Sprintf("%s&%s", reqBody, "email=js@testemail.com")
-	reqBody = fmt.Sprintf("%s&%s", reqBody, "phone=123456789")
-	reqBody = fmt.Sprintf("%s&%s", reqBody, "room_id=1")
+	for _, e := range postReservationTests {
+		req, _ := http.NewRequest("POST", "/make-reservation", strings.NewReader(e.postedData.Encode()))
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
 
-	req, _ = http.NewRequest("POST", "/make-reservation", strings.NewReader(reqBody))
-	ctx = getCtx(req)
-	req = req.WithContext(ctx)
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	rr = httptest.NewRecorder()
-	handler = http.HandlerFunc(Repo.PostReservation)
-	handler.ServeHTTP(rr, req)
+		if e.name == "database-down" {
+			Repo.DB = brokenRepo{db}
+		}
+		http.HandlerFunc(Repo.PostReservation).ServeHTTP(rr, req)
+		Repo.DB = db
 
-	if rr.Code != http.StatusSeeOther {
-		t.Errorf("Reservation hander returned for invalid start date: got %d, wanted %d", rr.Code, http.StatusSeeOther)
+		if rr.Code != e.expectedResponseCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, e.expectedResponseCode, rr.Code)
+		}
+		if loc := rr.Header().Get("Location"); loc != e.expectedLocation {
+			t.Errorf("failed %s: expected location %q, but got %q", e.name, e.expectedLocation, loc)
+		}
 	}
 
-	//test for invalid end date
-	reqBody = "start_date=2100-01-01"
-	reqBody = fmt.Sprintf("%s&%s", reqBody, "end_date=invalid")
-	reqBody = fmt.Sprintf("%s&%s", reqBody, "first_name=John")
-	reqBody = fmt.Sprintf("%s&%s", reqBody, "last_name=Smith")
-	reqBody = fmt.Sprintf("%s&%s", reqBody, "email=js@testemail.com")
-	reqBody = fmt.Sprintf("%s&%s", reqBody, "phone=123456789")
-	reqBody = fmt.Sprintf("%s&%s", reqBody, "room_id=1")
-
-	req, _ = http.NewRequest("POST", "/make-reservation", strings.NewReader(reqBody))
-	ctx = getCtx(req)
-	req = req.WithContext(ctx)
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	rr = httptest.NewRecorder()
-	handler = http.HandlerFunc(Repo.PostReservation)
-	handler.ServeHTTP(rr, req)
-
-	if rr.Code != http.StatusSeeOther {
-		t.Errorf("Reservation hander returned for invalid end date: got %d, wanted %d", rr.Code, http.StatusSeeOther)
+	// only the valid reservation was booked
+	free, err := db.SearchAvailabilityByDatesByRoomID(context.Background(), time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2050, 1, 2, 0, 0, 0, 0, time.UTC), 1)
+	if err != nil || free {
+		t.Errorf("expected room 1 to be booked for the valid reservation but it is free")
 	}
-
-	//test for an invalid RoomID
-	reqBody = "start_date=2100-01-01"
-	reqBody = fmt.Sprintf("%s&%s", reqBody, "2100-01-02")
-	reqBody = fmt.Sprintf("%s&%s", reqBody, "first_name=John")
-	reqBody = fmt.Sprintf("%s&%s", reqBody, "last_name=Smith")
-	reqBody = fmt.Sprintf("%s&%s", reqBody, "email=js@testemail.com")
-	reqBody = fmt.Sprintf("%s&%s", reqBody, "phone=123456789")
-	reqBody = fmt.Sprintf("%s&%s", reqBody, "room_id=invalid")
-
-	req, _ = http.NewRequest("POST", "/make-reservation", strings.NewReader(reqBody))
-	ctx = getCtx(req)
-	req = req.WithContext(ctx)
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	rr = httptest.NewRecorder()
-	handler = http.HandlerFunc(Repo.PostReservation)
-	handler.ServeHTTP(rr, req)
-
-	if rr.Code != http.StatusSeeOther {
-		t.Errorf("Reservation hander returned for invalid Room ID: got %d, wanted %d", rr.Code, http.StatusSeeOther)
+	if free, _ := db.SearchAvailabilityByDatesByRoomID(context.Background(),
+		time.Date(2070, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2070, 1, 2, 0, 0, 0, 0, time.UTC), 1); !free {
+		t.Error("expected the stay that was too short not to be booked")
 	}
+}
 
-	//Test for invalid data
-	reqBody = "start_date=2100-01-01"
-	reqBody = fmt.Sprintf("%s&%s", reqBody, "2100-01-02")
-	reqBody = fmt.Sprintf("%s&%s", reqBody, "first_name=J")
-	reqBody = fmt.Sprintf("%s&%s", reqBody, "last_name=Smith")
-	reqBody = fmt.Sprintf("%s&%s", reqBody, "email=js@testemail.com")
-	reqBody = fmt.Sprintf("%s&%s", reqBody, "phone=123456789")
-	reqBody = fmt.Sprintf("%s&%s", reqBody, "room_id=1")
-
-	req, _ = http.NewRequest("POST", "/make-reservation", strings.NewReader(reqBody))
-	ctx = getCtx(req)
-	req = req.WithContext(ctx)
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	rr = httptest.NewRecorder()
-	handler = http.HandlerFunc(Repo.PostReservation)
-	handler.ServeHTTP(rr, req)
+func TestRepository_AvailabilityJSON(t *testing.T) {
+	useFixtures(t)
 
-	if rr.Code != http.StatusSeeOther {
-		t.Errorf("Reservation hander returned for invalid data: got %d, wanted %d", rr.Code, http.StatusSeeOther)
+	tests := []struct {
+		name      string
+		start     string
+		end       string
+		available bool
+	}{
+		{"room taken", "2060-01-01", "2060-01-02", false},
+		{"room free", "2050-01-01", "2050-01-02", true},
 	}
 
-	// test for failure to insert reservation into database
-	reqBody = "start_date=2100-01-01"
-	reqBody = fmt.Sprintf("%s&%s", reqBody, "2100-01-02")
-	reqBody = fmt.Sprintf("%s&%s", reqBody, "first_name=John")
-	reqBody = fmt.Sprintf("%s&%s", reqBody, "last_name=Smith")
-	reqBody = fmt.Sprintf("%s&%s", reqBody, "email=js@testemail.com")
-	reqBody = fmt.Sprintf("%s&%s", reqBody, "phone=123456789")
-	reqBody = fmt.Sprintf("%s&%s", reqBody, "room_id=2")
-
-	req, _ = http.NewRequest("POST", "/make-reservation", strings.NewReader(reqBody))
-	ctx = getCtx(req)
-	req = req.WithContext(ctx)
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	rr = httptest.NewRecorder()
-	handler = http.HandlerFunc(Repo.PostReservation)
-	handler.ServeHTTP(rr, req)
-
-	if rr.Code != http.StatusSeeOther {
-		t.Errorf("Reservation hander failed when trying to fail inserting reservation: got %d, wanted %d", rr.Code, http.StatusSeeOther)
-	}
+	for _, e := range tests {
+		postedData := url.Values{}
+		postedData.Add("start", e.start)
+		postedData.Add("end", e.end)
+		postedData.Add("room_id", "1")
 
-	//test for failure to insert restriction
-	reqBody = "start_date=2100-01-01"
-	reqBody = fmt.Sprintf("%s&%s", reqBody, "2100-01-02")
-	reqBody = fmt.Sprintf("%s&%s", reqBody, "first_name=John")
-	reqBody = fmt.Sprintf("%s&%s", reqBody, "last_name=Smith")
-	reqBody = fmt.Sprintf("%s&%s", reqBody, "email=js@testemail.com")
-	reqBody = fmt.Sprintf("%s&%s", reqBody, "phone=123456789")
-	reqBody = fmt.Sprintf("%s&%s", reqBody, "room_id=100000")
+		req, _ := http.NewRequest("POST", "/search-availability-json", strings.NewReader(postedData.Encode()))
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
 
-	req, _ = http.NewRequest("POST", "/make-reservation", strings.NewReader(reqBody))
-	ctx = getCtx(req)
-	req = req.WithContext(ctx)
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	rr = httptest.NewRecorder()
-	handler = http.HandlerFunc(Repo.PostReservation)
-	handler.ServeHTTP(rr, req)
+		http.HandlerFunc(Repo.AvailabilityJSON).ServeHTTP(rr, req)
 
-	if rr.Code != http.StatusSeeOther {
-		t.Errorf("Reservation hander failed when trying to fail inserting reservation: got %d, wanted %d", rr.Code, http.StatusSeeOther)
+		var j jsonResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &j); err != nil {
+			t.Errorf("%s: failed to parse json: %v", e.name, err)
+			continue
+		}
+		if j.OK != e.available {
+			t.Errorf("%s: expected availability %v but got %v", e.name, e.available, j.OK)
+		}
 	}
-
 }
 
-func TestRepository_AvailabilityJSON(t *testing.T) {
-	/*****************************************
-	// first case -- rooms are not available
-	*****************************************/
-	// create our request body
-	postedData := url.Values{}
-	postedData.Add("start", "2050-01-01")
-	postedData.Add("end", "2050-01-02")
-	postedData.Add("room_id", "1")
-
-	// create our request
-	req, _ := http.NewRequest("POST", "/search-availability-json", strings.NewReader(postedData.Encode()))
-
-	// get the context with session
-	ctx := getCtx(req)
-	req = req.WithContext(ctx)
-
-	// set the request header
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-
-	// create our response recorder, which satisfies the requirements
-	// for http.ResponseWriter
-	rr := httptest.NewRecorder()
+func TestAvailability_BadInput(t *testing.T) {
+	routes := getRoutes()
 
-	// make our handler a http.HandlerFunc
-	handler := http.HandlerFunc(Repo.AvailabilityJSON)
+	tests := []struct {
+		name               string
+		url                string
+		start              string
+		end                string
+		roomID             string
+		expectedStatusCode int
+	}{
+		{"search bad start", "/search-availability", "soon", "2050-01-02", "", http.StatusInternalServerError},
+		{"search bad end", "/search-availability", "2050-01-01", "", "", http.StatusInternalServerError},
+		{"json bad start", "/search-availability-json", "", "2050-01-02", "1", http.StatusOK},
+		{"json bad room", "/search-availability-json", "2050-01-01", "2050-01-02", "first", http.StatusOK},
+	}
 
-	// make the request to our handler
-	handler.ServeHTTP(rr, req)
+	for _, e := range tests {
+		before := testutil.ToFloat64(metrics.AvailabilitySearches.WithLabelValues("web", "found")) +
+			testutil.ToFloat64(metrics.AvailabilitySearches.WithLabelValues("web", "empty"))
 
-	// since we have no rooms available, we expect to get status http.StatusSeeOther
-	// this time we want to parse JSON and get the expected response
-	var j jsonResponse
-	err := json.Unmarshal([]byte(rr.Body.String()), &j)
-	if err != nil {
-		t.Error("failed to parse json!")
-	}
+		postedData := url.Values{}
+		postedData.Add("start", e.start)
+		postedData.Add("end", e.end)
+		postedData.Add("room_id", e.roomID)
+		req, _ := http.NewRequest("POST", e.url, strings.NewReader(postedData.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		routes.ServeHTTP(rr, req)
 
-	// since we specified a start date > 2049-12-31, we expect no availability
-	if j.OK {
-		t.Error("Got availability when none was expected in AvailabilityJSON")
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+		if loc := rr.Header().Get("Location"); loc != "" {
+			t.Errorf("failed %s: expected only the error but was also sent to %s", e.name, loc)
+		}
+		if strings.HasSuffix(e.url, "-json") {
+			var j jsonResponse
+			if err := json.Unmarshal(rr.Body.Bytes(), &j); err != nil || j.OK || j.Message == "" {
+				t.Errorf("failed %s: expected a json error but got %s", e.name, rr.Body.String())
+			}
+		}
+		after := testutil.ToFloat64(metrics.AvailabilitySearches.WithLabelValues("web", "found")) +
+			testutil.ToFloat64(metrics.AvailabilitySearches.WithLabelValues("web", "empty"))
+		if after != before {
+			t.Errorf("failed %s: expected no search counted but got %v", e.name, after-before)
+		}
 	}
 }
 
@@ -448,4 +404,1229 @@ var postReservationTests = []struct {
 		expectedHTML:         "",
 		expectedLocation:     "/",
 	},
+	{
+		name: "invalid-room-id",
+		postedData: url.Values{
+			"start_date": {"2050-01-01"},
+			"end_date":   {"2050-01-02"},
+			"first_name": {"John"},
+			"last_name":  {"Smith"},
+			"email":      {"john@smith.com"},
+			"phone":      {"555-555-5555"},
+			"room_id":    {"invalid"},
+		},
+		expectedResponseCode: http.StatusSeeOther,
+		expectedHTML:         "",
+		expectedLocation:     "/",
+	},
+	{
+		name: "unknown-room",
+		postedData: url.Values{
+			"start_date": {"2050-01-01"},
+			"end_date":   {"2050-01-02"},
+			"first_name": {"John"},
+			"last_name":  {"Smith"},
+			"email":      {"john@smith.com"},
+			"phone":      {"555-555-5555"},
+			"room_id":    {"3"},
+		},
+		expectedResponseCode: http.StatusSeeOther,
+		expectedHTML:         "",
+		expectedLocation:     "/",
+	},
+	{
+		name: "invalid-data",
+		postedData: url.Values{
+			"start_date": {"2050-02-01"},
+			"end_date":   {"2050-02-02"},
+			"first_name": {"J"},
+			"last_name":  {"Smith"},
+			"email":      {"john@smith.com"},
+			"phone":      {"555-555-5555"},
+			"room_id":    {"1"},
+		},
+		expectedResponseCode: http.StatusOK,
+		expectedHTML:         "",
+		expectedLocation:     "",
+	},
+	{
+		name: "room-taken",
+		postedData: url.Values{
+			"start_date": {"2060-01-01"},
+			"end_date":   {"2060-01-02"},
+			"first_name": {"John"},
+			"last_name":  {"Smith"},
+			"email":      {"john@smith.com"},
+			"phone":      {"555-555-5555"},
+			"room_id":    {"1"},
+		},
+		expectedResponseCode: http.StatusSeeOther,
+		expectedHTML:         "",
+		expectedLocation:     "/search-availability",
+	},
+	{
+		name: "minimum-stay-not-met",
+		postedData: url.Values{
+			"start_date": {"2070-01-01"},
+			"end_date":   {"2070-01-02"},
+			"first_name": {"John"},
+			"last_name":  {"Smith"},
+			"email":      {"john@smith.com"},
+			"phone":      {"555-555-5555"},
+			"room_id":    {"1"},
+		},
+		expectedResponseCode: http.StatusSeeOther,
+		expectedHTML:         "",
+		expectedLocation:     "/search-availability",
+	},
+	{
+		name: "database-down",
+		postedData: url.Values{
+			"start_date": {"2050-02-01"},
+			"end_date":   {"2050-02-02"},
+			"first_name": {"John"},
+			"last_name":  {"Smith"},
+			"email":      {"john@smith.com"},
+			"phone":      {"555-555-5555"},
+			"room_id":    {"2"},
+		},
+		expectedResponseCode: http.StatusSeeOther,
+		expectedHTML:         "",
+		expectedLocation:     "/",
+	},
+}
+
+var adminPostRoomTests = []struct {
+	name               string
+	url                string
+	postedData         url.Values
+	expectedStatusCode int
+	expectedLocation   string
+}{
+	{
+		name: "new-room",
+		url:  "/admin/rooms/new",
+		postedData: url.Values{
+			"room_name": {"Major's Cabin"},
+			"slug":      {"majors-cabin"},
+			"capacity":  {"4"},
+			"base_rate": {"$120.00"},
+			"min_stay":  {"1"},
+			"photos":    {"/static/images/outside.png\n/static/images/tray.png"},
+		},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedLocation:   "/admin/rooms",
+	},
+	{
+		name: "invalid-slug",
+		url:  "/admin/rooms/new",
+		postedData: url.Values{
+			"room_name": {"Major's Cabin"},
+			"slug":      {"Major's Cabin"},
+			"capacity":  {"4"},
+		},
+		expectedStatusCode: http.StatusOK,
+	},
+	{
+		name: "slug-taken",
+		url:  "/admin/rooms/1",
+		postedData: url.Values{
+			"room_name": {"General's Quarters"},
+			"slug":      {"colonels-suite"},
+			"capacity":  {"2"},
+		},
+		expectedStatusCode: http.StatusOK,
+	},
+	{
+		name: "invalid-capacity",
+		url:  "/admin/rooms/2",
+		postedData: url.Values{
+			"room_name": {"Colonel's Suite"},
+			"slug":      {"colonels-suite"},
+			"capacity":  {"zero"},
+		},
+		expectedStatusCode: http.StatusOK,
+	},
+}
+
+func TestAdminPostRoom(t *testing.T) {
+	useFixtures(t)
+	routes := getRoutes()
+
+	for _, e := range adminPostRoomTests {
+		req, _ := http.NewRequest("POST", e.url, strings.NewReader(e.postedData.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+
+		routes.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+
+		if e.expectedLocation != "" {
+			actualLoc, _ := rr.Result().Location()
+			if actualLoc.String() != e.expectedLocation {
+				t.Errorf("failed %s: expected location %s, but got %s", e.name, e.expectedLocation, actualLoc.String())
+			}
+		}
+	}
+}
+
+// TestAdminDeleteRoom deletes rooms from the memory repository, which remembers who was booked into them
+func TestAdminDeleteRoom(t *testing.T) {
+	useMemoryRepo(t)
+
+	ctx := context.Background()
+	_, err := Repo.DB.BookRoom(ctx, models.Reservation{RoomID: 1, StartDate: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		EndDate: time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC), ConfirmationCode: "abc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	routes := getRoutes()
+	tests := []struct {
+		id                 int
+		expectedStatusCode int
+	}{
+		{1, http.StatusSeeOther},
+		{2, http.StatusSeeOther},
+		{99, http.StatusNotFound},
+	}
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("/admin/rooms/%d/delete/do", e.id), nil)
+		rr := httptest.NewRecorder()
+		routes.ServeHTTP(rr, req)
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("deleting room %d: expected %d but got %d", e.id, e.expectedStatusCode, rr.Code)
+		}
+	}
+
+	if _, err := Repo.DB.GetRoomById(ctx, 1); err != nil {
+		t.Errorf("expected the room with a past stay to be kept but got %v", err)
+	}
+	if _, err := Repo.DB.GetRoomById(ctx, 2); err == nil {
+		t.Error("expected the room nobody stayed in to be deleted")
+	}
+}
+
+var manageReservationTests = []struct {
+	name               string
+	url                string
+	postedData         url.Values
+	expectedStatusCode int
+	expectedLocation   string
+}{
+	{
+		name: "change-dates",
+		url:  "/reservations/valid-code",
+		postedData: url.Values{
+			"start_date": {"2050-02-01"},
+			"end_date":   {"2050-02-03"},
+		},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedLocation:   "/reservations/valid-code",
+	},
+	{
+		name: "room-taken",
+		url:  "/reservations/valid-code",
+		postedData: url.Values{
+			"start_date": {"2060-01-01"},
+			"end_date":   {"2060-01-03"},
+		},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedLocation:   "/reservations/valid-code",
+	},
+	{
+		name: "minimum-stay-not-met",
+		url:  "/reservations/valid-code",
+		postedData: url.Values{
+			"start_date": {"2070-01-01"},
+			"end_date":   {"2070-01-02"},
+		},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedLocation:   "/reservations/valid-code",
+	},
+	{
+		name: "departure-before-arrival",
+		url:  "/reservations/valid-code",
+		postedData: url.Values{
+			"start_date": {"2050-02-03"},
+			"end_date":   {"2050-02-01"},
+		},
+		expectedStatusCode: http.StatusOK,
+	},
+	{
+		name: "arrival-in-the-past",
+		url:  "/reservations/valid-code",
+		postedData: url.Values{
+			"start_date": {"2020-02-01"},
+			"end_date":   {"2050-02-03"},
+		},
+		expectedStatusCode: http.StatusOK,
+	},
+	{
+		name: "change-stay-that-is-over",
+		url:  "/reservations/past-code",
+		postedData: url.Values{
+			"start_date": {"2050-02-01"},
+			"end_date":   {"2050-02-03"},
+		},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedLocation:   "/reservations/past-code",
+	},
+	{
+		name: "unknown-code",
+		url:  "/reservations/green-eggs",
+		postedData: url.Values{
+			"start_date": {"2050-02-01"},
+			"end_date":   {"2050-02-03"},
+		},
+		expectedStatusCode: http.StatusNotFound,
+	},
+	{
+		name:               "cancel",
+		url:                "/reservations/valid-code/cancel",
+		expectedStatusCode: http.StatusSeeOther,
+		expectedLocation:   "/",
+	},
+	{
+		name:               "cancel-stay-that-is-over",
+		url:                "/reservations/past-code/cancel",
+		expectedStatusCode: http.StatusSeeOther,
+		expectedLocation:   "/reservations/past-code",
+	},
+	{
+		name:               "cancel-unknown-code",
+		url:                "/reservations/green-eggs/cancel",
+		expectedStatusCode: http.StatusNotFound,
+	},
+}
+
+func TestManageReservation(t *testing.T) {
+	db := useFixtures(t)
+	routes := getRoutes()
+
+	for _, e := range manageReservationTests {
+		req, _ := http.NewRequest("POST", e.url, strings.NewReader(e.postedData.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+
+		routes.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+
+		if e.expectedLocation != "" {
+			actualLoc, _ := rr.Result().Location()
+			if actualLoc == nil || actualLoc.String() != e.expectedLocation {
+				t.Errorf("failed %s: expected location %s, but got %v", e.name, e.expectedLocation, actualLoc)
+			}
+		}
+	}
+
+	// the guest with the valid code moved their stay and then cancelled it, the stay that is over is untouched
+	if _, err := db.GetReservationByCode(context.Background(), "valid-code"); err == nil {
+		t.Error("expected the cancelled reservation to be gone")
+	}
+	res, err := db.GetReservationByCode(context.Background(), "past-code")
+	if err != nil || res.StartDate.Year() != 2020 {
+		t.Errorf("expected the stay that is over to be kept as it was but got %+v, %v", res, err)
+	}
+}
+
+func TestCancelReservation_Emails(t *testing.T) {
+	useFixtures(t)
+	routes := getRoutes()
+
+	req, _ := http.NewRequest("POST", "/reservations/valid-code/cancel", nil)
+	rr := httptest.NewRecorder()
+	routes.ServeHTTP(rr, req)
+
+	messages, err := Repo.DB.GetUnsentMail(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var guest, owner bool
+	for _, m := range messages {
+		switch {
+		case m.Mail.To == "john@smith.com" && m.Mail.Subject == "Reservation Cancelled valid-code":
+			guest = true
+			if !strings.Contains(m.Mail.Text, "General's Quarters") ||
+				!strings.Contains(m.Mail.Content, "General&#39;s Quarters") {
+				t.Errorf("expected a text alternative and an escaped html body but got %+v", m.Mail)
+			}
+		case m.Mail.To == app.OwnerEmail && m.Mail.Subject == "Reservation Cancelled: General's Quarters":
+			owner = true
+		}
+	}
+	if !guest || !owner {
+		t.Errorf("expected emails to the guest and the owner but got %+v", messages)
+	}
+}
+
+func TestReservationMetrics(t *testing.T) {
+	useMemoryRepo(t)
+
+	ctx := context.Background()
+	start := time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(0, 0, 1)
+	id, err := Repo.DB.BookRoom(ctx, models.Reservation{FirstName: "John", LastName: "Smith", Email: "john@smith.com",
+		RoomID: 1, StartDate: start, EndDate: end, ConfirmationCode: "valid-code"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	routes := getRoutes()
+	counted := func(name string, counter prometheus.Counter, before float64) {
+		t.Helper()
+		if n := testutil.ToFloat64(counter) - before; n != 1 {
+			t.Errorf("expected 1 %s counted but got %v", name, n)
+		}
+	}
+	search := func(expectedStatus int) {
+		t.Helper()
+		postedData := url.Values{}
+		postedData.Add("start", "2050-01-01")
+		postedData.Add("end", "2050-01-02")
+		req, _ := http.NewRequest("POST", "/search-availability", strings.NewReader(postedData.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		routes.ServeHTTP(rr, req)
+		if rr.Code != expectedStatus {
+			t.Errorf("expected status %d from the search but got %d", expectedStatus, rr.Code)
+		}
+	}
+
+	// the other room is still free
+	found := metrics.AvailabilitySearches.WithLabelValues("web", "found")
+	before := testutil.ToFloat64(found)
+	search(http.StatusOK)
+	counted("search with rooms free", found, before)
+
+	_, err = Repo.DB.BookRoom(ctx, models.Reservation{FirstName: "Jane", LastName: "Smith", Email: "jane@smith.com",
+		RoomID: 2, StartDate: start, EndDate: end, ConfirmationCode: "other-code"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	empty := metrics.AvailabilitySearches.WithLabelValues("web", "empty")
+	before = testutil.ToFloat64(empty)
+	search(http.StatusSeeOther)
+	counted("search with no rooms free", empty, before)
+
+	cancelled := metrics.ReservationsCancelled.WithLabelValues("web")
+	before = testutil.ToFloat64(cancelled)
+	req, _ := http.NewRequest("POST", "/reservations/valid-code/cancel", nil)
+	rr := httptest.NewRecorder()
+	routes.ServeHTTP(rr, req)
+	if rr.Code != http.StatusSeeOther {
+		t.Errorf("expected the cancellation to redirect but got %d", rr.Code)
+	}
+	counted("cancellation", cancelled, before)
+	if _, err := Repo.DB.GetReservationById(ctx, id); err == nil {
+		t.Error("expected the cancelled reservation to be gone")
+	}
+}
+
+func TestRoomCalendar(t *testing.T) {
+	db := useFixtures(t)
+
+	// the fixtures are years away, so book a stay and block a few days soon
+	ctx := context.Background()
+	start := today().AddDate(0, 0, 10)
+	_, err := db.BookRoom(ctx, models.Reservation{FirstName: "John", LastName: "Smith", Email: "john@smith.com",
+		RoomID: 1, StartDate: start, EndDate: start.AddDate(0, 0, 2), ConfirmationCode: "soon-code"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	blockID, err := db.InsertBlock(ctx, models.RoomRestriction{RoomID: 1, RestrictionID: 2,
+		StartDate: start.AddDate(0, 0, 5), EndDate: start.AddDate(0, 0, 6), Note: "Painting"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	routes := getRoutes()
+
+	req, _ := http.NewRequest("GET", "/rooms/generals-quarters/calendar.ics?token=valid-ical-token", nil)
+	rr := httptest.NewRecorder()
+	routes.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected %d but got %d", http.StatusOK, rr.Code)
+	}
+	if ct := rr.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/calendar") {
+		t.Errorf("expected a text/calendar content type but got %q", ct)
+	}
+
+	body := rr.Body.String()
+	if strings.Count(body, "BEGIN:VEVENT") != 2 {
+		t.Errorf("expected two events but got %s", body)
+	}
+	for _, want := range []string{"SUMMARY:Reserved", "SUMMARY:Blocked", fmt.Sprintf("UID:restriction-%d@", blockID)} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected to find %q in %s", want, body)
+		}
+	}
+	// nothing about the guest or the owner's note should leak into the feed
+	if strings.Contains(body, "John") || strings.Contains(body, "Smith") || strings.Contains(body, "Painting") {
+		t.Errorf("guest details published in %s", body)
+	}
+}
+
+// TestRoomCalendar_Notes checks, against the memory repository, that restriction types which don't block booking
+// stay out of the feed
+func TestRoomCalendar_Notes(t *testing.T) {
+	useMemoryRepo(t)
+
+	ctx := context.Background()
+	if err := Repo.DB.UpdateRoomICalToken(ctx, 1, "feed-token"); err != nil {
+		t.Fatal(err)
+	}
+	noteID, err := Repo.DB.InsertRestriction(ctx, models.Restriction{RestrictionName: "Deep Clean", BlocksBooking: false})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := today().AddDate(0, 0, 10)
+	for _, id := range []int{noteID, 2} {
+		_, err := Repo.DB.InsertBlock(ctx, models.RoomRestriction{RoomID: 1, RestrictionID: id, StartDate: start,
+			EndDate: start.AddDate(0, 0, 2)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	room, _ := Repo.DB.GetRoomById(ctx, 1)
+	req, _ := http.NewRequest("GET", "/rooms/"+room.Slug+"/calendar.ics?token=feed-token", nil)
+	rr := httptest.NewRecorder()
+	getRoutes().ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected %d but got %d", http.StatusOK, rr.Code)
+	}
+	if n := strings.Count(rr.Body.String(), "BEGIN:VEVENT"); n != 1 {
+		t.Errorf("expected only the owner block in the feed but got %d events in %s", n, rr.Body.String())
+	}
+}
+
+func TestReservationFilter(t *testing.T) {
+	var tests = []struct {
+		name     string
+		query    string
+		expected models.ReservationFilter
+	}{
+		{"defaults", "", models.ReservationFilter{Sort: models.SortByArrival, Desc: true, Page: 1,
+			PerPage: reservationsPerPage}},
+		{"everything", "q=smith&room=2&from=2050-01-02&to=2050-01-09&processed=new&sort=name&dir=desc&page=3",
+			models.ReservationFilter{Search: "smith", RoomID: 2, From: time.Date(2050, 1, 2, 0, 0, 0, 0, time.UTC),
+				To: time.Date(2050, 1, 9, 0, 0, 0, 0, time.UTC), Processed: models.ReservationsNew,
+				Sort: models.SortByName, Desc: true, Page: 3, PerPage: reservationsPerPage}},
+		{"nonsense", "room=x&from=soon&processed=maybe&sort=shoe+size&page=-1",
+			models.ReservationFilter{Sort: models.SortByArrival, Desc: true, Page: 1, PerPage: reservationsPerPage}},
+		{"arrival first", "dir=asc", models.ReservationFilter{Sort: models.SortByArrival, Page: 1,
+			PerPage: reservationsPerPage}},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", "/admin/reservations-all?"+e.query, nil)
+		if got := reservationFilter(req); got != e.expected {
+			t.Errorf("%s: expected %+v but got %+v", e.name, e.expected, got)
+		}
+	}
+
+	list := reservationList{
+		Path: "/admin/reservations-all",
+		Filter: models.ReservationFilter{Search: "smith", RoomID: 2, Sort: models.SortByName, Desc: true, Page: 2,
+			PerPage: reservationsPerPage},
+		Pages: 2,
+	}
+	if got := list.SortURL(models.SortByName); got != "/admin/reservations-all?dir=asc&q=smith&room=2&sort=name" {
+		t.Errorf("expected sorting by name again to turn it round but got %s", got)
+	}
+	if got := list.SortURL(models.SortByRoom); got != "/admin/reservations-all?dir=asc&q=smith&room=2&sort=room" {
+		t.Errorf("expected sorting by another column to start from the top but got %s", got)
+	}
+	if got := list.PageURL(list.PrevPage()); got != "/admin/reservations-all?dir=desc&q=smith&room=2&sort=name" {
+		t.Errorf("expected the first page with the same filter but got %s", got)
+	}
+	if list.NextPage() != 0 || list.SortArrow(models.SortByName) != "▼" || list.SortArrow(models.SortByID) != "" {
+		t.Errorf("expected the last page sorted by name descending but got %+v", list)
+	}
+	if got := list.ExportURL("xlsx"); got != "/admin/reservations-export?dir=desc&format=xlsx&q=smith&room=2&sort=name" {
+		t.Errorf("expected every page of the list with the same filter but got %s", got)
+	}
+}
+
+// TestAdminExports downloads reservations and occupancy from the memory repository
+func TestAdminExports(t *testing.T) {
+	useMemoryRepo(t)
+
+	ctx := context.Background()
+	for _, res := range []models.Reservation{
+		{FirstName: "John", LastName: "Smith", Email: "john@here.com", Phone: "+44 20 7946 0000", RoomID: 1,
+			StartDate: time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC), EndDate: time.Date(2050, 1, 4, 0, 0, 0, 0, time.UTC),
+			TotalPrice: 30050, ConfirmationCode: "a"},
+		{FirstName: "=HYPERLINK(\"http://evil\")", LastName: "Smithers", RoomID: 2,
+			StartDate: time.Date(2050, 2, 27, 0, 0, 0, 0, time.UTC), EndDate: time.Date(2050, 3, 2, 0, 0, 0, 0, time.UTC),
+			ConfirmationCode: "b"},
+		{FirstName: "Jane", LastName: "Guest", RoomID: 1, StartDate: time.Date(2050, 6, 1, 0, 0, 0, 0, time.UTC),
+			EndDate: time.Date(2050, 6, 2, 0, 0, 0, 0, time.UTC), ConfirmationCode: "c"},
+	} {
+		if _, err := Repo.DB.BookRoom(ctx, res); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var tests = []struct {
+		name        string
+		url         string
+		status      int
+		contentType string
+		expected    []string
+	}{
+		{"reservations", "/admin/reservations-export?q=smith&sort=name", http.StatusOK, "text/csv", []string{
+			"ID,First Name,Last Name,Email,Phone,Room,Arrival,Departure,Nights,Total,Processed,Booked\n",
+			"1,John,Smith,john@here.com,'+44 20 7946 0000,General's Quarters,2050-01-01,2050-01-04,3,300.50,No,",
+			`"'=HYPERLINK(""http://evil"")",Smithers`,
+		}},
+		{"reservations as excel", "/admin/reservations-export?format=xlsx", http.StatusOK,
+			"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", []string{"PK"}},
+		{"unknown format", "/admin/reservations-export?format=pdf", http.StatusBadRequest, "", nil},
+		{"occupancy", "/admin/occupancy-export?from=2050-01&to=2050-03", http.StatusOK, "text/csv", []string{
+			"Room,Month,Nights,Reserved,Blocked,Occupancy\n",
+			"General's Quarters,2050-01,31,3,0,9.7%\n",
+			"Colonel's Suite,2050-02,28,2,0,7.1%\nColonel's Suite,2050-03,31,1,0,3.2%\n",
+		}},
+		{"occupancy as excel", "/admin/occupancy-export?format=xlsx", http.StatusOK,
+			"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", []string{"PK"}},
+		{"not a month", "/admin/occupancy-export?from=January", http.StatusBadRequest, "", nil},
+		{"backwards", "/admin/occupancy-export?from=2050-03&to=2050-01", http.StatusBadRequest, "", nil},
+		{"too long", "/admin/occupancy-export?from=2050-01&to=2060-01", http.StatusBadRequest, "", nil},
+	}
+
+	routes := getRoutes()
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", e.url, nil)
+		rr := httptest.NewRecorder()
+		routes.ServeHTTP(rr, req)
+
+		if rr.Code != e.status {
+			t.Errorf("%s: expected %d but got %d", e.name, e.status, rr.Code)
+			continue
+		}
+		if e.status != http.StatusOK {
+			continue
+		}
+		if ct := rr.Header().Get("Content-Type"); !strings.HasPrefix(ct, e.contentType) {
+			t.Errorf("%s: expected a %s content type but got %q", e.name, e.contentType, ct)
+		}
+		if cd := rr.Header().Get("Content-Disposition"); !strings.HasPrefix(cd, "attachment; filename=") {
+			t.Errorf("%s: expected a download but got %q", e.name, cd)
+		}
+		body := rr.Body.String()
+		for _, want := range e.expected {
+			if !strings.Contains(body, want) {
+				t.Errorf("%s: expected to find %q in %s", e.name, want, body)
+			}
+		}
+	}
+}
+
+func TestICalFeeds(t *testing.T) {
+	useFixtures(t)
+	routes := getRoutes()
+
+	// stands in for another booking platform's calendar
+	channel := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/calendar")
+		fmt.Fprint(w, "BEGIN:VCALENDAR\r\nVERSION:2.0\r\nBEGIN:VEVENT\r\nUID:abc@channel\r\n"+
+			"DTSTART;VALUE=DATE:20500101\r\nDTEND;VALUE=DATE:20500104\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n")
+	}))
+	defer channel.Close()
+
+	post := func(roomURL string, values url.Values) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", roomURL+"/feeds", strings.NewReader(values.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		routes.ServeHTTP(rr, req)
+		return rr
+	}
+	get := func(path string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", path, nil)
+		rr := httptest.NewRecorder()
+		routes.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// invalid calendars are turned away
+	for _, values := range []url.Values{
+		{"name": {"Channel"}},
+		{"url": {channel.URL}},
+		{"name": {"Channel"}, "url": {"ftp://example.com/calendar.ics"}},
+	} {
+		if rr := post("/admin/rooms/1", values); rr.Code != http.StatusSeeOther {
+			t.Errorf("expected %d for %v but got %d", http.StatusSeeOther, values, rr.Code)
+		}
+	}
+	if feeds, _ := Repo.DB.GetICalFeedsForRoom(context.Background(), 1); len(feeds) != 0 {
+		t.Fatalf("expected no calendars to be added but got %d", len(feeds))
+	}
+
+	rr := post("/admin/rooms/1", url.Values{"name": {"Channel"}, "url": {channel.URL}})
+	if loc, _ := rr.Result().Location(); rr.Code != http.StatusSeeOther || loc.String() != "/admin/rooms/1" {
+		t.Fatalf("expected a redirect to the room but got %d", rr.Code)
+	}
+	feeds, _ := Repo.DB.GetICalFeedsForRoom(context.Background(), 1)
+	if len(feeds) != 1 || feeds[0].LastSyncedAt.IsZero() {
+		t.Fatalf("expected one synced calendar but got %+v", feeds)
+	}
+	feed := feeds[0]
+	if blocks, _ := Repo.DB.GetICalFeedRestrictions(context.Background(), feed.ID); len(blocks) != 1 {
+		t.Errorf("expected the calendar's booking to be synced but got %d blocks", len(blocks))
+	}
+
+	if rr := get("/admin/rooms/1"); rr.Code != http.StatusOK {
+		t.Errorf("expected the room page to show its calendars but got %d", rr.Code)
+	}
+
+	// a calendar can only be reached through its own room
+	if rr := get(fmt.Sprintf("/admin/rooms/2/feeds/%d/sync/do", feed.ID)); rr.Code != http.StatusNotFound {
+		t.Errorf("expected %d for another room's calendar but got %d", http.StatusNotFound, rr.Code)
+	}
+	if rr := get(fmt.Sprintf("/admin/rooms/1/feeds/%d/sync/do", feed.ID)); rr.Code != http.StatusSeeOther {
+		t.Errorf("expected %d syncing the calendar but got %d", http.StatusSeeOther, rr.Code)
+	}
+	if rr := get(fmt.Sprintf("/admin/rooms/1/feeds/%d/delete/do", feed.ID)); rr.Code != http.StatusSeeOther {
+		t.Errorf("expected %d removing the calendar but got %d", http.StatusSeeOther, rr.Code)
+	}
+	if feeds, _ := Repo.DB.GetICalFeedsForRoom(context.Background(), 1); len(feeds) != 0 {
+		t.Errorf("expected the calendar to be removed but got %+v", feeds)
+	}
+}
+
+var blockPostTests = []struct {
+	name               string
+	url                string
+	postedData         url.Values
+	expectedStatusCode int
+	expectedLocation   string
+}{
+	{
+		name: "new-block",
+		url:  "/admin/blocks/new",
+		postedData: url.Values{
+			"room_id":        {"1"},
+			"restriction_id": {"2"},
+			"start_date":     {"2050-01-01"},
+			"end_date":       {"2050-01-08"},
+			"note":           {"Maintenance"},
+		},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedLocation:   "/admin/reservations-calendar?y=2050&m=01",
+	},
+	{
+		name: "edit-block",
+		url:  "/admin/blocks/1",
+		postedData: url.Values{
+			"room_id":        {"2"},
+			"restriction_id": {"4"},
+			"start_date":     {"2050-03-01"},
+			"end_date":       {"2050-03-02"},
+		},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedLocation:   "/admin/reservations-calendar?y=2050&m=03",
+	},
+	{
+		// reservations and external bookings are not made by hand
+		name: "reservation-type",
+		url:  "/admin/blocks/new",
+		postedData: url.Values{
+			"room_id":        {"1"},
+			"restriction_id": {"1"},
+			"start_date":     {"2050-01-01"},
+			"end_date":       {"2050-01-02"},
+		},
+		expectedStatusCode: http.StatusOK,
+	},
+	{
+		name: "block-not-found",
+		url:  "/admin/blocks/99",
+		postedData: url.Values{
+			"room_id":    {"1"},
+			"start_date": {"2050-01-01"},
+			"end_date":   {"2050-01-02"},
+		},
+		expectedStatusCode: http.StatusNotFound,
+	},
+	{
+		name: "ends-before-start",
+		url:  "/admin/blocks/new",
+		postedData: url.Values{
+			"room_id":    {"1"},
+			"start_date": {"2050-01-08"},
+			"end_date":   {"2050-01-01"},
+		},
+		expectedStatusCode: http.StatusOK,
+	},
+	{
+		name: "unknown-room",
+		url:  "/admin/blocks/new",
+		postedData: url.Values{
+			"room_id":    {"3"},
+			"start_date": {"2050-01-01"},
+			"end_date":   {"2050-01-02"},
+		},
+		expectedStatusCode: http.StatusOK,
+	},
+	{
+		// John Smith is staying in room 1 at the start of june
+		name: "over-reservation",
+		url:  "/admin/blocks/new",
+		postedData: url.Values{
+			"room_id":    {"1"},
+			"start_date": {"2050-05-01"},
+			"end_date":   {"2050-07-01"},
+		},
+		expectedStatusCode: http.StatusOK,
+	},
+}
+
+func TestAdminPostBlock(t *testing.T) {
+	useFixtures(t)
+	routes := getRoutes()
+
+	for _, e := range blockPostTests {
+		req, _ := http.NewRequest("POST", e.url, strings.NewReader(e.postedData.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+
+		routes.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+
+		if e.expectedLocation != "" {
+			actualLoc, _ := rr.Result().Location()
+			if actualLoc == nil || actualLoc.String() != e.expectedLocation {
+				t.Errorf("failed %s: expected location %s, but got %v", e.name, e.expectedLocation, actualLoc)
+			}
+		}
+	}
+}
+
+var restrictionPostTests = []struct {
+	name               string
+	url                string
+	postedData         url.Values
+	expectedStatusCode int
+}{
+	{
+		name: "new-type",
+		url:  "/admin/restrictions/new",
+		postedData: url.Values{
+			"restriction_name": {"Deep Clean"},
+			"colour":           {"#00ff00"},
+			"blocks_booking":   {"1"},
+		},
+		expectedStatusCode: http.StatusSeeOther,
+	},
+	{
+		name: "rename-system-type",
+		url:  "/admin/restrictions/2",
+		postedData: url.Values{
+			"restriction_name": {"Closed"},
+			"colour":           {"#ffc107"},
+		},
+		expectedStatusCode: http.StatusSeeOther,
+	},
+	{
+		name: "bad-colour",
+		url:  "/admin/restrictions/4",
+		postedData: url.Values{
+			"restriction_name": {"Renovation"},
+			"colour":           {"red"},
+		},
+		expectedStatusCode: http.StatusSeeOther,
+	},
+	{
+		name: "type-not-found",
+		url:  "/admin/restrictions/99",
+		postedData: url.Values{
+			"restriction_name": {"Renovation"},
+			"colour":           {"#000000"},
+		},
+		expectedStatusCode: http.StatusNotFound,
+	},
+}
+
+func TestAdminPostRestriction(t *testing.T) {
+	useFixtures(t)
+	routes := getRoutes()
+
+	for _, e := range restrictionPostTests {
+		req, _ := http.NewRequest("POST", e.url, strings.NewReader(e.postedData.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+
+		routes.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+	}
+}
+
+func TestCalendarRow(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2050, 1, d, 0, 0, 0, 0, time.UTC) }
+
+	external := models.Restriction{ID: 3, SystemKey: models.RestrictionExternal}
+
+	restrictions := []models.RoomRestriction{
+		// a block carried over from december
+		{ID: 1, RestrictionID: 2, StartDate: day(-2), EndDate: day(3), Note: "Cleaning"},
+		{ID: 2, RestrictionID: 1, ReservationID: 7, StartDate: day(5), EndDate: day(8)},
+		// an external booking partly hidden by the reservation
+		{ID: 3, RestrictionID: 3, ICalFeedID: 4, StartDate: day(7), EndDate: day(10), Restriction: external},
+	}
+
+	cells := calendarRow(day(1), day(31), restrictions)
+
+	expected := []struct {
+		start int
+		days  int
+		kind  string
+		id    int
+	}{
+		{1, 2, "block", 1},
+		{3, 1, "", 0},
+		{4, 1, "", 0},
+		{5, 3, "reservation", 7},
+		{8, 2, "external", 4},
+		{10, 1, "", 0},
+	}
+	for i, e := range expected {
+		c := cells[i]
+		if c.Start.Day() != e.start || c.Days != e.days || c.Kind != e.kind || c.ID != e.id {
+			t.Errorf("cell %d: expected %+v but got %+v", i, e, c)
+		}
+	}
+
+	total := 0
+	for _, c := range cells {
+		total += c.Days
+	}
+	if total != 31 {
+		t.Errorf("expected the cells to cover 31 days but they cover %d", total)
+	}
+}
+
+func TestForbidden(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/admin/rooms/1/delete/do", nil)
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+	rr := httptest.NewRecorder()
+
+	handler := http.HandlerFunc(Repo.Forbidden)
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("Forbidden handler returned wrong response code: got %d, wanted %d", rr.Code, http.StatusForbidden)
+	}
+}
+
+var userPostTests = []struct {
+	name               string
+	url                string
+	postedData         url.Values
+	expectedStatusCode int
+	expectedLocation   string
+}{
+	{
+		name: "invite",
+		url:  "/admin/users",
+		postedData: url.Values{
+			"first_name":   {"Jane"},
+			"last_name":    {"Doe"},
+			"email":        {"jane@here.com"},
+			"access_level": {"2"},
+		},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedLocation:   "/admin/users",
+	},
+	{
+		name: "invite-email-taken",
+		url:  "/admin/users",
+		postedData: url.Values{
+			"first_name":   {"Jane"},
+			"last_name":    {"Doe"},
+			"email":        {"me@here.com"},
+			"access_level": {"2"},
+		},
+		expectedStatusCode: http.StatusOK,
+	},
+	{
+		name: "invite-invalid-access-level",
+		url:  "/admin/users",
+		postedData: url.Values{
+			"first_name":   {"Jane"},
+			"last_name":    {"Doe"},
+			"email":        {"jane@here.com"},
+			"access_level": {"9"},
+		},
+		expectedStatusCode: http.StatusOK,
+	},
+	{
+		name:               "change-access-level",
+		url:                "/admin/users/2",
+		postedData:         url.Values{"access_level": {"1"}},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedLocation:   "/admin/users",
+	},
+	{
+		name:               "forgot-password",
+		url:                "/user/forgot-password",
+		postedData:         url.Values{"email": {"me@here.com"}},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedLocation:   "/user/login",
+	},
+	{
+		name:               "forgot-password-unknown-email",
+		url:                "/user/forgot-password",
+		postedData:         url.Values{"email": {"nobody@here.com"}},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedLocation:   "/user/login",
+	},
+	{
+		name:               "forgot-password-invalid-email",
+		url:                "/user/forgot-password",
+		postedData:         url.Values{"email": {"nobody"}},
+		expectedStatusCode: http.StatusOK,
+	},
+	{
+		name: "set-password",
+		url:  "/user/set-password/valid-token",
+		postedData: url.Values{
+			"password":         {"correct horse battery"},
+			"password_confirm": {"correct horse battery"},
+		},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedLocation:   "/user/login",
+	},
+	{
+		name: "set-password-mismatch",
+		url:  "/user/set-password/valid-token",
+		postedData: url.Values{
+			"password":         {"correct horse battery"},
+			"password_confirm": {"battery staple horse"},
+		},
+		expectedStatusCode: http.StatusOK,
+	},
+	{
+		name: "set-password-invalid-token",
+		url:  "/user/set-password/green-eggs",
+		postedData: url.Values{
+			"password":         {"correct horse battery"},
+			"password_confirm": {"correct horse battery"},
+		},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedLocation:   "/user/forgot-password",
+	},
+	{
+		name: "change-password",
+		url:  "/user/password",
+		postedData: url.Values{
+			"current_password": {"password"},
+			"password":         {"correct horse battery"},
+			"password_confirm": {"correct horse battery"},
+		},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedLocation:   "/admin/dashboard",
+	},
+	{
+		name: "change-password-wrong-current",
+		url:  "/user/password",
+		postedData: url.Values{
+			"current_password": {"green eggs"},
+			"password":         {"correct horse battery"},
+			"password_confirm": {"correct horse battery"},
+		},
+		expectedStatusCode: http.StatusOK,
+	},
+	{
+		name: "change-password-too-short",
+		url:  "/user/password",
+		postedData: url.Values{
+			"current_password": {"password"},
+			"password":         {"short"},
+			"password_confirm": {"short"},
+		},
+		expectedStatusCode: http.StatusOK,
+	},
+}
+
+func TestUserPosts(t *testing.T) {
+	routes := getRoutes()
+
+	for _, e := range userPostTests {
+		req, _ := http.NewRequest("POST", e.url, strings.NewReader(e.postedData.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+
+		routes.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+
+		if e.expectedLocation != "" {
+			actualLoc, _ := rr.Result().Location()
+			if actualLoc == nil || actualLoc.String() != e.expectedLocation {
+				t.Errorf("failed %s: expected location %s, but got %v", e.name, e.expectedLocation, actualLoc)
+			}
+		}
+	}
+}
+
+func postLogin(email, password string) *httptest.ResponseRecorder {
+	postData := url.Values{}
+	postData.Add("email", email)
+	postData.Add("password", password)
+
+	req, _ := http.NewRequest("POST", "/user/login", strings.NewReader(postData.Encode()))
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+
+	handler := http.HandlerFunc(Repo.PostShowLogin)
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func lastLoginOutcome(t *testing.T) string {
+	attempts, err := Repo.DB.RecentFailedLogins(context.Background(), 1)
+	if err != nil || len(attempts) == 0 {
+		t.Fatal("no login attempts recorded")
+	}
+	return attempts[0].Outcome
+}
+
+func TestLoginLockout(t *testing.T) {
+	// enough failures to be one short of a lockout, long enough ago that no backoff applies any more
+	for i := 0; i < lockoutFailures-1; i++ {
+		_ = Repo.DB.InsertLoginAttempt(context.Background(), models.LoginAttempt{
+			Email:     "staff@here.com",
+			IPAddress: "10.0.0.1",
+			Outcome:   models.LoginFailed,
+			CreatedAt: time.Now().Add(-10 * time.Minute),
+		})
+	}
+
+	rr := postLogin("staff@here.com", "wrong")
+	if rr.Code != http.StatusSeeOther {
+		t.Errorf("expected code %d, but got %d", http.StatusSeeOther, rr.Code)
+	}
+	if outcome := lastLoginOutcome(t); outcome != models.LoginFailed {
+		t.Errorf("expected the attempt to be recorded as %s, but got %s", models.LoginFailed, outcome)
+	}
+
+	u, _ := Repo.DB.GetUserByEmail(context.Background(), "staff@here.com")
+	if !u.LockedUntil.After(time.Now()) {
+		t.Fatal("expected the account to be locked")
+	}
+
+	_ = postLogin("staff@here.com", "wrong")
+	if outcome := lastLoginOutcome(t); outcome != models.LoginLocked {
+		t.Errorf("expected the attempt to be recorded as %s, but got %s", models.LoginLocked, outcome)
+	}
+
+	req, _ := http.NewRequest("GET", "/admin/users/2/unlock/do", nil)
+	rr = httptest.NewRecorder()
+	getRoutes().ServeHTTP(rr, req)
+	if rr.Code != http.StatusSeeOther {
+		t.Errorf("unlock: expected code %d, but got %d", http.StatusSeeOther, rr.Code)
+	}
+
+	u, _ = Repo.DB.GetUserByEmail(context.Background(), "staff@here.com")
+	if u.LockedUntil.After(time.Now()) {
+		t.Error("expected the account to be unlocked")
+	}
+}
+
+func TestLoginThrottling(t *testing.T) {
+	for i := 0; i < freeEmailFailures+2; i++ {
+		_ = Repo.DB.InsertLoginAttempt(context.Background(), models.LoginAttempt{
+			Email:     "someone@nothere.com",
+			IPAddress: "10.0.0.2",
+			Outcome:   models.LoginFailed,
+			CreatedAt: time.Now(),
+		})
+	}
+
+	rr := postLogin("someone@nothere.com", "password")
+	if rr.Code != http.StatusSeeOther {
+		t.Errorf("expected code %d, but got %d", http.StatusSeeOther, rr.Code)
+	}
+	if outcome := lastLoginOutcome(t); outcome != models.LoginThrottled {
+		t.Errorf("expected the attempt to be recorded as %s, but got %s", models.LoginThrottled, outcome)
+	}
+}
+
+func TestLoginBackoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		expected time.Duration
+	}{
+		{0, 0},
+		{freeEmailFailures - 1, 0},
+		{freeEmailFailures, time.Second},
+		{freeEmailFailures + 3, 8 * time.Second},
+		{freeEmailFailures + 20, maxLoginBackoff},
+	}
+
+	for _, e := range tests {
+		if got := loginBackoff(e.failures, freeEmailFailures); got != e.expected {
+			t.Errorf("loginBackoff(%d): expected %s, but got %s", e.failures, e.expected, got)
+		}
+	}
+}
+
+// testConn stands in for the database connection pool in readiness checks
+type testConn struct {
+	err error
+}
+
+func (c testConn) Ping(ctx context.Context) error {
+	return c.err
+}
+
+func TestReadyz(t *testing.T) {
+	routes := getRoutes()
+	defer func() { Repo.Conn = nil }()
+
+	tests := []struct {
+		name               string
+		conn               Pinger
+		expectedStatusCode int
+	}{
+		{"no-database", nil, http.StatusServiceUnavailable},
+		{"database-down", testConn{err: errors.New("connection refused")}, http.StatusServiceUnavailable},
+		{"database-up", testConn{}, http.StatusOK},
+	}
+	for _, e := range tests {
+		Repo.Conn = e.conn
+
+		req, _ := http.NewRequest("GET", "/readyz", nil)
+		rr := httptest.NewRecorder()
+		routes.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+		if strings.Contains(rr.Body.String(), "connection refused") {
+			t.Errorf("failed %s: database error shown to the caller", e.name)
+		}
+	}
 }
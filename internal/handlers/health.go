@@ -0,0 +1,43 @@
+package handlers
+
+import (
+	"bookings/internal/helpers"
+	"context"
+	"net/http"
+	"time"
+)
+
+// Pinger is a database connection that can be checked, such as *driver.DB
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// Healthz reports that the application is running. It checks nothing else, so that a process that is only waiting
+// for its database is not restarted
+func (rep *Repository) Healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+// Readyz reports whether the application can serve requests, which it can't without its database
+func (rep *Repository) Readyz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+
+	if rep.Conn == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte("no database\n"))
+		return
+	}
+	if err := rep.Conn.Ping(ctx); err != nil {
+		helpers.Logger(r.Context()).Warn("readiness check failed", "error", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte("database unavailable\n"))
+		return
+	}
+	_, _ = w.Write([]byte("ok\n"))
+}
@@ -0,0 +1,252 @@
+package handlers
+
+import (
+	"bookings/internal/helpers"
+	"bookings/internal/ical"
+	"bookings/internal/icalsync"
+	"bookings/internal/models"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// icalPast and icalFuture bound the dates published in a room's calendar feed
+	icalPast   = -30 * 24 * time.Hour
+	icalFuture = 2 * 365 * 24 * time.Hour
+)
+
+// RoomCalendar serves a room's reservations and blocks as an iCalendar feed, for other booking platforms to
+// subscribe to. The feed is protected by the room's ical token and leaves out everything about the guests
+func (rep *Repository) RoomCalendar(w http.ResponseWriter, r *http.Request) {
+	room, err := rep.DB.GetRoomBySlug(r.Context(), chi.URLParam(r, "slug"))
+	if errors.Is(err, sql.ErrNoRows) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	// a wrong token looks the same as a missing room, so feeds can't be discovered by guessing
+	token := r.URL.Query().Get("token")
+	if room.ICalToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(room.ICalToken)) != 1 {
+		http.NotFound(w, r)
+		return
+	}
+
+	now := time.Now()
+	restrictions, err := rep.DB.GetRestrictionsForRoomByDate(r.Context(), room.ID, now.Add(icalPast), now.Add(icalFuture))
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	host := "bookings"
+	if u, err := url.Parse(rep.App.BaseURL); err == nil && u.Hostname() != "" {
+		host = u.Hostname()
+	}
+
+	cal := ical.Calendar{
+		ProdID: "-//bookings//room calendar//EN",
+		Name:   room.RoomName,
+	}
+	for _, x := range restrictions {
+		// restrictions that don't keep guests out are only notes, and would make the room look taken elsewhere
+		if !x.Restriction.BlocksBooking {
+			continue
+		}
+		summary := "Blocked"
+		if x.ReservationID > 0 {
+			summary = "Reserved"
+		}
+		cal.Events = append(cal.Events, ical.Event{
+			UID:     ical.UID("restriction", x.ID, host),
+			Summary: summary,
+			Start:   x.StartDate,
+			End:     x.EndDate,
+			Stamp:   now,
+		})
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`inline; filename="%s.ics"`, room.Slug))
+	if err := cal.Encode(w); err != nil {
+		helpers.Logger(r.Context()).Error("writing calendar", "error", err)
+	}
+}
+
+// AdminRegenerateICalToken gives a room a new calendar feed token, cutting off everyone using the old feed url
+func (rep *Repository) AdminRegenerateICalToken(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	token, err := helpers.RandomToken(16)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	err = rep.DB.UpdateRoomICalToken(r.Context(), id, token)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	rep.App.Session.Put(r.Context(), "flash", "Calendar feed address changed")
+	http.Redirect(w, r, fmt.Sprintf("/admin/rooms/%d", id), http.StatusSeeOther)
+}
+
+// roomCalendarURL returns the address external calendars subscribe to for a room
+func (rep *Repository) roomCalendarURL(room models.Room) string {
+	return rep.App.BaseURL + "/rooms/" + room.Slug + "/calendar.ics?token=" + url.QueryEscape(room.ICalToken)
+}
+
+// maxICalUpload is the largest calendar file that can be uploaded for a room
+const maxICalUpload = 5 << 20
+
+// AdminPostICalFeed adds another booking platform's calendar to a room, either as a url to fetch or an uploaded
+// file, and syncs it straight away so that any problem with it shows up at once
+func (rep *Repository) AdminPostICalFeed(w http.ResponseWriter, r *http.Request) {
+	roomID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+	redirect := fmt.Sprintf("/admin/rooms/%d", roomID)
+
+	err = r.ParseMultipartForm(maxICalUpload)
+	if err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	feed := models.ICalFeed{
+		RoomID: roomID,
+		Name:   strings.TrimSpace(r.Form.Get("name")),
+		URL:    strings.TrimSpace(r.Form.Get("url")),
+	}
+
+	file, _, err := r.FormFile("file")
+	if err == nil {
+		defer file.Close()
+		contents, err := io.ReadAll(io.LimitReader(file, maxICalUpload+1))
+		if err != nil {
+			helpers.ServerError(w, r, err)
+			return
+		}
+		if len(contents) > maxICalUpload {
+			rep.App.Session.Put(r.Context(), "error", "The calendar file is too large")
+			http.Redirect(w, r, redirect, http.StatusSeeOther)
+			return
+		}
+		feed.Contents = string(contents)
+	}
+
+	if feed.Name == "" {
+		rep.App.Session.Put(r.Context(), "error", "Give the calendar a name, such as the platform it comes from")
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	}
+	if (feed.URL == "") == (feed.Contents == "") {
+		rep.App.Session.Put(r.Context(), "error", "Enter the calendar's address or upload a calendar file, but not both")
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	}
+	if feed.URL != "" {
+		u, err := url.Parse(feed.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			rep.App.Session.Put(r.Context(), "error", "The calendar's address must be an http or https url")
+			http.Redirect(w, r, redirect, http.StatusSeeOther)
+			return
+		}
+	}
+
+	feed.ID, err = rep.DB.InsertICalFeed(r.Context(), feed)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	if err := icalsync.New(rep.DB, rep.App.Logger).Sync(r.Context(), feed); err != nil {
+		rep.App.Session.Put(r.Context(), "error", "Calendar added, but it could not be synced: "+err.Error())
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	}
+
+	rep.App.Session.Put(r.Context(), "flash", "Calendar added and synced")
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+}
+
+// AdminSyncICalFeed syncs one of a room's external calendars without waiting for the background sync
+func (rep *Repository) AdminSyncICalFeed(w http.ResponseWriter, r *http.Request) {
+	feed, ok := rep.roomICalFeed(w, r)
+	if !ok {
+		return
+	}
+	redirect := fmt.Sprintf("/admin/rooms/%d", feed.RoomID)
+
+	if err := icalsync.New(rep.DB, rep.App.Logger).Sync(r.Context(), feed); err != nil {
+		rep.App.Session.Put(r.Context(), "error", "The calendar could not be synced: "+err.Error())
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	}
+
+	rep.App.Session.Put(r.Context(), "flash", "Calendar synced")
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+}
+
+// AdminDeleteICalFeed removes one of a room's external calendars, and the blocks that came from it
+func (rep *Repository) AdminDeleteICalFeed(w http.ResponseWriter, r *http.Request) {
+	feed, ok := rep.roomICalFeed(w, r)
+	if !ok {
+		return
+	}
+
+	err := rep.DB.DeleteICalFeed(r.Context(), feed.ID)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	rep.App.Session.Put(r.Context(), "flash", "Calendar removed")
+	http.Redirect(w, r, fmt.Sprintf("/admin/rooms/%d", feed.RoomID), http.StatusSeeOther)
+}
+
+// roomICalFeed loads the external calendar named in the url, making sure it belongs to the room in the url.
+// When it doesn't, a response has already been written and ok is false
+func (rep *Repository) roomICalFeed(w http.ResponseWriter, r *http.Request) (feed models.ICalFeed, ok bool) {
+	roomID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return feed, false
+	}
+	feedID, err := strconv.Atoi(chi.URLParam(r, "feed"))
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return feed, false
+	}
+
+	feed, err = rep.DB.GetICalFeedByID(r.Context(), feedID)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && feed.RoomID != roomID) {
+		http.NotFound(w, r)
+		return feed, false
+	}
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return feed, false
+	}
+	return feed, true
+}
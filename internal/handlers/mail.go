@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"bookings/internal/helpers"
+	"bookings/internal/models"
+	"bookings/internal/render"
+	"database/sql"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"net/http"
+	"strconv"
+)
+
+// AdminMail lists the emails that are waiting to be sent or were given up on
+func (rep *Repository) AdminMail(w http.ResponseWriter, r *http.Request) {
+	messages, err := rep.DB.GetUnsentMail(r.Context())
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["messages"] = messages
+
+	_ = render.Template(w, r, "admin-mail.page.tmpl", &models.TemplateData{
+		Data: data,
+	})
+}
+
+// AdminResendMail puts an unsent email back in the queue with a fresh set of attempts
+func (rep *Repository) AdminResendMail(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	err = rep.DB.ResendMail(r.Context(), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+	rep.App.Mail.Notify()
+
+	rep.App.Session.Put(r.Context(), "flash", "Email queued to be sent again")
+	http.Redirect(w, r, "/admin/mail", http.StatusSeeOther)
+}
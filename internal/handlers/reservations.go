@@ -0,0 +1,179 @@
+package handlers
+
+import (
+	"bookings/internal/helpers"
+	"bookings/internal/models"
+	"bookings/internal/render"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// reservationsPerPage is how many reservations the admin lists show at a time
+const reservationsPerPage = 25
+
+// reservationList is a page of one of the admin's reservation lists, along with the filter that picked it out
+type reservationList struct {
+	// Path is the list's own address, and Src the part of a reservation's address that leads back to it
+	Path         string
+	Src          string
+	Filter       models.ReservationFilter
+	Reservations []models.Reservation
+	Total        int
+	Pages        int
+	Rooms        []models.Room
+}
+
+// reservationFilter reads the admin lists' search, filters, sort and page from the query string. Values that don't
+// parse are left out, so that a mistyped date shows more reservations rather than an error
+func reservationFilter(r *http.Request) models.ReservationFilter {
+	q := r.URL.Query()
+	f := models.ReservationFilter{
+		Search:    q.Get("q"),
+		Processed: q.Get("processed"),
+		Sort:      q.Get("sort"),
+		Desc:      q.Get("dir") == "desc",
+		PerPage:   reservationsPerPage,
+	}
+	f.RoomID, _ = strconv.Atoi(q.Get("room"))
+	f.Page, _ = strconv.Atoi(q.Get("page"))
+	f.Page = max(f.Page, 1)
+	f.From, _ = time.Parse("2006-01-02", q.Get("from"))
+	f.To, _ = time.Parse("2006-01-02", q.Get("to"))
+
+	switch f.Sort {
+	case models.SortByID, models.SortByName, models.SortByRoom, models.SortByArrival, models.SortByDeparture,
+		models.SortByBooked:
+	default:
+		// the latest arrivals first, until asked otherwise
+		f.Sort = models.SortByArrival
+		f.Desc = q.Get("dir") != "asc"
+	}
+	if f.Processed != models.ReservationsNew && f.Processed != models.ReservationsProcessed {
+		f.Processed = models.ReservationsAll
+	}
+	return f
+}
+
+// values returns the query string of the list with the same filter, sorted and paged as asked
+func (l reservationList) values(sortBy string, desc bool, page int) url.Values {
+	v := url.Values{}
+	if l.Filter.Search != "" {
+		v.Set("q", l.Filter.Search)
+	}
+	if l.Filter.RoomID > 0 {
+		v.Set("room", strconv.Itoa(l.Filter.RoomID))
+	}
+	if !l.Filter.From.IsZero() {
+		v.Set("from", l.Filter.From.Format("2006-01-02"))
+	}
+	if !l.Filter.To.IsZero() {
+		v.Set("to", l.Filter.To.Format("2006-01-02"))
+	}
+	if l.Filter.Processed != models.ReservationsAll {
+		v.Set("processed", l.Filter.Processed)
+	}
+	v.Set("sort", sortBy)
+	v.Set("dir", "asc")
+	if desc {
+		v.Set("dir", "desc")
+	}
+	if page > 1 {
+		v.Set("page", strconv.Itoa(page))
+	}
+	return v
+}
+
+// url returns the address of the list with the same filter, sorted and paged as asked
+func (l reservationList) url(sortBy string, desc bool, page int) string {
+	return l.Path + "?" + l.values(sortBy, desc, page).Encode()
+}
+
+// ExportURL returns the address of every page of the list, as csv or xlsx
+func (l reservationList) ExportURL(format string) string {
+	v := l.values(l.Filter.Sort, l.Filter.Desc, 1)
+	v.Set("format", format)
+	return "/admin/reservations-export?" + v.Encode()
+}
+
+// SortURL returns the address that sorts the list by a column, the other way round if it already is
+func (l reservationList) SortURL(sortBy string) string {
+	return l.url(sortBy, l.Filter.Sort == sortBy && !l.Filter.Desc, 1)
+}
+
+// SortArrow marks the column the list is sorted by with the direction it is sorted in
+func (l reservationList) SortArrow(sortBy string) string {
+	switch {
+	case l.Filter.Sort != sortBy:
+		return ""
+	case l.Filter.Desc:
+		return "▼"
+	default:
+		return "▲"
+	}
+}
+
+// PageURL returns the address of another page of the list
+func (l reservationList) PageURL(page int) string {
+	return l.url(l.Filter.Sort, l.Filter.Desc, page)
+}
+
+// PrevPage and NextPage return the pages either side of this one, or 0 if there isn't one
+func (l reservationList) PrevPage() int {
+	if l.Filter.Page > 1 {
+		return min(l.Filter.Page-1, l.Pages)
+	}
+	return 0
+}
+
+func (l reservationList) NextPage() int {
+	if l.Filter.Page < l.Pages {
+		return l.Filter.Page + 1
+	}
+	return 0
+}
+
+// showReservations renders a page of reservations, searched, filtered and sorted as the query string asks.
+// processed, when set, fixes which reservations the list is of
+func (rep *Repository) showReservations(w http.ResponseWriter, r *http.Request, page, src, processed string) {
+	filter := reservationFilter(r)
+	if processed != models.ReservationsAll {
+		filter.Processed = processed
+	}
+
+	reservations, total, err := rep.DB.SearchReservations(r.Context(), filter)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+	rooms, err := rep.DB.AllRooms(r.Context())
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["list"] = reservationList{
+		Path:         r.URL.Path,
+		Src:          src,
+		Filter:       filter,
+		Reservations: reservations,
+		Total:        total,
+		Pages:        (total + filter.PerPage - 1) / filter.PerPage,
+		Rooms:        rooms,
+	}
+	render.Template(w, r, page, &models.TemplateData{
+		Data: data,
+	})
+}
+
+// AdminNewReservations shows the reservations that haven't been processed yet in admin tool
+func (rep *Repository) AdminNewReservations(w http.ResponseWriter, r *http.Request) {
+	rep.showReservations(w, r, "admin-new-reservations.page.tmpl", "new", models.ReservationsNew)
+}
+
+// AdminAllReservations shows all reservations in admin tool
+func (rep *Repository) AdminAllReservations(w http.ResponseWriter, r *http.Request) {
+	rep.showReservations(w, r, "admin-all-reservations.page.tmpl", "all", models.ReservationsAll)
+}
@@ -0,0 +1,116 @@
+package handlers
+
+import (
+	"bookings/internal/forms"
+	"bookings/internal/helpers"
+	"bookings/internal/models"
+	"bookings/internal/render"
+	"bookings/internal/repository"
+	"database/sql"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// colourRX matches the #rrggbb colours that colour inputs send
+var colourRX = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+// AdminRestrictions lists the restriction types, with forms to change them and add new ones
+func (rep *Repository) AdminRestrictions(w http.ResponseWriter, r *http.Request) {
+	restrictions, err := rep.DB.AllRestrictions(r.Context())
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["restrictions"] = restrictions
+
+	render.Template(w, r, "admin-restrictions.page.tmpl", &models.TemplateData{
+		Data: data,
+		Form: forms.New(nil),
+	})
+}
+
+// AdminPostRestriction adds a restriction type, or changes an existing one. The types the application relies on
+// can be renamed and recoloured, but always block booking
+func (rep *Repository) AdminPostRestriction(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	var restriction models.Restriction
+	if chi.URLParam(r, "id") != "new" {
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			helpers.ServerError(w, r, err)
+			return
+		}
+		restriction, err = rep.DB.GetRestrictionByID(r.Context(), id)
+		if errors.Is(err, sql.ErrNoRows) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			helpers.ServerError(w, r, err)
+			return
+		}
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("restriction_name", "colour")
+	if form.Get("colour") != "" && !colourRX.MatchString(form.Get("colour")) {
+		form.Errors.Add("colour", "Choose a colour")
+	}
+	if !form.Valid() {
+		rep.App.Session.Put(r.Context(), "error", "Every type needs a name and a colour")
+		http.Redirect(w, r, "/admin/restrictions", http.StatusSeeOther)
+		return
+	}
+
+	restriction.RestrictionName = strings.TrimSpace(form.Get("restriction_name"))
+	restriction.Colour = form.Get("colour")
+	restriction.BlocksBooking = form.Has("blocks_booking") || restriction.SystemKey != ""
+	restriction.GuestVisible = form.Has("guest_visible")
+
+	if restriction.ID == 0 {
+		_, err = rep.DB.InsertRestriction(r.Context(), restriction)
+	} else {
+		err = rep.DB.UpdateRestriction(r.Context(), restriction)
+	}
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	rep.App.Session.Put(r.Context(), "flash", "Restriction type saved")
+	http.Redirect(w, r, "/admin/restrictions", http.StatusSeeOther)
+}
+
+// AdminDeleteRestriction deletes a restriction type that nothing uses
+func (rep *Repository) AdminDeleteRestriction(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	err = rep.DB.DeleteRestriction(r.Context(), id)
+	if errors.Is(err, repository.ErrRestrictionInUse) {
+		rep.App.Session.Put(r.Context(), "error", "This type is still in use and cannot be deleted")
+		http.Redirect(w, r, "/admin/restrictions", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	rep.App.Session.Put(r.Context(), "flash", "Restriction type deleted")
+	http.Redirect(w, r, "/admin/restrictions", http.StatusSeeOther)
+}
@@ -2,16 +2,24 @@ package handlers
 
 import (
 	"bookings/internal/config"
+	"bookings/internal/helpers"
+	"bookings/internal/mailer"
 	"bookings/internal/models"
+	"bookings/internal/pricing"
 	"bookings/internal/render"
+	"bookings/internal/repository"
+	"bookings/internal/repository/dbrepo"
+	"context"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"github.com/alexedwards/scs/v2"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/justinas/nosurf"
+	"golang.org/x/crypto/bcrypt"
 	"html/template"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -27,6 +35,7 @@ var functions = template.FuncMap{
 	"formatDate": render.FormatDate,
 	"iterate":    render.Iterate,
 	"add":        render.Add,
+	"money":      pricing.Format,
 }
 
 func TestMain(m *testing.M) {
@@ -38,10 +47,9 @@ func TestMain(m *testing.M) {
 	gob.Register(map[string]int{})
 
 	app.InProduction = false
-	infoLog := log.New(os.Stdout, "INFO:\t", log.Ldate|log.Ltime)
-	app.InfoLog = infoLog
-	errorLog := log.New(os.Stdout, "ERROR\t", log.Ldate|log.Ldate|log.Lshortfile)
-	app.ErrorLog = errorLog
+	app.MailFrom = "me@here.com"
+	app.OwnerEmail = "me@here.com"
+	app.Logger = slog.New(slog.NewTextHandler(os.Stdout, nil))
 
 	session = scs.New()
 	session.Lifetime = 24 * time.Hour
@@ -50,12 +58,6 @@ func TestMain(m *testing.M) {
 	session.Cookie.Secure = app.InProduction
 	app.Session = session
 
-	mailChan := make(chan models.MailData)
-	app.MailChan = mailChan
-	defer close(mailChan)
-
-	listenForMail()
-
 	templateCache, err := CreateTestTemplateCache()
 	returnError(err)
 
@@ -63,20 +65,14 @@ func TestMain(m *testing.M) {
 	app.UseCache = true
 
 	repo := NewTestRepo(&app)
+	// mail is queued in the test repository but never sent
+	app.Mail = mailer.New(repo.DB, nil, app.Logger)
 
 	NewHandlers(repo)
 	render.NewRenderer(&app)
 	os.Exit(m.Run())
 }
 
-func listenForMail() {
-	go func() {
-		for {
-			_ = <-app.MailChan
-		}
-	}()
-}
-
 func getRoutes() http.Handler {
 
 	mux := chi.NewRouter()
@@ -88,12 +84,21 @@ func getRoutes() http.Handler {
 	mux.Get("/contact", Repo.Contact)
 	mux.Get("/colonels-suite", Repo.ColonelsSuite)
 	mux.Get("/generals-quarters", Repo.GeneralsQuarters)
+	mux.Get("/rooms", Repo.Rooms)
+	mux.Get("/rooms/{slug}", Repo.Room)
+	mux.Get("/rooms/{slug}/calendar.ics", Repo.RoomCalendar)
+	mux.Get("/healthz", Repo.Healthz)
+	mux.Get("/readyz", Repo.Readyz)
 
 	mux.Get("/make-reservation", Repo.MakeReservation)
 	mux.Post("/make-reservation", Repo.PostReservation)
 
 	mux.Get("/reservation-summary", Repo.ReservationSummary)
 
+	mux.Get("/reservations/{code}", Repo.ManageReservation)
+	mux.Post("/reservations/{code}", Repo.PostManageReservation)
+	mux.Post("/reservations/{code}/cancel", Repo.CancelReservation)
+
 	mux.Get("/search-availability", Repo.SearchAvailability)
 	mux.Post("/search-availability", Repo.PostAvailability)
 	mux.Post("/search-availability-json", Repo.AvailabilityJSON)
@@ -101,18 +106,76 @@ func getRoutes() http.Handler {
 	mux.Get("/user/login", Repo.ShowLogin)
 	mux.Post("/user/login", Repo.PostShowLogin)
 	mux.Get("/user/logout", Repo.Logout)
+	mux.Get("/user/forgot-password", Repo.ShowForgotPassword)
+	mux.Post("/user/forgot-password", Repo.PostForgotPassword)
+	mux.Get("/user/set-password/{token}", Repo.ShowSetPassword)
+	mux.Post("/user/set-password/{token}", Repo.PostSetPassword)
+	mux.Get("/user/password", Repo.ShowChangePassword)
+	mux.Post("/user/password", Repo.PostChangePassword)
 
 	mux.Get("/admin/dashboard", Repo.AdminDashboard)
 	mux.Get("/admin/reservations-new", Repo.AdminNewReservations)
 	mux.Get("/admin/reservations-all", Repo.AdminAllReservations)
+	mux.Get("/admin/reservations-export", Repo.AdminExportReservations)
+	mux.Get("/admin/occupancy-export", Repo.AdminExportOccupancy)
 	mux.Get("/admin/reservations-calendar", Repo.AdminCalendarReservations)
-	mux.Post("/admin/reservations-calendar", Repo.AdminCalendarPostReservations)
+	mux.Get("/admin/blocks/{id}", Repo.AdminShowBlock)
+	mux.Post("/admin/blocks/{id}", Repo.AdminPostBlock)
+	mux.Get("/admin/blocks/{id}/delete/do", Repo.AdminDeleteBlock)
+	mux.Get("/admin/mail", Repo.AdminMail)
+	mux.Get("/admin/mail/{id}/resend/do", Repo.AdminResendMail)
+	mux.Get("/admin/restrictions", Repo.AdminRestrictions)
+	mux.Post("/admin/restrictions/{id}", Repo.AdminPostRestriction)
+	mux.Get("/admin/restrictions/{id}/delete/do", Repo.AdminDeleteRestriction)
 
 	mux.Get("/admin/reservations/{src}/{id}/show", Repo.AdminShowReservation)
 	mux.Post("/admin/reservations/{src}/{id}", Repo.AdminPostShowReservation)
 	mux.Get("/admin/process-reservation/{src}/{id}/do", Repo.AdminProcessReservation)
 	mux.Get("/admin/delete-reservation/{src}/{id}/do", Repo.AdminDeleteReservation)
 
+	mux.Get("/admin/rooms", Repo.AdminRooms)
+	mux.Get("/admin/rooms/{id}", Repo.AdminShowRoom)
+	mux.Post("/admin/rooms/{id}", Repo.AdminPostRoom)
+	mux.Get("/admin/rooms/{id}/delete/do", Repo.AdminDeleteRoom)
+	mux.Post("/admin/rooms/{id}/seasons", Repo.AdminPostSeasonalRate)
+	mux.Get("/admin/rooms/{id}/seasons/{season}/delete/do", Repo.AdminDeleteSeasonalRate)
+	mux.Get("/admin/rooms/{id}/ical-token/do", Repo.AdminRegenerateICalToken)
+	mux.Post("/admin/rooms/{id}/feeds", Repo.AdminPostICalFeed)
+	mux.Get("/admin/rooms/{id}/feeds/{feed}/sync/do", Repo.AdminSyncICalFeed)
+	mux.Get("/admin/rooms/{id}/feeds/{feed}/delete/do", Repo.AdminDeleteICalFeed)
+
+	mux.Get("/admin/api-tokens", Repo.AdminAPITokens)
+	mux.Post("/admin/api-tokens", Repo.AdminPostAPIToken)
+	mux.Get("/admin/api-tokens/{id}/delete/do", Repo.AdminDeleteAPIToken)
+
+	mux.Get("/admin/users", Repo.AdminUsers)
+	mux.Post("/admin/users", Repo.AdminPostUser)
+	mux.Post("/admin/users/{id}", Repo.AdminPostUserAccess)
+	mux.Get("/admin/users/{id}/disable/do", Repo.AdminDisableUser)
+	mux.Get("/admin/users/{id}/enable/do", Repo.AdminEnableUser)
+	mux.Get("/admin/users/{id}/unlock/do", Repo.AdminUnlockUser)
+	mux.Get("/admin/login-attempts", Repo.AdminLoginAttempts)
+
+	mux.Route("/api/v1", func(mux chi.Router) {
+		mux.NotFound(Repo.APINotFound)
+		mux.Get("/rooms", Repo.APIRooms)
+		mux.Get("/rooms/{id}", Repo.APIRoom)
+		mux.Get("/rooms/{id}/availability", Repo.APIRoomAvailability)
+		mux.Get("/rooms/{id}/quote", Repo.APIRoomQuote)
+		mux.Get("/availability", Repo.APIAvailability)
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(Repo.APIAuth)
+			mux.Post("/reservations", Repo.APICreateReservation)
+			mux.Get("/reservations/{id}", Repo.APIReservation)
+			mux.Group(func(mux chi.Router) {
+				mux.Use(Repo.APIRequireAccess(models.AccessStaff))
+				mux.Delete("/reservations/{id}", Repo.APICancelReservation)
+				mux.Get("/admin/reservations", Repo.APIAdminReservations)
+			})
+		})
+	})
+
 	fileServer := http.FileServer(http.Dir("./static/"))
 	mux.Handle("/static/*", http.StripPrefix("/static", fileServer))
 	return mux
@@ -135,6 +198,91 @@ func SessionLoad(next http.Handler) http.Handler {
 	return session.LoadAndSave(next)
 }
 
+// useMemoryRepo points the handlers, and the mail they queue, at a fresh memory repository holding what a newly
+// migrated database does, and puts the test repository back when the test ends
+func useMemoryRepo(t *testing.T) repository.DatabaseRepo {
+	t.Helper()
+	db := dbrepo.NewMemoryRepo(&app)
+	testRepo, testMail := Repo.DB, app.Mail
+	Repo.DB, app.Mail = db, mailer.New(db, nil, app.Logger)
+	t.Cleanup(func() { Repo.DB, app.Mail = testRepo, testMail })
+	return db
+}
+
+// useFixtures is useMemoryRepo with a small hotel's worth of data, inserted in this order so its ids are known:
+//
+//   - users 1 me@here.com (owner), 2 staff@here.com (staff) and 3 partner@here.com (read only), all with the
+//     password "password"; the staff user has an invitation with the token "valid-token"
+//   - api tokens "valid-token" for the owner and "read-only-token" for the partner
+//   - restriction type 4, "Renovation", which the owners added themselves
+//   - block 1, room 1 from 2050-03-10 to 2050-03-12
+//   - reservation 1, "valid-code", John Smith in room 1 from 2050-06-01 to 2050-06-03
+//   - reservation 2, "past-code", a stay in room 2 that is over
+//   - reservation 3, "taken-code", room 1 from 2060-01-01 to 2060-01-03
+//   - a three night minimum stay in room 1 throughout 2070
+//   - room 1's calendar feed token "valid-ical-token"
+func useFixtures(t *testing.T) repository.DatabaseRepo {
+	t.Helper()
+	db := useMemoryRepo(t)
+	ctx := context.Background()
+	day := func(y int, m time.Month, d int) time.Time { return time.Date(y, m, d, 0, 0, 0, 0, time.UTC) }
+	check := func(_ int, err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	for _, u := range []models.User{
+		{FirstName: "Admin", LastName: "User", Email: "me@here.com", AccessLevel: models.AccessOwner},
+		{FirstName: "Staff", LastName: "User", Email: "staff@here.com", AccessLevel: models.AccessStaff},
+		{FirstName: "Pat", LastName: "Partner", Email: "partner@here.com", AccessLevel: models.AccessReadOnly},
+	} {
+		u.Password = string(hash)
+		check(db.InsertUser(ctx, u))
+	}
+	check(0, db.InsertPasswordToken(ctx, models.PasswordToken{UserID: 2, TokenHash: helpers.HashToken("valid-token"),
+		Purpose: models.PasswordTokenInvite, ExpiresAt: time.Now().Add(time.Hour)}))
+	check(db.InsertAPIToken(ctx, models.APIToken{UserID: 1, Name: "widget", TokenHash: helpers.HashToken("valid-token")}))
+	check(db.InsertAPIToken(ctx, models.APIToken{UserID: 3, Name: "partner",
+		TokenHash: helpers.HashToken("read-only-token")}))
+
+	check(db.InsertRestriction(ctx, models.Restriction{RestrictionName: "Renovation", Colour: "#6c757d",
+		BlocksBooking: true}))
+	check(db.InsertBlock(ctx, models.RoomRestriction{RoomID: 1, RestrictionID: 2, StartDate: day(2050, 3, 10),
+		EndDate: day(2050, 3, 12), Note: "Cleaning"}))
+
+	for _, res := range []models.Reservation{
+		{FirstName: "John", LastName: "Smith", Email: "john@smith.com", Phone: "555-555-5555", RoomID: 1,
+			StartDate: day(2050, 6, 1), EndDate: day(2050, 6, 3), ConfirmationCode: "valid-code"},
+		{FirstName: "Jane", LastName: "Smith", Email: "jane@smith.com", Phone: "555-555-5555", RoomID: 2,
+			StartDate: day(2020, 1, 1), EndDate: day(2020, 1, 3), ConfirmationCode: "past-code"},
+		{FirstName: "Jack", LastName: "Jones", Email: "jack@jones.com", Phone: "555-555-5555", RoomID: 1,
+			StartDate: day(2060, 1, 1), EndDate: day(2060, 1, 3), ConfirmationCode: "taken-code"},
+	} {
+		check(db.BookRoom(ctx, res))
+	}
+
+	check(db.InsertSeasonalRate(ctx, models.SeasonalRate{RoomID: 1, Name: "Festival", StartDate: day(2070, 1, 1),
+		EndDate: day(2071, 1, 1), NightlyRate: 20000, MinStay: 3}))
+	check(0, db.UpdateRoomICalToken(ctx, 1, "valid-ical-token"))
+	return db
+}
+
+// brokenRepo fails to look up or book reservations, as a database that has gone away would
+type brokenRepo struct {
+	repository.DatabaseRepo
+}
+
+func (brokenRepo) GetReservationById(ctx context.Context, id int) (models.Reservation, error) {
+	return models.Reservation{}, errors.New("connection refused")
+}
+
+func (brokenRepo) BookRoom(ctx context.Context, res models.Reservation) (int, error) {
+	return 0, errors.New("connection refused")
+}
+
 func returnError(err error) error {
 	return err
 }
@@ -0,0 +1,485 @@
+package handlers
+
+import (
+	"bookings/internal/email"
+	"bookings/internal/forms"
+	"bookings/internal/helpers"
+	"bookings/internal/models"
+	"bookings/internal/render"
+	"bookings/internal/repository"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// inviteLifetime and resetLifetime are how long the links in invitation and password reset emails work for
+const (
+	inviteLifetime = 7 * 24 * time.Hour
+	resetLifetime  = time.Hour
+)
+
+// minPasswordLength is the shortest password a user may choose
+const minPasswordLength = 10
+
+// Brute force protection for the login form. Past a few failures, for one email address or from one ip address,
+// each further failure doubles how long the next attempt has to wait, and too many for one account locks it
+const (
+	// loginWindow is how far back failed logins are counted
+	loginWindow = 15 * time.Minute
+	// freeEmailFailures and freeIPFailures are how many failures are allowed before attempts have to wait
+	freeEmailFailures = 3
+	freeIPFailures    = 10
+	maxLoginBackoff   = 5 * time.Minute
+	// lockoutFailures failures for one account within the window lock it for lockoutDuration
+	lockoutFailures = 10
+	lockoutDuration = 30 * time.Minute
+)
+
+// loginBackoff returns how long to wait after the last of a number of failures, starting at one second once
+// the free failures are used up and doubling with every failure after that
+func loginBackoff(failures, free int) time.Duration {
+	if failures < free {
+		return 0
+	}
+	n := failures - free
+	if n >= 16 {
+		return maxLoginBackoff
+	}
+	d := time.Second << n
+	if d > maxLoginBackoff {
+		d = maxLoginBackoff
+	}
+	return d
+}
+
+// loginWait returns how much longer a login has to wait given recent failures, or zero if it may go ahead
+func loginWait(f models.LoginFailures, now time.Time) time.Duration {
+	wait := f.LastByEmail.Add(loginBackoff(f.ByEmail, freeEmailFailures)).Sub(now)
+	if ipWait := f.LastByIP.Add(loginBackoff(f.ByIP, freeIPFailures)).Sub(now); ipWait > wait {
+		wait = ipWait
+	}
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+// recordLogin stores a login attempt. Failing to store one is logged rather than getting in the way of the login
+func (rep *Repository) recordLogin(r *http.Request, email, ip, outcome string) {
+	err := rep.DB.InsertLoginAttempt(r.Context(), models.LoginAttempt{
+		Email:     email,
+		IPAddress: ip,
+		Outcome:   outcome,
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		helpers.Logger(r.Context()).Error("recording login attempt", "error", err)
+	}
+}
+
+// AdminUsers lists the users of the admin area, with a form to invite new ones
+func (rep *Repository) AdminUsers(w http.ResponseWriter, r *http.Request) {
+	rep.renderAdminUsers(w, r, forms.New(nil))
+}
+
+func (rep *Repository) renderAdminUsers(w http.ResponseWriter, r *http.Request, form *forms.Form) {
+	users, err := rep.DB.AllUsers(r.Context())
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["users"] = users
+	data["now"] = time.Now()
+
+	intMap := make(map[string]int)
+	intMap["user_id"] = rep.App.Session.GetInt(r.Context(), "user_id")
+
+	_ = render.Template(w, r, "admin-users.page.tmpl", &models.TemplateData{
+		Data:   data,
+		IntMap: intMap,
+		Form:   form,
+	})
+}
+
+// AdminPostUser invites a new user, who is emailed a link to choose their password
+func (rep *Repository) AdminPostUser(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("first_name", "last_name", "email", "access_level")
+	form.IsEmail("email")
+
+	accessLevel, err := strconv.Atoi(form.Get("access_level"))
+	if err != nil || accessLevel < models.AccessReadOnly || accessLevel > models.AccessOwner {
+		form.Errors.Add("access_level", "Choose an access level")
+	}
+
+	if form.Get("email") != "" {
+		if _, err := rep.DB.GetUserByEmail(r.Context(), form.Get("email")); err == nil {
+			form.Errors.Add("email", "There is already a user with this email address")
+		}
+	}
+
+	if !form.Valid() {
+		rep.renderAdminUsers(w, r, form)
+		return
+	}
+
+	// invited users can't log in until they have chosen a password from the link we email them
+	unusable, err := helpers.RandomToken(32)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+	hashedPassword, err := helpers.HashPassword(unusable)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	user := models.User{
+		FirstName:   form.Get("first_name"),
+		LastName:    form.Get("last_name"),
+		Email:       form.Get("email"),
+		Password:    hashedPassword,
+		AccessLevel: accessLevel,
+	}
+	user.ID, err = rep.DB.InsertUser(r.Context(), user)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	err = rep.sendPasswordLink(r.Context(), user, models.PasswordTokenInvite)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	rep.App.Session.Put(r.Context(), "flash", fmt.Sprintf("Invitation sent to %s", user.Email))
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+// AdminPostUserAccess changes a user's access level
+func (rep *Repository) AdminPostUserAccess(w http.ResponseWriter, r *http.Request) {
+	user, ok := rep.otherUser(w, r)
+	if !ok {
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	accessLevel, err := strconv.Atoi(r.Form.Get("access_level"))
+	if err != nil || accessLevel < models.AccessReadOnly || accessLevel > models.AccessOwner {
+		rep.App.Session.Put(r.Context(), "error", "Choose an access level")
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return
+	}
+
+	user.AccessLevel = accessLevel
+	err = rep.DB.UpdateUser(r.Context(), user)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	rep.App.Session.Put(r.Context(), "flash", fmt.Sprintf("Access level changed for %s", user.Email))
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+// AdminDisableUser stops a user from logging in or using their api tokens
+func (rep *Repository) AdminDisableUser(w http.ResponseWriter, r *http.Request) {
+	rep.setUserDisabled(w, r, true)
+}
+
+// AdminEnableUser lets a disabled user log in again
+func (rep *Repository) AdminEnableUser(w http.ResponseWriter, r *http.Request) {
+	rep.setUserDisabled(w, r, false)
+}
+
+func (rep *Repository) setUserDisabled(w http.ResponseWriter, r *http.Request, disabled bool) {
+	user, ok := rep.otherUser(w, r)
+	if !ok {
+		return
+	}
+
+	err := rep.DB.SetUserDisabled(r.Context(), user.ID, disabled)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	if disabled {
+		rep.App.Session.Put(r.Context(), "flash", fmt.Sprintf("%s has been disabled", user.Email))
+	} else {
+		rep.App.Session.Put(r.Context(), "flash", fmt.Sprintf("%s has been enabled", user.Email))
+	}
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+// AdminUnlockUser lifts the lockout on an account straight away, rather than waiting for it to run out
+func (rep *Repository) AdminUnlockUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := rep.otherUser(w, r)
+	if !ok {
+		return
+	}
+
+	err := rep.DB.UnlockUser(r.Context(), user.ID)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	rep.App.Session.Put(r.Context(), "flash", fmt.Sprintf("%s has been unlocked", user.Email))
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+// AdminLoginAttempts lists the latest logins that failed, were throttled or hit a locked account
+func (rep *Repository) AdminLoginAttempts(w http.ResponseWriter, r *http.Request) {
+	attempts, err := rep.DB.RecentFailedLogins(r.Context(), 200)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["attempts"] = attempts
+
+	_ = render.Template(w, r, "admin-login-attempts.page.tmpl", &models.TemplateData{
+		Data: data,
+	})
+}
+
+// otherUser loads the user named in the url for the user admin actions, which owners may not use on
+// themselves so that there is always an owner left who can log in
+func (rep *Repository) otherUser(w http.ResponseWriter, r *http.Request) (models.User, bool) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return models.User{}, false
+	}
+
+	if id == rep.App.Session.GetInt(r.Context(), "user_id") {
+		rep.App.Session.Put(r.Context(), "error", "You can't change your own account here")
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return models.User{}, false
+	}
+
+	user, err := rep.DB.GetUserById(r.Context(), id)
+	if err != nil {
+		rep.App.Session.Put(r.Context(), "error", "Can't find that user")
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return models.User{}, false
+	}
+	return user, true
+}
+
+// sendPasswordLink emails a user a single use link to set their password
+func (rep *Repository) sendPasswordLink(ctx context.Context, user models.User, purpose string) error {
+	token, err := helpers.RandomToken(32)
+	if err != nil {
+		return err
+	}
+
+	lifetime := resetLifetime
+	if purpose == models.PasswordTokenInvite {
+		lifetime = inviteLifetime
+	}
+
+	err = rep.DB.InsertPasswordToken(ctx, models.PasswordToken{
+		UserID:    user.ID,
+		TokenHash: helpers.HashToken(token),
+		Purpose:   purpose,
+		ExpiresAt: time.Now().Add(lifetime),
+	})
+	if err != nil {
+		return err
+	}
+
+	link := rep.App.BaseURL + "/user/set-password/" + token
+
+	if purpose == models.PasswordTokenInvite {
+		return rep.sendMail(ctx, user.Email, email.Invitation{User: user, Link: link, Days: int(lifetime.Hours() / 24)})
+	}
+	return rep.sendMail(ctx, user.Email, email.PasswordReset{User: user, Link: link})
+}
+
+// ShowForgotPassword displays the form for asking for a password reset link
+func (rep *Repository) ShowForgotPassword(w http.ResponseWriter, r *http.Request) {
+	_ = render.Template(w, r, "forgot-password.page.tmpl", &models.TemplateData{
+		Form: forms.New(nil),
+	})
+}
+
+// PostForgotPassword emails a password reset link. It answers the same whether or not the address belongs
+// to a user, so the form can't be used to find out who has an account
+func (rep *Repository) PostForgotPassword(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("email")
+	form.IsEmail("email")
+	if !form.Valid() {
+		_ = render.Template(w, r, "forgot-password.page.tmpl", &models.TemplateData{
+			Form: form,
+		})
+		return
+	}
+
+	user, err := rep.DB.GetUserByEmail(r.Context(), form.Get("email"))
+	if err == nil && !user.Disabled {
+		err = rep.sendPasswordLink(r.Context(), user, models.PasswordTokenReset)
+		if err != nil {
+			helpers.ServerError(w, r, err)
+			return
+		}
+	}
+
+	rep.App.Session.Put(r.Context(), "flash", "If that address has an account, we've emailed it a reset link")
+	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+}
+
+// ShowSetPassword displays the form for choosing a password from an invitation or reset link
+func (rep *Repository) ShowSetPassword(w http.ResponseWriter, r *http.Request) {
+	token := chi.URLParam(r, "token")
+	pt, err := rep.DB.GetPasswordToken(r.Context(), helpers.HashToken(token))
+	if err != nil {
+		rep.App.Session.Put(r.Context(), "error", repository.ErrInvalidToken.Error())
+		http.Redirect(w, r, "/user/forgot-password", http.StatusSeeOther)
+		return
+	}
+
+	rep.renderSetPassword(w, r, token, pt, forms.New(nil))
+}
+
+func (rep *Repository) renderSetPassword(w http.ResponseWriter, r *http.Request, token string,
+	pt models.PasswordToken, form *forms.Form) {
+	data := make(map[string]interface{})
+	data["password_token"] = pt
+
+	stringMap := make(map[string]string)
+	stringMap["token"] = token
+
+	_ = render.Template(w, r, "set-password.page.tmpl", &models.TemplateData{
+		Data:      data,
+		StringMap: stringMap,
+		Form:      form,
+	})
+}
+
+// PostSetPassword sets a user's password from an invitation or reset link, and uses the link up
+func (rep *Repository) PostSetPassword(w http.ResponseWriter, r *http.Request) {
+	token := chi.URLParam(r, "token")
+	pt, err := rep.DB.GetPasswordToken(r.Context(), helpers.HashToken(token))
+	if err != nil {
+		rep.App.Session.Put(r.Context(), "error", repository.ErrInvalidToken.Error())
+		http.Redirect(w, r, "/user/forgot-password", http.StatusSeeOther)
+		return
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("password", "password_confirm")
+	form.MinLength("password", minPasswordLength)
+	form.Matches("password_confirm", "password")
+	if !form.Valid() {
+		rep.renderSetPassword(w, r, token, pt, form)
+		return
+	}
+
+	hashedPassword, err := helpers.HashPassword(form.Get("password"))
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	err = rep.DB.ResetPassword(r.Context(), pt.TokenHash, hashedPassword)
+	if errors.Is(err, repository.ErrInvalidToken) {
+		rep.App.Session.Put(r.Context(), "error", err.Error())
+		http.Redirect(w, r, "/user/forgot-password", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	rep.App.Session.Put(r.Context(), "flash", "Your password has been set, please log in")
+	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+}
+
+// ShowChangePassword displays the form for logged in users to change their password
+func (rep *Repository) ShowChangePassword(w http.ResponseWriter, r *http.Request) {
+	_ = render.Template(w, r, "change-password.page.tmpl", &models.TemplateData{
+		Form: forms.New(nil),
+	})
+}
+
+// PostChangePassword changes the logged in user's password, after checking their current one
+func (rep *Repository) PostChangePassword(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	user, err := rep.DB.GetUserById(r.Context(), rep.App.Session.GetInt(r.Context(), "user_id"))
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("current_password", "password", "password_confirm")
+	form.MinLength("password", minPasswordLength)
+	form.Matches("password_confirm", "password")
+	if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(form.Get("current_password"))) != nil {
+		form.Errors.Add("current_password", "Your current password is not correct")
+	}
+
+	if !form.Valid() {
+		_ = render.Template(w, r, "change-password.page.tmpl", &models.TemplateData{
+			Form: form,
+		})
+		return
+	}
+
+	hashedPassword, err := helpers.HashPassword(form.Get("password"))
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	err = rep.DB.UpdatePassword(r.Context(), user.ID, hashedPassword)
+	if err != nil {
+		helpers.ServerError(w, r, err)
+		return
+	}
+
+	rep.App.Session.Put(r.Context(), "flash", "Your password has been changed")
+	http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+}
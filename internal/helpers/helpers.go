@@ -2,34 +2,99 @@ package helpers
 
 import (
 	"bookings/internal/config"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"net"
 	"net/http"
 	"runtime/debug"
 )
 
 var app *config.AppConfig
 
+// PasswordCost is the bcrypt cost new password hashes are made with. Raising it upgrades existing
+// hashes the next time their users log in
+const PasswordCost = 12
+
 // NewHelpers sets a new app config for helpers
 func NewHelpers(a *config.AppConfig) {
 	app = a
 }
 
-func ClientError(w http.ResponseWriter, status int) {
-	app.InfoLog.Println("Client error with status of ", status)
+// ClientError responds with a 4xx status, which is logged at debug level as it is not the site's fault
+func ClientError(w http.ResponseWriter, r *http.Request, status int) {
+	Logger(r.Context()).Debug("client error", "status", status)
 	http.Error(w, http.StatusText(status), status)
 }
 
-func ServerError(w http.ResponseWriter, err error) {
-	trace := fmt.Sprintf("%s\n%s", err.Error(), debug.Stack())
-	app.ErrorLog.Println(trace)
-	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+// ServerError logs an error along with the stack, and responds with a 500 page that gives the request id, so that
+// a user reporting the problem can be matched with the log
+func ServerError(w http.ResponseWriter, r *http.Request, err error) {
+	id := RequestID(r.Context())
+	Logger(r.Context()).Error(err.Error(), "stack", string(debug.Stack()))
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusInternalServerError)
+	if id == "" {
+		fmt.Fprintln(w, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	fmt.Fprintf(w, "%s\nRequest ID: %s\n", http.StatusText(http.StatusInternalServerError), id)
 }
 
-func ParseError(err error) {
-	app.ErrorLog.Println("cannot parse string")
+// ParseError logs a form value that could not be parsed
+func ParseError(r *http.Request, err error) {
+	Logger(r.Context()).Warn("cannot parse form value", "error", err)
 }
 
 func IsAuthenticated(r *http.Request) bool {
 	exists := app.Session.Exists(r.Context(), "user_id")
 	return exists
 }
+
+// HasAccess reports whether the logged in user's access level is at least level
+func HasAccess(r *http.Request, level int) bool {
+	return app.Session.GetInt(r.Context(), "access_level") >= level
+}
+
+// ClientIP returns the ip address a request came from
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// RandomToken returns a hex encoded, cryptographically random token of n bytes
+func RandomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// HashToken returns the sha256 hash of a token, so that only the hash needs to be stored
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// HashPassword returns the bcrypt hash of a password
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), PasswordCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// NeedsRehash reports whether a bcrypt hash was made with a lower cost than PasswordCost
+func NeedsRehash(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err == nil && cost < PasswordCost
+}
@@ -0,0 +1,49 @@
+package helpers
+
+import (
+	"context"
+	"log/slog"
+)
+
+type contextKey int
+
+const requestInfoKey contextKey = iota
+
+// RequestInfo is what the request log records about a request that is only learned while handling it
+type RequestInfo struct {
+	ID     string
+	UserID int
+}
+
+// WithRequestInfo returns a context carrying info, which handlers further in fill in
+func WithRequestInfo(ctx context.Context, info *RequestInfo) context.Context {
+	return context.WithValue(ctx, requestInfoKey, info)
+}
+
+// RequestID returns the id of the request a context belongs to, or "" outside a request
+func RequestID(ctx context.Context) string {
+	if info, ok := ctx.Value(requestInfoKey).(*RequestInfo); ok {
+		return info.ID
+	}
+	return ""
+}
+
+// SetRequestUser records which user made a request, for the request log
+func SetRequestUser(ctx context.Context, userID int) {
+	if info, ok := ctx.Value(requestInfoKey).(*RequestInfo); ok {
+		info.UserID = userID
+	}
+}
+
+// Logger returns the application's logger, or the default one before the application has set it up, tagged
+// with the request id when ctx belongs to a request
+func Logger(ctx context.Context) *slog.Logger {
+	logger := slog.Default()
+	if app != nil && app.Logger != nil {
+		logger = app.Logger
+	}
+	if id := RequestID(ctx); id != "" {
+		return logger.With("request_id", id)
+	}
+	return logger
+}
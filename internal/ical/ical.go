@@ -0,0 +1,116 @@
+// Package ical reads and writes iCalendar (RFC 5545) feeds of all-day events, so that rooms can share occupancy
+// with other booking platforms
+package ical
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	dateLayout     = "20060102"
+	dateTimeLayout = "20060102T150405Z"
+	// maxLineOctets is the longest a content line may be before it has to be folded
+	maxLineOctets = 75
+)
+
+// Calendar is an iCalendar object holding events
+type Calendar struct {
+	// ProdID identifies the product that created the calendar
+	ProdID string
+	// Name is shown by calendar apps that support the X-WR-CALNAME extension
+	Name   string
+	Events []Event
+}
+
+// Event is an all-day event. End is exclusive, like a reservation's departure date
+type Event struct {
+	UID     string
+	Summary string
+	Start   time.Time
+	End     time.Time
+	// Stamp is when the event was last changed
+	Stamp time.Time
+}
+
+// Encode writes the calendar to w in iCalendar format
+func (c Calendar) Encode(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	lw := &lineWriter{w: bw}
+
+	lw.line("BEGIN:VCALENDAR")
+	lw.line("VERSION:2.0")
+	lw.line("PRODID:" + escapeText(c.ProdID))
+	lw.line("CALSCALE:GREGORIAN")
+	lw.line("METHOD:PUBLISH")
+	if c.Name != "" {
+		lw.line("X-WR-CALNAME:" + escapeText(c.Name))
+	}
+	for _, e := range c.Events {
+		lw.line("BEGIN:VEVENT")
+		lw.line("UID:" + escapeText(e.UID))
+		lw.line("DTSTAMP:" + e.Stamp.UTC().Format(dateTimeLayout))
+		lw.line("DTSTART;VALUE=DATE:" + e.Start.Format(dateLayout))
+		lw.line("DTEND;VALUE=DATE:" + e.End.Format(dateLayout))
+		lw.line("SUMMARY:" + escapeText(e.Summary))
+		lw.line("TRANSP:OPAQUE")
+		lw.line("END:VEVENT")
+	}
+	lw.line("END:VCALENDAR")
+
+	if lw.err != nil {
+		return lw.err
+	}
+	return bw.Flush()
+}
+
+// lineWriter writes content lines ending in CRLF, folding the ones that are too long, and keeps the first error
+type lineWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (lw *lineWriter) line(s string) {
+	if lw.err != nil {
+		return
+	}
+	_, lw.err = io.WriteString(lw.w, fold(s)+"\r\n")
+}
+
+// fold splits a content line into lines of at most maxLineOctets octets, each continuation starting with a space.
+// It never splits a multi-byte character
+func fold(s string) string {
+	if len(s) <= maxLineOctets {
+		return s
+	}
+
+	var b strings.Builder
+	limit := maxLineOctets
+	n := 0
+	for _, r := range s {
+		size := len(string(r))
+		if n+size > limit {
+			b.WriteString("\r\n ")
+			// the leading space counts towards the continuation line's length
+			limit = maxLineOctets - 1
+			n = 0
+		}
+		b.WriteRune(r)
+		n += size
+	}
+	return b.String()
+}
+
+// escapeText escapes the characters that have a meaning in iCalendar TEXT values
+func escapeText(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`)
+	return r.Replace(s)
+}
+
+// UID builds an event uid that is unique to the given kind and id on host
+func UID(kind string, id int, host string) string {
+	return fmt.Sprintf("%s-%d@%s", kind, id, host)
+}
@@ -0,0 +1,185 @@
+package ical
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCalendar_Encode(t *testing.T) {
+	cal := Calendar{
+		ProdID: "-//bookings//test//EN",
+		Name:   "General's Quarters",
+		Events: []Event{
+			{
+				UID:     UID("restriction", 7, "example.com"),
+				Summary: "Reserved",
+				Start:   time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC),
+				End:     time.Date(2050, 1, 3, 0, 0, 0, 0, time.UTC),
+				Stamp:   time.Date(2049, 12, 1, 10, 30, 0, 0, time.UTC),
+			},
+		},
+	}
+
+	var b strings.Builder
+	if err := cal.Encode(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := strings.Join([]string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//bookings//test//EN",
+		"CALSCALE:GREGORIAN",
+		"METHOD:PUBLISH",
+		"X-WR-CALNAME:General's Quarters",
+		"BEGIN:VEVENT",
+		"UID:restriction-7@example.com",
+		"DTSTAMP:20491201T103000Z",
+		"DTSTART;VALUE=DATE:20500101",
+		"DTEND;VALUE=DATE:20500103",
+		"SUMMARY:Reserved",
+		"TRANSP:OPAQUE",
+		"END:VEVENT",
+		"END:VCALENDAR",
+		"",
+	}, "\r\n")
+
+	if b.String() != expected {
+		t.Errorf("expected\n%q\nbut got\n%q", expected, b.String())
+	}
+}
+
+var escapeTests = []struct {
+	name     string
+	in       string
+	expected string
+}{
+	{"plain", "Blocked", "Blocked"},
+	{"comma", "Smith, John", `Smith\, John`},
+	{"semicolon", "a;b", `a\;b`},
+	{"backslash", `a\b`, `a\\b`},
+	{"newline", "a\nb", `a\nb`},
+	{"crlf", "a\r\nb", `a\nb`},
+}
+
+func TestEscapeText(t *testing.T) {
+	for _, e := range escapeTests {
+		if got := escapeText(e.in); got != e.expected {
+			t.Errorf("%s: expected %q but got %q", e.name, e.expected, got)
+		}
+	}
+}
+
+func TestFold(t *testing.T) {
+	short := strings.Repeat("a", maxLineOctets)
+	if fold(short) != short {
+		t.Errorf("a line of %d octets should not be folded", maxLineOctets)
+	}
+
+	// multi-byte characters must not be split across lines
+	long := "SUMMARY:" + strings.Repeat("é", 100)
+	folded := fold(long)
+	for _, line := range strings.Split(folded, "\r\n") {
+		if len(line) > maxLineOctets {
+			t.Errorf("line of %d octets is longer than %d", len(line), maxLineOctets)
+		}
+		if strings.ToValidUTF8(line, "") != line {
+			t.Errorf("line %q splits a character", line)
+		}
+	}
+	if strings.ReplaceAll(folded, "\r\n ", "") != long {
+		t.Error("unfolding did not give back the original line")
+	}
+}
+
+func TestParse(t *testing.T) {
+	in := strings.Join([]string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//channel//EN",
+		"BEGIN:VEVENT",
+		"UID:one@channel",
+		"DTSTART;VALUE=DATE:20500101",
+		"DTEND;VALUE=DATE:20500104",
+		"SUMMARY:Reserved\\, paid",
+		"BEGIN:VALARM",
+		"SUMMARY:alarm",
+		"END:VALARM",
+		"END:VEVENT",
+		"BEGIN:VEVENT",
+		"UID:two@chan",
+		" nel",
+		`DTSTART;TZID="Europe/London":20500110T150000`,
+		"DTEND;TZID=\"Europe/London\":20500112T110000",
+		"END:VEVENT",
+		"BEGIN:VEVENT",
+		"UID:three@channel",
+		"DTSTART;VALUE=DATE:20500120",
+		"END:VEVENT",
+		"BEGIN:VEVENT",
+		"UID:cancelled@channel",
+		"DTSTART;VALUE=DATE:20500201",
+		"DTEND;VALUE=DATE:20500203",
+		"STATUS:CANCELLED",
+		"END:VEVENT",
+		"END:VCALENDAR",
+	}, "\r\n")
+
+	events, err := Parse(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []struct {
+		uid     string
+		summary string
+		start   string
+		end     string
+	}{
+		{"one@channel", "Reserved, paid", "20500101", "20500104"},
+		{"two@channel", "", "20500110", "20500112"},
+		{"three@channel", "", "20500120", "20500121"},
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("expected %d events but got %d: %+v", len(expected), len(events), events)
+	}
+	for i, e := range expected {
+		got := events[i]
+		if got.UID != e.uid || got.Summary != e.summary ||
+			got.Start.Format(dateLayout) != e.start || got.End.Format(dateLayout) != e.end {
+			t.Errorf("event %d: expected %+v but got %+v", i, e, got)
+		}
+	}
+}
+
+func TestParse_NotCalendar(t *testing.T) {
+	_, err := Parse(strings.NewReader("<html></html>"))
+	if err != ErrNotCalendar {
+		t.Errorf("expected ErrNotCalendar but got %v", err)
+	}
+}
+
+func TestParse_RoundTrip(t *testing.T) {
+	cal := Calendar{
+		ProdID: "-//bookings//test//EN",
+		Events: []Event{{
+			UID:     "restriction-1@example.com",
+			Summary: strings.Repeat("a; b, c ", 20),
+			Start:   time.Date(2050, 3, 1, 0, 0, 0, 0, time.UTC),
+			End:     time.Date(2050, 3, 4, 0, 0, 0, 0, time.UTC),
+		}},
+	}
+	var b strings.Builder
+	if err := cal.Encode(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := Parse(strings.NewReader(b.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Summary != cal.Events[0].Summary || !events[0].End.Equal(cal.Events[0].End) {
+		t.Errorf("expected %+v back but got %+v", cal.Events, events)
+	}
+}
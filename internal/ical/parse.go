@@ -0,0 +1,150 @@
+package ical
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+	"time"
+)
+
+// ErrNotCalendar is returned when the input has no VCALENDAR object in it
+var ErrNotCalendar = errors.New("ical: not an iCalendar file")
+
+// Parse reads the events from an iCalendar file. Events are treated as all-day: times are dropped and only the
+// date is kept, an event without an end lasts one day, and cancelled events are left out
+func Parse(r io.Reader) ([]Event, error) {
+	lines, err := unfold(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var events []Event
+	var stack []string
+	var e Event
+	cancelled := false
+	found := false
+
+	for _, line := range lines {
+		name, value := splitLine(line)
+		switch name {
+		case "BEGIN":
+			component := strings.ToUpper(value)
+			if component == "VCALENDAR" {
+				found = true
+			}
+			if component == "VEVENT" {
+				e = Event{}
+				cancelled = false
+			}
+			stack = append(stack, component)
+			continue
+		case "END":
+			if len(stack) == 0 {
+				continue
+			}
+			component := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if component == "VEVENT" && !e.Start.IsZero() {
+				if !e.End.After(e.Start) {
+					e.End = e.Start.AddDate(0, 0, 1)
+				}
+				if e.UID == "" {
+					e.UID = e.Start.Format(dateLayout) + "-" + e.End.Format(dateLayout)
+				}
+				if !cancelled {
+					events = append(events, e)
+				}
+			}
+			continue
+		}
+
+		// only properties that belong to the event itself matter, not those of its alarms
+		if len(stack) == 0 || stack[len(stack)-1] != "VEVENT" {
+			continue
+		}
+
+		switch name {
+		case "UID":
+			e.UID = value
+		case "SUMMARY":
+			e.Summary = unescapeText(value)
+		case "DTSTART":
+			e.Start, err = parseDate(value)
+			if err != nil {
+				return nil, err
+			}
+		case "DTEND":
+			e.End, err = parseDate(value)
+			if err != nil {
+				return nil, err
+			}
+		case "DTSTAMP", "LAST-MODIFIED":
+			if t, err := time.Parse(dateTimeLayout, value); err == nil && t.After(e.Stamp) {
+				e.Stamp = t
+			}
+		case "STATUS":
+			cancelled = strings.EqualFold(value, "CANCELLED")
+		}
+	}
+
+	if !found {
+		return nil, ErrNotCalendar
+	}
+	return events, nil
+}
+
+// unfold reads content lines, joining the continuation lines that start with a space or tab onto the line before
+func unfold(r io.Reader) ([]string, error) {
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return lines, nil
+}
+
+// splitLine splits a content line into its upper cased name and its value, dropping any parameters.
+// Colons inside quoted parameter values do not end the parameters
+func splitLine(line string) (name, value string) {
+	quoted := false
+	for i, c := range line {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == ':' && !quoted:
+			name = line[:i]
+			if j := strings.IndexByte(name, ';'); j >= 0 {
+				name = name[:j]
+			}
+			return strings.ToUpper(name), line[i+1:]
+		}
+	}
+	return strings.ToUpper(line), ""
+}
+
+// parseDate reads the date from a DATE or DATE-TIME value, ignoring the time of day
+func parseDate(value string) (time.Time, error) {
+	if len(value) < len(dateLayout) {
+		return time.Time{}, errors.New("ical: invalid date " + value)
+	}
+	return time.Parse(dateLayout, value[:len(dateLayout)])
+}
+
+// unescapeText reverses escapeText
+func unescapeText(s string) string {
+	r := strings.NewReplacer(`\\`, `\`, `\;`, ";", `\,`, ",", `\n`, "\n", `\N`, "\n")
+	return r.Replace(s)
+}
@@ -0,0 +1,141 @@
+// Package icalsync keeps the blocks copied from other booking platforms' calendars in step with those calendars
+package icalsync
+
+import (
+	"bookings/internal/ical"
+	"bookings/internal/models"
+	"bookings/internal/repository"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxFeedSize is the largest calendar that will be read, which is far more than any room's bookings need
+const maxFeedSize = 5 << 20
+
+// Syncer fetches external calendars and turns their events into the room's external blocks
+type Syncer struct {
+	DB     repository.DatabaseRepo
+	Client *http.Client
+	Logger *slog.Logger
+}
+
+// New returns a syncer that fetches calendars with a client that gives up after 30 seconds
+func New(db repository.DatabaseRepo, logger *slog.Logger) *Syncer {
+	return &Syncer{
+		DB:     db,
+		Client: &http.Client{Timeout: 30 * time.Second},
+		Logger: logger,
+	}
+}
+
+// Start syncs every feed straight away and then once every interval, in the background until ctx is done.
+// The returned channel is closed when it stops, after any sync in progress has given up
+func (s *Syncer) Start(ctx context.Context, interval time.Duration) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			s.SyncAll(ctx)
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return done
+}
+
+// SyncAll syncs every feed, carrying on past the ones that fail
+func (s *Syncer) SyncAll(ctx context.Context) {
+	feeds, err := s.DB.AllICalFeeds(ctx)
+	if err != nil {
+		s.Logger.Error("listing calendars", "error", err)
+		return
+	}
+	for _, f := range feeds {
+		if err := s.Sync(ctx, f); err != nil {
+			s.Logger.Warn("syncing calendar", "feed_id", f.ID, "feed", f.Name, "error", err)
+		}
+	}
+}
+
+// Sync replaces a feed's blocks with the events currently in its calendar, and records how that went on the feed.
+// When the calendar can't be read the blocks from the last good sync are left alone
+func (s *Syncer) Sync(ctx context.Context, f models.ICalFeed) error {
+	err := s.sync(ctx, f)
+	if err != nil {
+		f.LastError = err.Error()
+	} else {
+		f.LastSyncedAt = time.Now()
+		f.LastError = ""
+	}
+
+	if statusErr := s.DB.UpdateICalFeedStatus(ctx, f); statusErr != nil && err == nil {
+		err = statusErr
+	}
+	return err
+}
+
+func (s *Syncer) sync(ctx context.Context, f models.ICalFeed) error {
+	events, err := s.read(ctx, f)
+	if err != nil {
+		return err
+	}
+
+	// some platforms repeat an event, the last copy wins
+	var restrictions []models.RoomRestriction
+	seen := make(map[string]int)
+	for _, e := range events {
+		r := models.RoomRestriction{
+			StartDate:  e.Start,
+			EndDate:    e.End,
+			RoomID:     f.RoomID,
+			ICalFeedID: f.ID,
+			ICalUID:    e.UID,
+		}
+		if i, ok := seen[e.UID]; ok {
+			restrictions[i] = r
+			continue
+		}
+		seen[e.UID] = len(restrictions)
+		restrictions = append(restrictions, r)
+	}
+
+	return s.DB.ReplaceICalFeedRestrictions(ctx, f, restrictions)
+}
+
+// read returns the events in a feed's calendar, downloading it if the feed has a url
+func (s *Syncer) read(ctx context.Context, f models.ICalFeed) ([]ical.Event, error) {
+	if f.URL == "" {
+		return ical.Parse(strings.NewReader(f.Contents))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", f.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching calendar: %s", resp.Status)
+	}
+
+	events, err := ical.Parse(io.LimitReader(resp.Body, maxFeedSize))
+	if errors.Is(err, ical.ErrNotCalendar) {
+		return nil, fmt.Errorf("%s did not return a calendar", f.URL)
+	}
+	return events, err
+}
@@ -0,0 +1,173 @@
+package icalsync
+
+import (
+	"bookings/internal/config"
+	"bookings/internal/models"
+	"bookings/internal/repository/dbrepo"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// channel stands in for another booking platform, serving whichever calendar it was last given
+type channel struct {
+	mu       sync.Mutex
+	calendar string
+	status   int
+}
+
+func (c *channel) set(status int, events ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.status = status
+	c.calendar = "BEGIN:VCALENDAR\r\nVERSION:2.0\r\nPRODID:-//channel//EN\r\n" +
+		strings.Join(events, "") + "END:VCALENDAR\r\n"
+}
+
+func (c *channel) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	w.Header().Set("Content-Type", "text/calendar")
+	w.WriteHeader(c.status)
+	io.WriteString(w, c.calendar)
+}
+
+func event(uid, start, end string) string {
+	return fmt.Sprintf("BEGIN:VEVENT\r\nUID:%s\r\nDTSTART;VALUE=DATE:%s\r\nDTEND;VALUE=DATE:%s\r\n"+
+		"SUMMARY:Reserved\r\nEND:VEVENT\r\n", uid, start, end)
+}
+
+func TestSyncer_Sync(t *testing.T) {
+	ch := &channel{}
+	ts := httptest.NewServer(ch)
+	defer ts.Close()
+
+	db := dbrepo.NewTestingRepo(&config.AppConfig{})
+	s := New(db, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	id, _ := db.InsertICalFeed(context.Background(), models.ICalFeed{RoomID: 1, Name: "Channel", URL: ts.URL})
+	feed, _ := db.GetICalFeedByID(context.Background(), id)
+
+	// first sync adds both bookings
+	ch.set(http.StatusOK, event("a", "20500101", "20500103"), event("b", "20500110", "20500112"))
+	if err := s.Sync(context.Background(), feed); err != nil {
+		t.Fatal(err)
+	}
+	blocks, _ := db.GetICalFeedRestrictions(context.Background(), id)
+	if len(blocks) != 2 {
+		t.Fatalf("expected 2 blocks but got %d", len(blocks))
+	}
+	for _, b := range blocks {
+		if b.RoomID != 1 || b.ICalFeedID != id {
+			t.Errorf("block %s is not an external block for room 1: %+v", b.ICalUID, b)
+		}
+	}
+	firstID := blocks[0].ID
+
+	// the first booking moves and the second is cancelled
+	ch.set(http.StatusOK, event("a", "20500102", "20500105"))
+	if err := s.Sync(context.Background(), feed); err != nil {
+		t.Fatal(err)
+	}
+	blocks, _ = db.GetICalFeedRestrictions(context.Background(), id)
+	if len(blocks) != 1 {
+		t.Fatalf("expected 1 block but got %d", len(blocks))
+	}
+	if blocks[0].ID != firstID {
+		t.Errorf("expected the moved booking to keep block %d but got %d", firstID, blocks[0].ID)
+	}
+	if got := blocks[0].StartDate.Format("2006-01-02"); got != "2050-01-02" {
+		t.Errorf("expected the block to start on 2050-01-02 but got %s", got)
+	}
+	if got := blocks[0].EndDate.Format("2006-01-02"); got != "2050-01-05" {
+		t.Errorf("expected the block to end on 2050-01-05 but got %s", got)
+	}
+
+	feed, _ = db.GetICalFeedByID(context.Background(), id)
+	if feed.LastSyncedAt.IsZero() || feed.LastError != "" {
+		t.Errorf("expected a clean sync to be recorded but got %+v", feed)
+	}
+	lastSynced := feed.LastSyncedAt
+
+	// when the platform is down the blocks are kept and the error recorded
+	ch.set(http.StatusInternalServerError)
+	if err := s.Sync(context.Background(), feed); err == nil {
+		t.Error("expected an error when the calendar can't be fetched")
+	}
+	blocks, _ = db.GetICalFeedRestrictions(context.Background(), id)
+	if len(blocks) != 1 {
+		t.Errorf("expected the block to survive a failed sync but got %d blocks", len(blocks))
+	}
+	feed, _ = db.GetICalFeedByID(context.Background(), id)
+	if feed.LastError == "" || !feed.LastSyncedAt.Equal(lastSynced) {
+		t.Errorf("expected the failure to be recorded but got %+v", feed)
+	}
+}
+
+func TestSyncer_SyncUploaded(t *testing.T) {
+	db := dbrepo.NewTestingRepo(&config.AppConfig{})
+	s := New(db, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	ch := &channel{}
+	ch.set(http.StatusOK, event("a", "20500101", "20500103"), event("a", "20500104", "20500106"))
+	id, _ := db.InsertICalFeed(context.Background(), models.ICalFeed{RoomID: 2, Name: "Upload", Contents: ch.calendar})
+	feed, _ := db.GetICalFeedByID(context.Background(), id)
+
+	if err := s.Sync(context.Background(), feed); err != nil {
+		t.Fatal(err)
+	}
+	blocks, _ := db.GetICalFeedRestrictions(context.Background(), id)
+	if len(blocks) != 1 {
+		t.Fatalf("expected a repeated event to give 1 block but got %d", len(blocks))
+	}
+	if got := blocks[0].StartDate.Format("2006-01-02"); got != "2050-01-04" {
+		t.Errorf("expected the last copy of the event to win but the block starts on %s", got)
+	}
+}
+
+func TestSyncer_SyncNotCalendar(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "<html>not a calendar</html>")
+	}))
+	defer ts.Close()
+
+	db := dbrepo.NewTestingRepo(&config.AppConfig{})
+	s := New(db, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	id, _ := db.InsertICalFeed(context.Background(), models.ICalFeed{RoomID: 1, URL: ts.URL})
+	feed, _ := db.GetICalFeedByID(context.Background(), id)
+
+	if err := s.Sync(context.Background(), feed); err == nil {
+		t.Error("expected an error for a page that is not a calendar")
+	}
+}
+
+func TestSyncer_Start(t *testing.T) {
+	// a calendar that never answers, so the first sync is in progress when the syncer is stopped
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer ts.Close()
+
+	db := dbrepo.NewTestingRepo(&config.AppConfig{})
+	s := New(db, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if _, err := db.InsertICalFeed(context.Background(), models.ICalFeed{RoomID: 1, URL: ts.URL}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := s.Start(ctx, time.Hour)
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the syncer to stop once its context was done")
+	}
+}
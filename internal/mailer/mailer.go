@@ -0,0 +1,192 @@
+// Package mailer sends the emails queued in the outbox, retrying the ones the mail server refuses
+package mailer
+
+import (
+	"bookings/internal/metrics"
+	"bookings/internal/models"
+	"bookings/internal/repository"
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Sender delivers a single email
+type Sender interface {
+	Send(m models.MailData) error
+}
+
+// maxBackoff is the longest a message waits between attempts
+const maxBackoff = 6 * time.Hour
+
+// Mailer queues emails in the outbox and sends them with a pool of workers. A message that can't be sent is tried
+// again after Backoff, doubling each time, until MaxAttempts have failed and it is marked failed for someone to
+// resend by hand
+type Mailer struct {
+	DB     repository.DatabaseRepo
+	Sender Sender
+	Logger *slog.Logger
+
+	Workers      int
+	MaxAttempts  int
+	Backoff      time.Duration
+	PollInterval time.Duration
+	// Lease is how long a worker holds a message it is sending before another may take it
+	Lease time.Duration
+
+	now  func() time.Time
+	wake chan struct{}
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// New returns a mailer with four workers that tries each message eight times, over about two hours
+func New(db repository.DatabaseRepo, sender Sender, logger *slog.Logger) *Mailer {
+	return &Mailer{
+		DB:           db,
+		Sender:       sender,
+		Logger:       logger,
+		Workers:      4,
+		MaxAttempts:  8,
+		Backoff:      time.Minute,
+		PollInterval: 30 * time.Second,
+		Lease:        10 * time.Minute,
+		now:          time.Now,
+		wake:         make(chan struct{}, 1),
+		stop:         make(chan struct{}),
+	}
+}
+
+// Queue adds an email to the outbox and wakes a worker to send it. Once Queue returns the email is stored, so it
+// is sent even if the mail server is down or the application restarts
+func (m *Mailer) Queue(ctx context.Context, mail models.MailData) error {
+	_, err := m.DB.QueueMail(ctx, mail)
+	if err != nil {
+		return err
+	}
+	m.Notify()
+	return nil
+}
+
+// Notify wakes a worker to look for messages that are due, such as one put back in the queue to be resent
+func (m *Mailer) Notify() {
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Start starts the workers in the background. Each sends whatever is due, then waits to be woken by Queue or for
+// PollInterval to pass
+func (m *Mailer) Start() {
+	for i := 0; i < m.Workers; i++ {
+		m.wg.Add(1)
+		go m.work()
+	}
+}
+
+func (m *Mailer) work() {
+	defer m.wg.Done()
+
+	ticker := time.NewTicker(m.PollInterval)
+	defer ticker.Stop()
+	for {
+		m.SendDue()
+		select {
+		case <-m.wake:
+		case <-ticker.C:
+		case <-m.stop:
+			// drain whatever became due while the last batch was being sent
+			m.SendDue()
+			return
+		}
+	}
+}
+
+// Shutdown stops the workers once they have sent every message that is due, or when ctx is done. Messages still in
+// the outbox are sent the next time the application starts
+func (m *Mailer) Shutdown(ctx context.Context) error {
+	close(m.stop)
+
+	done := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// SendDue sends messages until none are due, and returns how many it tried. It is not tied to any request, and
+// finishes the messages it claims even while shutting down, so its queries are only limited by the database timeout
+func (m *Mailer) SendDue() int {
+	tried := 0
+	for {
+		now := m.now()
+		msg, err := m.DB.ClaimMail(context.Background(), now, now.Add(m.Lease))
+		if errors.Is(err, sql.ErrNoRows) {
+			return tried
+		}
+		if err != nil {
+			m.Logger.Error("claiming email", "error", err)
+			return tried
+		}
+
+		// there may be more, so let another worker help
+		m.Notify()
+
+		m.send(msg)
+		tried++
+	}
+}
+
+// send makes one attempt at a message and records how it went
+func (m *Mailer) send(msg models.OutboxMessage) {
+	err := m.Sender.Send(msg.Mail)
+	msg.Attempts++
+	if err == nil {
+		metrics.MailSends.WithLabelValues("sent").Inc()
+	} else {
+		metrics.MailSends.WithLabelValues("failed").Inc()
+	}
+
+	switch {
+	case err == nil:
+		msg.Status = models.MailSent
+		msg.SentAt = m.now()
+		msg.LastError = ""
+	case msg.Attempts >= m.MaxAttempts:
+		msg.Status = models.MailFailed
+		msg.LastError = err.Error()
+		m.Logger.Error("giving up on email", "email_id", msg.ID, "to", msg.Mail.To, "attempts", msg.Attempts,
+			"error", err)
+	default:
+		msg.LastError = err.Error()
+		msg.NextAttemptAt = m.now().Add(m.backoff(msg.Attempts))
+		m.Logger.Warn("sending email", "email_id", msg.ID, "to", msg.Mail.To, "attempt", msg.Attempts,
+			"retry_at", msg.NextAttemptAt, "error", err)
+	}
+
+	if err := m.DB.UpdateMailStatus(context.Background(), msg); err != nil {
+		m.Logger.Error("recording email status", "email_id", msg.ID, "error", err)
+	}
+}
+
+// backoff is how long to wait after a message's attempts have failed
+func (m *Mailer) backoff(attempts int) time.Duration {
+	d := m.Backoff
+	for i := 1; i < attempts && d < maxBackoff; i++ {
+		d *= 2
+	}
+	if d > maxBackoff {
+		d = maxBackoff
+	}
+	return d
+}
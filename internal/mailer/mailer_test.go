@@ -0,0 +1,160 @@
+package mailer
+
+import (
+	"bookings/internal/config"
+	"bookings/internal/metrics"
+	"bookings/internal/models"
+	"bookings/internal/repository/dbrepo"
+	"context"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakySender fails a number of times before it starts delivering
+type flakySender struct {
+	mu       sync.Mutex
+	failures int
+	sent     []models.MailData
+}
+
+func (s *flakySender) Send(m models.MailData) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failures > 0 {
+		s.failures--
+		return errors.New("connection refused")
+	}
+	s.sent = append(s.sent, m)
+	return nil
+}
+
+func (s *flakySender) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.sent)
+}
+
+func newTestMailer(sender Sender) (*Mailer, *time.Time) {
+	m := New(dbrepo.NewTestingRepo(&config.AppConfig{}), sender, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	now := time.Date(2050, 1, 1, 12, 0, 0, 0, time.UTC)
+	m.now = func() time.Time { return now }
+	return m, &now
+}
+
+func TestMailer_Retry(t *testing.T) {
+	sender := &flakySender{failures: 2}
+	m, now := newTestMailer(sender)
+	sent := testutil.ToFloat64(metrics.MailSends.WithLabelValues("sent"))
+	failed := testutil.ToFloat64(metrics.MailSends.WithLabelValues("failed"))
+
+	if err := m.Queue(context.Background(), models.MailData{To: "guest@here.com", Subject: "Reservation Confirmation"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the first attempt fails and the retry waits a minute
+	if n := m.SendDue(); n != 1 {
+		t.Fatalf("expected 1 attempt but got %d", n)
+	}
+	*now = now.Add(59 * time.Second)
+	if n := m.SendDue(); n != 0 {
+		t.Fatalf("expected the retry to wait but it was tried %d times", n)
+	}
+
+	// the second fails too, and the wait doubles
+	*now = now.Add(time.Second)
+	m.SendDue()
+	*now = now.Add(time.Minute)
+	if n := m.SendDue(); n != 0 {
+		t.Fatalf("expected the wait to double but it was tried %d times", n)
+	}
+	*now = now.Add(time.Minute)
+	m.SendDue()
+
+	if sender.count() != 1 {
+		t.Fatalf("expected the third attempt to send the email")
+	}
+	unsent, _ := m.DB.GetUnsentMail(context.Background())
+	if len(unsent) != 0 {
+		t.Errorf("expected no unsent mail but got %+v", unsent)
+	}
+
+	if n := testutil.ToFloat64(metrics.MailSends.WithLabelValues("failed")) - failed; n != 2 {
+		t.Errorf("expected 2 failed sends counted but got %v", n)
+	}
+	if n := testutil.ToFloat64(metrics.MailSends.WithLabelValues("sent")) - sent; n != 1 {
+		t.Errorf("expected 1 send counted but got %v", n)
+	}
+}
+
+func TestMailer_DeadLetter(t *testing.T) {
+	sender := &flakySender{failures: 3}
+	m, now := newTestMailer(sender)
+	m.MaxAttempts = 3
+
+	_ = m.Queue(context.Background(), models.MailData{To: "guest@here.com"})
+	for i := 0; i < 3; i++ {
+		m.SendDue()
+		*now = now.Add(maxBackoff)
+	}
+
+	unsent, _ := m.DB.GetUnsentMail(context.Background())
+	if len(unsent) != 1 || unsent[0].Status != models.MailFailed || unsent[0].LastError != "connection refused" {
+		t.Fatalf("expected a failed message but got %+v", unsent)
+	}
+	if n := m.SendDue(); n != 0 {
+		t.Fatalf("expected a failed message to be left alone but it was tried %d times", n)
+	}
+
+	// resending starts it over
+	if err := m.DB.ResendMail(context.Background(), unsent[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	m.SendDue()
+	if sender.count() != 1 {
+		t.Errorf("expected the resent email to be sent")
+	}
+}
+
+func TestMailer_Backoff(t *testing.T) {
+	m, _ := newTestMailer(nil)
+
+	tests := []struct {
+		attempts int
+		expected time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{4, 8 * time.Minute},
+		{20, maxBackoff},
+	}
+	for _, e := range tests {
+		if got := m.backoff(e.attempts); got != e.expected {
+			t.Errorf("after %d attempts expected %s but got %s", e.attempts, e.expected, got)
+		}
+	}
+}
+
+func TestMailer_ShutdownDrains(t *testing.T) {
+	sender := &flakySender{}
+	m := New(dbrepo.NewTestingRepo(&config.AppConfig{}), sender, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	m.PollInterval = time.Hour
+	m.Start()
+
+	for i := 0; i < 10; i++ {
+		_ = m.Queue(context.Background(), models.MailData{To: "guest@here.com"})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := m.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if sender.count() != 10 {
+		t.Errorf("expected all 10 emails to be sent before shutting down but %d were", sender.count())
+	}
+}
@@ -0,0 +1,87 @@
+// Package metrics holds the Prometheus metrics the application exposes on /metrics
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"time"
+)
+
+// Registry holds every metric below, along with the Go runtime and process metrics
+var Registry = prometheus.NewRegistry()
+
+var (
+	// HTTPDuration is how long requests take, by method, chi route pattern and status code. The route pattern
+	// rather than the path is used so that ids and tokens in urls don't each get their own series
+	HTTPDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "bookings_http_request_duration_seconds",
+		Help:    "How long HTTP requests take to handle, by route.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	// DBDuration is how long each repository method takes
+	DBDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "bookings_db_query_duration_seconds",
+		Help:    "How long database queries take, by repository method.",
+		Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 3},
+	}, []string{"method"})
+
+	// ReservationsCreated counts reservations made, by where they were made: web or api
+	ReservationsCreated = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bookings_reservations_created_total",
+		Help: "Reservations made, by source.",
+	}, []string{"source"})
+
+	// ReservationsCancelled counts reservations cancelled, by who cancelled them: web for guests, api or admin
+	ReservationsCancelled = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bookings_reservations_cancelled_total",
+		Help: "Reservations cancelled, by source.",
+	}, []string{"source"})
+
+	// AvailabilitySearches counts availability searches, by source and whether anything was free
+	AvailabilitySearches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bookings_availability_searches_total",
+		Help: "Availability searches, by source and result: found or empty.",
+	}, []string{"source", "result"})
+
+	// MailSends counts attempts to send an email, by outcome: sent or failed
+	MailSends = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bookings_mail_sends_total",
+		Help: "Attempts to send an email, by outcome.",
+	}, []string{"outcome"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		HTTPDuration,
+		DBDuration,
+		ReservationsCreated,
+		ReservationsCancelled,
+		AvailabilitySearches,
+		MailSends,
+	)
+}
+
+// Handler serves the metrics in the Prometheus text format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// ObserveQuery records how long a repository method took since start, meant to be deferred as
+// defer metrics.ObserveQuery("GetRoomById", time.Now())
+func ObserveQuery(method string, start time.Time) {
+	DBDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+}
+
+// Search records an availability search from source, and whether it found anything
+func Search(source string, found bool) {
+	result := "found"
+	if !found {
+		result = "empty"
+	}
+	AvailabilitySearches.WithLabelValues(source, result).Inc()
+}
@@ -0,0 +1,285 @@
+// Package migrate brings a database's schema up to date from the migration files embedded in the binary. It keeps
+// track of them in soda's schema_migration table, so databases that soda migrated carry on where they left off
+package migrate
+
+import (
+	"bookings/migrations"
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/gobuffalo/fizz"
+	"github.com/gobuffalo/fizz/translators"
+	"io/fs"
+	"log/slog"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// nameRX matches soda's migration file names, version_name[.dialect].up|down.fizz|sql
+var nameRX = regexp.MustCompile(`^(\d+)_([^.]+)(?:\.([a-z0-9]+))?\.(up|down)\.(sql|fizz)$`)
+
+// lockID names the Postgres advisory lock held while migrating, so that servers starting together don't race
+const lockID = 7_264_883_119
+
+// Migration is one step in the schema's history, with the files that apply and undo it
+type Migration struct {
+	Version string
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Status is a migration and whether it has been applied
+type Status struct {
+	Migration
+	Applied bool
+}
+
+// Migrator applies migrations to a database
+type Migrator struct {
+	DB *sql.DB
+	FS fs.FS
+	// Dialect is soda's name for the database, which picks the sql files written for it, such as
+	// seed.postgres.up.sql, and how fizz is translated
+	Dialect string
+	Logger  *slog.Logger
+}
+
+// New returns a migrator that applies the embedded migrations to a database of the named driver, postgres or
+// sqlite
+func New(db *sql.DB, driver string, logger *slog.Logger) (*Migrator, error) {
+	m := &Migrator{
+		DB:     db,
+		Logger: logger,
+	}
+	switch driver {
+	case "postgres":
+		m.FS = migrations.FS
+		m.Dialect = "postgres"
+	case "sqlite":
+		sub, err := fs.Sub(migrations.FS, "sqlite")
+		if err != nil {
+			return nil, err
+		}
+		m.FS = sub
+		m.Dialect = "sqlite3"
+	default:
+		return nil, fmt.Errorf("no migrations for %s databases", driver)
+	}
+	return m, nil
+}
+
+// Migrations lists the migrations for the dialect, oldest first
+func (m *Migrator) Migrations() ([]Migration, error) {
+	entries, err := fs.ReadDir(m.FS, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[string]*Migration{}
+	for _, e := range entries {
+		parts := nameRX.FindStringSubmatch(e.Name())
+		if parts == nil || e.IsDir() {
+			continue
+		}
+		version, name, dialect, direction := parts[1], parts[2], parts[3], parts[4]
+		if dialect != "" && dialect != "all" && dialect != m.Dialect {
+			continue
+		}
+
+		mig := byVersion[version]
+		if mig == nil {
+			mig = &Migration{Version: version, Name: name}
+			byVersion[version] = mig
+		}
+		if mig.Name != name {
+			return nil, fmt.Errorf("migrations %s and %s have the same version", mig.Name, name)
+		}
+
+		file := &mig.Up
+		if direction == "down" {
+			file = &mig.Down
+		}
+		if *file != "" {
+			return nil, fmt.Errorf("%s and %s are the same migration", *file, e.Name())
+		}
+		*file = e.Name()
+	}
+
+	all := make([]Migration, 0, len(byVersion))
+	for _, mig := range byVersion {
+		if mig.Up == "" {
+			return nil, fmt.Errorf("migration %s_%s has no up file", mig.Version, mig.Name)
+		}
+		all = append(all, *mig)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if len(all[i].Version) != len(all[j].Version) {
+			return len(all[i].Version) < len(all[j].Version)
+		}
+		return all[i].Version < all[j].Version
+	})
+	return all, nil
+}
+
+// Up applies every migration that has not been applied yet, oldest first, and returns how many it applied
+func (m *Migrator) Up(ctx context.Context) (int, error) {
+	var n int
+	err := m.locked(ctx, func(conn *sql.Conn, all []Migration, applied map[string]bool) error {
+		for _, mig := range all {
+			if applied[mig.Version] {
+				continue
+			}
+			err := m.run(ctx, conn, mig, mig.Up, "insert into schema_migration (version) values ($1)")
+			if err != nil {
+				return err
+			}
+			m.Logger.Info("applied migration", "version", mig.Version, "name", mig.Name)
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
+
+// Down undoes the last steps migrations that were applied, newest first, and returns how many it undid
+func (m *Migrator) Down(ctx context.Context, steps int) (int, error) {
+	var n int
+	err := m.locked(ctx, func(conn *sql.Conn, all []Migration, applied map[string]bool) error {
+		for i := len(all) - 1; i >= 0 && n < steps; i-- {
+			mig := all[i]
+			if !applied[mig.Version] {
+				continue
+			}
+			if mig.Down == "" {
+				return fmt.Errorf("migration %s_%s cannot be undone", mig.Version, mig.Name)
+			}
+			err := m.run(ctx, conn, mig, mig.Down, "delete from schema_migration where version = $1")
+			if err != nil {
+				return err
+			}
+			m.Logger.Info("undid migration", "version", mig.Version, "name", mig.Name)
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
+
+// Status lists every migration, oldest first, and whether it has been applied
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	var statuses []Status
+	err := m.locked(ctx, func(conn *sql.Conn, all []Migration, applied map[string]bool) error {
+		for _, mig := range all {
+			statuses = append(statuses, Status{Migration: mig, Applied: applied[mig.Version]})
+		}
+		return nil
+	})
+	return statuses, err
+}
+
+// locked calls fn with a connection that holds the migration lock, the migrations and the versions already applied
+func (m *Migrator) locked(ctx context.Context,
+	fn func(conn *sql.Conn, all []Migration, applied map[string]bool) error) error {
+	all, err := m.Migrations()
+	if err != nil {
+		return err
+	}
+
+	conn, err := m.DB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if m.Dialect == "postgres" {
+		_, err = conn.ExecContext(ctx, "select pg_advisory_lock($1)", lockID)
+		if err != nil {
+			return err
+		}
+		defer conn.ExecContext(context.Background(), "select pg_advisory_unlock($1)", lockID)
+	}
+
+	// the same table soda creates, so either can carry on from the other
+	_, err = conn.ExecContext(ctx, "create table if not exists schema_migration (version varchar(14) not null)")
+	if err != nil {
+		return err
+	}
+	_, err = conn.ExecContext(ctx,
+		"create unique index if not exists schema_migration_version_idx on schema_migration (version)")
+	if err != nil {
+		return err
+	}
+
+	rows, err := conn.QueryContext(ctx, "select version from schema_migration")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	applied := map[string]bool{}
+	for rows.Next() {
+		var version string
+		if err := rows.Scan(&version); err != nil {
+			return err
+		}
+		applied[version] = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	return fn(conn, all, applied)
+}
+
+// run executes a migration file and records that it ran in one transaction, so a migration that fails part way
+// leaves nothing behind
+func (m *Migrator) run(ctx context.Context, conn *sql.Conn, mig Migration, file, record string) error {
+	statements, err := m.SQL(file)
+	if err != nil {
+		return err
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if strings.TrimSpace(statements) != "" {
+		if _, err := tx.ExecContext(ctx, statements); err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+	}
+	if _, err := tx.ExecContext(ctx, record, mig.Version); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SQL returns the statements in a migration file, translating fizz into the dialect's sql
+func (m *Migrator) SQL(file string) (string, error) {
+	contents, err := fs.ReadFile(m.FS, file)
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasSuffix(file, ".fizz") {
+		return string(contents), nil
+	}
+
+	var t fizz.Translator
+	switch m.Dialect {
+	case "postgres":
+		t = translators.NewPostgres()
+	default:
+		return "", fmt.Errorf("cannot translate fizz for %s", m.Dialect)
+	}
+
+	statements, err := fizz.AString(string(contents), t)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", file, err)
+	}
+	return statements, nil
+}
@@ -0,0 +1,142 @@
+package migrate
+
+import (
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+var logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+func TestMigrations_Embedded(t *testing.T) {
+	m, err := New(nil, "postgres", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	all, err := m.Migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) == 0 {
+		t.Fatal("expected the embedded migrations")
+	}
+	if all[0].Name != "create_user_table" {
+		t.Errorf("expected the users table to be created first but got %s", all[0].Name)
+	}
+
+	var seeded bool
+	for i, mig := range all {
+		if i > 0 && mig.Version <= all[i-1].Version {
+			t.Errorf("%s is out of order", mig.Version)
+		}
+		seeded = seeded || mig.Up == "20220915030234_seed_room_tables.postgres.up.sql"
+
+		// every file must translate, or a fresh database would stop part way
+		for _, file := range []string{mig.Up, mig.Down} {
+			if file == "" {
+				continue
+			}
+			if _, err := m.SQL(file); err != nil {
+				t.Errorf("%s: %v", file, err)
+			}
+		}
+	}
+	if !seeded {
+		t.Error("expected the postgres seed migrations")
+	}
+}
+
+func TestMigrations_Files(t *testing.T) {
+	var tests = []struct {
+		name     string
+		files    []string
+		expected []Migration
+		err      string
+	}{
+		{
+			name: "fizz and dialects",
+			files: []string{
+				"2_seed.postgres.up.sql", "2_seed.postgres.down.sql", "2_seed.mysql.up.sql",
+				"1_create.up.fizz", "1_create.down.fizz", "README.md",
+			},
+			expected: []Migration{
+				{Version: "1", Name: "create", Up: "1_create.up.fizz", Down: "1_create.down.fizz"},
+				{Version: "2", Name: "seed", Up: "2_seed.postgres.up.sql", Down: "2_seed.postgres.down.sql"},
+			},
+		},
+		{
+			name:     "versions are ordered as numbers",
+			files:    []string{"10_later.up.sql", "9_earlier.up.sql"},
+			expected: []Migration{{Version: "9", Name: "earlier", Up: "9_earlier.up.sql"}, {Version: "10", Name: "later", Up: "10_later.up.sql"}},
+		},
+		{
+			name:  "no up file",
+			files: []string{"1_create.down.fizz"},
+			err:   "has no up file",
+		},
+		{
+			name:  "same version",
+			files: []string{"1_create.up.fizz", "1_seed.up.sql"},
+			err:   "have the same version",
+		},
+		{
+			name:  "same migration twice",
+			files: []string{"1_create.up.fizz", "1_create.up.sql"},
+			err:   "are the same migration",
+		},
+	}
+
+	for _, e := range tests {
+		fsys := fstest.MapFS{}
+		for _, f := range e.files {
+			fsys[f] = &fstest.MapFile{}
+		}
+		m := &Migrator{FS: fsys, Dialect: "postgres", Logger: logger}
+
+		all, err := m.Migrations()
+		if e.err != "" {
+			if err == nil || !strings.Contains(err.Error(), e.err) {
+				t.Errorf("%s: expected an error containing %q but got %v", e.name, e.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", e.name, err)
+			continue
+		}
+		if len(all) != len(e.expected) {
+			t.Errorf("%s: expected %+v but got %+v", e.name, e.expected, all)
+			continue
+		}
+		for i := range all {
+			if all[i] != e.expected[i] {
+				t.Errorf("%s: expected %+v but got %+v", e.name, e.expected[i], all[i])
+			}
+		}
+	}
+}
+
+func TestSQL_TranslatesFizz(t *testing.T) {
+	m := &Migrator{
+		FS: fstest.MapFS{
+			"1_create.up.fizz": &fstest.MapFile{Data: []byte(`create_table("widgets") {
+  t.Column("id", "integer", {primary: true})
+  t.Column("name", "string", {})
+}`)},
+		},
+		Dialect: "postgres",
+	}
+
+	statements, err := m.SQL("1_create.up.fizz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`CREATE TABLE "widgets"`, `"name" VARCHAR (255) NOT NULL`, `"created_at"`} {
+		if !strings.Contains(statements, want) {
+			t.Errorf("expected %s in\n%s", want, statements)
+		}
+	}
+}
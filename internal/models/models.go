@@ -12,23 +12,77 @@ type User struct {
 	Email       string    `json:"email"`
 	Password    string    `json:"password"`
 	AccessLevel int       `json:"accessLevel"`
+	Disabled    bool      `json:"disabled"`
+	LockedUntil time.Time `json:"lockedUntil"`
 	CreatedAt   time.Time `json:"createdAt"`
 	UpdatedAt   time.Time `json:"updatedAt"`
 }
 
+// Access levels a user can have, stored in users.access_level. Each level may do everything the ones below it can
+const (
+	// AccessReadOnly users can look around the admin area but not change anything
+	AccessReadOnly = 1
+	// AccessStaff users can also edit and process reservations
+	AccessStaff = 2
+	// AccessOwner users can also delete reservations, change blocks, rooms and rates, and manage api tokens
+	AccessOwner = 3
+)
+
 // Room is the room model
 type Room struct {
-	ID        int       `json:"ID"`
-	RoomName  string    `json:"roomName"`
+	ID          int      `json:"ID"`
+	RoomName    string   `json:"roomName"`
+	Slug        string   `json:"slug"`
+	Description string   `json:"description"`
+	Capacity    int      `json:"capacity"`
+	Photos      []string `json:"photos"`
+	// BaseRate and WeekendSurcharge are nightly amounts in cents
+	BaseRate         int `json:"baseRate"`
+	WeekendSurcharge int `json:"weekendSurcharge"`
+	MinStay          int `json:"minStay"`
+	// ICalToken is the secret that external calendars quote to subscribe to the room's feed
+	ICalToken string    `json:"-"`
 	CreatedAt time.Time `json:"createdAt"`
 	UpdatedAt time.Time `json:"updatedAt"`
 }
 
+// SeasonalRate overrides a room's base rate for the nights from StartDate up to, but not including, EndDate
+type SeasonalRate struct {
+	ID          int       `json:"ID"`
+	RoomID      int       `json:"roomID"`
+	Name        string    `json:"name"`
+	StartDate   time.Time `json:"startDate"`
+	EndDate     time.Time `json:"endDate"`
+	NightlyRate int       `json:"nightlyRate"`
+	MinStay     int       `json:"minStay"`
+	CreatedAt   time.Time `json:"createdAt"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+// Keys of the restriction types the application relies on, seeded into restrictions.system_key. Types the owners
+// add themselves have no key
+const (
+	// RestrictionReservation holds a room for a guest's reservation
+	RestrictionReservation = "reservation"
+	// RestrictionOwnerBlock is a block the owners put on a room, for maintenance, cleaning or their own stay
+	RestrictionOwnerBlock = "owner_block"
+	// RestrictionExternal is a block synced from another booking platform's calendar
+	RestrictionExternal = "external"
+)
+
+// Restriction is a type of room restriction, such as a reservation or an owner block
 type Restriction struct {
-	ID              int       `json:"ID"`
-	RestrictionName string    `json:"roomName"`
-	CreatedAt       time.Time `json:"createdAt"`
-	UpdatedAt       time.Time `json:"updatedAt"`
+	ID              int    `json:"ID"`
+	RestrictionName string `json:"roomName"`
+	SystemKey       string `json:"systemKey"`
+	// Colour is the css colour of the type's bars on the admin calendar
+	Colour string `json:"colour"`
+	// BlocksBooking is whether guests are kept from booking the room; other types are only notes on the calendar
+	BlocksBooking bool `json:"blocksBooking"`
+	// GuestVisible is whether guests are told the type's name when it keeps them from booking
+	GuestVisible bool      `json:"guestVisible"`
+	CreatedAt    time.Time `json:"createdAt"`
+	UpdatedAt    time.Time `json:"updatedAt"`
 }
 
 type Reservation struct {
@@ -40,10 +94,47 @@ type Reservation struct {
 	StartDate time.Time `json:"startDate"`
 	EndDate   time.Time `json:"endDate"`
 	Processed int       `json:"processed"`
-	RoomID    int       `json:"roomID"`
-	CreatedAt time.Time `json:"createdAt"`
-	UpdatedAt time.Time `json:"updatedAt"`
-	Room      Room
+	// TotalPrice is the quoted price of the stay in cents
+	TotalPrice int `json:"totalPrice"`
+	// ConfirmationCode is the unguessable code that lets the guest manage the reservation
+	ConfirmationCode string    `json:"-"`
+	RoomID           int       `json:"roomID"`
+	CreatedAt        time.Time `json:"createdAt"`
+	UpdatedAt        time.Time `json:"updatedAt"`
+	Room             Room
+}
+
+// Which reservations a ReservationFilter keeps by whether they have been processed
+const (
+	ReservationsAll       = ""
+	ReservationsNew       = "new"
+	ReservationsProcessed = "processed"
+)
+
+// Columns reservations can be sorted by
+const (
+	SortByID        = "id"
+	SortByName      = "name"
+	SortByRoom      = "room"
+	SortByArrival   = "arrival"
+	SortByDeparture = "departure"
+	SortByBooked    = "booked"
+)
+
+// ReservationFilter picks out a page of reservations. Each word of Search must match the start of the guest's first
+// name, last name, email address or phone number, ignoring case. From and To keep the stays with a night between
+// them, To included. Zero values don't filter, an unknown Sort sorts by arrival, and a PerPage of 0 returns every
+// match
+type ReservationFilter struct {
+	Search    string
+	RoomID    int
+	From      time.Time
+	To        time.Time
+	Processed string
+	Sort      string
+	Desc      bool
+	Page      int
+	PerPage   int
 }
 
 // RoomRestriction is the room restriction model
@@ -54,18 +145,118 @@ type RoomRestriction struct {
 	RoomID        int
 	ReservationID int
 	RestrictionID int
-	CreatedAt     time.Time `json:"createdAt"`
-	UpdatedAt     time.Time `json:"updatedAt"`
-	Room          Room
-	Reservation   Reservation
-	Restriction   Restriction
+	// ICalFeedID and ICalUID identify the external calendar event an external block was synced from
+	ICalFeedID int
+	ICalUID    string
+	// Note says why an owner block is there
+	Note        string
+	CreatedAt   time.Time `json:"createdAt"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+	Room        Room
+	Reservation Reservation
+	Restriction Restriction
+}
+
+// ICalFeed is another booking platform's calendar for a room, either fetched from URL or uploaded as Contents.
+// Its events are synced into the room's restrictions as external blocks
+type ICalFeed struct {
+	ID       int
+	RoomID   int
+	Name     string
+	URL      string
+	Contents string
+	// LastSyncedAt is the last successful sync, LastError why the latest sync failed, if it did
+	LastSyncedAt time.Time
+	LastError    string
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+}
+
+// APIToken is a bearer token used by partners and the booking widget to call the JSON api
+type APIToken struct {
+	ID         int       `json:"ID"`
+	UserID     int       `json:"userID"`
+	Name       string    `json:"name"`
+	TokenHash  string    `json:"-"`
+	LastUsedAt time.Time `json:"lastUsedAt"`
+	CreatedAt  time.Time `json:"createdAt"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+	User       User
 }
 
-// MailData holds an email message
+// Purposes a password token can be issued for
+const (
+	PasswordTokenInvite = "invite"
+	PasswordTokenReset  = "reset"
+)
+
+// PasswordToken is a single use token, emailed to a user, that lets them set their password
+type PasswordToken struct {
+	ID        int       `json:"ID"`
+	UserID    int       `json:"userID"`
+	TokenHash string    `json:"-"`
+	Purpose   string    `json:"purpose"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	User      User
+}
+
+// Outcomes of a login attempt
+const (
+	// LoginSucceeded is a login with the right email address and password
+	LoginSucceeded = "succeeded"
+	// LoginFailed is a login with an unknown email address or the wrong password
+	LoginFailed = "failed"
+	// LoginThrottled is a login refused without checking the password, because of too many recent failures
+	LoginThrottled = "throttled"
+	// LoginLocked is a login refused because the account is locked
+	LoginLocked = "locked"
+)
+
+// LoginAttempt is a record of someone trying to log in
+type LoginAttempt struct {
+	ID        int       `json:"ID"`
+	Email     string    `json:"email"`
+	IPAddress string    `json:"ipAddress"`
+	Outcome   string    `json:"outcome"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// LoginFailures summarises the recent failed logins for an email address and for an ip address
+type LoginFailures struct {
+	ByEmail     int
+	LastByEmail time.Time
+	ByIP        int
+	LastByIP    time.Time
+}
+
+// MailData holds an email message. Content is the HTML body and Text the plain text alternative
 type MailData struct {
-	To       string
-	From     string
-	Subject  string
-	Content  string
-	Template string
+	To      string
+	From    string
+	Subject string
+	Content string
+	Text    string
+}
+
+// the states of a message in the outbox
+const (
+	MailPending = "pending"
+	MailSent    = "sent"
+	MailFailed  = "failed"
+)
+
+// OutboxMessage is an email waiting to be sent, or the record of one that was sent or given up on
+type OutboxMessage struct {
+	ID            int
+	Mail          MailData
+	Status        string
+	Attempts      int
+	NextAttemptAt time.Time
+	LastError     string
+	SentAt        time.Time
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
 }
@@ -0,0 +1,110 @@
+// Package occupancy counts, room by room and month by month, the nights that were reserved and the nights that were
+// blocked, from the room restrictions covering them
+package occupancy
+
+import (
+	"bookings/internal/models"
+	"time"
+)
+
+// what a night in a room was taken up by. A reserved night stays reserved whatever else covers it
+const (
+	free byte = iota
+	blocked
+	reserved
+)
+
+// Month is one room's nights in one month
+type Month struct {
+	Room models.Room
+	// Month is the first day of the month
+	Month    time.Time
+	Nights   int
+	Reserved int
+	Blocked  int
+}
+
+// Rate is the share of the nights the room could be let that were reserved. Blocked nights couldn't be let, so
+// they aren't counted
+func (m Month) Rate() float64 {
+	if m.Nights-m.Blocked <= 0 {
+		return 0
+	}
+	return float64(m.Reserved) / float64(m.Nights-m.Blocked)
+}
+
+// Tally counts the nights of a run of months as the room restrictions covering them are added one at a time, so
+// that the restrictions don't all have to be held at once
+type Tally struct {
+	rooms []models.Room
+	// start is the first night counted and end the night after the last
+	start time.Time
+	end   time.Time
+	// nights holds what each night from start was taken up by, for each room by its id
+	nights map[int][]byte
+}
+
+// New returns a tally for the rooms, from the month of from to the month of to, or of no months if to comes first
+func New(rooms []models.Room, from, to time.Time) *Tally {
+	t := &Tally{
+		rooms:  rooms,
+		start:  time.Date(from.Year(), from.Month(), 1, 0, 0, 0, 0, time.UTC),
+		end:    time.Date(to.Year(), to.Month()+1, 1, 0, 0, 0, 0, time.UTC),
+		nights: make(map[int][]byte),
+	}
+	if t.end.Before(t.start) {
+		t.end = t.start
+	}
+	for _, room := range rooms {
+		t.nights[room.ID] = make([]byte, t.night(t.end))
+	}
+	return t
+}
+
+// Start and End return the first night counted and the night after the last, the range of restrictions to add
+func (t *Tally) Start() time.Time { return t.start }
+func (t *Tally) End() time.Time   { return t.end }
+
+// night returns which night from the start a date is
+func (t *Tally) night(d time.Time) int {
+	d = time.Date(d.Year(), d.Month(), d.Day(), 0, 0, 0, 0, time.UTC)
+	return int(d.Sub(t.start).Hours() / 24)
+}
+
+// Add counts the nights a room restriction covers. Restrictions that don't keep guests from booking are only notes,
+// and don't count
+func (t *Tally) Add(rr models.RoomRestriction) {
+	nights, ok := t.nights[rr.RoomID]
+	if !ok || !rr.Restriction.BlocksBooking {
+		return
+	}
+	state := blocked
+	if rr.ReservationID != 0 {
+		state = reserved
+	}
+	for n := max(t.night(rr.StartDate), 0); n < min(t.night(rr.EndDate), len(nights)); n++ {
+		nights[n] = max(nights[n], state)
+	}
+}
+
+// Months returns the counts for each room, in the order the rooms were given, month by month
+func (t *Tally) Months() []Month {
+	var months []Month
+	for _, room := range t.rooms {
+		nights := t.nights[room.ID]
+		for first := t.start; first.Before(t.end); first = first.AddDate(0, 1, 0) {
+			m := Month{Room: room, Month: first}
+			for n := t.night(first); n < t.night(first.AddDate(0, 1, 0)); n++ {
+				m.Nights++
+				switch nights[n] {
+				case reserved:
+					m.Reserved++
+				case blocked:
+					m.Blocked++
+				}
+			}
+			months = append(months, m)
+		}
+	}
+	return months
+}
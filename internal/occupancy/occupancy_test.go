@@ -0,0 +1,71 @@
+package occupancy
+
+import (
+	"bookings/internal/models"
+	"testing"
+	"time"
+)
+
+func date(s string) time.Time {
+	d, _ := time.Parse("2006-01-02", s)
+	return d
+}
+
+func TestTally(t *testing.T) {
+	rooms := []models.Room{{ID: 1, RoomName: "General's Quarters"}, {ID: 2, RoomName: "Colonel's Suite"}}
+	tally := New(rooms, date("2050-01-15"), date("2050-02-01"))
+	if !tally.Start().Equal(date("2050-01-01")) || !tally.End().Equal(date("2050-03-01")) {
+		t.Fatalf("expected whole months but got %s to %s", tally.Start(), tally.End())
+	}
+
+	reservation := models.Restriction{SystemKey: models.RestrictionReservation, BlocksBooking: true}
+	block := models.Restriction{SystemKey: models.RestrictionOwnerBlock, BlocksBooking: true}
+	note := models.Restriction{RestrictionName: "Deep clean"}
+	for _, rr := range []models.RoomRestriction{
+		// from before the first month, and across the end of january
+		{RoomID: 1, ReservationID: 1, StartDate: date("2049-12-30"), EndDate: date("2050-01-03"), Restriction: reservation},
+		{RoomID: 1, ReservationID: 2, StartDate: date("2050-01-30"), EndDate: date("2050-02-02"), Restriction: reservation},
+		// a block under a reservation leaves the night reserved
+		{RoomID: 1, StartDate: date("2050-01-01"), EndDate: date("2050-01-11"), Restriction: block},
+		// notes don't count, and nor do rooms or nights outside the tally
+		{RoomID: 1, StartDate: date("2050-02-10"), EndDate: date("2050-02-20"), Restriction: note},
+		{RoomID: 3, ReservationID: 3, StartDate: date("2050-01-10"), EndDate: date("2050-01-20"), Restriction: reservation},
+		{RoomID: 2, ReservationID: 4, StartDate: date("2050-02-27"), EndDate: date("2050-03-05"), Restriction: reservation},
+	} {
+		tally.Add(rr)
+	}
+
+	var tests = []struct {
+		room     int
+		month    string
+		nights   int
+		reserved int
+		blocked  int
+		rate     float64
+	}{
+		{1, "2050-01-01", 31, 4, 8, 4.0 / 23},
+		{1, "2050-02-01", 28, 1, 0, 1.0 / 28},
+		{2, "2050-01-01", 31, 0, 0, 0},
+		{2, "2050-02-01", 28, 2, 0, 2.0 / 28},
+	}
+
+	months := tally.Months()
+	if len(months) != len(tests) {
+		t.Fatalf("expected %d months but got %+v", len(tests), months)
+	}
+	for i, e := range tests {
+		m := months[i]
+		if m.Room.ID != e.room || !m.Month.Equal(date(e.month)) || m.Nights != e.nights || m.Reserved != e.reserved ||
+			m.Blocked != e.blocked || m.Rate() != e.rate {
+			t.Errorf("expected room %d in %s to have %d nights, %d reserved and %d blocked, a rate of %f, but got %+v, %f",
+				e.room, e.month, e.nights, e.reserved, e.blocked, e.rate, m, m.Rate())
+		}
+	}
+
+	if months := New(rooms, date("2050-02-01"), date("2050-01-01")).Months(); len(months) != 0 {
+		t.Errorf("expected no months when the range is backwards but got %+v", months)
+	}
+	if rate := (Month{Nights: 30, Blocked: 30}).Rate(); rate != 0 {
+		t.Errorf("expected a room blocked all month to have no rate but got %f", rate)
+	}
+}
@@ -0,0 +1,148 @@
+package pricing
+
+import (
+	"bookings/internal/models"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidDates is returned when the departure date is not after the arrival date
+var ErrInvalidDates = errors.New("departure must be after arrival")
+
+// MinimumStayError is returned when a stay is shorter than the room or season allows
+type MinimumStayError struct {
+	MinStay int
+}
+
+func (e MinimumStayError) Error() string {
+	return fmt.Sprintf("a minimum stay of %d nights is required for these dates", e.MinStay)
+}
+
+// Night is the price of one night of a stay
+type Night struct {
+	Date      time.Time `json:"date"`
+	Rate      int       `json:"rate"`
+	Surcharge int       `json:"surcharge"`
+	Season    string    `json:"season,omitempty"`
+	Total     int       `json:"total"`
+}
+
+// Quote is the price of a stay, broken down per night. All amounts are in cents
+type Quote struct {
+	RoomID    int       `json:"roomID"`
+	StartDate time.Time `json:"startDate"`
+	EndDate   time.Time `json:"endDate"`
+	MinStay   int       `json:"minStay"`
+	Nights    []Night   `json:"nights"`
+	Total     int       `json:"total"`
+}
+
+// IsWeekend reports whether the night starting on d is a Friday or Saturday night
+func IsWeekend(d time.Time) bool {
+	return d.Weekday() == time.Friday || d.Weekday() == time.Saturday
+}
+
+// Calculate prices a stay in a room from arrival (start) to departure (end). A seasonal rate applies to
+// the nights from its start date up to, but not including, its end date; when seasons overlap the one
+// that starts latest wins. The longest minimum stay of the room and of any season touched by the stay applies
+func Calculate(room models.Room, seasons []models.SeasonalRate, start, end time.Time) (Quote, error) {
+	q := Quote{
+		RoomID:    room.ID,
+		StartDate: start,
+		EndDate:   end,
+		MinStay:   room.MinStay,
+	}
+
+	if !end.After(start) {
+		return q, ErrInvalidDates
+	}
+
+	for d := start; d.Before(end); d = d.AddDate(0, 0, 1) {
+		n := Night{Date: d, Rate: room.BaseRate}
+
+		var season *models.SeasonalRate
+		for i, s := range seasons {
+			if !d.Before(s.StartDate) && d.Before(s.EndDate) {
+				if season == nil || s.StartDate.After(season.StartDate) {
+					season = &seasons[i]
+				}
+			}
+		}
+		if season != nil {
+			n.Rate = season.NightlyRate
+			n.Season = season.Name
+			if season.MinStay > q.MinStay {
+				q.MinStay = season.MinStay
+			}
+		}
+
+		if IsWeekend(d) {
+			n.Surcharge = room.WeekendSurcharge
+		}
+
+		n.Total = n.Rate + n.Surcharge
+		q.Total += n.Total
+		q.Nights = append(q.Nights, n)
+	}
+
+	if len(q.Nights) < q.MinStay {
+		return q, MinimumStayError{MinStay: q.MinStay}
+	}
+	return q, nil
+}
+
+// Format returns an amount in cents as dollars, e.g. 12345 becomes $123.45
+func Format(cents int) string {
+	sign := ""
+	if cents < 0 {
+		sign = "-"
+		cents = -cents
+	}
+	return fmt.Sprintf("%s$%d.%02d", sign, cents/100, cents%100)
+}
+
+// ParseAmount turns a dollar amount such as "123.45" or "$120" into cents
+func ParseAmount(s string) (int, error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "$")
+	if s == "" {
+		return 0, nil
+	}
+
+	dollars, cents, found := strings.Cut(s, ".")
+	if found && (len(cents) == 0 || len(cents) > 2) {
+		return 0, fmt.Errorf("%q is not a valid amount", s)
+	}
+	// Atoi would take signs, so "-0.50" and "1.-5" have to be turned away before it sees them
+	if !isDigits(dollars) || !isDigits(cents) {
+		return 0, fmt.Errorf("%q is not a valid amount", s)
+	}
+	if len(cents) == 1 {
+		cents += "0"
+	}
+
+	d, err := strconv.Atoi(dollars)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a valid amount", s)
+	}
+	c := 0
+	if cents != "" {
+		c, err = strconv.Atoi(cents)
+		if err != nil {
+			return 0, fmt.Errorf("%q is not a valid amount", s)
+		}
+	}
+	return d*100 + c, nil
+}
+
+// isDigits reports whether s is made of nothing but the digits 0 to 9. An empty s counts, as cents are optional
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,92 @@
+package pricing
+
+import (
+	"bookings/internal/models"
+	"errors"
+	"testing"
+	"time"
+)
+
+func date(s string) time.Time {
+	d, _ := time.Parse("2006-01-02", s)
+	return d
+}
+
+var room = models.Room{
+	ID:               1,
+	BaseRate:         10000,
+	WeekendSurcharge: 2500,
+	MinStay:          1,
+}
+
+var seasons = []models.SeasonalRate{
+	{Name: "Summer", StartDate: date("2050-06-01"), EndDate: date("2050-09-01"), NightlyRate: 15000, MinStay: 3},
+	{Name: "Festival", StartDate: date("2050-07-01"), EndDate: date("2050-07-05"), NightlyRate: 20000},
+}
+
+var calculateTests = []struct {
+	name          string
+	start         string
+	end           string
+	expectedTotal int
+	expectedErr   error
+}{
+	// 2050-01-03 is a Monday
+	{"weekdays", "2050-01-03", "2050-01-05", 20000, nil},
+	{"over-weekend", "2050-01-06", "2050-01-09", 10000 + 12500 + 12500, nil},
+	{"summer", "2050-06-06", "2050-06-09", 45000, nil},
+	{"summer-too-short", "2050-06-06", "2050-06-07", 15000, MinimumStayError{MinStay: 3}},
+	{"into-summer", "2050-05-31", "2050-06-02", 10000 + 15000, MinimumStayError{MinStay: 3}},
+	{"festival-overrides-summer", "2050-06-29", "2050-07-02", 15000 + 15000 + 20000 + 2500, nil},
+	{"no-nights", "2050-01-03", "2050-01-03", 0, ErrInvalidDates},
+}
+
+func TestCalculate(t *testing.T) {
+	for _, e := range calculateTests {
+		q, err := Calculate(room, seasons, date(e.start), date(e.end))
+		if !errors.Is(err, e.expectedErr) {
+			t.Errorf("%s: expected error %v, got %v", e.name, e.expectedErr, err)
+		}
+		if q.Total != e.expectedTotal {
+			t.Errorf("%s: expected total %d, got %d", e.name, e.expectedTotal, q.Total)
+		}
+	}
+}
+
+func TestCalculateBreakdown(t *testing.T) {
+	q, err := Calculate(room, seasons, date("2050-06-29"), date("2050-07-02"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(q.Nights) != 3 {
+		t.Fatalf("expected 3 nights, got %d", len(q.Nights))
+	}
+	if q.Nights[1].Season != "Summer" || q.Nights[2].Season != "Festival" {
+		t.Errorf("wrong seasons in breakdown: %+v", q.Nights)
+	}
+	if q.Nights[2].Surcharge == 0 {
+		t.Error("2050-07-01 is a Friday but got no weekend surcharge")
+	}
+}
+
+func TestFormat(t *testing.T) {
+	for cents, expected := range map[int]string{0: "$0.00", 5: "$0.05", 12345: "$123.45", -250: "-$2.50"} {
+		if got := Format(cents); got != expected {
+			t.Errorf("Format(%d): expected %s, got %s", cents, expected, got)
+		}
+	}
+}
+
+func TestParseAmount(t *testing.T) {
+	for in, expected := range map[string]int{"": 0, "120": 12000, "$99.5": 9950, "0.05": 5, " 123.45 ": 12345} {
+		got, err := ParseAmount(in)
+		if err != nil || got != expected {
+			t.Errorf("ParseAmount(%q): expected %d, got %d (%v)", in, expected, got, err)
+		}
+	}
+	for _, in := range []string{"abc", "1.234", "-5", "1.", "-0.50", "1.-5", "+5", "1.+5", ".50", "$-1", "1 000"} {
+		if _, err := ParseAmount(in); err == nil {
+			t.Errorf("ParseAmount(%q): expected an error", in)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package render
 import (
 	"bookings/internal/config"
 	"bookings/internal/models"
+	"bookings/internal/pricing"
 	"bytes"
 	"errors"
 	"fmt"
@@ -19,6 +20,7 @@ var functions = template.FuncMap{
 	"formatDate": FormatDate,
 	"iterate":    Iterate,
 	"add":        Add,
+	"money":      pricing.Format,
 }
 
 var app *config.AppConfig
@@ -58,6 +60,7 @@ func AddDefaultDate(td *models.TemplateData, r *http.Request) *models.TemplateDa
 	td.CSRFToken = nosurf.Token(r)
 	if app.Session.Exists(r.Context(), "user_id") {
 		td.IsAuthenticated = 1
+		td.AccessLevel = app.Session.GetInt(r.Context(), "access_level")
 	}
 	return td
 }
@@ -5,7 +5,7 @@ import (
 	"bookings/internal/models"
 	"encoding/gob"
 	"github.com/alexedwards/scs/v2"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"testing"
@@ -23,11 +23,7 @@ func TestMain(m *testing.M) {
 	// change this to true when in production
 	testApp.InProduction = false
 
-	infoLog := log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
-	testApp.InfoLog = infoLog
-
-	errorLog := log.New(os.Stdout, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile)
-	testApp.ErrorLog = errorLog
+	testApp.Logger = slog.New(slog.NewTextHandler(os.Stdout, nil))
 
 	session = scs.New()
 	session.Lifetime = 24 * time.Hour
@@ -2,8 +2,12 @@ package dbrepo
 
 import (
 	"bookings/internal/config"
+	"bookings/internal/models"
 	"bookings/internal/repository"
 	"database/sql"
+	"strings"
+	"sync"
+	"time"
 )
 
 type postgresDBRepo struct {
@@ -11,9 +15,52 @@ type postgresDBRepo struct {
 	DB  *sql.DB
 }
 
+// sqliteDBRepo stores everything in a SQLite database. SQLite understands nearly all of the sql postgresDBRepo
+// runs, so it runs the same, and overrides the few methods that rely on Postgres's row locks, its update ... from
+// returning the joined table's columns, or the type of an aggregated time
+type sqliteDBRepo struct {
+	postgresDBRepo
+}
+
+// memoryDBRepo keeps everything in memory, starting from the rooms and restriction types a fresh database is
+// seeded with. It follows the same rules as the sql repositories, down to overlapping stays, unique columns and what
+// is deleted along with a room, so that handlers can be tested, or the site shown, without a database
+type memoryDBRepo struct {
+	App *config.AppConfig
+
+	mu                sync.Mutex
+	ids               map[string]int
+	users             []models.User
+	rooms             []models.Room
+	seasonalRates     []models.SeasonalRate
+	reservations      []models.Reservation
+	restrictions      []models.Restriction
+	roomRestrictions  []models.RoomRestriction
+	icalFeeds         []models.ICalFeed
+	apiTokens         []models.APIToken
+	passwordTokens    []memoryPasswordToken
+	loginAttempts     []models.LoginAttempt
+	outbox            []models.OutboxMessage
+	reservationEmails map[string]bool
+}
+
 type testDBRepo struct {
 	App *config.AppConfig
 	DB  *sql.DB
+
+	// login attempts and lockouts are kept in memory, so that login throttling works without a database
+	mu            sync.Mutex
+	loginAttempts []models.LoginAttempt
+	lockedUntil   map[int]time.Time
+
+	// so are external calendars and the blocks synced from them, so that syncing can be tested end to end
+	icalFeeds        map[int]models.ICalFeed
+	icalRestrictions map[int][]models.RoomRestriction
+
+	// and the mail outbox, so that the mailer's retries can be tested, along with the scheduled emails each
+	// reservation has been sent
+	outbox            []models.OutboxMessage
+	reservationEmails map[string]bool
 }
 
 func NewPostgresRepo(conn *sql.DB, a *config.AppConfig) repository.DatabaseRepo {
@@ -23,8 +70,49 @@ func NewPostgresRepo(conn *sql.DB, a *config.AppConfig) repository.DatabaseRepo
 	}
 }
 
+// NewSQLiteRepo returns a repository for a SQLite database opened with driver.NewSQLiteDatabase
+func NewSQLiteRepo(conn *sql.DB, a *config.AppConfig) repository.DatabaseRepo {
+	return &sqliteDBRepo{
+		postgresDBRepo{
+			App: a,
+			DB:  conn,
+		},
+	}
+}
+
+// NewMemoryRepo returns a repository that keeps everything in memory, seeded as a freshly migrated database is
+func NewMemoryRepo(a *config.AppConfig) repository.DatabaseRepo {
+	m := &memoryDBRepo{
+		App:               a,
+		ids:               make(map[string]int),
+		reservationEmails: make(map[string]bool),
+	}
+	m.seed()
+	return m
+}
+
 func NewTestingRepo(a *config.AppConfig) repository.DatabaseRepo {
 	return &testDBRepo{
-		App: a,
+		App:               a,
+		lockedUntil:       make(map[int]time.Time),
+		icalFeeds:         make(map[int]models.ICalFeed),
+		icalRestrictions:  make(map[int][]models.RoomRestriction),
+		reservationEmails: make(map[string]bool),
 	}
 }
+
+// splitPhotos turns the newline separated photos column into a slice of paths
+func splitPhotos(s string) []string {
+	var photos []string
+	for _, p := range strings.Split(s, "\n") {
+		if p = strings.TrimSpace(p); p != "" {
+			photos = append(photos, p)
+		}
+	}
+	return photos
+}
+
+// joinPhotos stores a slice of photo paths in the newline separated photos column
+func joinPhotos(photos []string) string {
+	return strings.Join(photos, "\n")
+}
@@ -0,0 +1,1529 @@
+package dbrepo
+
+import (
+	"bookings/internal/models"
+	"bookings/internal/repository"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// memoryPasswordToken is a password token along with when it was used, which the model doesn't carry
+type memoryPasswordToken struct {
+	models.PasswordToken
+	UsedAt time.Time
+}
+
+// seed gives the repository the rooms and restriction types a freshly migrated database has
+func (m *memoryDBRepo) seed() {
+	seeded := time.Date(2022, 9, 10, 0, 0, 0, 0, time.UTC)
+
+	for _, r := range []models.Room{
+		{RoomName: "General's Quarters", Slug: "generals-quarters",
+			Description: "Your home away from home, set on the majestic waters of the Atlantic Ocean.",
+			Photos:      []string{"/static/images/generals-quarters.png"}},
+		{RoomName: "Colonel's Suite", Slug: "colonels-suite",
+			Description: "Your home away from home, set on the majestic waters of the Atlantic Ocean, this will be a vacation to remember.",
+			Photos:      []string{"/static/images/colonels-suite.png"}},
+	} {
+		r.ID = m.nextID("rooms")
+		r.Capacity = 2
+		r.MinStay = 1
+		r.ICalToken = randomHex()
+		r.CreatedAt, r.UpdatedAt = seeded, seeded
+		m.rooms = append(m.rooms, r)
+	}
+
+	for _, r := range []models.Restriction{
+		{RestrictionName: "Reservation", SystemKey: models.RestrictionReservation, Colour: "#dc3545"},
+		{RestrictionName: "Owner Block", SystemKey: models.RestrictionOwnerBlock, Colour: "#ffc107"},
+		{RestrictionName: "External Booking", SystemKey: models.RestrictionExternal, Colour: "#17a2b8"},
+	} {
+		r.ID = m.nextID("restrictions")
+		r.BlocksBooking = true
+		r.CreatedAt, r.UpdatedAt = seeded, seeded
+		m.restrictions = append(m.restrictions, r)
+	}
+}
+
+// nextID returns the next id in a table, ids are never reused
+func (m *memoryDBRepo) nextID(table string) int {
+	m.ids[table]++
+	return m.ids[table]
+}
+
+// randomHex returns 32 random hex digits, as the migrations give each room for its calendar token
+func randomHex() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// duplicate is the error a unique index gives
+func duplicate(table, column string) error {
+	return fmt.Errorf("duplicate key value violates unique constraint on %s.%s", table, column)
+}
+
+// missing is the error a foreign key gives
+func missing(table string, id int) error {
+	return fmt.Errorf("insert or update violates foreign key constraint: no %s with id %d", table, id)
+}
+
+// overlaps reports whether the stay from start up to end shares a night with the restriction
+func overlaps(start, end time.Time, rr models.RoomRestriction) bool {
+	return start.Before(rr.EndDate) && end.After(rr.StartDate)
+}
+
+func (m *memoryDBRepo) roomIndex(id int) int {
+	for i := range m.rooms {
+		if m.rooms[i].ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (m *memoryDBRepo) userIndex(id int) int {
+	for i := range m.users {
+		if m.users[i].ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (m *memoryDBRepo) reservationIndex(id int) int {
+	for i := range m.reservations {
+		if m.reservations[i].ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (m *memoryDBRepo) restrictionIndex(id int) int {
+	for i := range m.restrictions {
+		if m.restrictions[i].ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (m *memoryDBRepo) feedIndex(id int) int {
+	for i := range m.icalFeeds {
+		if m.icalFeeds[i].ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// restrictionBySystemKey returns the restriction type the application relies on for key
+func (m *memoryDBRepo) restrictionBySystemKey(key string) (models.Restriction, bool) {
+	for _, r := range m.restrictions {
+		if r.SystemKey == key {
+			return r, true
+		}
+	}
+	return models.Restriction{}, false
+}
+
+// blocked reports whether a restriction that keeps guests out overlaps the stay, not counting those of the
+// reservation with id except
+func (m *memoryDBRepo) blocked(roomID int, start, end time.Time, except int) bool {
+	for _, rr := range m.roomRestrictions {
+		if rr.RoomID != roomID || !overlaps(start, end, rr) || (except != 0 && rr.ReservationID == except) {
+			continue
+		}
+		if i := m.restrictionIndex(rr.RestrictionID); i >= 0 && m.restrictions[i].BlocksBooking {
+			return true
+		}
+	}
+	return false
+}
+
+// withRoom returns the reservation with the id and name of its room, as the sql repositories join them
+func (m *memoryDBRepo) withRoom(res models.Reservation) models.Reservation {
+	res.Room = models.Room{}
+	if i := m.roomIndex(res.RoomID); i >= 0 {
+		res.Room.ID = m.rooms[i].ID
+		res.Room.RoomName = m.rooms[i].RoomName
+	}
+	return res
+}
+
+// deleteRoomRestrictions removes the room restrictions remove says to
+func (m *memoryDBRepo) deleteRoomRestrictions(remove func(rr models.RoomRestriction) bool) {
+	kept := m.roomRestrictions[:0]
+	for _, rr := range m.roomRestrictions {
+		if !remove(rr) {
+			kept = append(kept, rr)
+		}
+	}
+	m.roomRestrictions = kept
+}
+
+// deleteReservations removes the reservations remove says to, along with their restrictions and emails
+func (m *memoryDBRepo) deleteReservations(remove func(res models.Reservation) bool) {
+	kept := m.reservations[:0]
+	for _, res := range m.reservations {
+		if !remove(res) {
+			kept = append(kept, res)
+			continue
+		}
+		id := res.ID
+		m.deleteRoomRestrictions(func(rr models.RoomRestriction) bool { return rr.ReservationID == id })
+		for key := range m.reservationEmails {
+			if strings.HasPrefix(key, fmt.Sprintf("%d/", id)) {
+				delete(m.reservationEmails, key)
+			}
+		}
+	}
+	m.reservations = kept
+}
+
+func (m *memoryDBRepo) AllUsers(ctx context.Context) ([]models.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var users []models.User
+	for _, u := range m.users {
+		u.Password = ""
+		users = append(users, u)
+	}
+	sort.SliceStable(users, func(i, j int) bool {
+		if users[i].LastName != users[j].LastName {
+			return users[i].LastName < users[j].LastName
+		}
+		return users[i].FirstName < users[j].FirstName
+	})
+	return users, nil
+}
+
+func (m *memoryDBRepo) AllRooms(ctx context.Context) ([]models.Room, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var rooms []models.Room
+	for _, r := range m.rooms {
+		r.ICalToken = ""
+		r.Photos = splitPhotos(joinPhotos(r.Photos))
+		rooms = append(rooms, r)
+	}
+	sort.SliceStable(rooms, func(i, j int) bool { return rooms[i].RoomName < rooms[j].RoomName })
+	return rooms, nil
+}
+
+// insertReservation stores a new reservation, the lock already held
+func (m *memoryDBRepo) insertReservation(res models.Reservation) (int, error) {
+	if m.roomIndex(res.RoomID) < 0 {
+		return 0, missing("rooms", res.RoomID)
+	}
+	for _, r := range m.reservations {
+		if r.ConfirmationCode == res.ConfirmationCode {
+			return 0, duplicate("reservations", "confirmation_code")
+		}
+	}
+
+	now := time.Now()
+	res.ID = m.nextID("reservations")
+	res.Processed = 0
+	res.CreatedAt, res.UpdatedAt = now, now
+	res.Room = models.Room{}
+	m.reservations = append(m.reservations, res)
+	return res.ID, nil
+}
+
+func (m *memoryDBRepo) InsertReservation(ctx context.Context, res models.Reservation) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.insertReservation(res)
+}
+
+// insertRoomRestriction stores a new room restriction after checking what it refers to, the lock already held
+func (m *memoryDBRepo) insertRoomRestriction(r models.RoomRestriction) (int, error) {
+	if m.roomIndex(r.RoomID) < 0 {
+		return 0, missing("rooms", r.RoomID)
+	}
+	if m.restrictionIndex(r.RestrictionID) < 0 {
+		return 0, missing("restrictions", r.RestrictionID)
+	}
+	if r.ReservationID != 0 && m.reservationIndex(r.ReservationID) < 0 {
+		return 0, missing("reservations", r.ReservationID)
+	}
+	if r.ICalFeedID != 0 && m.feedIndex(r.ICalFeedID) < 0 {
+		return 0, missing("ical_feeds", r.ICalFeedID)
+	}
+
+	now := time.Now()
+	r.ID = m.nextID("room_restrictions")
+	r.CreatedAt, r.UpdatedAt = now, now
+	r.Room, r.Reservation, r.Restriction = models.Room{}, models.Reservation{}, models.Restriction{}
+	m.roomRestrictions = append(m.roomRestrictions, r)
+	return r.ID, nil
+}
+
+func (m *memoryDBRepo) InsertRoomRestriction(ctx context.Context, r models.RoomRestriction) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// the sql repositories insert reservation_id as given, so it must refer to a reservation
+	if m.reservationIndex(r.ReservationID) < 0 {
+		return missing("reservations", r.ReservationID)
+	}
+	_, err := m.insertRoomRestriction(models.RoomRestriction{StartDate: r.StartDate, EndDate: r.EndDate,
+		RoomID: r.RoomID, ReservationID: r.ReservationID, RestrictionID: r.RestrictionID})
+	return err
+}
+
+// BookRoom inserts a reservation and its room restriction, unless the room was booked or blocked in the meantime
+func (m *memoryDBRepo) BookRoom(ctx context.Context, res models.Reservation) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.roomIndex(res.RoomID) < 0 {
+		return 0, sql.ErrNoRows
+	}
+	if m.blocked(res.RoomID, res.StartDate, res.EndDate, 0) {
+		return 0, repository.ErrRoomUnavailable
+	}
+	restriction, ok := m.restrictionBySystemKey(models.RestrictionReservation)
+	if !ok {
+		return 0, missing("restrictions", 0)
+	}
+
+	id, err := m.insertReservation(res)
+	if err != nil {
+		return 0, err
+	}
+	_, err = m.insertRoomRestriction(models.RoomRestriction{StartDate: res.StartDate, EndDate: res.EndDate,
+		RoomID: res.RoomID, ReservationID: id, RestrictionID: restriction.ID})
+	if err != nil {
+		m.deleteReservations(func(r models.Reservation) bool { return r.ID == id })
+		return 0, err
+	}
+	return id, nil
+}
+
+func (m *memoryDBRepo) SearchAvailabilityByDatesByRoomID(ctx context.Context, startDate, endDate time.Time, roomId int) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return !m.blocked(roomId, startDate, endDate, 0), nil
+}
+
+func (m *memoryDBRepo) SearchAvailabilityForAllRooms(ctx context.Context, startDate, endDate time.Time) ([]models.Room, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var rooms []models.Room
+	for _, r := range m.rooms {
+		if m.blocked(r.ID, startDate, endDate, 0) {
+			continue
+		}
+		rooms = append(rooms, models.Room{
+			ID:               r.ID,
+			RoomName:         r.RoomName,
+			Slug:             r.Slug,
+			Description:      r.Description,
+			Capacity:         r.Capacity,
+			Photos:           splitPhotos(joinPhotos(r.Photos)),
+			BaseRate:         r.BaseRate,
+			WeekendSurcharge: r.WeekendSurcharge,
+			MinStay:          r.MinStay,
+		})
+	}
+	sort.SliceStable(rooms, func(i, j int) bool { return rooms[i].RoomName < rooms[j].RoomName })
+	return rooms, nil
+}
+
+func (m *memoryDBRepo) GetRoomById(ctx context.Context, id int) (models.Room, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.roomIndex(id)
+	if i < 0 {
+		return models.Room{}, sql.ErrNoRows
+	}
+	r := m.rooms[i]
+	r.Photos = splitPhotos(joinPhotos(r.Photos))
+	return r, nil
+}
+
+func (m *memoryDBRepo) GetRoomBySlug(ctx context.Context, slug string) (models.Room, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, r := range m.rooms {
+		if r.Slug == slug {
+			r.Photos = splitPhotos(joinPhotos(r.Photos))
+			return r, nil
+		}
+	}
+	return models.Room{}, sql.ErrNoRows
+}
+
+func (m *memoryDBRepo) InsertRoom(ctx context.Context, r models.Room) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, other := range m.rooms {
+		if other.Slug == r.Slug {
+			return 0, duplicate("rooms", "slug")
+		}
+	}
+
+	now := time.Now()
+	r.ID = m.nextID("rooms")
+	r.Photos = splitPhotos(joinPhotos(r.Photos))
+	r.CreatedAt, r.UpdatedAt = now, now
+	m.rooms = append(m.rooms, r)
+	return r.ID, nil
+}
+
+func (m *memoryDBRepo) UpdateRoom(ctx context.Context, r models.Room) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.roomIndex(r.ID)
+	if i < 0 {
+		return nil
+	}
+	for _, other := range m.rooms {
+		if other.Slug == r.Slug && other.ID != r.ID {
+			return duplicate("rooms", "slug")
+		}
+	}
+
+	room := &m.rooms[i]
+	room.RoomName = r.RoomName
+	room.Slug = r.Slug
+	room.Description = r.Description
+	room.Capacity = r.Capacity
+	room.Photos = splitPhotos(joinPhotos(r.Photos))
+	room.BaseRate = r.BaseRate
+	room.WeekendSurcharge = r.WeekendSurcharge
+	room.MinStay = r.MinStay
+	room.UpdatedAt = time.Now()
+	return nil
+}
+
+func (m *memoryDBRepo) UpdateRoomICalToken(ctx context.Context, id int, token string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if i := m.roomIndex(id); i >= 0 {
+		m.rooms[i].ICalToken = token
+		m.rooms[i].UpdatedAt = time.Now()
+	}
+	return nil
+}
+
+// DeleteRoom deletes a room, along with its blocks, rates and calendars, returning
+// repository.ErrRoomHasReservations if guests were ever booked into it
+func (m *memoryDBRepo) DeleteRoom(ctx context.Context, id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.roomIndex(id)
+	if i < 0 {
+		return sql.ErrNoRows
+	}
+	for _, res := range m.reservations {
+		if res.RoomID == id {
+			return repository.ErrRoomHasReservations
+		}
+	}
+	m.rooms = append(m.rooms[:i], m.rooms[i+1:]...)
+
+	m.deleteRoomRestrictions(func(rr models.RoomRestriction) bool { return rr.RoomID == id })
+
+	feeds := m.icalFeeds[:0]
+	for _, f := range m.icalFeeds {
+		if f.RoomID != id {
+			feeds = append(feeds, f)
+		}
+	}
+	m.icalFeeds = feeds
+
+	rates := m.seasonalRates[:0]
+	for _, s := range m.seasonalRates {
+		if s.RoomID != id {
+			rates = append(rates, s)
+		}
+	}
+	m.seasonalRates = rates
+	return nil
+}
+
+func (m *memoryDBRepo) GetSeasonalRatesForRoom(ctx context.Context, roomID int, start, end time.Time) ([]models.SeasonalRate, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var seasons []models.SeasonalRate
+	for _, s := range m.seasonalRates {
+		if s.RoomID == roomID && start.Before(s.EndDate) && end.After(s.StartDate) {
+			seasons = append(seasons, s)
+		}
+	}
+	sort.SliceStable(seasons, func(i, j int) bool { return seasons[i].StartDate.Before(seasons[j].StartDate) })
+	return seasons, nil
+}
+
+func (m *memoryDBRepo) InsertSeasonalRate(ctx context.Context, s models.SeasonalRate) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.roomIndex(s.RoomID) < 0 {
+		return 0, missing("rooms", s.RoomID)
+	}
+
+	now := time.Now()
+	s.ID = m.nextID("seasonal_rates")
+	s.CreatedAt, s.UpdatedAt = now, now
+	m.seasonalRates = append(m.seasonalRates, s)
+	return s.ID, nil
+}
+
+func (m *memoryDBRepo) DeleteSeasonalRate(ctx context.Context, id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, s := range m.seasonalRates {
+		if s.ID == id {
+			m.seasonalRates = append(m.seasonalRates[:i], m.seasonalRates[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (m *memoryDBRepo) GetUserById(ctx context.Context, id int) (models.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.userIndex(id)
+	if i < 0 {
+		return models.User{}, sql.ErrNoRows
+	}
+	return m.users[i], nil
+}
+
+func (m *memoryDBRepo) GetUserByEmail(ctx context.Context, email string) (models.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, u := range m.users {
+		if strings.EqualFold(u.Email, email) {
+			return u, nil
+		}
+	}
+	return models.User{}, sql.ErrNoRows
+}
+
+func (m *memoryDBRepo) InsertUser(ctx context.Context, u models.User) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, other := range m.users {
+		if other.Email == u.Email {
+			return 0, duplicate("users", "email")
+		}
+	}
+
+	now := time.Now()
+	m.users = append(m.users, models.User{
+		ID:          m.nextID("users"),
+		FirstName:   u.FirstName,
+		LastName:    u.LastName,
+		Email:       u.Email,
+		Password:    u.Password,
+		AccessLevel: u.AccessLevel,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	})
+	return m.users[len(m.users)-1].ID, nil
+}
+
+func (m *memoryDBRepo) UpdateUser(ctx context.Context, u models.User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.userIndex(u.ID)
+	if i < 0 {
+		return nil
+	}
+	for _, other := range m.users {
+		if other.Email == u.Email && other.ID != u.ID {
+			return duplicate("users", "email")
+		}
+	}
+
+	user := &m.users[i]
+	user.FirstName = u.FirstName
+	user.LastName = u.LastName
+	user.Email = u.Email
+	user.AccessLevel = u.AccessLevel
+	user.UpdatedAt = time.Now()
+	return nil
+}
+
+func (m *memoryDBRepo) UpdatePassword(ctx context.Context, id int, hashedPassword string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if i := m.userIndex(id); i >= 0 {
+		m.users[i].Password = hashedPassword
+		m.users[i].UpdatedAt = time.Now()
+	}
+	return nil
+}
+
+func (m *memoryDBRepo) SetUserDisabled(ctx context.Context, id int, disabled bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if i := m.userIndex(id); i >= 0 {
+		m.users[i].Disabled = disabled
+		m.users[i].UpdatedAt = time.Now()
+	}
+	return nil
+}
+
+func (m *memoryDBRepo) LockUser(ctx context.Context, id int, until time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if i := m.userIndex(id); i >= 0 {
+		m.users[i].LockedUntil = until
+		m.users[i].UpdatedAt = time.Now()
+	}
+	return nil
+}
+
+// UnlockUser ends a user's lockout now. The failures that led to it then no longer count against them
+func (m *memoryDBRepo) UnlockUser(ctx context.Context, id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if i := m.userIndex(id); i >= 0 && m.users[i].LockedUntil.After(now) {
+		m.users[i].LockedUntil = now
+		m.users[i].UpdatedAt = now
+	}
+	return nil
+}
+
+func (m *memoryDBRepo) InsertLoginAttempt(ctx context.Context, a models.LoginAttempt) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	a.ID = m.nextID("login_attempts")
+	a.Email = strings.ToLower(a.Email)
+	a.UpdatedAt = a.CreatedAt
+	m.loginAttempts = append(m.loginAttempts, a)
+	return nil
+}
+
+// GetLoginFailures counts the failed logins since the given time for an email address and for an ip address.
+// Failures for an email address from before its last successful login, or before its account's lockout ended,
+// are not counted
+func (m *memoryDBRepo) GetLoginFailures(ctx context.Context, email, ip string, since time.Time) (models.LoginFailures, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	email = strings.ToLower(email)
+	afterLogin, afterLock := since, since
+	for _, a := range m.loginAttempts {
+		if a.Email == email && a.Outcome == models.LoginSucceeded && a.CreatedAt.After(afterLogin) {
+			afterLogin = a.CreatedAt
+		}
+	}
+	for _, u := range m.users {
+		if strings.ToLower(u.Email) == email && !u.LockedUntil.IsZero() {
+			afterLock = u.LockedUntil
+		}
+	}
+
+	var f models.LoginFailures
+	for _, a := range m.loginAttempts {
+		if a.Outcome != models.LoginFailed || !a.CreatedAt.After(since) {
+			continue
+		}
+		if a.Email == email && a.CreatedAt.After(afterLogin) && a.CreatedAt.After(afterLock) {
+			f.ByEmail++
+			if a.CreatedAt.After(f.LastByEmail) {
+				f.LastByEmail = a.CreatedAt
+			}
+		}
+		if a.IPAddress == ip {
+			f.ByIP++
+			if a.CreatedAt.After(f.LastByIP) {
+				f.LastByIP = a.CreatedAt
+			}
+		}
+	}
+	return f, nil
+}
+
+func (m *memoryDBRepo) RecentFailedLogins(ctx context.Context, limit int) ([]models.LoginAttempt, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var attempts []models.LoginAttempt
+	for _, a := range m.loginAttempts {
+		if a.Outcome != models.LoginSucceeded {
+			attempts = append(attempts, a)
+		}
+	}
+	sort.SliceStable(attempts, func(i, j int) bool { return attempts[i].CreatedAt.After(attempts[j].CreatedAt) })
+	if len(attempts) > limit {
+		attempts = attempts[:limit]
+	}
+	return attempts, nil
+}
+
+func (m *memoryDBRepo) InsertPasswordToken(ctx context.Context, t models.PasswordToken) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.userIndex(t.UserID) < 0 {
+		return missing("users", t.UserID)
+	}
+	for _, other := range m.passwordTokens {
+		if other.TokenHash == t.TokenHash {
+			return duplicate("password_tokens", "token_hash")
+		}
+	}
+
+	now := time.Now()
+	m.passwordTokens = append(m.passwordTokens, memoryPasswordToken{PasswordToken: models.PasswordToken{
+		ID:        m.nextID("password_tokens"),
+		UserID:    t.UserID,
+		TokenHash: t.TokenHash,
+		Purpose:   t.Purpose,
+		ExpiresAt: t.ExpiresAt,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}})
+	return nil
+}
+
+// GetPasswordToken returns an unused, unexpired password token and its user by the token's hash
+func (m *memoryDBRepo) GetPasswordToken(ctx context.Context, hash string) (models.PasswordToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for _, t := range m.passwordTokens {
+		if t.TokenHash != hash || !t.UsedAt.IsZero() || !t.ExpiresAt.After(now) {
+			continue
+		}
+		i := m.userIndex(t.UserID)
+		if i < 0 || m.users[i].Disabled {
+			continue
+		}
+		u := m.users[i]
+		pt := t.PasswordToken
+		pt.User = models.User{ID: u.ID, FirstName: u.FirstName, LastName: u.LastName, Email: u.Email,
+			AccessLevel: u.AccessLevel}
+		return pt, nil
+	}
+	return models.PasswordToken{}, repository.ErrInvalidToken
+}
+
+// ResetPassword uses up a password token, and any others issued to its user, and sets the user's password,
+// returning repository.ErrInvalidToken if the token has expired or was already used
+func (m *memoryDBRepo) ResetPassword(ctx context.Context, tokenHash, hashedPassword string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	userID := 0
+	for _, t := range m.passwordTokens {
+		if t.TokenHash == tokenHash && t.UsedAt.IsZero() && t.ExpiresAt.After(now) {
+			userID = t.UserID
+		}
+	}
+	if userID == 0 {
+		return repository.ErrInvalidToken
+	}
+
+	if i := m.userIndex(userID); i >= 0 {
+		m.users[i].Password = hashedPassword
+		m.users[i].UpdatedAt = now
+	}
+	for i := range m.passwordTokens {
+		if t := &m.passwordTokens[i]; t.UserID == userID && t.UsedAt.IsZero() {
+			t.UsedAt, t.UpdatedAt = now, now
+		}
+	}
+	return nil
+}
+
+func (m *memoryDBRepo) Authenticate(ctx context.Context, email, testPassword string) (int, string, error) {
+	m.mu.Lock()
+	var hashedPassword string
+	id := 0
+	for _, u := range m.users {
+		if u.Email == email && !u.Disabled {
+			id, hashedPassword = u.ID, u.Password
+		}
+	}
+	m.mu.Unlock()
+
+	if id == 0 {
+		return 0, "", sql.ErrNoRows
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(testPassword))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return 0, "", errors.New("incorrect password")
+	} else if err != nil {
+		return 0, "", err
+	}
+	return id, hashedPassword, nil
+}
+
+// matchesReservation reports whether a filter keeps a reservation, as reservationConditions does
+func matchesReservation(f models.ReservationFilter, res models.Reservation) bool {
+	for _, word := range strings.Fields(strings.ToLower(f.Search)) {
+		found := false
+		for _, s := range []string{res.FirstName, res.LastName, res.Email, res.Phone} {
+			found = found || strings.HasPrefix(strings.ToLower(s), word)
+		}
+		if !found {
+			return false
+		}
+	}
+	if f.RoomID > 0 && res.RoomID != f.RoomID {
+		return false
+	}
+	if !f.From.IsZero() && !res.EndDate.After(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && res.StartDate.After(f.To) {
+		return false
+	}
+	switch f.Processed {
+	case models.ReservationsNew:
+		return res.Processed == 0
+	case models.ReservationsProcessed:
+		return res.Processed != 0
+	}
+	return true
+}
+
+// compareReservations orders two reservations as reservationOrder does, ascending, returning a negative number if
+// a comes first
+func compareReservations(sortBy string, a, b models.Reservation) int {
+	var keys []int
+	switch sortBy {
+	case models.SortByID:
+	case models.SortByName:
+		keys = []int{
+			strings.Compare(strings.ToLower(a.LastName), strings.ToLower(b.LastName)),
+			strings.Compare(strings.ToLower(a.FirstName), strings.ToLower(b.FirstName)),
+		}
+	case models.SortByRoom:
+		keys = []int{strings.Compare(a.Room.RoomName, b.Room.RoomName), a.StartDate.Compare(b.StartDate)}
+	case models.SortByDeparture:
+		keys = []int{a.EndDate.Compare(b.EndDate)}
+	case models.SortByBooked:
+		keys = []int{a.CreatedAt.Compare(b.CreatedAt)}
+	default:
+		keys = []int{a.StartDate.Compare(b.StartDate)}
+	}
+	for _, k := range append(keys, a.ID-b.ID) {
+		if k != 0 {
+			return k
+		}
+	}
+	return 0
+}
+
+func (m *memoryDBRepo) SearchReservations(ctx context.Context, f models.ReservationFilter) ([]models.Reservation, int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var reservations []models.Reservation
+	for _, res := range m.reservations {
+		if matchesReservation(f, res) {
+			res.ConfirmationCode = ""
+			reservations = append(reservations, m.withRoom(res))
+		}
+	}
+	sort.Slice(reservations, func(i, j int) bool {
+		c := compareReservations(f.Sort, reservations[i], reservations[j])
+		if f.Desc {
+			return c > 0
+		}
+		return c < 0
+	})
+
+	total := len(reservations)
+	if f.PerPage > 0 {
+		from := min((max(f.Page, 1)-1)*f.PerPage, total)
+		reservations = reservations[from:min(from+f.PerPage, total)]
+	}
+	return reservations, total, nil
+}
+
+func (m *memoryDBRepo) EachReservation(ctx context.Context, f models.ReservationFilter, fn func(models.Reservation) error) error {
+	reservations, _, err := m.SearchReservations(ctx, f)
+	if err != nil {
+		return err
+	}
+	// fn is called without holding the lock, so that it may use the repository too
+	for _, res := range reservations {
+		if err := fn(res); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *memoryDBRepo) GetReservationById(ctx context.Context, id int) (models.Reservation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.reservationIndex(id)
+	if i < 0 {
+		return models.Reservation{}, sql.ErrNoRows
+	}
+	return m.withRoom(m.reservations[i]), nil
+}
+
+func (m *memoryDBRepo) GetReservationByCode(ctx context.Context, code string) (models.Reservation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, res := range m.reservations {
+		if res.ConfirmationCode == code {
+			return m.withRoom(res), nil
+		}
+	}
+	return models.Reservation{}, sql.ErrNoRows
+}
+
+// ChangeReservationDates moves a reservation and its room restriction to new dates, returning
+// repository.ErrRoomUnavailable if another booking or block overlaps the new dates
+func (m *memoryDBRepo) ChangeReservationDates(ctx context.Context, res models.Reservation) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.roomIndex(res.RoomID) < 0 {
+		return sql.ErrNoRows
+	}
+	if m.blocked(res.RoomID, res.StartDate, res.EndDate, res.ID) {
+		return repository.ErrRoomUnavailable
+	}
+
+	now := time.Now()
+	if i := m.reservationIndex(res.ID); i >= 0 {
+		r := &m.reservations[i]
+		r.StartDate, r.EndDate, r.TotalPrice, r.UpdatedAt = res.StartDate, res.EndDate, res.TotalPrice, now
+	}
+	for i := range m.roomRestrictions {
+		if rr := &m.roomRestrictions[i]; rr.ReservationID == res.ID {
+			rr.StartDate, rr.EndDate, rr.UpdatedAt = res.StartDate, res.EndDate, now
+		}
+	}
+	return nil
+}
+
+func (m *memoryDBRepo) UpdateReservation(ctx context.Context, u models.Reservation) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if i := m.reservationIndex(u.ID); i >= 0 {
+		r := &m.reservations[i]
+		r.FirstName, r.LastName, r.Email, r.Phone, r.UpdatedAt = u.FirstName, u.LastName, u.Email, u.Phone, time.Now()
+	}
+	return nil
+}
+
+func (m *memoryDBRepo) UpdateProcessedForReservation(ctx context.Context, id, processed int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if i := m.reservationIndex(id); i >= 0 {
+		m.reservations[i].Processed = processed
+	}
+	return nil
+}
+
+// DeleteReservation deletes a reservation, along with its room restriction
+func (m *memoryDBRepo) DeleteReservation(ctx context.Context, id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.deleteReservations(func(res models.Reservation) bool { return res.ID == id })
+	return nil
+}
+
+// AllRestrictions returns every restriction type, the ones the application relies on first
+func (m *memoryDBRepo) AllRestrictions(ctx context.Context) ([]models.Restriction, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	restrictions := append([]models.Restriction(nil), m.restrictions...)
+	sort.SliceStable(restrictions, func(i, j int) bool {
+		return restrictions[i].SystemKey != "" && restrictions[j].SystemKey == ""
+	})
+	return restrictions, nil
+}
+
+func (m *memoryDBRepo) GetRestrictionByID(ctx context.Context, id int) (models.Restriction, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.restrictionIndex(id)
+	if i < 0 {
+		return models.Restriction{}, sql.ErrNoRows
+	}
+	return m.restrictions[i], nil
+}
+
+func (m *memoryDBRepo) InsertRestriction(ctx context.Context, r models.Restriction) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	m.restrictions = append(m.restrictions, models.Restriction{
+		ID:              m.nextID("restrictions"),
+		RestrictionName: r.RestrictionName,
+		Colour:          r.Colour,
+		BlocksBooking:   r.BlocksBooking,
+		GuestVisible:    r.GuestVisible,
+		CreatedAt:       now,
+		UpdatedAt:       now,
+	})
+	return m.restrictions[len(m.restrictions)-1].ID, nil
+}
+
+// UpdateRestriction changes a restriction type's settings. Its system key never changes
+func (m *memoryDBRepo) UpdateRestriction(ctx context.Context, r models.Restriction) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if i := m.restrictionIndex(r.ID); i >= 0 {
+		rt := &m.restrictions[i]
+		rt.RestrictionName, rt.Colour, rt.BlocksBooking, rt.GuestVisible = r.RestrictionName, r.Colour,
+			r.BlocksBooking, r.GuestVisible
+		rt.UpdatedAt = time.Now()
+	}
+	return nil
+}
+
+// DeleteRestriction deletes a restriction type, returning repository.ErrRestrictionInUse if the application
+// relies on it or rooms are still restricted by it
+func (m *memoryDBRepo) DeleteRestriction(ctx context.Context, id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.restrictionIndex(id)
+	if i < 0 || m.restrictions[i].SystemKey != "" {
+		return repository.ErrRestrictionInUse
+	}
+	for _, rr := range m.roomRestrictions {
+		if rr.RestrictionID == id {
+			return repository.ErrRestrictionInUse
+		}
+	}
+	m.restrictions = append(m.restrictions[:i], m.restrictions[i+1:]...)
+	return nil
+}
+
+// isBlock reports whether a room restriction is one the owners put on by hand, rather than a reservation's or one
+// synced from an external calendar
+func isBlock(rr models.RoomRestriction) bool {
+	return rr.ReservationID == 0 && rr.ICalFeedID == 0
+}
+
+func (m *memoryDBRepo) GetBlockByID(ctx context.Context, id int) (models.RoomRestriction, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, rr := range m.roomRestrictions {
+		if rr.ID != id || !isBlock(rr) {
+			continue
+		}
+		b := models.RoomRestriction{ID: rr.ID, RoomID: rr.RoomID, RestrictionID: rr.RestrictionID,
+			StartDate: rr.StartDate, EndDate: rr.EndDate, Note: rr.Note, CreatedAt: rr.CreatedAt, UpdatedAt: rr.UpdatedAt}
+		if i := m.roomIndex(rr.RoomID); i >= 0 {
+			b.Room.ID, b.Room.RoomName = m.rooms[i].ID, m.rooms[i].RoomName
+		}
+		return b, nil
+	}
+	return models.RoomRestriction{}, sql.ErrNoRows
+}
+
+func (m *memoryDBRepo) InsertBlock(ctx context.Context, b models.RoomRestriction) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.insertRoomRestriction(models.RoomRestriction{StartDate: b.StartDate, EndDate: b.EndDate,
+		RoomID: b.RoomID, RestrictionID: b.RestrictionID, Note: b.Note})
+}
+
+func (m *memoryDBRepo) UpdateBlock(ctx context.Context, b models.RoomRestriction) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range m.roomRestrictions {
+		rr := &m.roomRestrictions[i]
+		if rr.ID != b.ID || !isBlock(*rr) {
+			continue
+		}
+		if m.roomIndex(b.RoomID) < 0 {
+			return missing("rooms", b.RoomID)
+		}
+		if m.restrictionIndex(b.RestrictionID) < 0 {
+			return missing("restrictions", b.RestrictionID)
+		}
+		rr.StartDate, rr.EndDate, rr.RoomID, rr.RestrictionID, rr.Note = b.StartDate, b.EndDate, b.RoomID,
+			b.RestrictionID, b.Note
+		rr.UpdatedAt = time.Now()
+	}
+	return nil
+}
+
+// DeleteBlockById deletes a block. Reservations and synced blocks have to be removed their own way
+func (m *memoryDBRepo) DeleteBlockById(ctx context.Context, id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.deleteRoomRestrictions(func(rr models.RoomRestriction) bool { return rr.ID == id && isBlock(rr) })
+	return nil
+}
+
+// GetRestrictionsForRoomByDate returns a room's restrictions that overlap the dates, with their types
+func (m *memoryDBRepo) GetRestrictionsForRoomByDate(ctx context.Context, roomID int, start, end time.Time) ([]models.RoomRestriction, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var restrictions []models.RoomRestriction
+	for _, rr := range m.roomRestrictions {
+		// the sql includes restrictions starting on the end date
+		if rr.RoomID != roomID || !start.Before(rr.EndDate) || end.Before(rr.StartDate) {
+			continue
+		}
+		r := models.RoomRestriction{ID: rr.ID, ReservationID: rr.ReservationID, RestrictionID: rr.RestrictionID,
+			RoomID: rr.RoomID, ICalFeedID: rr.ICalFeedID, StartDate: rr.StartDate, EndDate: rr.EndDate, Note: rr.Note}
+		if i := m.restrictionIndex(rr.RestrictionID); i >= 0 {
+			r.Restriction = m.restrictions[i]
+			r.Restriction.CreatedAt, r.Restriction.UpdatedAt = time.Time{}, time.Time{}
+		}
+		restrictions = append(restrictions, r)
+	}
+	return restrictions, nil
+}
+
+func (m *memoryDBRepo) EachRoomRestriction(ctx context.Context, start, end time.Time, fn func(models.RoomRestriction) error) error {
+	m.mu.Lock()
+	var restrictions []models.RoomRestriction
+	for _, rr := range m.roomRestrictions {
+		if !start.Before(rr.EndDate) || !end.After(rr.StartDate) {
+			continue
+		}
+		r := models.RoomRestriction{ID: rr.ID, ReservationID: rr.ReservationID, RestrictionID: rr.RestrictionID,
+			RoomID: rr.RoomID, ICalFeedID: rr.ICalFeedID, StartDate: rr.StartDate, EndDate: rr.EndDate, Note: rr.Note}
+		if i := m.restrictionIndex(rr.RestrictionID); i >= 0 {
+			r.Restriction = m.restrictions[i]
+			r.Restriction.CreatedAt, r.Restriction.UpdatedAt = time.Time{}, time.Time{}
+		}
+		restrictions = append(restrictions, r)
+	}
+	m.mu.Unlock()
+
+	sort.Slice(restrictions, func(i, j int) bool {
+		a, b := restrictions[i], restrictions[j]
+		if a.RoomID != b.RoomID {
+			return a.RoomID < b.RoomID
+		}
+		if !a.StartDate.Equal(b.StartDate) {
+			return a.StartDate.Before(b.StartDate)
+		}
+		return a.ID < b.ID
+	})
+	// fn is called without holding the lock, so that it may use the repository too
+	for _, rr := range restrictions {
+		if err := fn(rr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *memoryDBRepo) AllICalFeeds(ctx context.Context) ([]models.ICalFeed, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	feeds := append([]models.ICalFeed(nil), m.icalFeeds...)
+	sort.SliceStable(feeds, func(i, j int) bool {
+		if feeds[i].RoomID != feeds[j].RoomID {
+			return feeds[i].RoomID < feeds[j].RoomID
+		}
+		return feeds[i].Name < feeds[j].Name
+	})
+	return feeds, nil
+}
+
+func (m *memoryDBRepo) GetICalFeedsForRoom(ctx context.Context, roomID int) ([]models.ICalFeed, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var feeds []models.ICalFeed
+	for _, f := range m.icalFeeds {
+		if f.RoomID == roomID {
+			feeds = append(feeds, f)
+		}
+	}
+	sort.SliceStable(feeds, func(i, j int) bool { return feeds[i].Name < feeds[j].Name })
+	return feeds, nil
+}
+
+func (m *memoryDBRepo) GetICalFeedByID(ctx context.Context, id int) (models.ICalFeed, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.feedIndex(id)
+	if i < 0 {
+		return models.ICalFeed{}, sql.ErrNoRows
+	}
+	return m.icalFeeds[i], nil
+}
+
+func (m *memoryDBRepo) InsertICalFeed(ctx context.Context, f models.ICalFeed) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.roomIndex(f.RoomID) < 0 {
+		return 0, missing("rooms", f.RoomID)
+	}
+
+	now := time.Now()
+	m.icalFeeds = append(m.icalFeeds, models.ICalFeed{
+		ID:        m.nextID("ical_feeds"),
+		RoomID:    f.RoomID,
+		Name:      f.Name,
+		URL:       f.URL,
+		Contents:  f.Contents,
+		CreatedAt: now,
+		UpdatedAt: now,
+	})
+	return m.icalFeeds[len(m.icalFeeds)-1].ID, nil
+}
+
+func (m *memoryDBRepo) UpdateICalFeedStatus(ctx context.Context, f models.ICalFeed) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if i := m.feedIndex(f.ID); i >= 0 {
+		feed := &m.icalFeeds[i]
+		feed.LastSyncedAt, feed.LastError, feed.UpdatedAt = f.LastSyncedAt, f.LastError, time.Now()
+	}
+	return nil
+}
+
+// DeleteICalFeed removes an external calendar, along with the blocks synced from it
+func (m *memoryDBRepo) DeleteICalFeed(ctx context.Context, id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.feedIndex(id)
+	if i < 0 {
+		return nil
+	}
+	m.icalFeeds = append(m.icalFeeds[:i], m.icalFeeds[i+1:]...)
+	m.deleteRoomRestrictions(func(rr models.RoomRestriction) bool { return rr.ICalFeedID == id })
+	return nil
+}
+
+func (m *memoryDBRepo) GetICalFeedRestrictions(ctx context.Context, feedID int) ([]models.RoomRestriction, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var restrictions []models.RoomRestriction
+	for _, rr := range m.roomRestrictions {
+		if rr.ICalFeedID == feedID {
+			restrictions = append(restrictions, models.RoomRestriction{ID: rr.ID, RestrictionID: rr.RestrictionID,
+				RoomID: rr.RoomID, ICalFeedID: rr.ICalFeedID, ICalUID: rr.ICalUID, StartDate: rr.StartDate,
+				EndDate: rr.EndDate})
+		}
+	}
+	sort.SliceStable(restrictions, func(i, j int) bool {
+		return restrictions[i].StartDate.Before(restrictions[j].StartDate)
+	})
+	return restrictions, nil
+}
+
+// ReplaceICalFeedRestrictions makes an external calendar's blocks match restrictions: events already synced keep
+// their row and have their dates updated, new ones are inserted, and ones no longer in the calendar are removed
+func (m *memoryDBRepo) ReplaceICalFeedRestrictions(ctx context.Context, f models.ICalFeed, restrictions []models.RoomRestriction) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	external, ok := m.restrictionBySystemKey(models.RestrictionExternal)
+	if !ok {
+		return missing("restrictions", 0)
+	}
+
+	now := time.Now()
+	synced := make(map[string]bool)
+	for _, r := range restrictions {
+		synced[r.ICalUID] = true
+
+		updated := false
+		for i := range m.roomRestrictions {
+			if rr := &m.roomRestrictions[i]; rr.ICalFeedID == f.ID && rr.ICalUID == r.ICalUID {
+				rr.StartDate, rr.EndDate, rr.UpdatedAt = r.StartDate, r.EndDate, now
+				updated = true
+			}
+		}
+		if updated {
+			continue
+		}
+		_, err := m.insertRoomRestriction(models.RoomRestriction{StartDate: r.StartDate, EndDate: r.EndDate,
+			RoomID: f.RoomID, RestrictionID: external.ID, ICalFeedID: f.ID, ICalUID: r.ICalUID})
+		if err != nil {
+			return err
+		}
+	}
+
+	m.deleteRoomRestrictions(func(rr models.RoomRestriction) bool {
+		return rr.ICalFeedID == f.ID && !synced[rr.ICalUID]
+	})
+	return nil
+}
+
+// queueMail adds an email to the outbox, the lock already held
+func (m *memoryDBRepo) queueMail(mail models.MailData) int {
+	now := time.Now()
+	m.outbox = append(m.outbox, models.OutboxMessage{
+		ID:            m.nextID("mail_outbox"),
+		Mail:          mail,
+		Status:        models.MailPending,
+		NextAttemptAt: now,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	})
+	return m.outbox[len(m.outbox)-1].ID
+}
+
+func (m *memoryDBRepo) QueueMail(ctx context.Context, mail models.MailData) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.queueMail(mail), nil
+}
+
+// ClaimMail takes the pending message that has waited longest for its next attempt, if one is due by now, and
+// holds it until leaseUntil. Returns sql.ErrNoRows when nothing is due
+func (m *memoryDBRepo) ClaimMail(ctx context.Context, now, leaseUntil time.Time) (models.OutboxMessage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	claim := -1
+	for i, o := range m.outbox {
+		if o.Status != models.MailPending || o.NextAttemptAt.After(now) {
+			continue
+		}
+		if claim < 0 || o.NextAttemptAt.Before(m.outbox[claim].NextAttemptAt) {
+			claim = i
+		}
+	}
+	if claim < 0 {
+		return models.OutboxMessage{}, sql.ErrNoRows
+	}
+
+	m.outbox[claim].NextAttemptAt = leaseUntil
+	m.outbox[claim].UpdatedAt = now
+	return m.outbox[claim], nil
+}
+
+func (m *memoryDBRepo) UpdateMailStatus(ctx context.Context, o models.OutboxMessage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range m.outbox {
+		if msg := &m.outbox[i]; msg.ID == o.ID {
+			msg.Status, msg.Attempts, msg.NextAttemptAt, msg.LastError, msg.SentAt = o.Status, o.Attempts,
+				o.NextAttemptAt, o.LastError, o.SentAt
+			msg.UpdatedAt = time.Now()
+		}
+	}
+	return nil
+}
+
+// GetUnsentMail returns the messages that are waiting to be sent or were given up on, newest first
+func (m *memoryDBRepo) GetUnsentMail(ctx context.Context) ([]models.OutboxMessage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var messages []models.OutboxMessage
+	for i := len(m.outbox) - 1; i >= 0; i-- {
+		if o := m.outbox[i]; o.Status != models.MailSent {
+			o.SentAt = time.Time{}
+			messages = append(messages, o)
+		}
+	}
+	sort.SliceStable(messages, func(i, j int) bool { return messages[i].CreatedAt.After(messages[j].CreatedAt) })
+	return messages, nil
+}
+
+// ResendMail puts a message that has not been sent back in the queue with a fresh set of attempts. Returns
+// sql.ErrNoRows when there is no such unsent message
+func (m *memoryDBRepo) ResendMail(ctx context.Context, id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for i := range m.outbox {
+		if o := &m.outbox[i]; o.ID == id && o.Status != models.MailSent {
+			o.Status, o.Attempts, o.NextAttemptAt, o.LastError, o.UpdatedAt = models.MailPending, 0, now, "", now
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+func (m *memoryDBRepo) GetArrivalsWithoutEmail(ctx context.Context, kind string, from, to time.Time) ([]models.Reservation, error) {
+	return m.reservationsWithoutEmail(kind, from, to, func(res models.Reservation) time.Time { return res.StartDate })
+}
+
+func (m *memoryDBRepo) GetDeparturesWithoutEmail(ctx context.Context, kind string, from, to time.Time) ([]models.Reservation, error) {
+	return m.reservationsWithoutEmail(kind, from, to, func(res models.Reservation) time.Time { return res.EndDate })
+}
+
+// reservationsWithoutEmail returns the reservations whose date is between from and to, inclusive, that have no
+// record of the kind of email
+func (m *memoryDBRepo) reservationsWithoutEmail(kind string, from, to time.Time,
+	date func(models.Reservation) time.Time) ([]models.Reservation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var reservations []models.Reservation
+	for _, res := range m.reservations {
+		d := date(res)
+		if d.Before(from) || d.After(to) || m.reservationEmails[fmt.Sprintf("%d/%s", res.ID, kind)] {
+			continue
+		}
+		res.Processed = 0
+		reservations = append(reservations, m.withRoom(res))
+	}
+	sort.SliceStable(reservations, func(i, j int) bool {
+		return reservations[i].StartDate.Before(reservations[j].StartDate)
+	})
+	return reservations, nil
+}
+
+// QueueReservationEmail records that a reservation has been sent the kind of scheduled email and puts the email in
+// the outbox. Returns false, and queues nothing, if the reservation has already had this kind of email
+func (m *memoryDBRepo) QueueReservationEmail(ctx context.Context, reservationID int, kind string, mail models.MailData) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.reservationIndex(reservationID) < 0 {
+		return false, missing("reservations", reservationID)
+	}
+	key := fmt.Sprintf("%d/%s", reservationID, kind)
+	if m.reservationEmails[key] {
+		return false, nil
+	}
+	m.reservationEmails[key] = true
+	m.queueMail(mail)
+	return true, nil
+}
+
+// AllAPITokens returns every api token with the user it belongs to, newest first
+func (m *memoryDBRepo) AllAPITokens(ctx context.Context) ([]models.APIToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var tokens []models.APIToken
+	for i := len(m.apiTokens) - 1; i >= 0; i-- {
+		t := m.apiTokens[i]
+		t.TokenHash = ""
+		t.User = models.User{}
+		if j := m.userIndex(t.UserID); j >= 0 {
+			u := m.users[j]
+			t.User = models.User{ID: u.ID, FirstName: u.FirstName, LastName: u.LastName, Email: u.Email,
+				AccessLevel: u.AccessLevel}
+		}
+		tokens = append(tokens, t)
+	}
+	sort.SliceStable(tokens, func(i, j int) bool { return tokens[i].CreatedAt.After(tokens[j].CreatedAt) })
+	return tokens, nil
+}
+
+func (m *memoryDBRepo) InsertAPIToken(ctx context.Context, t models.APIToken) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.userIndex(t.UserID) < 0 {
+		return 0, missing("users", t.UserID)
+	}
+	for _, other := range m.apiTokens {
+		if other.TokenHash == t.TokenHash {
+			return 0, duplicate("api_tokens", "token_hash")
+		}
+	}
+
+	now := time.Now()
+	m.apiTokens = append(m.apiTokens, models.APIToken{
+		ID:        m.nextID("api_tokens"),
+		UserID:    t.UserID,
+		Name:      t.Name,
+		TokenHash: t.TokenHash,
+		CreatedAt: now,
+		UpdatedAt: now,
+	})
+	return m.apiTokens[len(m.apiTokens)-1].ID, nil
+}
+
+func (m *memoryDBRepo) DeleteAPIToken(ctx context.Context, id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, t := range m.apiTokens {
+		if t.ID == id {
+			m.apiTokens = append(m.apiTokens[:i], m.apiTokens[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// GetUserByAPITokenHash returns the user an api token was issued to, and records that the token was used
+func (m *memoryDBRepo) GetUserByAPITokenHash(ctx context.Context, hash string) (models.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range m.apiTokens {
+		t := &m.apiTokens[i]
+		if t.TokenHash != hash {
+			continue
+		}
+		j := m.userIndex(t.UserID)
+		if j < 0 || m.users[j].Disabled {
+			break
+		}
+		t.LastUsedAt = time.Now()
+		u := m.users[j]
+		return models.User{ID: u.ID, FirstName: u.FirstName, LastName: u.LastName, Email: u.Email,
+			AccessLevel: u.AccessLevel, CreatedAt: u.CreatedAt, UpdatedAt: u.UpdatedAt}, nil
+	}
+	return models.User{}, sql.ErrNoRows
+}
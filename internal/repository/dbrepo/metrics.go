@@ -0,0 +1,369 @@
+package dbrepo
+
+import (
+	"bookings/internal/metrics"
+	"bookings/internal/models"
+	"bookings/internal/repository"
+	"context"
+	"time"
+)
+
+// metricsDBRepo times every call to the repository it wraps, whichever database that repository uses
+type metricsDBRepo struct {
+	repo repository.DatabaseRepo
+}
+
+// NewMetricsRepo wraps repo so that how long each of its methods takes is recorded in metrics.DBDuration
+func NewMetricsRepo(repo repository.DatabaseRepo) repository.DatabaseRepo {
+	return &metricsDBRepo{repo: repo}
+}
+
+func (mr *metricsDBRepo) AllUsers(ctx context.Context) ([]models.User, error) {
+	defer metrics.ObserveQuery("AllUsers", time.Now())
+	return mr.repo.AllUsers(ctx)
+}
+
+func (mr *metricsDBRepo) AllRooms(ctx context.Context) ([]models.Room, error) {
+	defer metrics.ObserveQuery("AllRooms", time.Now())
+	return mr.repo.AllRooms(ctx)
+}
+
+func (mr *metricsDBRepo) InsertReservation(ctx context.Context, res models.Reservation) (int, error) {
+	defer metrics.ObserveQuery("InsertReservation", time.Now())
+	return mr.repo.InsertReservation(ctx, res)
+}
+
+func (mr *metricsDBRepo) InsertRoomRestriction(ctx context.Context, r models.RoomRestriction) error {
+	defer metrics.ObserveQuery("InsertRoomRestriction", time.Now())
+	return mr.repo.InsertRoomRestriction(ctx, r)
+}
+
+func (mr *metricsDBRepo) BookRoom(ctx context.Context, res models.Reservation) (int, error) {
+	defer metrics.ObserveQuery("BookRoom", time.Now())
+	return mr.repo.BookRoom(ctx, res)
+}
+
+func (mr *metricsDBRepo) SearchAvailabilityByDatesByRoomID(ctx context.Context, startDate, endDate time.Time, roomId int) (bool, error) {
+	defer metrics.ObserveQuery("SearchAvailabilityByDatesByRoomID", time.Now())
+	return mr.repo.SearchAvailabilityByDatesByRoomID(ctx, startDate, endDate, roomId)
+}
+
+func (mr *metricsDBRepo) SearchAvailabilityForAllRooms(ctx context.Context, startDate, endDate time.Time) ([]models.Room, error) {
+	defer metrics.ObserveQuery("SearchAvailabilityForAllRooms", time.Now())
+	return mr.repo.SearchAvailabilityForAllRooms(ctx, startDate, endDate)
+}
+
+func (mr *metricsDBRepo) GetRoomById(ctx context.Context, id int) (models.Room, error) {
+	defer metrics.ObserveQuery("GetRoomById", time.Now())
+	return mr.repo.GetRoomById(ctx, id)
+}
+
+func (mr *metricsDBRepo) GetRoomBySlug(ctx context.Context, slug string) (models.Room, error) {
+	defer metrics.ObserveQuery("GetRoomBySlug", time.Now())
+	return mr.repo.GetRoomBySlug(ctx, slug)
+}
+
+func (mr *metricsDBRepo) InsertRoom(ctx context.Context, r models.Room) (int, error) {
+	defer metrics.ObserveQuery("InsertRoom", time.Now())
+	return mr.repo.InsertRoom(ctx, r)
+}
+
+func (mr *metricsDBRepo) UpdateRoom(ctx context.Context, r models.Room) error {
+	defer metrics.ObserveQuery("UpdateRoom", time.Now())
+	return mr.repo.UpdateRoom(ctx, r)
+}
+
+func (mr *metricsDBRepo) UpdateRoomICalToken(ctx context.Context, id int, token string) error {
+	defer metrics.ObserveQuery("UpdateRoomICalToken", time.Now())
+	return mr.repo.UpdateRoomICalToken(ctx, id, token)
+}
+
+func (mr *metricsDBRepo) DeleteRoom(ctx context.Context, id int) error {
+	defer metrics.ObserveQuery("DeleteRoom", time.Now())
+	return mr.repo.DeleteRoom(ctx, id)
+}
+
+func (mr *metricsDBRepo) GetSeasonalRatesForRoom(ctx context.Context, roomID int, start, end time.Time) ([]models.SeasonalRate, error) {
+	defer metrics.ObserveQuery("GetSeasonalRatesForRoom", time.Now())
+	return mr.repo.GetSeasonalRatesForRoom(ctx, roomID, start, end)
+}
+
+func (mr *metricsDBRepo) InsertSeasonalRate(ctx context.Context, s models.SeasonalRate) (int, error) {
+	defer metrics.ObserveQuery("InsertSeasonalRate", time.Now())
+	return mr.repo.InsertSeasonalRate(ctx, s)
+}
+
+func (mr *metricsDBRepo) DeleteSeasonalRate(ctx context.Context, id int) error {
+	defer metrics.ObserveQuery("DeleteSeasonalRate", time.Now())
+	return mr.repo.DeleteSeasonalRate(ctx, id)
+}
+
+func (mr *metricsDBRepo) GetUserById(ctx context.Context, id int) (models.User, error) {
+	defer metrics.ObserveQuery("GetUserById", time.Now())
+	return mr.repo.GetUserById(ctx, id)
+}
+
+func (mr *metricsDBRepo) GetUserByEmail(ctx context.Context, email string) (models.User, error) {
+	defer metrics.ObserveQuery("GetUserByEmail", time.Now())
+	return mr.repo.GetUserByEmail(ctx, email)
+}
+
+func (mr *metricsDBRepo) InsertUser(ctx context.Context, u models.User) (int, error) {
+	defer metrics.ObserveQuery("InsertUser", time.Now())
+	return mr.repo.InsertUser(ctx, u)
+}
+
+func (mr *metricsDBRepo) UpdateUser(ctx context.Context, u models.User) error {
+	defer metrics.ObserveQuery("UpdateUser", time.Now())
+	return mr.repo.UpdateUser(ctx, u)
+}
+
+func (mr *metricsDBRepo) UpdatePassword(ctx context.Context, id int, hashedPassword string) error {
+	defer metrics.ObserveQuery("UpdatePassword", time.Now())
+	return mr.repo.UpdatePassword(ctx, id, hashedPassword)
+}
+
+func (mr *metricsDBRepo) SetUserDisabled(ctx context.Context, id int, disabled bool) error {
+	defer metrics.ObserveQuery("SetUserDisabled", time.Now())
+	return mr.repo.SetUserDisabled(ctx, id, disabled)
+}
+
+func (mr *metricsDBRepo) LockUser(ctx context.Context, id int, until time.Time) error {
+	defer metrics.ObserveQuery("LockUser", time.Now())
+	return mr.repo.LockUser(ctx, id, until)
+}
+
+func (mr *metricsDBRepo) UnlockUser(ctx context.Context, id int) error {
+	defer metrics.ObserveQuery("UnlockUser", time.Now())
+	return mr.repo.UnlockUser(ctx, id)
+}
+
+func (mr *metricsDBRepo) InsertLoginAttempt(ctx context.Context, a models.LoginAttempt) error {
+	defer metrics.ObserveQuery("InsertLoginAttempt", time.Now())
+	return mr.repo.InsertLoginAttempt(ctx, a)
+}
+
+func (mr *metricsDBRepo) GetLoginFailures(ctx context.Context, email, ip string, since time.Time) (models.LoginFailures, error) {
+	defer metrics.ObserveQuery("GetLoginFailures", time.Now())
+	return mr.repo.GetLoginFailures(ctx, email, ip, since)
+}
+
+func (mr *metricsDBRepo) RecentFailedLogins(ctx context.Context, limit int) ([]models.LoginAttempt, error) {
+	defer metrics.ObserveQuery("RecentFailedLogins", time.Now())
+	return mr.repo.RecentFailedLogins(ctx, limit)
+}
+
+func (mr *metricsDBRepo) InsertPasswordToken(ctx context.Context, t models.PasswordToken) error {
+	defer metrics.ObserveQuery("InsertPasswordToken", time.Now())
+	return mr.repo.InsertPasswordToken(ctx, t)
+}
+
+func (mr *metricsDBRepo) GetPasswordToken(ctx context.Context, hash string) (models.PasswordToken, error) {
+	defer metrics.ObserveQuery("GetPasswordToken", time.Now())
+	return mr.repo.GetPasswordToken(ctx, hash)
+}
+
+func (mr *metricsDBRepo) ResetPassword(ctx context.Context, tokenHash, hashedPassword string) error {
+	defer metrics.ObserveQuery("ResetPassword", time.Now())
+	return mr.repo.ResetPassword(ctx, tokenHash, hashedPassword)
+}
+
+func (mr *metricsDBRepo) Authenticate(ctx context.Context, email, testPassword string) (int, string, error) {
+	defer metrics.ObserveQuery("Authenticate", time.Now())
+	return mr.repo.Authenticate(ctx, email, testPassword)
+}
+
+func (mr *metricsDBRepo) SearchReservations(ctx context.Context, f models.ReservationFilter) ([]models.Reservation, int, error) {
+	defer metrics.ObserveQuery("SearchReservations", time.Now())
+	return mr.repo.SearchReservations(ctx, f)
+}
+
+func (mr *metricsDBRepo) EachReservation(ctx context.Context, f models.ReservationFilter, fn func(models.Reservation) error) error {
+	defer metrics.ObserveQuery("EachReservation", time.Now())
+	return mr.repo.EachReservation(ctx, f, fn)
+}
+
+func (mr *metricsDBRepo) GetReservationById(ctx context.Context, id int) (models.Reservation, error) {
+	defer metrics.ObserveQuery("GetReservationById", time.Now())
+	return mr.repo.GetReservationById(ctx, id)
+}
+
+func (mr *metricsDBRepo) GetReservationByCode(ctx context.Context, code string) (models.Reservation, error) {
+	defer metrics.ObserveQuery("GetReservationByCode", time.Now())
+	return mr.repo.GetReservationByCode(ctx, code)
+}
+
+func (mr *metricsDBRepo) ChangeReservationDates(ctx context.Context, res models.Reservation) error {
+	defer metrics.ObserveQuery("ChangeReservationDates", time.Now())
+	return mr.repo.ChangeReservationDates(ctx, res)
+}
+
+func (mr *metricsDBRepo) UpdateReservation(ctx context.Context, u models.Reservation) error {
+	defer metrics.ObserveQuery("UpdateReservation", time.Now())
+	return mr.repo.UpdateReservation(ctx, u)
+}
+
+func (mr *metricsDBRepo) UpdateProcessedForReservation(ctx context.Context, id, processed int) error {
+	defer metrics.ObserveQuery("UpdateProcessedForReservation", time.Now())
+	return mr.repo.UpdateProcessedForReservation(ctx, id, processed)
+}
+
+func (mr *metricsDBRepo) DeleteReservation(ctx context.Context, id int) error {
+	defer metrics.ObserveQuery("DeleteReservation", time.Now())
+	return mr.repo.DeleteReservation(ctx, id)
+}
+
+func (mr *metricsDBRepo) AllRestrictions(ctx context.Context) ([]models.Restriction, error) {
+	defer metrics.ObserveQuery("AllRestrictions", time.Now())
+	return mr.repo.AllRestrictions(ctx)
+}
+
+func (mr *metricsDBRepo) GetRestrictionByID(ctx context.Context, id int) (models.Restriction, error) {
+	defer metrics.ObserveQuery("GetRestrictionByID", time.Now())
+	return mr.repo.GetRestrictionByID(ctx, id)
+}
+
+func (mr *metricsDBRepo) InsertRestriction(ctx context.Context, r models.Restriction) (int, error) {
+	defer metrics.ObserveQuery("InsertRestriction", time.Now())
+	return mr.repo.InsertRestriction(ctx, r)
+}
+
+func (mr *metricsDBRepo) UpdateRestriction(ctx context.Context, r models.Restriction) error {
+	defer metrics.ObserveQuery("UpdateRestriction", time.Now())
+	return mr.repo.UpdateRestriction(ctx, r)
+}
+
+func (mr *metricsDBRepo) DeleteRestriction(ctx context.Context, id int) error {
+	defer metrics.ObserveQuery("DeleteRestriction", time.Now())
+	return mr.repo.DeleteRestriction(ctx, id)
+}
+
+func (mr *metricsDBRepo) GetBlockByID(ctx context.Context, id int) (models.RoomRestriction, error) {
+	defer metrics.ObserveQuery("GetBlockByID", time.Now())
+	return mr.repo.GetBlockByID(ctx, id)
+}
+
+func (mr *metricsDBRepo) InsertBlock(ctx context.Context, b models.RoomRestriction) (int, error) {
+	defer metrics.ObserveQuery("InsertBlock", time.Now())
+	return mr.repo.InsertBlock(ctx, b)
+}
+
+func (mr *metricsDBRepo) UpdateBlock(ctx context.Context, b models.RoomRestriction) error {
+	defer metrics.ObserveQuery("UpdateBlock", time.Now())
+	return mr.repo.UpdateBlock(ctx, b)
+}
+
+func (mr *metricsDBRepo) DeleteBlockById(ctx context.Context, id int) error {
+	defer metrics.ObserveQuery("DeleteBlockById", time.Now())
+	return mr.repo.DeleteBlockById(ctx, id)
+}
+
+func (mr *metricsDBRepo) GetRestrictionsForRoomByDate(ctx context.Context, roomID int, start, end time.Time) ([]models.RoomRestriction, error) {
+	defer metrics.ObserveQuery("GetRestrictionsForRoomByDate", time.Now())
+	return mr.repo.GetRestrictionsForRoomByDate(ctx, roomID, start, end)
+}
+
+func (mr *metricsDBRepo) EachRoomRestriction(ctx context.Context, start, end time.Time, fn func(models.RoomRestriction) error) error {
+	defer metrics.ObserveQuery("EachRoomRestriction", time.Now())
+	return mr.repo.EachRoomRestriction(ctx, start, end, fn)
+}
+
+func (mr *metricsDBRepo) AllICalFeeds(ctx context.Context) ([]models.ICalFeed, error) {
+	defer metrics.ObserveQuery("AllICalFeeds", time.Now())
+	return mr.repo.AllICalFeeds(ctx)
+}
+
+func (mr *metricsDBRepo) GetICalFeedsForRoom(ctx context.Context, roomID int) ([]models.ICalFeed, error) {
+	defer metrics.ObserveQuery("GetICalFeedsForRoom", time.Now())
+	return mr.repo.GetICalFeedsForRoom(ctx, roomID)
+}
+
+func (mr *metricsDBRepo) GetICalFeedByID(ctx context.Context, id int) (models.ICalFeed, error) {
+	defer metrics.ObserveQuery("GetICalFeedByID", time.Now())
+	return mr.repo.GetICalFeedByID(ctx, id)
+}
+
+func (mr *metricsDBRepo) InsertICalFeed(ctx context.Context, f models.ICalFeed) (int, error) {
+	defer metrics.ObserveQuery("InsertICalFeed", time.Now())
+	return mr.repo.InsertICalFeed(ctx, f)
+}
+
+func (mr *metricsDBRepo) UpdateICalFeedStatus(ctx context.Context, f models.ICalFeed) error {
+	defer metrics.ObserveQuery("UpdateICalFeedStatus", time.Now())
+	return mr.repo.UpdateICalFeedStatus(ctx, f)
+}
+
+func (mr *metricsDBRepo) DeleteICalFeed(ctx context.Context, id int) error {
+	defer metrics.ObserveQuery("DeleteICalFeed", time.Now())
+	return mr.repo.DeleteICalFeed(ctx, id)
+}
+
+func (mr *metricsDBRepo) GetICalFeedRestrictions(ctx context.Context, feedID int) ([]models.RoomRestriction, error) {
+	defer metrics.ObserveQuery("GetICalFeedRestrictions", time.Now())
+	return mr.repo.GetICalFeedRestrictions(ctx, feedID)
+}
+
+func (mr *metricsDBRepo) ReplaceICalFeedRestrictions(ctx context.Context, f models.ICalFeed, restrictions []models.RoomRestriction) error {
+	defer metrics.ObserveQuery("ReplaceICalFeedRestrictions", time.Now())
+	return mr.repo.ReplaceICalFeedRestrictions(ctx, f, restrictions)
+}
+
+func (mr *metricsDBRepo) GetArrivalsWithoutEmail(ctx context.Context, kind string, from, to time.Time) ([]models.Reservation, error) {
+	defer metrics.ObserveQuery("GetArrivalsWithoutEmail", time.Now())
+	return mr.repo.GetArrivalsWithoutEmail(ctx, kind, from, to)
+}
+
+func (mr *metricsDBRepo) GetDeparturesWithoutEmail(ctx context.Context, kind string, from, to time.Time) ([]models.Reservation, error) {
+	defer metrics.ObserveQuery("GetDeparturesWithoutEmail", time.Now())
+	return mr.repo.GetDeparturesWithoutEmail(ctx, kind, from, to)
+}
+
+func (mr *metricsDBRepo) QueueReservationEmail(ctx context.Context, reservationID int, kind string, m models.MailData) (bool, error) {
+	defer metrics.ObserveQuery("QueueReservationEmail", time.Now())
+	return mr.repo.QueueReservationEmail(ctx, reservationID, kind, m)
+}
+
+func (mr *metricsDBRepo) QueueMail(ctx context.Context, m models.MailData) (int, error) {
+	defer metrics.ObserveQuery("QueueMail", time.Now())
+	return mr.repo.QueueMail(ctx, m)
+}
+
+func (mr *metricsDBRepo) ClaimMail(ctx context.Context, now, leaseUntil time.Time) (models.OutboxMessage, error) {
+	defer metrics.ObserveQuery("ClaimMail", time.Now())
+	return mr.repo.ClaimMail(ctx, now, leaseUntil)
+}
+
+func (mr *metricsDBRepo) UpdateMailStatus(ctx context.Context, m models.OutboxMessage) error {
+	defer metrics.ObserveQuery("UpdateMailStatus", time.Now())
+	return mr.repo.UpdateMailStatus(ctx, m)
+}
+
+func (mr *metricsDBRepo) GetUnsentMail(ctx context.Context) ([]models.OutboxMessage, error) {
+	defer metrics.ObserveQuery("GetUnsentMail", time.Now())
+	return mr.repo.GetUnsentMail(ctx)
+}
+
+func (mr *metricsDBRepo) ResendMail(ctx context.Context, id int) error {
+	defer metrics.ObserveQuery("ResendMail", time.Now())
+	return mr.repo.ResendMail(ctx, id)
+}
+
+func (mr *metricsDBRepo) AllAPITokens(ctx context.Context) ([]models.APIToken, error) {
+	defer metrics.ObserveQuery("AllAPITokens", time.Now())
+	return mr.repo.AllAPITokens(ctx)
+}
+
+func (mr *metricsDBRepo) InsertAPIToken(ctx context.Context, t models.APIToken) (int, error) {
+	defer metrics.ObserveQuery("InsertAPIToken", time.Now())
+	return mr.repo.InsertAPIToken(ctx, t)
+}
+
+func (mr *metricsDBRepo) DeleteAPIToken(ctx context.Context, id int) error {
+	defer metrics.ObserveQuery("DeleteAPIToken", time.Now())
+	return mr.repo.DeleteAPIToken(ctx, id)
+}
+
+func (mr *metricsDBRepo) GetUserByAPITokenHash(ctx context.Context, hash string) (models.User, error) {
+	defer metrics.ObserveQuery("GetUserByAPITokenHash", time.Now())
+	return mr.repo.GetUserByAPITokenHash(ctx, hash)
+}
@@ -2,41 +2,112 @@ package dbrepo
 
 import (
 	"bookings/internal/models"
+	"bookings/internal/repository"
 	"context"
+	"database/sql"
 	"errors"
+	"fmt"
 	"golang.org/x/crypto/bcrypt"
-	"log"
+	"strings"
 	"time"
 )
 
-func (m *postgresDBRepo) AllUsers() bool {
-	return true
+// defaultQueryTimeout is how long a query may take when the configuration doesn't say
+const defaultQueryTimeout = 3 * time.Second
+
+// exportTimeout is the least time a query an export streams from is given, since it runs while the export is sent
+const exportTimeout = 5 * time.Minute
+
+// queryTimeout is the longest a single query may take
+func (m *postgresDBRepo) queryTimeout() time.Duration {
+	if m.App != nil && m.App.DBTimeout > 0 {
+		return m.App.DBTimeout
+	}
+	return defaultQueryTimeout
+}
+
+// withTimeout limits a query to the configured timeout, on top of any deadline ctx already has, so that it also
+// stops when the request it is for is cancelled
+func (m *postgresDBRepo) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, m.queryTimeout())
 }
 
-func (m *postgresDBRepo) AllRooms() ([]models.Room, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// AllUsers returns all users, ordered by name
+func (m *postgresDBRepo) AllUsers(ctx context.Context) ([]models.User, error) {
+	ctx, cancel := m.withTimeout(ctx)
 	defer cancel()
 
-	var rooms []models.Room
-	query := `select id, room_name, created_at, updated_at from rooms order by room_name`
+	var users []models.User
+	query := `select id, first_name, last_name, email, access_level, disabled, locked_until, created_at, updated_at
+			from users order by last_name, first_name`
 
 	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return users, err
+	}
 	defer rows.Close()
+
+	for rows.Next() {
+		var u models.User
+		var lockedUntil sql.NullTime
+		err := rows.Scan(
+			&u.ID,
+			&u.FirstName,
+			&u.LastName,
+			&u.Email,
+			&u.AccessLevel,
+			&u.Disabled,
+			&lockedUntil,
+			&u.CreatedAt,
+			&u.UpdatedAt,
+		)
+		if err != nil {
+			return users, err
+		}
+		u.LockedUntil = lockedUntil.Time
+		users = append(users, u)
+	}
+
+	if err = rows.Err(); err != nil {
+		return users, err
+	}
+	return users, nil
+}
+
+func (m *postgresDBRepo) AllRooms(ctx context.Context) ([]models.Room, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var rooms []models.Room
+	query := `select id, room_name, slug, description, capacity, photos, base_rate, weekend_surcharge, min_stay,
+			created_at, updated_at from rooms order by room_name`
+
+	rows, err := m.DB.QueryContext(ctx, query)
 	if err != nil {
 		return rooms, err
 	}
+	defer rows.Close()
 
 	for rows.Next() {
 		var rm models.Room
+		var photos string
 		err := rows.Scan(
 			&rm.ID,
 			&rm.RoomName,
+			&rm.Slug,
+			&rm.Description,
+			&rm.Capacity,
+			&photos,
+			&rm.BaseRate,
+			&rm.WeekendSurcharge,
+			&rm.MinStay,
 			&rm.CreatedAt,
 			&rm.UpdatedAt,
 		)
 		if err != nil {
 			return rooms, err
 		}
+		rm.Photos = splitPhotos(photos)
 		rooms = append(rooms, rm)
 	}
 
@@ -47,16 +118,17 @@ func (m *postgresDBRepo) AllRooms() ([]models.Room, error) {
 }
 
 // InsertReservation inserts a reservation into the database
-func (m *postgresDBRepo) InsertReservation(res models.Reservation) (int, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m *postgresDBRepo) InsertReservation(ctx context.Context, res models.Reservation) (int, error) {
+	ctx, cancel := m.withTimeout(ctx)
 	defer cancel()
 	var newID int
 
-	stmt := `insert into reservations (first_name, last_name, email, phone, start_date, end_date, room_id, created_at, updated_at) 
-			values ($1, $2, $3, $4, $5, $6, $7, $8, $9) returning id`
+	stmt := `insert into reservations (first_name, last_name, email, phone, start_date, end_date, room_id, total_price,
+			confirmation_code, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) returning id`
 
 	err := m.DB.QueryRowContext(ctx, stmt, res.FirstName, res.LastName, res.Email, res.Phone,
-		res.StartDate, res.EndDate, res.RoomID, time.Now(), time.Now()).Scan(&newID)
+		res.StartDate, res.EndDate, res.RoomID, res.TotalPrice, res.ConfirmationCode, time.Now(), time.Now()).Scan(&newID)
 	if err != nil {
 		return 0, err
 	}
@@ -64,8 +136,8 @@ func (m *postgresDBRepo) InsertReservation(res models.Reservation) (int, error)
 }
 
 // InsertRoomRestriction inserts a room restriction into the database
-func (m *postgresDBRepo) InsertRoomRestriction(res models.RoomRestriction) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m *postgresDBRepo) InsertRoomRestriction(ctx context.Context, res models.RoomRestriction) error {
+	ctx, cancel := m.withTimeout(ctx)
 	defer cancel()
 
 	stmt := `insert into room_restrictions(start_date, end_date, room_id, created_at, updated_at, reservation_id, restriction_id) 
@@ -78,14 +150,69 @@ func (m *postgresDBRepo) InsertRoomRestriction(res models.RoomRestriction) error
 	return nil
 }
 
+// BookRoom inserts a reservation and its room restriction in a single transaction. The room row is
+// locked while availability is re-checked, so two guests racing for the same dates cannot both be booked
+func (m *postgresDBRepo) BookRoom(ctx context.Context, res models.Reservation) (int, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// concurrent bookings for the same room wait here until the first one commits or rolls back
+	var roomID int
+	err = tx.QueryRowContext(ctx, `select id from rooms where id = $1 for update`, res.RoomID).Scan(&roomID)
+	if err != nil {
+		return 0, err
+	}
+
+	var numOfRows int
+	query := `select count(id) from room_restrictions where $1 < end_date and $2 > start_date and room_id = $3
+			and restriction_id in (select id from restrictions where blocks_booking)`
+	err = tx.QueryRowContext(ctx, query, res.StartDate, res.EndDate, res.RoomID).Scan(&numOfRows)
+	if err != nil {
+		return 0, err
+	}
+	if numOfRows > 0 {
+		return 0, repository.ErrRoomUnavailable
+	}
+
+	var newID int
+	stmt := `insert into reservations (first_name, last_name, email, phone, start_date, end_date, room_id, total_price,
+			confirmation_code, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) returning id`
+	err = tx.QueryRowContext(ctx, stmt, res.FirstName, res.LastName, res.Email, res.Phone,
+		res.StartDate, res.EndDate, res.RoomID, res.TotalPrice, res.ConfirmationCode, time.Now(), time.Now()).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	stmt = `insert into room_restrictions(start_date, end_date, room_id, created_at, updated_at, reservation_id, restriction_id)
+			values ($1, $2, $3, $4, $5, $6, (select id from restrictions where system_key = $7))`
+	_, err = tx.ExecContext(ctx, stmt, res.StartDate, res.EndDate, res.RoomID, time.Now(), time.Now(), newID,
+		models.RestrictionReservation)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+	return newID, nil
+}
+
 // SearchAvailabilityByDatesByRoomID returns true if an availablity exists and false if no availability exits
-func (m *postgresDBRepo) SearchAvailabilityByDatesByRoomID(startDate, endDate time.Time, roomId int) (bool, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m *postgresDBRepo) SearchAvailabilityByDatesByRoomID(ctx context.Context, startDate, endDate time.Time, roomId int) (bool, error) {
+	ctx, cancel := m.withTimeout(ctx)
 	defer cancel()
 
 	var numOfRows int
 
-	query := `select count(id) from room_restrictions where $1 < end_date and $2 > start_date and room_id = $3`
+	query := `select count(id) from room_restrictions where $1 < end_date and $2 > start_date and room_id = $3
+			and restriction_id in (select id from restrictions where blocks_booking)`
 	row := m.DB.QueryRowContext(ctx, query, startDate, endDate, roomId)
 	err := row.Scan(&numOfRows)
 	if err != nil {
@@ -98,29 +225,42 @@ func (m *postgresDBRepo) SearchAvailabilityByDatesByRoomID(startDate, endDate ti
 }
 
 // SearchAvailabilityForAllRooms returns a slice of available rooms, if any for a given date range
-func (m *postgresDBRepo) SearchAvailabilityForAllRooms(startDate, endDate time.Time) ([]models.Room, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m *postgresDBRepo) SearchAvailabilityForAllRooms(ctx context.Context, startDate, endDate time.Time) ([]models.Room, error) {
+	ctx, cancel := m.withTimeout(ctx)
 	defer cancel()
 	var rooms []models.Room
 
 	query := `
-		select r.id, r.room_name
+		select r.id, r.room_name, r.slug, r.description, r.capacity, r.photos, r.base_rate, r.weekend_surcharge, r.min_stay
 		from rooms r
-		where r.id not in (select rr.room_id from room_restrictions rr where $1 <rr.end_date and $2 >rr.start_date)`
+		where r.id not in (select rr.room_id from room_restrictions rr where $1 <rr.end_date and $2 >rr.start_date
+			and rr.restriction_id in (select id from restrictions where blocks_booking))
+		order by r.room_name`
 
 	rows, err := m.DB.QueryContext(ctx, query, startDate, endDate)
 	if err != nil {
 		return rooms, err
 	}
+	defer rows.Close()
+
 	for rows.Next() {
 		var room models.Room
+		var photos string
 		err := rows.Scan(
 			&room.ID,
 			&room.RoomName,
+			&room.Slug,
+			&room.Description,
+			&room.Capacity,
+			&photos,
+			&room.BaseRate,
+			&room.WeekendSurcharge,
+			&room.MinStay,
 		)
 		if err != nil {
 			return rooms, err
 		}
+		room.Photos = splitPhotos(photos)
 		rooms = append(rooms, room)
 	}
 
@@ -131,35 +271,137 @@ func (m *postgresDBRepo) SearchAvailabilityForAllRooms(startDate, endDate time.T
 }
 
 // GetRoomById gets a room by id
-func (m *postgresDBRepo) GetRoomById(id int) (models.Room, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m *postgresDBRepo) GetRoomById(ctx context.Context, id int) (models.Room, error) {
+	return m.getRoom(ctx, `where id = $1`, id)
+}
+
+// GetRoomBySlug gets a room by the slug used in its public url
+func (m *postgresDBRepo) GetRoomBySlug(ctx context.Context, slug string) (models.Room, error) {
+	return m.getRoom(ctx, `where slug = $1`, slug)
+}
+
+// getRoom returns the first room matching the where clause
+func (m *postgresDBRepo) getRoom(ctx context.Context, where string, args ...interface{}) (models.Room, error) {
+	ctx, cancel := m.withTimeout(ctx)
 	defer cancel()
 	var room models.Room
+	var photos string
 
-	query := `select id, room_name, created_at, updated_at from rooms where id =$1`
+	query := `select id, room_name, slug, description, capacity, photos, base_rate, weekend_surcharge, min_stay,
+			ical_token, created_at, updated_at from rooms ` + where
 
-	row := m.DB.QueryRowContext(ctx, query, id)
+	row := m.DB.QueryRowContext(ctx, query, args...)
 
 	err := row.Scan(
 		&room.ID,
 		&room.RoomName,
+		&room.Slug,
+		&room.Description,
+		&room.Capacity,
+		&photos,
+		&room.BaseRate,
+		&room.WeekendSurcharge,
+		&room.MinStay,
+		&room.ICalToken,
 		&room.CreatedAt,
 		&room.UpdatedAt)
 	if err != nil {
 		return room, err
-	} else {
-		return room, nil
 	}
+	room.Photos = splitPhotos(photos)
+	return room, nil
+}
+
+// InsertRoom inserts a room into the database
+func (m *postgresDBRepo) InsertRoom(ctx context.Context, r models.Room) (int, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	var newID int
+
+	stmt := `insert into rooms (room_name, slug, description, capacity, photos, base_rate, weekend_surcharge, min_stay,
+			ical_token, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) returning id`
+
+	err := m.DB.QueryRowContext(ctx, stmt, r.RoomName, r.Slug, r.Description, r.Capacity, joinPhotos(r.Photos),
+		r.BaseRate, r.WeekendSurcharge, r.MinStay, r.ICalToken, time.Now(), time.Now()).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+	return newID, nil
+}
+
+// UpdateRoom updates a room in the database
+func (m *postgresDBRepo) UpdateRoom(ctx context.Context, r models.Room) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `update rooms set room_name = $1, slug = $2, description = $3, capacity = $4, photos = $5,
+			base_rate = $6, weekend_surcharge = $7, min_stay = $8, updated_at = $9
+			where id = $10`
+
+	_, err := m.DB.ExecContext(ctx, stmt, r.RoomName, r.Slug, r.Description, r.Capacity, joinPhotos(r.Photos),
+		r.BaseRate, r.WeekendSurcharge, r.MinStay, time.Now(), r.ID)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// UpdateRoomICalToken replaces the token that protects a room's calendar feed
+func (m *postgresDBRepo) UpdateRoomICalToken(ctx context.Context, id int, token string) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `update rooms set ical_token = $1, updated_at = $2 where id = $3`,
+		token, time.Now(), id)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// DeleteRoom deletes a room, along with its blocks, rates and calendars, returning
+// repository.ErrRoomHasReservations if guests were ever booked into it, and sql.ErrNoRows if there is no such room
+func (m *postgresDBRepo) DeleteRoom(ctx context.Context, id int) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	// deleting a room would cascade to its reservations, so only rooms that were never let can go
+	stmt := `delete from rooms where id = $1
+			and not exists (select 1 from reservations where room_id = $1)`
+
+	result, err := m.DB.ExecContext(ctx, stmt, id)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+
+	var exists bool
+	err = m.DB.QueryRowContext(ctx, "select exists (select 1 from rooms where id = $1)", id).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return sql.ErrNoRows
+	}
+	return repository.ErrRoomHasReservations
 }
 
 // GetUserById returns a user by ID from postgres
-func (m *postgresDBRepo) GetUserById(id int) (models.User, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m *postgresDBRepo) GetUserById(ctx context.Context, id int) (models.User, error) {
+	ctx, cancel := m.withTimeout(ctx)
 	defer cancel()
 	var u models.User
+	var lockedUntil sql.NullTime
 
-	query := `select id, first_name, last_name, email, password, access_level, created_at, updated_at from users
-		where id = $1`
+	query := `select id, first_name, last_name, email, password, access_level, disabled, locked_until,
+		created_at, updated_at from users where id = $1`
 
 	row := m.DB.QueryRowContext(ctx, query, id)
 	err := row.Scan(
@@ -169,37 +411,113 @@ func (m *postgresDBRepo) GetUserById(id int) (models.User, error) {
 		&u.Email,
 		&u.Password,
 		&u.AccessLevel,
+		&u.Disabled,
+		&lockedUntil,
+		&u.CreatedAt,
+		&u.UpdatedAt)
+	if err != nil {
+		return u, err
+	}
+	u.LockedUntil = lockedUntil.Time
+	return u, nil
+}
+
+// GetUserByEmail returns a user by email address
+func (m *postgresDBRepo) GetUserByEmail(ctx context.Context, email string) (models.User, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	var u models.User
+	var lockedUntil sql.NullTime
+
+	query := `select id, first_name, last_name, email, password, access_level, disabled, locked_until,
+		created_at, updated_at from users where lower(email) = lower($1)`
+
+	row := m.DB.QueryRowContext(ctx, query, email)
+	err := row.Scan(
+		&u.ID,
+		&u.FirstName,
+		&u.LastName,
+		&u.Email,
+		&u.Password,
+		&u.AccessLevel,
+		&u.Disabled,
+		&lockedUntil,
 		&u.CreatedAt,
 		&u.UpdatedAt)
 	if err != nil {
 		return u, err
 	}
+	u.LockedUntil = lockedUntil.Time
 	return u, nil
 }
 
+// InsertUser adds a user, returning the new user's id
+func (m *postgresDBRepo) InsertUser(ctx context.Context, u models.User) (int, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var newID int
+	stmt := `insert into users (first_name, last_name, email, password, access_level, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6, $7) returning id`
+
+	err := m.DB.QueryRowContext(ctx, stmt, u.FirstName, u.LastName, u.Email, u.Password, u.AccessLevel,
+		time.Now(), time.Now()).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+	return newID, nil
+}
+
 // UpdateUser updates the user in Postgres
-func (m *postgresDBRepo) UpdateUser(u models.User) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m *postgresDBRepo) UpdateUser(ctx context.Context, u models.User) error {
+	ctx, cancel := m.withTimeout(ctx)
 	defer cancel()
 
-	query := `update users set first_name=$1, last_name=$2, email=$3, access_level=$4, updated_at=$5 from users`
+	query := `update users set first_name=$1, last_name=$2, email=$3, access_level=$4, updated_at=$5 where id=$6`
 	_, err := m.DB.ExecContext(ctx,
 		query,
 		u.FirstName,
 		u.LastName,
 		u.Email,
 		u.AccessLevel,
-		time.Now())
+		time.Now(),
+		u.ID)
 
 	if err != nil {
-		return nil
+		return err
 	}
-	return err
+	return nil
+}
+
+// UpdatePassword sets a user's bcrypt hashed password
+func (m *postgresDBRepo) UpdatePassword(ctx context.Context, id int, hashedPassword string) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	query := `update users set password = $1, updated_at = $2 where id = $3`
+	_, err := m.DB.ExecContext(ctx, query, hashedPassword, time.Now(), id)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// SetUserDisabled disables or re-enables a user. Disabled users cannot log in or use their api tokens
+func (m *postgresDBRepo) SetUserDisabled(ctx context.Context, id int, disabled bool) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	query := `update users set disabled = $1, updated_at = $2 where id = $3`
+	_, err := m.DB.ExecContext(ctx, query, disabled, time.Now(), id)
+	if err != nil {
+		return err
+	}
+	return nil
 }
 
 // UpdateReservation updates a reservation in postgres
-func (m *postgresDBRepo) UpdateReservation(u models.Reservation) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m *postgresDBRepo) UpdateReservation(ctx context.Context, u models.Reservation) error {
+	ctx, cancel := m.withTimeout(ctx)
 	defer cancel()
 
 	query := `update reservations set first_name=$1, last_name=$2, email=$3, phone=$4, updated_at=$5
@@ -221,8 +539,8 @@ func (m *postgresDBRepo) UpdateReservation(u models.Reservation) error {
 }
 
 // DeleteReservation deletes on reservation by id
-func (m *postgresDBRepo) DeleteReservation(id int) error {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+func (m *postgresDBRepo) DeleteReservation(ctx context.Context, id int) error {
+	ctx, cancel := m.withTimeout(ctx)
 	defer cancel()
 
 	query := `delete from reservations where id=$1`
@@ -234,8 +552,8 @@ func (m *postgresDBRepo) DeleteReservation(id int) error {
 }
 
 // UpdateProcessedForReservation updates processed for reservation by id
-func (m *postgresDBRepo) UpdateProcessedForReservation(id, processed int) error {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+func (m *postgresDBRepo) UpdateProcessedForReservation(ctx context.Context, id, processed int) error {
+	ctx, cancel := m.withTimeout(ctx)
 	defer cancel()
 
 	query := `update reservations set processed = $1 where id = $2`
@@ -246,71 +564,123 @@ func (m *postgresDBRepo) UpdateProcessedForReservation(id, processed int) error
 	return nil
 }
 
-// AllReservations returns a slice of all reservations
-func (m *postgresDBRepo) AllReservations() ([]models.Reservation, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
-	var reservations []models.Reservation
-
-	query := `select r.id, r.first_name, r.last_name, r.phone, r.email, r.start_date, r.end_date, r.room_id, r.processed,
-       r.created_at, r.updated_at, rm.id as room_id, rm.room_name from reservations r left join rooms rm on r.room_id = rm.id
-		order by r.start_date asc`
+// reservationSortColumns are the columns each sort key orders reservations by, before their ids
+var reservationSortColumns = map[string][]string{
+	models.SortByID:        nil,
+	models.SortByName:      {"lower(r.last_name)", "lower(r.first_name)"},
+	models.SortByRoom:      {"rm.room_name", "r.start_date"},
+	models.SortByArrival:   {"r.start_date"},
+	models.SortByDeparture: {"r.end_date"},
+	models.SortByBooked:    {"r.created_at"},
+}
 
-	rows, err := m.DB.QueryContext(ctx, query)
-	defer rows.Close()
+// likePrefix returns a like pattern matching strings that start with s, ignoring case
+func likePrefix(s string) string {
+	s = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(strings.ToLower(s))
+	return s + "%"
+}
 
-	if err != nil {
-		return reservations, err
+// reservationConditions returns the where clause, and its arguments, that keeps the reservations a filter matches
+func reservationConditions(f models.ReservationFilter) (string, []interface{}) {
+	conditions := []string{"true"}
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
 	}
 
-	for rows.Next() {
-		var i models.Reservation
-		err := rows.Scan(
-			&i.ID,
-			&i.FirstName,
-			&i.LastName,
-			&i.Phone,
-			&i.Email,
-			&i.StartDate,
-			&i.EndDate,
-			&i.RoomID,
-			&i.Processed,
-			&i.CreatedAt,
-			&i.UpdatedAt,
-			&i.Room.ID,
-			&i.Room.RoomName,
-		)
+	for _, word := range strings.Fields(f.Search) {
+		p := arg(likePrefix(word))
+		conditions = append(conditions, fmt.Sprintf(`(lower(r.first_name) like %[1]s escape '\'
+			or lower(r.last_name) like %[1]s escape '\' or lower(r.email) like %[1]s escape '\'
+			or lower(r.phone) like %[1]s escape '\')`, p))
+	}
+	if f.RoomID > 0 {
+		conditions = append(conditions, "r.room_id = "+arg(f.RoomID))
+	}
+	if !f.From.IsZero() {
+		conditions = append(conditions, "r.end_date > "+arg(f.From))
+	}
+	if !f.To.IsZero() {
+		conditions = append(conditions, "r.start_date <= "+arg(f.To))
+	}
+	switch f.Processed {
+	case models.ReservationsNew:
+		conditions = append(conditions, "r.processed = 0")
+	case models.ReservationsProcessed:
+		conditions = append(conditions, "r.processed <> 0")
+	}
+	return strings.Join(conditions, " and "), args
+}
 
-		if err != nil {
-			return reservations, err
-		}
-		reservations = append(reservations, i)
+// reservationOrder returns the order by clause for a filter's sort
+func reservationOrder(f models.ReservationFilter) string {
+	columns, ok := reservationSortColumns[f.Sort]
+	if !ok {
+		columns = reservationSortColumns[models.SortByArrival]
 	}
-	if err = rows.Err(); err != nil {
-		return reservations, err
+	dir := " asc"
+	if f.Desc {
+		dir = " desc"
 	}
-	return reservations, nil
+	var order []string
+	for _, c := range append(columns, "r.id") {
+		order = append(order, c+dir)
+	}
+	return strings.Join(order, ", ")
 }
 
-// AllNewReservations returns a slice of new reservations
-func (m *postgresDBRepo) AllNewReservations() ([]models.Reservation, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// SearchReservations returns the page of reservations a filter asks for, and how many reservations match it in all
+func (m *postgresDBRepo) SearchReservations(ctx context.Context, f models.ReservationFilter) ([]models.Reservation, int, error) {
+	ctx, cancel := m.withTimeout(ctx)
 	defer cancel()
 
 	var reservations []models.Reservation
+	where, args := reservationConditions(f)
 
-	query := `select r.id, r.first_name, r.last_name, r.phone, r.email, r.start_date, r.end_date, r.room_id,
-       r.created_at, r.updated_at, rm.id as room_id, rm.room_name from reservations r left join rooms rm on r.room_id = rm.id
-                                                                  where processed = 0
-		order by r.start_date asc`
+	var total int
+	err := m.DB.QueryRowContext(ctx, "select count(r.id) from reservations r where "+where, args...).Scan(&total)
+	if err != nil {
+		return reservations, 0, err
+	}
 
-	rows, err := m.DB.QueryContext(ctx, query)
-	defer rows.Close()
+	err = m.eachReservation(ctx, f, func(res models.Reservation) error {
+		reservations = append(reservations, res)
+		return nil
+	})
+	if err != nil {
+		return reservations, 0, err
+	}
+	return reservations, total, nil
+}
+
+// EachReservation calls fn with each reservation a filter matches, in order, as they are read, stopping at the
+// first error fn returns
+func (m *postgresDBRepo) EachReservation(ctx context.Context, f models.ReservationFilter, fn func(models.Reservation) error) error {
+	ctx, cancel := context.WithTimeout(ctx, max(exportTimeout, m.queryTimeout()))
+	defer cancel()
+
+	return m.eachReservation(ctx, f, fn)
+}
+
+// eachReservation reads the reservations a filter matches, a page of them if it asks for one, and calls fn with each
+func (m *postgresDBRepo) eachReservation(ctx context.Context, f models.ReservationFilter, fn func(models.Reservation) error) error {
+	where, args := reservationConditions(f)
+	query := `select r.id, r.first_name, r.last_name, r.phone, r.email, r.start_date, r.end_date, r.room_id, r.processed,
+			r.total_price, r.created_at, r.updated_at, rm.id, rm.room_name
+			from reservations r left join rooms rm on r.room_id = rm.id
+			where ` + where + `
+			order by ` + reservationOrder(f)
+	if f.PerPage > 0 {
+		page := max(f.Page, 1)
+		query += fmt.Sprintf(" limit %d offset %d", f.PerPage, (page-1)*f.PerPage)
+	}
 
+	rows, err := m.DB.QueryContext(ctx, query, args...)
 	if err != nil {
-		return reservations, err
+		return err
 	}
+	defer rows.Close()
 
 	for rows.Next() {
 		var i models.Reservation
@@ -323,35 +693,45 @@ func (m *postgresDBRepo) AllNewReservations() ([]models.Reservation, error) {
 			&i.StartDate,
 			&i.EndDate,
 			&i.RoomID,
+			&i.Processed,
+			&i.TotalPrice,
 			&i.CreatedAt,
 			&i.UpdatedAt,
 			&i.Room.ID,
 			&i.Room.RoomName,
 		)
-
 		if err != nil {
-			return reservations, err
+			return err
+		}
+		if err := fn(i); err != nil {
+			return err
 		}
-		reservations = append(reservations, i)
-	}
-	if err = rows.Err(); err != nil {
-		return reservations, err
 	}
-	return reservations, nil
+	return rows.Err()
 }
 
 // GetReservationById returns one reservation by ID
-func (m *postgresDBRepo) GetReservationById(id int) (models.Reservation, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m *postgresDBRepo) GetReservationById(ctx context.Context, id int) (models.Reservation, error) {
+	return m.getReservation(ctx, "r.id = $1", id)
+}
+
+// GetReservationByCode returns a reservation by its confirmation code
+func (m *postgresDBRepo) GetReservationByCode(ctx context.Context, code string) (models.Reservation, error) {
+	return m.getReservation(ctx, "r.confirmation_code = $1", code)
+}
+
+// getReservation returns the first reservation matching the where clause
+func (m *postgresDBRepo) getReservation(ctx context.Context, where string, args ...interface{}) (models.Reservation, error) {
+	ctx, cancel := m.withTimeout(ctx)
 	defer cancel()
 
 	var res models.Reservation
 	query := `Select r.id, r.first_name, r.last_name, r.email, r.phone, r.start_date, r.end_date,
-       		r.room_id, r.created_at, r.updated_at, r.processed, rm.id, rm.room_name
+       		r.room_id, r.created_at, r.updated_at, r.processed, r.total_price, r.confirmation_code, rm.id, rm.room_name
 			from reservations r left join rooms rm on r.room_id = rm.id
-			where r.id = $1`
+			where ` + where
 
-	row := m.DB.QueryRowContext(ctx, query, id)
+	row := m.DB.QueryRowContext(ctx, query, args...)
 	err := row.Scan(
 		&res.ID,
 		&res.FirstName,
@@ -364,6 +744,8 @@ func (m *postgresDBRepo) GetReservationById(id int) (models.Reservation, error)
 		&res.CreatedAt,
 		&res.UpdatedAt,
 		&res.Processed,
+		&res.TotalPrice,
+		&res.ConfirmationCode,
 		&res.Room.ID,
 		&res.Room.RoomName,
 	)
@@ -373,30 +755,87 @@ func (m *postgresDBRepo) GetReservationById(id int) (models.Reservation, error)
 	return res, nil
 }
 
-// GetRestrictionsForRoomByDate returns a slice of RoomRestrictions by RoomID, Start Date, and End Date
-func (m *postgresDBRepo) GetRestrictionsForRoomByDate(roomID int, start, end time.Time) ([]models.RoomRestriction, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+// ChangeReservationDates moves a reservation and its room restriction to new dates in a single transaction,
+// returning repository.ErrRoomUnavailable if another booking or block overlaps the new dates
+func (m *postgresDBRepo) ChangeReservationDates(ctx context.Context, res models.Reservation) error {
+	ctx, cancel := m.withTimeout(ctx)
 	defer cancel()
 
-	var restrictions []models.RoomRestriction
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
-	query := `select id, coalesce(reservation_id, 0), restriction_id, room_id, start_date, end_date from room_restrictions
-	where $1< end_date and $2>=start_date and room_id = $3`
+	var roomID int
+	err = tx.QueryRowContext(ctx, `select id from rooms where id = $1 for update`, res.RoomID).Scan(&roomID)
+	if err != nil {
+		return err
+	}
 
-	rows, err := m.DB.QueryContext(ctx, query, start, end, roomID)
+	// the reservation's own restriction doesn't count against its new dates
+	var numOfRows int
+	query := `select count(id) from room_restrictions
+			where $1 < end_date and $2 > start_date and room_id = $3 and coalesce(reservation_id, 0) <> $4
+			and restriction_id in (select id from restrictions where blocks_booking)`
+	err = tx.QueryRowContext(ctx, query, res.StartDate, res.EndDate, res.RoomID, res.ID).Scan(&numOfRows)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer rows.Close()
-	for rows.Next() {
-		var r models.RoomRestriction
-		err := rows.Scan(
-			&r.ID,
-			&r.ReservationID,
-			&r.RestrictionID,
-			&r.RoomID,
-			&r.StartDate,
-			&r.EndDate,
+	if numOfRows > 0 {
+		return repository.ErrRoomUnavailable
+	}
+
+	stmt := `update reservations set start_date = $1, end_date = $2, total_price = $3, updated_at = $4 where id = $5`
+	_, err = tx.ExecContext(ctx, stmt, res.StartDate, res.EndDate, res.TotalPrice, time.Now(), res.ID)
+	if err != nil {
+		return err
+	}
+
+	stmt = `update room_restrictions set start_date = $1, end_date = $2, updated_at = $3 where reservation_id = $4`
+	_, err = tx.ExecContext(ctx, stmt, res.StartDate, res.EndDate, time.Now(), res.ID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetRestrictionsForRoomByDate returns a slice of RoomRestrictions by RoomID, Start Date, and End Date
+func (m *postgresDBRepo) GetRestrictionsForRoomByDate(ctx context.Context, roomID int, start, end time.Time) ([]models.RoomRestriction, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var restrictions []models.RoomRestriction
+
+	query := `select rr.id, coalesce(rr.reservation_id, 0), rr.restriction_id, rr.room_id, coalesce(rr.ical_feed_id, 0),
+	rr.start_date, rr.end_date, rr.note, r.id, r.restriction_name, r.system_key, r.colour, r.blocks_booking,
+	r.guest_visible
+	from room_restrictions rr left join restrictions r on rr.restriction_id = r.id
+	where $1< rr.end_date and $2>=rr.start_date and rr.room_id = $3`
+
+	rows, err := m.DB.QueryContext(ctx, query, start, end, roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var r models.RoomRestriction
+		err := rows.Scan(
+			&r.ID,
+			&r.ReservationID,
+			&r.RestrictionID,
+			&r.RoomID,
+			&r.ICalFeedID,
+			&r.StartDate,
+			&r.EndDate,
+			&r.Note,
+			&r.Restriction.ID,
+			&r.Restriction.RestrictionName,
+			&r.Restriction.SystemKey,
+			&r.Restriction.Colour,
+			&r.Restriction.BlocksBooking,
+			&r.Restriction.GuestVisible,
 		)
 		if err != nil {
 			return nil, err
@@ -410,13 +849,59 @@ func (m *postgresDBRepo) GetRestrictionsForRoomByDate(roomID int, start, end tim
 	return restrictions, nil
 }
 
+// EachRoomRestriction calls fn with each room restriction that covers a night from start up to end, by room and
+// then date, as they are read, stopping at the first error fn returns
+func (m *postgresDBRepo) EachRoomRestriction(ctx context.Context, start, end time.Time, fn func(models.RoomRestriction) error) error {
+	ctx, cancel := context.WithTimeout(ctx, max(exportTimeout, m.queryTimeout()))
+	defer cancel()
+
+	query := `select rr.id, coalesce(rr.reservation_id, 0), rr.restriction_id, rr.room_id, coalesce(rr.ical_feed_id, 0),
+	rr.start_date, rr.end_date, rr.note, r.id, r.restriction_name, r.system_key, r.colour, r.blocks_booking,
+	r.guest_visible
+	from room_restrictions rr left join restrictions r on rr.restriction_id = r.id
+	where $1 < rr.end_date and $2 > rr.start_date
+	order by rr.room_id, rr.start_date, rr.id`
+
+	rows, err := m.DB.QueryContext(ctx, query, start, end)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var r models.RoomRestriction
+		err := rows.Scan(
+			&r.ID,
+			&r.ReservationID,
+			&r.RestrictionID,
+			&r.RoomID,
+			&r.ICalFeedID,
+			&r.StartDate,
+			&r.EndDate,
+			&r.Note,
+			&r.Restriction.ID,
+			&r.Restriction.RestrictionName,
+			&r.Restriction.SystemKey,
+			&r.Restriction.Colour,
+			&r.Restriction.BlocksBooking,
+			&r.Restriction.GuestVisible,
+		)
+		if err != nil {
+			return err
+		}
+		if err := fn(r); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
 // Authenticate authenticates the user
-func (m *postgresDBRepo) Authenticate(email, testPassword string) (int, string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m *postgresDBRepo) Authenticate(ctx context.Context, email, testPassword string) (int, string, error) {
+	ctx, cancel := m.withTimeout(ctx)
 	defer cancel()
 	var id int
 	var hashedPassword string
-	row := m.DB.QueryRowContext(ctx, "select id, password from users where email=$1", email)
+	row := m.DB.QueryRowContext(ctx, "select id, password from users where email=$1 and not disabled", email)
 	err := row.Scan(&id, &hashedPassword)
 	if err != nil {
 		return id, "", err
@@ -432,34 +917,996 @@ func (m *postgresDBRepo) Authenticate(email, testPassword string) (int, string,
 	return id, hashedPassword, nil
 }
 
-// InsertBlockForRoom inserts a room restriction
-func (m *postgresDBRepo) InsertBlockForRoom(id int, startDate time.Time) error {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+// AllRestrictions returns every restriction type, the ones the application relies on first
+func (m *postgresDBRepo) AllRestrictions(ctx context.Context) ([]models.Restriction, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var restrictions []models.Restriction
+
+	query := `select id, restriction_name, system_key, colour, blocks_booking, guest_visible, created_at, updated_at
+			from restrictions order by system_key = '', id`
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return restrictions, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r models.Restriction
+		err := rows.Scan(
+			&r.ID,
+			&r.RestrictionName,
+			&r.SystemKey,
+			&r.Colour,
+			&r.BlocksBooking,
+			&r.GuestVisible,
+			&r.CreatedAt,
+			&r.UpdatedAt,
+		)
+		if err != nil {
+			return restrictions, err
+		}
+		restrictions = append(restrictions, r)
+	}
+
+	if err = rows.Err(); err != nil {
+		return restrictions, err
+	}
+	return restrictions, nil
+}
+
+// GetRestrictionByID returns a restriction type by id
+func (m *postgresDBRepo) GetRestrictionByID(ctx context.Context, id int) (models.Restriction, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	var r models.Restriction
+
+	query := `select id, restriction_name, system_key, colour, blocks_booking, guest_visible, created_at, updated_at
+			from restrictions where id = $1`
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&r.ID,
+		&r.RestrictionName,
+		&r.SystemKey,
+		&r.Colour,
+		&r.BlocksBooking,
+		&r.GuestVisible,
+		&r.CreatedAt,
+		&r.UpdatedAt,
+	)
+	if err != nil {
+		return r, err
+	}
+	return r, nil
+}
+
+// InsertRestriction adds a restriction type for the owners to block rooms with
+func (m *postgresDBRepo) InsertRestriction(ctx context.Context, r models.Restriction) (int, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	var newID int
+
+	stmt := `insert into restrictions (restriction_name, colour, blocks_booking, guest_visible, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6) returning id`
+
+	err := m.DB.QueryRowContext(ctx, stmt, r.RestrictionName, r.Colour, r.BlocksBooking, r.GuestVisible,
+		time.Now(), time.Now()).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+	return newID, nil
+}
+
+// UpdateRestriction changes a restriction type's settings. Its system key never changes
+func (m *postgresDBRepo) UpdateRestriction(ctx context.Context, r models.Restriction) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `update restrictions set restriction_name = $1, colour = $2, blocks_booking = $3, guest_visible = $4,
+			updated_at = $5
+			where id = $6`
+
+	_, err := m.DB.ExecContext(ctx, stmt, r.RestrictionName, r.Colour, r.BlocksBooking, r.GuestVisible, time.Now(),
+		r.ID)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// DeleteRestriction deletes a restriction type, returning repository.ErrRestrictionInUse if the application
+// relies on it or rooms are still restricted by it
+func (m *postgresDBRepo) DeleteRestriction(ctx context.Context, id int) error {
+	ctx, cancel := m.withTimeout(ctx)
 	defer cancel()
 
-	query := `insert into room_restrictions (start_date, end_date, room_id, restriction_id, created_at, updated_at)
-			values($1, $2, $3, $4, $5, $6)`
+	// deleting a type would cascade to its room restrictions, so only unused types can go
+	stmt := `delete from restrictions where id = $1 and system_key = ''
+			and not exists (select 1 from room_restrictions where restriction_id = $1)`
 
-	//The number 2 means that it is a block for the restriction id
-	_, err := m.DB.QueryContext(ctx, query, startDate, startDate.AddDate(0, 0, 1), id, 2, time.Now(),
-		time.Now())
+	result, err := m.DB.ExecContext(ctx, stmt, id)
 	if err != nil {
-		log.Println(err)
 		return err
 	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return repository.ErrRestrictionInUse
+	}
 	return nil
 }
 
-// DeleteBlockById deletes a room restriction
-func (m *postgresDBRepo) DeleteBlockById(id int) error {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+// GetBlockByID returns a block the owners put on a room, of whatever type
+func (m *postgresDBRepo) GetBlockByID(ctx context.Context, id int) (models.RoomRestriction, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	var b models.RoomRestriction
+
+	query := `select rr.id, rr.room_id, rr.restriction_id, rr.start_date, rr.end_date, rr.note, rr.created_at,
+			rr.updated_at, r.id, r.room_name
+			from room_restrictions rr left join rooms r on rr.room_id = r.id
+			where rr.id = $1 and rr.reservation_id is null and rr.ical_feed_id is null`
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&b.ID,
+		&b.RoomID,
+		&b.RestrictionID,
+		&b.StartDate,
+		&b.EndDate,
+		&b.Note,
+		&b.CreatedAt,
+		&b.UpdatedAt,
+		&b.Room.ID,
+		&b.Room.RoomName,
+	)
+	if err != nil {
+		return b, err
+	}
+	return b, nil
+}
+
+// InsertBlock blocks a room out from the block's start date up to, but not including, its end date
+func (m *postgresDBRepo) InsertBlock(ctx context.Context, b models.RoomRestriction) (int, error) {
+	ctx, cancel := m.withTimeout(ctx)
 	defer cancel()
+	var newID int
 
-	query := `delete from room_restrictions where id = $1`
+	query := `insert into room_restrictions (start_date, end_date, room_id, restriction_id, note, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6, $7) returning id`
 
-	_, err := m.DB.QueryContext(ctx, query, id)
+	err := m.DB.QueryRowContext(ctx, query, b.StartDate, b.EndDate, b.RoomID, b.RestrictionID, b.Note,
+		time.Now(), time.Now()).Scan(&newID)
 	if err != nil {
-		log.Println(err)
+		return 0, err
 	}
-	return err
+	return newID, nil
+}
+
+// UpdateBlock changes a block's type, room, dates and note
+func (m *postgresDBRepo) UpdateBlock(ctx context.Context, b models.RoomRestriction) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	query := `update room_restrictions set start_date = $1, end_date = $2, room_id = $3, restriction_id = $4, note = $5,
+			updated_at = $6
+			where id = $7 and reservation_id is null and ical_feed_id is null`
+
+	_, err := m.DB.ExecContext(ctx, query, b.StartDate, b.EndDate, b.RoomID, b.RestrictionID, b.Note, time.Now(), b.ID)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// DeleteBlockById deletes a block. Reservations and synced blocks have to be removed their own way
+func (m *postgresDBRepo) DeleteBlockById(ctx context.Context, id int) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	query := `delete from room_restrictions where id = $1 and reservation_id is null and ical_feed_id is null`
+
+	_, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// AllAPITokens returns a slice of all api tokens with the user they belong to
+func (m *postgresDBRepo) AllAPITokens(ctx context.Context) ([]models.APIToken, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var tokens []models.APIToken
+
+	query := `select t.id, t.user_id, t.name, t.last_used_at, t.created_at, t.updated_at,
+			u.id, u.first_name, u.last_name, u.email, u.access_level
+			from api_tokens t left join users u on t.user_id = u.id
+			order by t.created_at desc`
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return tokens, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var t models.APIToken
+		var lastUsed sql.NullTime
+		err := rows.Scan(
+			&t.ID,
+			&t.UserID,
+			&t.Name,
+			&lastUsed,
+			&t.CreatedAt,
+			&t.UpdatedAt,
+			&t.User.ID,
+			&t.User.FirstName,
+			&t.User.LastName,
+			&t.User.Email,
+			&t.User.AccessLevel,
+		)
+		if err != nil {
+			return tokens, err
+		}
+		t.LastUsedAt = lastUsed.Time
+		tokens = append(tokens, t)
+	}
+
+	if err = rows.Err(); err != nil {
+		return tokens, err
+	}
+	return tokens, nil
+}
+
+// InsertAPIToken stores the hash of a new api token
+func (m *postgresDBRepo) InsertAPIToken(ctx context.Context, t models.APIToken) (int, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	var newID int
+
+	stmt := `insert into api_tokens (user_id, name, token_hash, created_at, updated_at)
+			values ($1, $2, $3, $4, $5) returning id`
+
+	err := m.DB.QueryRowContext(ctx, stmt, t.UserID, t.Name, t.TokenHash, time.Now(), time.Now()).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+	return newID, nil
+}
+
+// DeleteAPIToken revokes an api token by id
+func (m *postgresDBRepo) DeleteAPIToken(ctx context.Context, id int) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `delete from api_tokens where id = $1`, id)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetUserByAPITokenHash returns the user an api token was issued to, and records that the token was used
+func (m *postgresDBRepo) GetUserByAPITokenHash(ctx context.Context, hash string) (models.User, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	var u models.User
+
+	query := `update api_tokens t set last_used_at = $1 from users u
+			where t.user_id = u.id and t.token_hash = $2 and not u.disabled
+			returning u.id, u.first_name, u.last_name, u.email, u.access_level, u.created_at, u.updated_at`
+
+	row := m.DB.QueryRowContext(ctx, query, time.Now(), hash)
+	err := row.Scan(
+		&u.ID,
+		&u.FirstName,
+		&u.LastName,
+		&u.Email,
+		&u.AccessLevel,
+		&u.CreatedAt,
+		&u.UpdatedAt)
+	if err != nil {
+		return u, err
+	}
+	return u, nil
+}
+
+// GetSeasonalRatesForRoom returns the seasonal rates of a room that overlap the given dates
+func (m *postgresDBRepo) GetSeasonalRatesForRoom(ctx context.Context, roomID int, start, end time.Time) ([]models.SeasonalRate, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var seasons []models.SeasonalRate
+
+	query := `select id, room_id, name, start_date, end_date, nightly_rate, min_stay, created_at, updated_at
+			from seasonal_rates where room_id = $1 and $2 < end_date and $3 > start_date
+			order by start_date`
+
+	rows, err := m.DB.QueryContext(ctx, query, roomID, start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var s models.SeasonalRate
+		err := rows.Scan(
+			&s.ID,
+			&s.RoomID,
+			&s.Name,
+			&s.StartDate,
+			&s.EndDate,
+			&s.NightlyRate,
+			&s.MinStay,
+			&s.CreatedAt,
+			&s.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		seasons = append(seasons, s)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return seasons, nil
+}
+
+// InsertSeasonalRate inserts a seasonal rate for a room
+func (m *postgresDBRepo) InsertSeasonalRate(ctx context.Context, s models.SeasonalRate) (int, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	var newID int
+
+	stmt := `insert into seasonal_rates (room_id, name, start_date, end_date, nightly_rate, min_stay, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6, $7, $8) returning id`
+
+	err := m.DB.QueryRowContext(ctx, stmt, s.RoomID, s.Name, s.StartDate, s.EndDate, s.NightlyRate, s.MinStay,
+		time.Now(), time.Now()).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+	return newID, nil
+}
+
+// DeleteSeasonalRate deletes a seasonal rate by id
+func (m *postgresDBRepo) DeleteSeasonalRate(ctx context.Context, id int) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `delete from seasonal_rates where id = $1`, id)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// InsertPasswordToken stores a password token
+func (m *postgresDBRepo) InsertPasswordToken(ctx context.Context, t models.PasswordToken) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `insert into password_tokens (user_id, token_hash, purpose, expires_at, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6)`
+	_, err := m.DB.ExecContext(ctx, stmt, t.UserID, t.TokenHash, t.Purpose, t.ExpiresAt, time.Now(), time.Now())
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetPasswordToken returns an unused, unexpired password token and its user by the token's hash
+func (m *postgresDBRepo) GetPasswordToken(ctx context.Context, hash string) (models.PasswordToken, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var t models.PasswordToken
+	query := `select t.id, t.user_id, t.token_hash, t.purpose, t.expires_at, t.created_at, t.updated_at,
+			u.id, u.first_name, u.last_name, u.email, u.access_level
+			from password_tokens t left join users u on t.user_id = u.id
+			where t.token_hash = $1 and t.used_at is null and t.expires_at > $2 and not u.disabled`
+
+	row := m.DB.QueryRowContext(ctx, query, hash, time.Now())
+	err := row.Scan(
+		&t.ID,
+		&t.UserID,
+		&t.TokenHash,
+		&t.Purpose,
+		&t.ExpiresAt,
+		&t.CreatedAt,
+		&t.UpdatedAt,
+		&t.User.ID,
+		&t.User.FirstName,
+		&t.User.LastName,
+		&t.User.Email,
+		&t.User.AccessLevel,
+	)
+	if err == sql.ErrNoRows {
+		return t, repository.ErrInvalidToken
+	}
+	if err != nil {
+		return t, err
+	}
+	return t, nil
+}
+
+// ResetPassword uses up a password token and sets its user's password in a single transaction, returning
+// repository.ErrInvalidToken if the token has expired or was used in the meantime
+func (m *postgresDBRepo) ResetPassword(ctx context.Context, tokenHash, hashedPassword string) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var userID int
+	query := `update password_tokens set used_at = $1, updated_at = $1
+			where token_hash = $2 and used_at is null and expires_at > $1
+			returning user_id`
+	err = tx.QueryRowContext(ctx, query, time.Now(), tokenHash).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return repository.ErrInvalidToken
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `update users set password = $1, updated_at = $2 where id = $3`,
+		hashedPassword, time.Now(), userID)
+	if err != nil {
+		return err
+	}
+
+	// any other links issued to the user stop working once they have set a password
+	_, err = tx.ExecContext(ctx, `update password_tokens set used_at = $1, updated_at = $1
+			where user_id = $2 and used_at is null`, time.Now(), userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// InsertLoginAttempt records an attempt to log in, for throttling and auditing
+func (m *postgresDBRepo) InsertLoginAttempt(ctx context.Context, a models.LoginAttempt) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `insert into login_attempts (email, ip_address, outcome, created_at, updated_at)
+			values ($1, $2, $3, $4, $5)`
+	_, err := m.DB.ExecContext(ctx, stmt, strings.ToLower(a.Email), a.IPAddress, a.Outcome, a.CreatedAt, a.CreatedAt)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetLoginFailures counts the failed logins since the given time for an email address and for an ip address.
+// Failures for an email address from before its last successful login, or before its account's lockout ended,
+// are not counted
+func (m *postgresDBRepo) GetLoginFailures(ctx context.Context, email, ip string, since time.Time) (models.LoginFailures, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var f models.LoginFailures
+	var last sql.NullTime
+
+	query := `select count(id), max(created_at) from login_attempts
+			where email = $1 and outcome = $2 and created_at > $3
+			and created_at > coalesce((select max(created_at) from login_attempts where email = $1 and outcome = $4), $3)
+			and created_at > coalesce((select locked_until from users where lower(email) = $1), $3)`
+	err := m.DB.QueryRowContext(ctx, query, strings.ToLower(email), models.LoginFailed, since, models.LoginSucceeded).
+		Scan(&f.ByEmail, &last)
+	if err != nil {
+		return f, err
+	}
+	f.LastByEmail = last.Time
+
+	query = `select count(id), max(created_at) from login_attempts
+			where ip_address = $1 and outcome = $2 and created_at > $3`
+	err = m.DB.QueryRowContext(ctx, query, ip, models.LoginFailed, since).Scan(&f.ByIP, &last)
+	if err != nil {
+		return f, err
+	}
+	f.LastByIP = last.Time
+
+	return f, nil
+}
+
+// RecentFailedLogins returns the latest login attempts that did not succeed, newest first
+func (m *postgresDBRepo) RecentFailedLogins(ctx context.Context, limit int) ([]models.LoginAttempt, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var attempts []models.LoginAttempt
+	query := `select id, email, ip_address, outcome, created_at, updated_at from login_attempts
+			where outcome <> $1 order by created_at desc limit $2`
+
+	rows, err := m.DB.QueryContext(ctx, query, models.LoginSucceeded, limit)
+	if err != nil {
+		return attempts, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var a models.LoginAttempt
+		err := rows.Scan(
+			&a.ID,
+			&a.Email,
+			&a.IPAddress,
+			&a.Outcome,
+			&a.CreatedAt,
+			&a.UpdatedAt,
+		)
+		if err != nil {
+			return attempts, err
+		}
+		attempts = append(attempts, a)
+	}
+
+	if err = rows.Err(); err != nil {
+		return attempts, err
+	}
+	return attempts, nil
+}
+
+// LockUser stops a user from logging in until the given time
+func (m *postgresDBRepo) LockUser(ctx context.Context, id int, until time.Time) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	query := `update users set locked_until = $1, updated_at = $2 where id = $3`
+	_, err := m.DB.ExecContext(ctx, query, until, time.Now(), id)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// UnlockUser ends a user's lockout now. The failures that led to it then no longer count against them
+func (m *postgresDBRepo) UnlockUser(ctx context.Context, id int) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	query := `update users set locked_until = $1, updated_at = $1 where id = $2 and locked_until > $1`
+	_, err := m.DB.ExecContext(ctx, query, time.Now(), id)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// AllICalFeeds returns every room's external calendars
+func (m *postgresDBRepo) AllICalFeeds(ctx context.Context) ([]models.ICalFeed, error) {
+	return m.getICalFeeds(ctx, `order by room_id, name`)
+}
+
+// GetICalFeedsForRoom returns a room's external calendars
+func (m *postgresDBRepo) GetICalFeedsForRoom(ctx context.Context, roomID int) ([]models.ICalFeed, error) {
+	return m.getICalFeeds(ctx, `where room_id = $1 order by name`, roomID)
+}
+
+// GetICalFeedByID returns an external calendar by id
+func (m *postgresDBRepo) GetICalFeedByID(ctx context.Context, id int) (models.ICalFeed, error) {
+	feeds, err := m.getICalFeeds(ctx, `where id = $1`, id)
+	if err != nil {
+		return models.ICalFeed{}, err
+	}
+	if len(feeds) == 0 {
+		return models.ICalFeed{}, sql.ErrNoRows
+	}
+	return feeds[0], nil
+}
+
+// getICalFeeds returns the external calendars matching the where clause
+func (m *postgresDBRepo) getICalFeeds(ctx context.Context, where string, args ...interface{}) ([]models.ICalFeed, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var feeds []models.ICalFeed
+	query := `select id, room_id, name, url, contents, last_synced_at, last_error, created_at, updated_at
+			from ical_feeds ` + where
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return feeds, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var f models.ICalFeed
+		var lastSyncedAt sql.NullTime
+		err := rows.Scan(
+			&f.ID,
+			&f.RoomID,
+			&f.Name,
+			&f.URL,
+			&f.Contents,
+			&lastSyncedAt,
+			&f.LastError,
+			&f.CreatedAt,
+			&f.UpdatedAt,
+		)
+		if err != nil {
+			return feeds, err
+		}
+		f.LastSyncedAt = lastSyncedAt.Time
+		feeds = append(feeds, f)
+	}
+
+	if err = rows.Err(); err != nil {
+		return feeds, err
+	}
+	return feeds, nil
+}
+
+// InsertICalFeed adds an external calendar to a room
+func (m *postgresDBRepo) InsertICalFeed(ctx context.Context, f models.ICalFeed) (int, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	var newID int
+
+	stmt := `insert into ical_feeds (room_id, name, url, contents, last_error, created_at, updated_at)
+			values ($1, $2, $3, $4, '', $5, $6) returning id`
+
+	err := m.DB.QueryRowContext(ctx, stmt, f.RoomID, f.Name, f.URL, f.Contents, time.Now(), time.Now()).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+	return newID, nil
+}
+
+// UpdateICalFeedStatus records the outcome of an external calendar's latest sync
+func (m *postgresDBRepo) UpdateICalFeedStatus(ctx context.Context, f models.ICalFeed) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var lastSyncedAt sql.NullTime
+	if !f.LastSyncedAt.IsZero() {
+		lastSyncedAt = sql.NullTime{Time: f.LastSyncedAt, Valid: true}
+	}
+
+	_, err := m.DB.ExecContext(ctx, `update ical_feeds set last_synced_at = $1, last_error = $2, updated_at = $3
+			where id = $4`, lastSyncedAt, f.LastError, time.Now(), f.ID)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// DeleteICalFeed removes an external calendar, along with the blocks synced from it
+func (m *postgresDBRepo) DeleteICalFeed(ctx context.Context, id int) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `delete from ical_feeds where id = $1`, id)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetICalFeedRestrictions returns the blocks synced from an external calendar
+func (m *postgresDBRepo) GetICalFeedRestrictions(ctx context.Context, feedID int) ([]models.RoomRestriction, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var restrictions []models.RoomRestriction
+
+	query := `select id, restriction_id, room_id, ical_feed_id, ical_uid, start_date, end_date from room_restrictions
+			where ical_feed_id = $1 order by start_date`
+
+	rows, err := m.DB.QueryContext(ctx, query, feedID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r models.RoomRestriction
+		err := rows.Scan(
+			&r.ID,
+			&r.RestrictionID,
+			&r.RoomID,
+			&r.ICalFeedID,
+			&r.ICalUID,
+			&r.StartDate,
+			&r.EndDate,
+		)
+		if err != nil {
+			return nil, err
+		}
+		restrictions = append(restrictions, r)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return restrictions, nil
+}
+
+// ReplaceICalFeedRestrictions makes an external calendar's blocks match restrictions: events already synced keep
+// their row and have their dates updated, new ones are inserted, and ones no longer in the calendar are removed
+func (m *postgresDBRepo) ReplaceICalFeedRestrictions(ctx context.Context, f models.ICalFeed, restrictions []models.RoomRestriction) error {
+	// a sync can write many rows, so it gets longer than a single query
+	ctx, cancel := context.WithTimeout(ctx, max(10*time.Second, m.queryTimeout()))
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// every row this sync touches gets the same updated_at, so the ones it didn't touch are easy to find
+	now := time.Now()
+
+	stmt := `insert into room_restrictions (start_date, end_date, room_id, restriction_id, ical_feed_id, ical_uid,
+			created_at, updated_at)
+			values ($1, $2, $3, (select id from restrictions where system_key = $4), $5, $6, $7, $7)
+			on conflict (ical_feed_id, ical_uid)
+			do update set start_date = excluded.start_date, end_date = excluded.end_date, updated_at = excluded.updated_at`
+
+	for _, r := range restrictions {
+		_, err = tx.ExecContext(ctx, stmt, r.StartDate, r.EndDate, f.RoomID, models.RestrictionExternal, f.ID,
+			r.ICalUID, now)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `delete from room_restrictions where ical_feed_id = $1 and updated_at < $2`, f.ID, now)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// QueueMail adds an email to the outbox, to be sent straight away
+func (m *postgresDBRepo) QueueMail(ctx context.Context, mail models.MailData) (int, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var id int
+	err := m.DB.QueryRowContext(ctx, `insert into mail_outbox (to_address, from_address, subject, content,
+			text_content, status, next_attempt_at, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6, $7, $7, $7) returning id`,
+		mail.To, mail.From, mail.Subject, mail.Content, mail.Text, models.MailPending, time.Now(),
+	).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// ClaimMail takes the pending message that has waited longest for its next attempt, if one is due by now, and
+// holds it until leaseUntil so that no other worker sends it too. A message that is never marked sent or failed,
+// because its worker died, is picked up again once the lease runs out. Returns sql.ErrNoRows when nothing is due
+func (m *postgresDBRepo) ClaimMail(ctx context.Context, now, leaseUntil time.Time) (models.OutboxMessage, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var o models.OutboxMessage
+	var sentAt sql.NullTime
+	err := m.DB.QueryRowContext(ctx, `update mail_outbox set next_attempt_at = $2, updated_at = $1
+			where id = (select id from mail_outbox where status = $3 and next_attempt_at <= $1
+				order by next_attempt_at limit 1 for update skip locked)
+			returning id, to_address, from_address, subject, content, text_content, status, attempts, next_attempt_at,
+				last_error, sent_at, created_at, updated_at`, now, leaseUntil, models.MailPending,
+	).Scan(
+		&o.ID,
+		&o.Mail.To,
+		&o.Mail.From,
+		&o.Mail.Subject,
+		&o.Mail.Content,
+		&o.Mail.Text,
+		&o.Status,
+		&o.Attempts,
+		&o.NextAttemptAt,
+		&o.LastError,
+		&sentAt,
+		&o.CreatedAt,
+		&o.UpdatedAt,
+	)
+	if err != nil {
+		return o, err
+	}
+	o.SentAt = sentAt.Time
+	return o, nil
+}
+
+// UpdateMailStatus records the outcome of an attempt to send a message
+func (m *postgresDBRepo) UpdateMailStatus(ctx context.Context, o models.OutboxMessage) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var sentAt sql.NullTime
+	if !o.SentAt.IsZero() {
+		sentAt = sql.NullTime{Time: o.SentAt, Valid: true}
+	}
+
+	_, err := m.DB.ExecContext(ctx, `update mail_outbox set status = $1, attempts = $2, next_attempt_at = $3,
+			last_error = $4, sent_at = $5, updated_at = $6 where id = $7`,
+		o.Status, o.Attempts, o.NextAttemptAt, o.LastError, sentAt, time.Now(), o.ID)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetUnsentMail returns the messages that are waiting to be sent or were given up on, newest first
+func (m *postgresDBRepo) GetUnsentMail(ctx context.Context) ([]models.OutboxMessage, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var messages []models.OutboxMessage
+	rows, err := m.DB.QueryContext(ctx, `select id, to_address, from_address, subject, content, text_content, status,
+			attempts, next_attempt_at, last_error, created_at, updated_at
+			from mail_outbox where status <> $1 order by created_at desc`, models.MailSent)
+	if err != nil {
+		return messages, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var o models.OutboxMessage
+		err := rows.Scan(
+			&o.ID,
+			&o.Mail.To,
+			&o.Mail.From,
+			&o.Mail.Subject,
+			&o.Mail.Content,
+			&o.Mail.Text,
+			&o.Status,
+			&o.Attempts,
+			&o.NextAttemptAt,
+			&o.LastError,
+			&o.CreatedAt,
+			&o.UpdatedAt,
+		)
+		if err != nil {
+			return messages, err
+		}
+		messages = append(messages, o)
+	}
+
+	if err = rows.Err(); err != nil {
+		return messages, err
+	}
+	return messages, nil
+}
+
+// ResendMail puts a message that has not been sent back in the queue with a fresh set of attempts. Returns
+// sql.ErrNoRows when there is no such unsent message
+func (m *postgresDBRepo) ResendMail(ctx context.Context, id int) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	now := time.Now()
+	result, err := m.DB.ExecContext(ctx, `update mail_outbox set status = $1, attempts = 0, next_attempt_at = $2,
+			last_error = '', updated_at = $2 where id = $3 and status <> $4`, models.MailPending, now, id, models.MailSent)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// GetArrivalsWithoutEmail returns the reservations arriving between from and to, inclusive, that have not been
+// sent the kind of scheduled email
+func (m *postgresDBRepo) GetArrivalsWithoutEmail(ctx context.Context, kind string, from, to time.Time) ([]models.Reservation, error) {
+	return m.getReservationsWithoutEmail(ctx, `r.start_date`, kind, from, to)
+}
+
+// GetDeparturesWithoutEmail returns the reservations departing between from and to, inclusive, that have not been
+// sent the kind of scheduled email
+func (m *postgresDBRepo) GetDeparturesWithoutEmail(ctx context.Context, kind string, from, to time.Time) ([]models.Reservation, error) {
+	return m.getReservationsWithoutEmail(ctx, `r.end_date`, kind, from, to)
+}
+
+// getReservationsWithoutEmail returns the reservations with a date in column between from and to that have no
+// record of the kind of email
+func (m *postgresDBRepo) getReservationsWithoutEmail(ctx context.Context, column, kind string, from, to time.Time) ([]models.Reservation, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var reservations []models.Reservation
+	query := `select r.id, r.first_name, r.last_name, r.email, r.phone, r.start_date, r.end_date, r.room_id,
+			r.total_price, r.confirmation_code, r.created_at, r.updated_at, rm.id, rm.room_name
+			from reservations r left join rooms rm on (r.room_id = rm.id)
+			where ` + column + ` between $1 and $2
+			and not exists (select 1 from reservation_emails e where e.reservation_id = r.id and e.kind = $3)
+			order by r.start_date`
+
+	rows, err := m.DB.QueryContext(ctx, query, from, to, kind)
+	if err != nil {
+		return reservations, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var i models.Reservation
+		err := rows.Scan(
+			&i.ID,
+			&i.FirstName,
+			&i.LastName,
+			&i.Email,
+			&i.Phone,
+			&i.StartDate,
+			&i.EndDate,
+			&i.RoomID,
+			&i.TotalPrice,
+			&i.ConfirmationCode,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+			&i.Room.ID,
+			&i.Room.RoomName,
+		)
+		if err != nil {
+			return reservations, err
+		}
+		reservations = append(reservations, i)
+	}
+
+	if err = rows.Err(); err != nil {
+		return reservations, err
+	}
+	return reservations, nil
+}
+
+// QueueReservationEmail records that a reservation has been sent the kind of scheduled email and puts the email in
+// the outbox, together, so that it is sent exactly once however often the scheduler restarts. Returns false, and
+// queues nothing, if the reservation has already had this kind of email
+func (m *postgresDBRepo) QueueReservationEmail(ctx context.Context, reservationID int, kind string, mail models.MailData) (bool, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	result, err := tx.ExecContext(ctx, `insert into reservation_emails (reservation_id, kind, created_at, updated_at)
+			values ($1, $2, $3, $3) on conflict (reservation_id, kind) do nothing`, reservationID, kind, now)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if n == 0 {
+		return false, nil
+	}
+
+	_, err = tx.ExecContext(ctx, `insert into mail_outbox (to_address, from_address, subject, content, text_content,
+			status, next_attempt_at, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6, $7, $7, $7)`,
+		mail.To, mail.From, mail.Subject, mail.Content, mail.Text, models.MailPending, now)
+	if err != nil {
+		return false, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return false, err
+	}
+	return true, nil
 }
@@ -0,0 +1,63 @@
+package dbrepo
+
+import (
+	"bookings/internal/config"
+	"bookings/internal/driver"
+	"bookings/internal/migrate"
+	"bookings/internal/repository"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newPostgresRepo returns a repository for a new schema in the Postgres database named by BOOKINGS_TEST_DSN,
+// migrated and seeded as a fresh install would be, and dropped when the test ends. Without BOOKINGS_TEST_DSN the
+// test is skipped
+func newPostgresRepo(t *testing.T) repository.DatabaseRepo {
+	t.Helper()
+	dsn := os.Getenv("BOOKINGS_TEST_DSN")
+	if dsn == "" {
+		t.Skip("set BOOKINGS_TEST_DSN to test against Postgres")
+	}
+
+	admin, err := driver.NewDatabase(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := fmt.Sprintf("bookings_test_%d", time.Now().UnixNano())
+	if _, err := admin.Exec(`create schema ` + schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		admin.Exec(`drop schema ` + schema + ` cascade`)
+		admin.Close()
+	})
+
+	// every connection of the pool works in the new schema
+	sep := " "
+	if strings.Contains(dsn, "://") {
+		sep = "?"
+		if strings.Contains(dsn, "?") {
+			sep = "&"
+		}
+	}
+	db, err := driver.NewDatabase(dsn + sep + "search_path=" + schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	m, err := migrate.New(db, "postgres", slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Up(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return NewPostgresRepo(db, &config.AppConfig{})
+}
@@ -0,0 +1,731 @@
+package dbrepo
+
+import (
+	"bookings/internal/config"
+	"bookings/internal/models"
+	"bookings/internal/repository"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// repoKinds opens a new repository of each kind, seeded as a fresh install is. Every TestRepo test runs against all
+// of them, so that the memory repository used in tests behaves as the databases do
+var repoKinds = []struct {
+	name string
+	open func(t *testing.T) repository.DatabaseRepo
+}{
+	{"memory", func(t *testing.T) repository.DatabaseRepo { return NewMemoryRepo(&config.AppConfig{}) }},
+	{"sqlite", newSQLiteRepo},
+	{"postgres", newPostgresRepo},
+}
+
+// forEachRepo runs test against a new repository of each kind
+func forEachRepo(t *testing.T, test func(t *testing.T, repo repository.DatabaseRepo)) {
+	for _, kind := range repoKinds {
+		t.Run(kind.name, func(t *testing.T) {
+			test(t, kind.open(t))
+		})
+	}
+}
+
+func date(s string) time.Time {
+	d, _ := time.Parse("2006-01-02", s)
+	return d
+}
+
+func TestRepo_Rooms(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, repo repository.DatabaseRepo) {
+		ctx := context.Background()
+
+		rooms, err := repo.AllRooms(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rooms) != 2 {
+			t.Fatalf("expected the two seeded rooms but got %+v", rooms)
+		}
+
+		room, err := repo.GetRoomBySlug(ctx, "generals-quarters")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if room.RoomName != "General's Quarters" || room.ICalToken == "" || len(room.Photos) != 1 {
+			t.Errorf("expected the seeded room with a calendar token but got %+v", room)
+		}
+
+		if _, err := repo.InsertRoom(ctx, models.Room{RoomName: "Copy", Slug: "generals-quarters"}); err == nil {
+			t.Error("expected a second room with the same slug to be refused")
+		}
+
+		id, err := repo.InsertRoom(ctx, models.Room{RoomName: "Major's Attic", Slug: "majors-attic", Capacity: 1, BaseRate: 5000,
+			MinStay: 1, Photos: []string{"/static/a.png", "/static/b.png"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		room, err = repo.GetRoomById(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if room.BaseRate != 5000 || len(room.Photos) != 2 {
+			t.Errorf("expected the room as inserted but got %+v", room)
+		}
+
+		if err := repo.DeleteRoom(ctx, id); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := repo.GetRoomById(ctx, id); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("expected the room to be gone but got %v", err)
+		}
+	})
+}
+
+func TestRepo_Booking(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, repo repository.DatabaseRepo) {
+		ctx := context.Background()
+
+		res := models.Reservation{FirstName: "Jane", LastName: "Guest", Email: "jane@here.com", RoomID: 1,
+			StartDate: date("2050-06-01"), EndDate: date("2050-06-04"), TotalPrice: 30000, ConfirmationCode: "abc"}
+		id, err := repo.BookRoom(ctx, res)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var tests = []struct {
+			start     string
+			end       string
+			available bool
+		}{
+			{"2050-05-29", "2050-06-01", true},
+			{"2050-05-30", "2050-06-02", false},
+			{"2050-06-03", "2050-06-05", false},
+			{"2050-06-04", "2050-06-06", true},
+		}
+		for _, e := range tests {
+			available, err := repo.SearchAvailabilityByDatesByRoomID(ctx, date(e.start), date(e.end), 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if available != e.available {
+				t.Errorf("%s to %s: expected available to be %t", e.start, e.end, e.available)
+			}
+		}
+
+		rooms, err := repo.SearchAvailabilityForAllRooms(ctx, date("2050-06-02"), date("2050-06-03"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rooms) != 1 || rooms[0].ID != 2 {
+			t.Errorf("expected only the other room to be free but got %+v", rooms)
+		}
+
+		res.ConfirmationCode = "def"
+		if _, err := repo.BookRoom(ctx, res); !errors.Is(err, repository.ErrRoomUnavailable) {
+			t.Errorf("expected a double booking to be refused but got %v", err)
+		}
+
+		got, err := repo.GetReservationByCode(ctx, "abc")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.ID != id || !got.StartDate.Equal(res.StartDate) || got.Room.RoomName != "General's Quarters" {
+			t.Errorf("expected the reservation with its room but got %+v", got)
+		}
+
+		got.StartDate, got.EndDate = date("2050-06-02"), date("2050-06-06")
+		if err := repo.ChangeReservationDates(ctx, got); err != nil {
+			t.Fatal(err)
+		}
+		restrictions, err := repo.GetRestrictionsForRoomByDate(ctx, 1, date("2050-06-01"), date("2050-07-01"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(restrictions) != 1 || !restrictions[0].EndDate.Equal(date("2050-06-06")) ||
+			restrictions[0].Restriction.SystemKey != models.RestrictionReservation {
+			t.Errorf("expected the reservation's restriction to move with it but got %+v", restrictions)
+		}
+
+		if err := repo.DeleteReservation(ctx, id); err != nil {
+			t.Fatal(err)
+		}
+		available, err := repo.SearchAvailabilityByDatesByRoomID(ctx, date("2050-06-02"), date("2050-06-03"), 1)
+		if err != nil || !available {
+			t.Errorf("expected cancelling to free the dates but got %t, %v", available, err)
+		}
+	})
+}
+
+func TestRepo_SearchReservations(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, repo repository.DatabaseRepo) {
+		ctx := context.Background()
+
+		for i, res := range []models.Reservation{
+			{FirstName: "Jane", LastName: "Guest", Email: "jane@here.com", Phone: "555-0100", RoomID: 1,
+				StartDate: date("2050-06-01"), EndDate: date("2050-06-04")},
+			{FirstName: "John", LastName: "Smith", Email: "john@example.com", Phone: "555-0199", RoomID: 2,
+				StartDate: date("2050-06-03"), EndDate: date("2050-06-05")},
+			{FirstName: "Ann", LastName: "O'Brien", Email: "ann_obrien@here.com", Phone: "020 7946 0000", RoomID: 1,
+				StartDate: date("2050-07-01"), EndDate: date("2050-07-03")},
+			{FirstName: "Jo", LastName: "Smithers", Email: "jo%x@here.com", RoomID: 2,
+				StartDate: date("2050-08-01"), EndDate: date("2050-08-02")},
+		} {
+			res.ConfirmationCode = fmt.Sprintf("code-%d", i)
+			id, err := repo.BookRoom(ctx, res)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.LastName == "O'Brien" {
+				if err := repo.UpdateProcessedForReservation(ctx, id, 1); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+
+		var tests = []struct {
+			name     string
+			filter   models.ReservationFilter
+			expected []string
+			total    int
+		}{
+			{"everything by arrival", models.ReservationFilter{}, []string{"Guest", "Smith", "O'Brien", "Smithers"}, 4},
+			{"last name", models.ReservationFilter{Search: "smith"}, []string{"Smith", "Smithers"}, 2},
+			{"every word", models.ReservationFilter{Search: "JOHN smith"}, []string{"Smith"}, 1},
+			{"first name", models.ReservationFilter{Search: "jo"}, []string{"Smith", "Smithers"}, 2},
+			{"phone", models.ReservationFilter{Search: "555-01"}, []string{"Guest", "Smith"}, 2},
+			{"like wildcards", models.ReservationFilter{Search: "a_n"}, nil, 0},
+			{"escaped percent", models.ReservationFilter{Search: "jo%"}, []string{"Smithers"}, 1},
+			{"room", models.ReservationFilter{RoomID: 1}, []string{"Guest", "O'Brien"}, 2},
+			{"from", models.ReservationFilter{From: date("2050-06-04")}, []string{"Smith", "O'Brien", "Smithers"}, 3},
+			{"to", models.ReservationFilter{To: date("2050-06-03")}, []string{"Guest", "Smith"}, 2},
+			{"between", models.ReservationFilter{From: date("2050-06-04"), To: date("2050-07-01")},
+				[]string{"Smith", "O'Brien"}, 2},
+			{"new", models.ReservationFilter{Processed: models.ReservationsNew}, []string{"Guest", "Smith", "Smithers"}, 3},
+			{"processed", models.ReservationFilter{Processed: models.ReservationsProcessed}, []string{"O'Brien"}, 1},
+			{"name", models.ReservationFilter{Sort: models.SortByName}, []string{"Guest", "O'Brien", "Smith", "Smithers"}, 4},
+			{"name descending", models.ReservationFilter{Sort: models.SortByName, Desc: true},
+				[]string{"Smithers", "Smith", "O'Brien", "Guest"}, 4},
+			{"room then arrival", models.ReservationFilter{Sort: models.SortByRoom},
+				[]string{"Smith", "Smithers", "Guest", "O'Brien"}, 4},
+			{"departure descending", models.ReservationFilter{Sort: models.SortByDeparture, Desc: true},
+				[]string{"Smithers", "O'Brien", "Smith", "Guest"}, 4},
+			{"id descending", models.ReservationFilter{Sort: models.SortByID, Desc: true},
+				[]string{"Smithers", "O'Brien", "Smith", "Guest"}, 4},
+			{"second page", models.ReservationFilter{Page: 2, PerPage: 3}, []string{"Smithers"}, 4},
+			{"past the last page", models.ReservationFilter{Page: 3, PerPage: 3}, nil, 4},
+		}
+		for _, e := range tests {
+			reservations, total, err := repo.SearchReservations(ctx, e.filter)
+			if err != nil {
+				t.Errorf("%s: %v", e.name, err)
+				continue
+			}
+			var got []string
+			for _, res := range reservations {
+				got = append(got, res.LastName)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(e.expected) || total != e.total {
+				t.Errorf("%s: expected %v of %d but got %v of %d", e.name, e.expected, e.total, got, total)
+			}
+		}
+
+		reservations, _, err := repo.SearchReservations(ctx, models.ReservationFilter{Search: "guest"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(reservations) != 1 || reservations[0].Room.RoomName != "General's Quarters" ||
+			reservations[0].ConfirmationCode != "" {
+			t.Errorf("expected the reservation with its room and without its code but got %+v", reservations)
+		}
+
+		var streamed []string
+		err = repo.EachReservation(ctx, models.ReservationFilter{Sort: models.SortByName}, func(res models.Reservation) error {
+			streamed = append(streamed, res.LastName)
+			return nil
+		})
+		if err != nil || fmt.Sprint(streamed) != "[Guest O'Brien Smith Smithers]" {
+			t.Errorf("expected every reservation in order but got %v, %v", streamed, err)
+		}
+		stop := errors.New("stop")
+		calls := 0
+		err = repo.EachReservation(ctx, models.ReservationFilter{}, func(models.Reservation) error {
+			calls++
+			return stop
+		})
+		if !errors.Is(err, stop) || calls != 1 {
+			t.Errorf("expected the first error to stop the reservations but got %v after %d", err, calls)
+		}
+	})
+}
+
+func TestRepo_EachRoomRestriction(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, repo repository.DatabaseRepo) {
+		ctx := context.Background()
+
+		var ownerBlock int
+		all, err := repo.AllRestrictions(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range all {
+			if r.SystemKey == models.RestrictionOwnerBlock {
+				ownerBlock = r.ID
+			}
+		}
+
+		for _, res := range []models.Reservation{
+			{RoomID: 2, StartDate: date("2050-01-30"), EndDate: date("2050-02-02"), ConfirmationCode: "a"},
+			{RoomID: 1, StartDate: date("2050-02-10"), EndDate: date("2050-02-12"), ConfirmationCode: "b"},
+			// outside the range on either side
+			{RoomID: 1, StartDate: date("2050-01-29"), EndDate: date("2050-02-01"), ConfirmationCode: "c"},
+			{RoomID: 1, StartDate: date("2050-03-01"), EndDate: date("2050-03-03"), ConfirmationCode: "d"},
+		} {
+			if _, err := repo.BookRoom(ctx, res); err != nil {
+				t.Fatal(err)
+			}
+		}
+		_, err = repo.InsertBlock(ctx, models.RoomRestriction{RoomID: 1, RestrictionID: ownerBlock,
+			StartDate: date("2050-02-01"), EndDate: date("2050-02-05")})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got []string
+		err = repo.EachRoomRestriction(ctx, date("2050-02-01"), date("2050-03-01"), func(rr models.RoomRestriction) error {
+			got = append(got, fmt.Sprintf("%d %s %s %t", rr.RoomID, rr.StartDate.Format("01-02"),
+				rr.Restriction.SystemKey, rr.ReservationID != 0))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := "[1 02-01 owner_block false 1 02-10 reservation true 2 01-30 reservation true]"
+		if fmt.Sprint(got) != expected {
+			t.Errorf("expected %s but got %v", expected, got)
+		}
+	})
+}
+
+func TestRepo_Users(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, repo repository.DatabaseRepo) {
+		ctx := context.Background()
+
+		hash, _ := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+		id, err := repo.InsertUser(ctx, models.User{FirstName: "Owen", LastName: "Owner", Email: "owner@here.com",
+			Password: string(hash), AccessLevel: models.AccessOwner})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got, _, err := repo.Authenticate(ctx, "owner@here.com", "password"); err != nil || got != id {
+			t.Errorf("expected to log in as %d but got %d, %v", id, got, err)
+		}
+		if _, _, err := repo.Authenticate(ctx, "owner@here.com", "wrong"); err == nil {
+			t.Error("expected the wrong password to be refused")
+		}
+
+		_, err = repo.InsertAPIToken(ctx, models.APIToken{UserID: id, Name: "widget", TokenHash: "tokenhash"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		u, err := repo.GetUserByAPITokenHash(ctx, "tokenhash")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.ID != id || u.Email != "owner@here.com" {
+			t.Errorf("expected the token's user but got %+v", u)
+		}
+		tokens, _ := repo.AllAPITokens(ctx)
+		if len(tokens) != 1 || tokens[0].LastUsedAt.IsZero() || tokens[0].User.AccessLevel != models.AccessOwner {
+			t.Errorf("expected the token's use and its user's access to be listed but got %+v", tokens)
+		}
+
+		if err := repo.SetUserDisabled(ctx, id, true); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := repo.GetUserByAPITokenHash(ctx, "tokenhash"); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("expected a disabled user's token to stop working but got %v", err)
+		}
+	})
+}
+
+func TestRepo_LoginFailures(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, repo repository.DatabaseRepo) {
+		ctx := context.Background()
+
+		// Postgres keeps microseconds
+		now := time.Now().UTC().Truncate(time.Microsecond)
+
+		outcomes := []string{models.LoginFailed, models.LoginFailed, models.LoginSucceeded, models.LoginFailed}
+		for i, outcome := range outcomes {
+			err := repo.InsertLoginAttempt(ctx, models.LoginAttempt{Email: "staff@here.com", IPAddress: "10.0.0.1",
+				Outcome: outcome, CreatedAt: now.Add(time.Duration(i-len(outcomes)) * time.Minute)})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		f, err := repo.GetLoginFailures(ctx, "Staff@here.com", "10.0.0.1", now.Add(-time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.ByEmail != 1 || f.ByIP != 3 {
+			t.Errorf("expected 1 failure since the last login and 3 from the address but got %+v", f)
+		}
+		if last := now.Add(-time.Minute); !f.LastByEmail.Equal(last) || !f.LastByIP.Equal(last) {
+			t.Errorf("expected the last failure at %s but got %+v", last, f)
+		}
+
+		f, err = repo.GetLoginFailures(ctx, "nobody@here.com", "10.0.0.2", now.Add(-time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.ByEmail != 0 || !f.LastByEmail.IsZero() {
+			t.Errorf("expected no failures but got %+v", f)
+		}
+	})
+}
+
+func TestRepo_Mail(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, repo repository.DatabaseRepo) {
+		ctx := context.Background()
+		now := time.Now()
+
+		id, err := repo.QueueMail(ctx, models.MailData{To: "guest@here.com", From: "me@here.com", Subject: "Hello"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		msg, err := repo.ClaimMail(ctx, now.Add(time.Second), now.Add(10*time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.ID != id || msg.Mail.Subject != "Hello" {
+			t.Errorf("expected the queued message but got %+v", msg)
+		}
+		if _, err := repo.ClaimMail(ctx, now.Add(time.Second), now.Add(10*time.Minute)); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("expected a claimed message to be held but got %v", err)
+		}
+
+		msg.Status, msg.Attempts, msg.SentAt = models.MailSent, 1, now
+		if err := repo.UpdateMailStatus(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+		unsent, err := repo.GetUnsentMail(ctx)
+		if err != nil || len(unsent) != 0 {
+			t.Errorf("expected no unsent mail but got %+v, %v", unsent, err)
+		}
+	})
+}
+
+func TestRepo_ICalFeed(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, repo repository.DatabaseRepo) {
+		ctx := context.Background()
+
+		feed := models.ICalFeed{RoomID: 2, Name: "Elsewhere", URL: "https://elsewhere.example/room.ics"}
+		id, err := repo.InsertICalFeed(ctx, feed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		feed.ID = id
+
+		blocks := []models.RoomRestriction{
+			{StartDate: date("2050-01-01"), EndDate: date("2050-01-03"), ICalUID: "a"},
+			{StartDate: date("2050-02-01"), EndDate: date("2050-02-03"), ICalUID: "b"},
+		}
+		if err := repo.ReplaceICalFeedRestrictions(ctx, feed, blocks); err != nil {
+			t.Fatal(err)
+		}
+		// syncing again moves one event and drops the other
+		time.Sleep(time.Millisecond)
+		blocks = []models.RoomRestriction{{StartDate: date("2050-01-02"), EndDate: date("2050-01-04"), ICalUID: "a"}}
+		if err := repo.ReplaceICalFeedRestrictions(ctx, feed, blocks); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := repo.GetICalFeedRestrictions(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 1 || got[0].ICalUID != "a" || !got[0].StartDate.Equal(date("2050-01-02")) {
+			t.Errorf("expected the one moved event but got %+v", got)
+		}
+
+		available, err := repo.SearchAvailabilityByDatesByRoomID(ctx, date("2050-01-02"), date("2050-01-03"), 2)
+		if err != nil || available {
+			t.Errorf("expected the external block to keep guests out but got %t, %v", available, err)
+		}
+	})
+}
+
+func TestRepo_ConcurrentBooking(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, repo repository.DatabaseRepo) {
+		ctx := context.Background()
+		var wg sync.WaitGroup
+		errs := make(chan error, 8)
+		for i := 0; i < cap(errs); i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				_, err := repo.BookRoom(ctx, models.Reservation{FirstName: "Jane", LastName: "Guest", RoomID: 2,
+					StartDate: date("2050-08-01"), EndDate: date("2050-08-03"), ConfirmationCode: fmt.Sprint(i)})
+				errs <- err
+			}(i)
+		}
+		wg.Wait()
+		close(errs)
+
+		booked := 0
+		for err := range errs {
+			switch {
+			case err == nil:
+				booked++
+			case !errors.Is(err, repository.ErrRoomUnavailable):
+				t.Errorf("expected the room to be unavailable but got %v", err)
+			}
+		}
+		if booked != 1 {
+			t.Errorf("expected exactly one booking but got %d", booked)
+		}
+	})
+}
+
+func TestRepo_Restrictions(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, repo repository.DatabaseRepo) {
+		ctx := context.Background()
+		typeID, err := repo.InsertRestriction(ctx, models.Restriction{RestrictionName: "Cleaning", Colour: "#6c757d"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		all, err := repo.AllRestrictions(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(all) != 4 || all[0].SystemKey != models.RestrictionReservation || all[3].ID != typeID {
+			t.Errorf("expected the seeded types and then the new one but got %+v", all)
+		}
+
+		blockID, err := repo.InsertBlock(ctx, models.RoomRestriction{RoomID: 1, RestrictionID: typeID, Note: "deep clean",
+			StartDate: date("2050-03-01"), EndDate: date("2050-03-05")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		block, err := repo.GetBlockByID(ctx, blockID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if block.Note != "deep clean" || block.Room.RoomName != "General's Quarters" {
+			t.Errorf("expected the block with its room but got %+v", block)
+		}
+
+		// a type that doesn't block booking only marks the calendar, until it is changed to
+		available, err := repo.SearchAvailabilityByDatesByRoomID(ctx, date("2050-03-02"), date("2050-03-03"), 1)
+		if err != nil || !available {
+			t.Errorf("expected the room to be free but got %t, %v", available, err)
+		}
+		if err := repo.UpdateRestriction(ctx, models.Restriction{ID: typeID, RestrictionName: "Cleaning",
+			Colour: "#6c757d", BlocksBooking: true}); err != nil {
+			t.Fatal(err)
+		}
+		available, err = repo.SearchAvailabilityByDatesByRoomID(ctx, date("2050-03-02"), date("2050-03-03"), 1)
+		if err != nil || available {
+			t.Errorf("expected the block to keep guests out but got %t, %v", available, err)
+		}
+
+		for _, id := range []int{1, typeID} {
+			if err := repo.DeleteRestriction(ctx, id); !errors.Is(err, repository.ErrRestrictionInUse) {
+				t.Errorf("expected type %d to be kept but got %v", id, err)
+			}
+		}
+
+		// a reservation's restriction is not a block
+		resID, err := repo.BookRoom(ctx, models.Reservation{RoomID: 1, StartDate: date("2050-04-01"),
+			EndDate: date("2050-04-02"), ConfirmationCode: "abc"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		restrictions, err := repo.GetRestrictionsForRoomByDate(ctx, 1, date("2050-03-01"), date("2050-05-01"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(restrictions) != 2 {
+			t.Fatalf("expected the block and the reservation but got %+v", restrictions)
+		}
+		for _, r := range restrictions {
+			if r.ReservationID != resID {
+				continue
+			}
+			if _, err := repo.GetBlockByID(ctx, r.ID); !errors.Is(err, sql.ErrNoRows) {
+				t.Errorf("expected a reservation not to be found as a block but got %v", err)
+			}
+			if err := repo.DeleteBlockById(ctx, r.ID); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if available, _ := repo.SearchAvailabilityByDatesByRoomID(ctx, date("2050-04-01"), date("2050-04-02"), 1); available {
+			t.Error("expected deleting a reservation as a block to do nothing")
+		}
+
+		if err := repo.DeleteBlockById(ctx, blockID); err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.DeleteRestriction(ctx, typeID); err != nil {
+			t.Errorf("expected an unused type to be deleted but got %v", err)
+		}
+	})
+}
+
+func TestRepo_PasswordTokens(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, repo repository.DatabaseRepo) {
+		ctx := context.Background()
+		id, err := repo.InsertUser(ctx, models.User{FirstName: "Sam", LastName: "Staff", Email: "staff@here.com",
+			Password: "old", AccessLevel: models.AccessStaff})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := repo.InsertUser(ctx, models.User{Email: "staff@here.com", Password: "x"}); err == nil {
+			t.Error("expected a second user with the same email address to be refused")
+		}
+
+		for hash, expires := range map[string]time.Time{
+			"first":   time.Now().Add(time.Hour),
+			"second":  time.Now().Add(time.Hour),
+			"expired": time.Now().Add(-time.Hour),
+		} {
+			err := repo.InsertPasswordToken(ctx, models.PasswordToken{UserID: id, TokenHash: hash,
+				Purpose: models.PasswordTokenReset, ExpiresAt: expires})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if _, err := repo.GetPasswordToken(ctx, "expired"); !errors.Is(err, repository.ErrInvalidToken) {
+			t.Errorf("expected an expired token to be invalid but got %v", err)
+		}
+		pt, err := repo.GetPasswordToken(ctx, "first")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pt.UserID != id || pt.User.Email != "staff@here.com" || pt.Purpose != models.PasswordTokenReset {
+			t.Errorf("expected the token with its user but got %+v", pt)
+		}
+
+		if err := repo.ResetPassword(ctx, "first", "new"); err != nil {
+			t.Fatal(err)
+		}
+		if u, _ := repo.GetUserById(ctx, id); u.Password != "new" {
+			t.Errorf("expected the password to be changed but got %q", u.Password)
+		}
+		for _, hash := range []string{"first", "second"} {
+			if _, err := repo.GetPasswordToken(ctx, hash); !errors.Is(err, repository.ErrInvalidToken) {
+				t.Errorf("expected %s to be used up but got %v", hash, err)
+			}
+		}
+		if err := repo.ResetPassword(ctx, "first", "again"); !errors.Is(err, repository.ErrInvalidToken) {
+			t.Errorf("expected a used token to be refused but got %v", err)
+		}
+	})
+}
+
+func TestRepo_ScheduledEmails(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, repo repository.DatabaseRepo) {
+		ctx := context.Background()
+		id, err := repo.BookRoom(ctx, models.Reservation{FirstName: "Jane", Email: "jane@here.com", RoomID: 2,
+			StartDate: date("2050-06-01"), EndDate: date("2050-06-04"), ConfirmationCode: "abc"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		arriving, err := repo.GetArrivalsWithoutEmail(ctx, "pre_arrival", date("2050-05-31"), date("2050-06-01"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(arriving) != 1 || arriving[0].ID != id || arriving[0].ConfirmationCode != "abc" ||
+			arriving[0].Room.RoomName != "Colonel's Suite" {
+			t.Fatalf("expected the arriving reservation with its room but got %+v", arriving)
+		}
+
+		mail := models.MailData{To: "jane@here.com", From: "me@here.com", Subject: "See you soon"}
+		if queued, err := repo.QueueReservationEmail(ctx, id, "pre_arrival", mail); err != nil || !queued {
+			t.Fatalf("expected the email to be queued but got %t, %v", queued, err)
+		}
+		if queued, err := repo.QueueReservationEmail(ctx, id, "pre_arrival", mail); err != nil || queued {
+			t.Errorf("expected the email to be queued only once but got %t, %v", queued, err)
+		}
+
+		arriving, _ = repo.GetArrivalsWithoutEmail(ctx, "pre_arrival", date("2050-05-31"), date("2050-06-01"))
+		departing, _ := repo.GetDeparturesWithoutEmail(ctx, "thank_you", date("2050-06-04"), date("2050-06-04"))
+		if len(arriving) != 0 || len(departing) != 1 {
+			t.Errorf("expected only the thank you left to send but got %+v and %+v", arriving, departing)
+		}
+
+		unsent, err := repo.GetUnsentMail(ctx)
+		if err != nil || len(unsent) != 1 || unsent[0].Mail.Subject != "See you soon" {
+			t.Errorf("expected one queued email but got %+v, %v", unsent, err)
+		}
+	})
+}
+
+func TestRepo_DeleteRoom(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, repo repository.DatabaseRepo) {
+		ctx := context.Background()
+		roomID, err := repo.InsertRoom(ctx, models.Room{RoomName: "Major's Attic", Slug: "majors-attic", Capacity: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = repo.InsertSeasonalRate(ctx, models.SeasonalRate{RoomID: roomID, Name: "Summer", NightlyRate: 9000,
+			StartDate: date("2050-06-01"), EndDate: date("2050-09-01")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resID, err := repo.BookRoom(ctx, models.Reservation{RoomID: roomID, StartDate: date("2050-07-01"),
+			EndDate: date("2050-07-02"), ConfirmationCode: "abc"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := repo.InsertICalFeed(ctx, models.ICalFeed{RoomID: roomID, Name: "Elsewhere"}); err != nil {
+			t.Fatal(err)
+		}
+
+		// a season counts if it shares a night with the stay
+		seasons, err := repo.GetSeasonalRatesForRoom(ctx, roomID, date("2050-08-31"), date("2050-09-02"))
+		if err != nil || len(seasons) != 1 {
+			t.Errorf("expected the summer rate but got %+v, %v", seasons, err)
+		}
+		seasons, _ = repo.GetSeasonalRatesForRoom(ctx, roomID, date("2050-09-01"), date("2050-09-02"))
+		if len(seasons) != 0 {
+			t.Errorf("expected no rate after the season ends but got %+v", seasons)
+		}
+
+		// the room's reservations are kept, and the room with them
+		if err := repo.DeleteRoom(ctx, roomID); !errors.Is(err, repository.ErrRoomHasReservations) {
+			t.Fatalf("expected a room with reservations to be kept but got %v", err)
+		}
+		if _, err := repo.GetReservationById(ctx, resID); err != nil {
+			t.Errorf("expected the room's reservation to be kept but got %v", err)
+		}
+
+		if err := repo.DeleteReservation(ctx, resID); err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.DeleteRoom(ctx, roomID); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := repo.GetRoomById(ctx, roomID); err == nil {
+			t.Error("expected the room to be deleted")
+		}
+		if err := repo.DeleteRoom(ctx, roomID); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("expected deleting a room that isn't there to find no rows but got %v", err)
+		}
+		if feeds, _ := repo.AllICalFeeds(ctx); len(feeds) != 0 {
+			t.Errorf("expected the room's calendars to be deleted with it but got %+v", feeds)
+		}
+		if seasons, _ := repo.GetSeasonalRatesForRoom(ctx, roomID, date("2050-06-01"), date("2050-09-01")); len(seasons) != 0 {
+			t.Errorf("expected the room's rates to be deleted with it but got %+v", seasons)
+		}
+	})
+}
@@ -0,0 +1,219 @@
+package dbrepo
+
+import (
+	"bookings/internal/models"
+	"bookings/internal/repository"
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// sqliteTimeFormat is how the driver writes times, and so how times come back from expressions such as max(),
+// which SQLite returns as plain text
+const sqliteTimeFormat = "2006-01-02 15:04:05.999999999-07:00"
+
+// BookRoom inserts a reservation and its room restriction in a single transaction. SQLite transactions take the
+// database's write lock as they begin, so nothing else can book the room between the check and the insert
+func (m *sqliteDBRepo) BookRoom(ctx context.Context, res models.Reservation) (int, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var numOfRows int
+	query := `select count(id) from room_restrictions where $1 < end_date and $2 > start_date and room_id = $3
+			and restriction_id in (select id from restrictions where blocks_booking)`
+	err = tx.QueryRowContext(ctx, query, res.StartDate, res.EndDate, res.RoomID).Scan(&numOfRows)
+	if err != nil {
+		return 0, err
+	}
+	if numOfRows > 0 {
+		return 0, repository.ErrRoomUnavailable
+	}
+
+	var newID int
+	stmt := `insert into reservations (first_name, last_name, email, phone, start_date, end_date, room_id, total_price,
+			confirmation_code, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) returning id`
+	err = tx.QueryRowContext(ctx, stmt, res.FirstName, res.LastName, res.Email, res.Phone,
+		res.StartDate, res.EndDate, res.RoomID, res.TotalPrice, res.ConfirmationCode, time.Now(), time.Now()).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	stmt = `insert into room_restrictions(start_date, end_date, room_id, created_at, updated_at, reservation_id, restriction_id)
+			values ($1, $2, $3, $4, $5, $6, (select id from restrictions where system_key = $7))`
+	_, err = tx.ExecContext(ctx, stmt, res.StartDate, res.EndDate, res.RoomID, time.Now(), time.Now(), newID,
+		models.RestrictionReservation)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+	return newID, nil
+}
+
+// ChangeReservationDates moves a reservation and its room restriction to new dates in a single transaction,
+// returning repository.ErrRoomUnavailable if another booking or block overlaps the new dates
+func (m *sqliteDBRepo) ChangeReservationDates(ctx context.Context, res models.Reservation) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// the reservation's own restriction doesn't count against its new dates
+	var numOfRows int
+	query := `select count(id) from room_restrictions
+			where $1 < end_date and $2 > start_date and room_id = $3 and coalesce(reservation_id, 0) <> $4
+			and restriction_id in (select id from restrictions where blocks_booking)`
+	err = tx.QueryRowContext(ctx, query, res.StartDate, res.EndDate, res.RoomID, res.ID).Scan(&numOfRows)
+	if err != nil {
+		return err
+	}
+	if numOfRows > 0 {
+		return repository.ErrRoomUnavailable
+	}
+
+	stmt := `update reservations set start_date = $1, end_date = $2, total_price = $3, updated_at = $4 where id = $5`
+	_, err = tx.ExecContext(ctx, stmt, res.StartDate, res.EndDate, res.TotalPrice, time.Now(), res.ID)
+	if err != nil {
+		return err
+	}
+
+	stmt = `update room_restrictions set start_date = $1, end_date = $2, updated_at = $3 where reservation_id = $4`
+	_, err = tx.ExecContext(ctx, stmt, res.StartDate, res.EndDate, time.Now(), res.ID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetUserByAPITokenHash returns the user an api token was issued to, and records that the token was used. SQLite
+// can only return the columns of the table it updates, so the user is read separately
+func (m *sqliteDBRepo) GetUserByAPITokenHash(ctx context.Context, hash string) (models.User, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	var u models.User
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return u, err
+	}
+	defer tx.Rollback()
+
+	query := `update api_tokens set last_used_at = $1
+			where token_hash = $2 and user_id in (select id from users where not disabled)
+			returning user_id`
+	err = tx.QueryRowContext(ctx, query, time.Now(), hash).Scan(&u.ID)
+	if err != nil {
+		return u, err
+	}
+
+	query = `select first_name, last_name, email, access_level, created_at, updated_at from users where id = $1`
+	err = tx.QueryRowContext(ctx, query, u.ID).Scan(
+		&u.FirstName,
+		&u.LastName,
+		&u.Email,
+		&u.AccessLevel,
+		&u.CreatedAt,
+		&u.UpdatedAt)
+	if err != nil {
+		return u, err
+	}
+
+	return u, tx.Commit()
+}
+
+// GetLoginFailures counts the failed logins since the given time for an email address and for an ip address.
+// Failures for an email address from before its last successful login, or before its account's lockout ended,
+// are not counted
+func (m *sqliteDBRepo) GetLoginFailures(ctx context.Context, email, ip string, since time.Time) (models.LoginFailures, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var f models.LoginFailures
+	var last sql.NullString
+
+	query := `select count(id), max(created_at) from login_attempts
+			where email = $1 and outcome = $2 and created_at > $3
+			and created_at > coalesce((select max(created_at) from login_attempts where email = $1 and outcome = $4), $3)
+			and created_at > coalesce((select locked_until from users where lower(email) = $1), $3)`
+	err := m.DB.QueryRowContext(ctx, query, strings.ToLower(email), models.LoginFailed, since, models.LoginSucceeded).
+		Scan(&f.ByEmail, &last)
+	if err != nil {
+		return f, err
+	}
+	f.LastByEmail, err = parseSQLiteTime(last)
+	if err != nil {
+		return f, err
+	}
+
+	query = `select count(id), max(created_at) from login_attempts
+			where ip_address = $1 and outcome = $2 and created_at > $3`
+	err = m.DB.QueryRowContext(ctx, query, ip, models.LoginFailed, since).Scan(&f.ByIP, &last)
+	if err != nil {
+		return f, err
+	}
+	f.LastByIP, err = parseSQLiteTime(last)
+	if err != nil {
+		return f, err
+	}
+
+	return f, nil
+}
+
+// ClaimMail takes the pending message that has waited longest for its next attempt, if one is due by now, and
+// holds it until leaseUntil so that no other worker sends it too. SQLite runs one write at a time, so the update
+// needs no row lock. Returns sql.ErrNoRows when nothing is due
+func (m *sqliteDBRepo) ClaimMail(ctx context.Context, now, leaseUntil time.Time) (models.OutboxMessage, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var o models.OutboxMessage
+	var sentAt sql.NullTime
+	err := m.DB.QueryRowContext(ctx, `update mail_outbox set next_attempt_at = $2, updated_at = $1
+			where id = (select id from mail_outbox where status = $3 and next_attempt_at <= $1
+				order by next_attempt_at limit 1)
+			returning id, to_address, from_address, subject, content, text_content, status, attempts, next_attempt_at,
+				last_error, sent_at, created_at, updated_at`, now, leaseUntil, models.MailPending,
+	).Scan(
+		&o.ID,
+		&o.Mail.To,
+		&o.Mail.From,
+		&o.Mail.Subject,
+		&o.Mail.Content,
+		&o.Mail.Text,
+		&o.Status,
+		&o.Attempts,
+		&o.NextAttemptAt,
+		&o.LastError,
+		&sentAt,
+		&o.CreatedAt,
+		&o.UpdatedAt,
+	)
+	if err != nil {
+		return o, err
+	}
+	o.SentAt = sentAt.Time
+	return o, nil
+}
+
+// parseSQLiteTime reads a time SQLite returned as text, the zero time standing for null
+func parseSQLiteTime(s sql.NullString) (time.Time, error) {
+	if !s.Valid {
+		return time.Time{}, nil
+	}
+	return time.Parse(sqliteTimeFormat, s.String)
+}
@@ -0,0 +1,81 @@
+package dbrepo
+
+import (
+	"bookings/internal/config"
+	"bookings/internal/driver"
+	"bookings/internal/migrate"
+	"bookings/internal/repository"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newSQLiteRepo returns a repository for a new SQLite database, migrated and seeded as a fresh install would be
+func newSQLiteRepo(t *testing.T) repository.DatabaseRepo {
+	t.Helper()
+	db, err := driver.NewSQLiteDatabase(filepath.Join(t.TempDir(), "bookings.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	m, err := migrate.New(db, "sqlite", slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Up(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return NewSQLiteRepo(db, &config.AppConfig{})
+}
+
+func TestSQLite_Migrate(t *testing.T) {
+	db, err := driver.NewSQLiteDatabase(filepath.Join(t.TempDir(), "bookings.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	m, err := migrate.New(db, "sqlite", slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	if n, err := m.Up(ctx); err != nil || n != 2 {
+		t.Fatalf("expected the schema and its indexes to be applied but got %d, %v", n, err)
+	}
+	if n, err := m.Up(ctx); err != nil || n != 0 {
+		t.Fatalf("expected nothing left to apply but got %d, %v", n, err)
+	}
+	if n, err := m.Down(ctx, 1); err != nil || n != 1 {
+		t.Fatalf("expected the last migration to be undone but got %d, %v", n, err)
+	}
+	statuses, err := m.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 2 || !statuses[0].Applied || statuses[1].Applied {
+		t.Errorf("expected the schema applied and the indexes pending but got %+v", statuses)
+	}
+}
+
+func TestSQLite_Context(t *testing.T) {
+	repo := newSQLiteRepo(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := repo.AllRooms(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected a cancelled request to stop its query but got %v", err)
+	}
+
+	// the configured timeout applies on top of the request's own deadline
+	repo.(*sqliteDBRepo).App.DBTimeout = time.Nanosecond
+	if _, err := repo.AllRooms(context.Background()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the query to time out but got %v", err)
+	}
+}
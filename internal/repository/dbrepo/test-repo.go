@@ -2,21 +2,53 @@ package dbrepo
 
 import (
 	"bookings/internal/models"
+	"bookings/internal/repository"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"strings"
 	"time"
 )
 
-func (m *testDBRepo) AllUsers() bool {
-	return true
+// testRestrictions are the seeded restriction types, plus one the owners added
+var testRestrictions = []models.Restriction{
+	{ID: 1, RestrictionName: "Reservation", SystemKey: models.RestrictionReservation, Colour: "#dc3545",
+		BlocksBooking: true},
+	{ID: 2, RestrictionName: "Owner Block", SystemKey: models.RestrictionOwnerBlock, Colour: "#ffc107",
+		BlocksBooking: true},
+	{ID: 3, RestrictionName: "External Booking", SystemKey: models.RestrictionExternal, Colour: "#17a2b8",
+		BlocksBooking: true},
+	{ID: 4, RestrictionName: "Renovation", Colour: "#6c757d", BlocksBooking: true, GuestVisible: true},
 }
 
-func (m *testDBRepo) AllRooms() ([]models.Room, error) {
+// testUsers are the users the test repository knows by email address
+var testUsers = []models.User{
+	{ID: 1, FirstName: "Admin", LastName: "User", Email: "me@here.com", AccessLevel: models.AccessOwner},
+	{ID: 2, FirstName: "Staff", LastName: "User", Email: "staff@here.com", AccessLevel: models.AccessStaff},
+}
+
+func (m *testDBRepo) AllUsers(ctx context.Context) ([]models.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var users []models.User
+	for _, u := range testUsers {
+		u.LockedUntil = m.lockedUntil[u.ID]
+		users = append(users, u)
+	}
+	return users, nil
+}
+
+func (m *testDBRepo) AllRooms(ctx context.Context) ([]models.Room, error) {
 	var rooms []models.Room
 	return rooms, nil
 }
 
 // InsertReservation inserts a reservation into the database
-func (m *testDBRepo) InsertReservation(res models.Reservation) (int, error) {
+func (m *testDBRepo) InsertReservation(ctx context.Context, res models.Reservation) (int, error) {
 	// if the room id is 2 then fail, otherwise pass
 	if res.RoomID == 2 {
 		return 0, errors.New("some error")
@@ -25,27 +57,39 @@ func (m *testDBRepo) InsertReservation(res models.Reservation) (int, error) {
 }
 
 // InsertRoomRestriction inserts a room restriction into the database
-func (m *testDBRepo) InsertRoomRestriction(res models.RoomRestriction) error {
+func (m *testDBRepo) InsertRoomRestriction(ctx context.Context, res models.RoomRestriction) error {
 	if res.RoomID == 100000 {
 		return errors.New("some error")
 	}
 	return nil
 }
 
+// BookRoom inserts a reservation and its room restriction
+func (m *testDBRepo) BookRoom(ctx context.Context, res models.Reservation) (int, error) {
+	// if the room id is 2 then fail, and treat 2060-01-01 as already taken by another guest
+	if res.RoomID == 2 {
+		return 0, errors.New("some error")
+	}
+	if res.StartDate.Format("2006-01-02") == "2060-01-01" {
+		return 0, repository.ErrRoomUnavailable
+	}
+	return 1, nil
+}
+
 // SearchAvailabilityByDatesByRoomID returns true if an availability exists and false if no availability exits
-func (m *testDBRepo) SearchAvailabilityByDatesByRoomID(startDate, endDate time.Time, roomId int) (bool, error) {
+func (m *testDBRepo) SearchAvailabilityByDatesByRoomID(ctx context.Context, startDate, endDate time.Time, roomId int) (bool, error) {
 
 	return false, nil
 }
 
 // SearchAvailabilityForAllRooms returns a slice of available rooms, if any for a given date range
-func (m *testDBRepo) SearchAvailabilityForAllRooms(startDate, endDate time.Time) ([]models.Room, error) {
+func (m *testDBRepo) SearchAvailabilityForAllRooms(ctx context.Context, startDate, endDate time.Time) ([]models.Room, error) {
 	var rooms []models.Room
 	return rooms, nil
 }
 
 // GetRoomById gets a room by id
-func (m *testDBRepo) GetRoomById(id int) (models.Room, error) {
+func (m *testDBRepo) GetRoomById(ctx context.Context, id int) (models.Room, error) {
 	var room models.Room
 	if id > 2 {
 		return room, errors.New("some error")
@@ -53,64 +97,660 @@ func (m *testDBRepo) GetRoomById(id int) (models.Room, error) {
 	return room, nil
 }
 
-func (m *testDBRepo) GetUserByID(id int) (models.User, error) {
-	var u models.User
+// GetRoomBySlug gets a room by slug, only the two seeded rooms exist
+func (m *testDBRepo) GetRoomBySlug(ctx context.Context, slug string) (models.Room, error) {
+	var room models.Room
+	switch slug {
+	case "generals-quarters":
+		room.ID = 1
+	case "colonels-suite":
+		room.ID = 2
+	default:
+		return room, sql.ErrNoRows
+	}
+	room.Slug = slug
+	room.ICalToken = "valid-ical-token"
+	return room, nil
+}
+
+func (m *testDBRepo) InsertRoom(ctx context.Context, r models.Room) (int, error) {
+	return 3, nil
+}
+
+func (m *testDBRepo) UpdateRoom(ctx context.Context, r models.Room) error {
+	return nil
+}
+
+func (m *testDBRepo) UpdateRoomICalToken(ctx context.Context, id int, token string) error {
+	return nil
+}
+
+// DeleteRoom refuses to delete room 1, which has reservations
+func (m *testDBRepo) DeleteRoom(ctx context.Context, id int) error {
+	switch {
+	case id == 1:
+		return repository.ErrRoomHasReservations
+	case id > 2:
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// GetSeasonalRatesForRoom returns a season with a three night minimum stay for stays in 2070
+func (m *testDBRepo) GetSeasonalRatesForRoom(ctx context.Context, roomID int, start, end time.Time) ([]models.SeasonalRate, error) {
+	var seasons []models.SeasonalRate
+	if start.Year() == 2070 {
+		seasons = append(seasons, models.SeasonalRate{
+			ID:          1,
+			RoomID:      roomID,
+			Name:        "Peak",
+			StartDate:   time.Date(2070, 1, 1, 0, 0, 0, 0, time.UTC),
+			EndDate:     time.Date(2071, 1, 1, 0, 0, 0, 0, time.UTC),
+			NightlyRate: 25000,
+			MinStay:     3,
+		})
+	}
+	return seasons, nil
+}
+
+func (m *testDBRepo) InsertSeasonalRate(ctx context.Context, s models.SeasonalRate) (int, error) {
+	return 1, nil
+}
+
+func (m *testDBRepo) DeleteSeasonalRate(ctx context.Context, id int) error {
+	return nil
+}
+
+// testPasswordHash is a low cost bcrypt hash of "password"
+const testPasswordHash = "$2a$04$dPgVlxFLAgItjk25TQZT3.CVWjOvYeAg7hDM3kPRMcV.mhRvhRWLe"
+
+// GetUserById returns an owner for user 1, and a read-only user for anyone else. Both have the password "password"
+func (m *testDBRepo) GetUserById(ctx context.Context, id int) (models.User, error) {
+	u := models.User{ID: id, AccessLevel: models.AccessReadOnly, Password: testPasswordHash}
+	if id == 1 {
+		u.AccessLevel = models.AccessOwner
+	}
 	return u, nil
 }
 
-func (m *testDBRepo) UpdateUser(u models.User) error {
+func (m *testDBRepo) UpdateUser(ctx context.Context, u models.User) error {
 	return nil
 }
 
-func (m *testDBRepo) UpdateReservation(u models.Reservation) error {
+// GetUserByEmail only knows the testUsers
+func (m *testDBRepo) GetUserByEmail(ctx context.Context, email string) (models.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, u := range testUsers {
+		if strings.EqualFold(u.Email, email) {
+			u.LockedUntil = m.lockedUntil[u.ID]
+			return u, nil
+		}
+	}
+	return models.User{}, sql.ErrNoRows
+}
+
+func (m *testDBRepo) InsertUser(ctx context.Context, u models.User) (int, error) {
+	return 3, nil
+}
+
+func (m *testDBRepo) UpdatePassword(ctx context.Context, id int, hashedPassword string) error {
+	return nil
+}
+
+func (m *testDBRepo) SetUserDisabled(ctx context.Context, id int, disabled bool) error {
 	return nil
 }
 
-func (m *testDBRepo) UpdateProcessedForReservation(id, processed int) error {
+func (m *testDBRepo) LockUser(ctx context.Context, id int, until time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.lockedUntil[id] = until
 	return nil
 }
 
-func (m *testDBRepo) Authenticate(email, testPassword string) (int, string, error) {
+func (m *testDBRepo) UnlockUser(ctx context.Context, id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.lockedUntil[id].After(time.Now()) {
+		m.lockedUntil[id] = time.Now()
+	}
+	return nil
+}
+
+func (m *testDBRepo) InsertLoginAttempt(ctx context.Context, a models.LoginAttempt) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	a.ID = len(m.loginAttempts) + 1
+	a.Email = strings.ToLower(a.Email)
+	a.UpdatedAt = a.CreatedAt
+	m.loginAttempts = append(m.loginAttempts, a)
+	return nil
+}
+
+// GetLoginFailures counts failures the same way as the postgres repository, from the attempts held in memory
+func (m *testDBRepo) GetLoginFailures(ctx context.Context, email, ip string, since time.Time) (models.LoginFailures, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var f models.LoginFailures
+	email = strings.ToLower(email)
+
+	emailSince := since
+	for _, u := range testUsers {
+		if strings.EqualFold(u.Email, email) && m.lockedUntil[u.ID].After(emailSince) {
+			emailSince = m.lockedUntil[u.ID]
+		}
+	}
+	for _, a := range m.loginAttempts {
+		if a.Email == email && a.Outcome == models.LoginSucceeded && a.CreatedAt.After(emailSince) {
+			emailSince = a.CreatedAt
+		}
+	}
+
+	for _, a := range m.loginAttempts {
+		if a.Outcome != models.LoginFailed {
+			continue
+		}
+		if a.Email == email && a.CreatedAt.After(emailSince) {
+			f.ByEmail++
+			if a.CreatedAt.After(f.LastByEmail) {
+				f.LastByEmail = a.CreatedAt
+			}
+		}
+		if a.IPAddress == ip && a.CreatedAt.After(since) {
+			f.ByIP++
+			if a.CreatedAt.After(f.LastByIP) {
+				f.LastByIP = a.CreatedAt
+			}
+		}
+	}
+	return f, nil
+}
+
+func (m *testDBRepo) RecentFailedLogins(ctx context.Context, limit int) ([]models.LoginAttempt, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var attempts []models.LoginAttempt
+	for i := len(m.loginAttempts) - 1; i >= 0 && len(attempts) < limit; i-- {
+		if m.loginAttempts[i].Outcome != models.LoginSucceeded {
+			attempts = append(attempts, m.loginAttempts[i])
+		}
+	}
+	return attempts, nil
+}
+
+func (m *testDBRepo) InsertPasswordToken(ctx context.Context, t models.PasswordToken) error {
+	return nil
+}
+
+// GetPasswordToken only accepts the token "valid-token"
+func (m *testDBRepo) GetPasswordToken(ctx context.Context, hash string) (models.PasswordToken, error) {
+	var t models.PasswordToken
+	sum := sha256.Sum256([]byte("valid-token"))
+	if hash != hex.EncodeToString(sum[:]) {
+		return t, repository.ErrInvalidToken
+	}
+	t = models.PasswordToken{
+		ID:        1,
+		UserID:    2,
+		TokenHash: hash,
+		Purpose:   models.PasswordTokenInvite,
+		ExpiresAt: time.Now().Add(time.Hour),
+		User:      models.User{ID: 2, FirstName: "Staff", LastName: "User", Email: "staff@here.com"},
+	}
+	return t, nil
+}
+
+// ResetPassword only accepts the token "valid-token"
+func (m *testDBRepo) ResetPassword(ctx context.Context, tokenHash, hashedPassword string) error {
+	if _, err := m.GetPasswordToken(ctx, tokenHash); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (m *testDBRepo) UpdateReservation(ctx context.Context, u models.Reservation) error {
+	return nil
+}
+
+func (m *testDBRepo) UpdateProcessedForReservation(ctx context.Context, id, processed int) error {
+	return nil
+}
+
+func (m *testDBRepo) Authenticate(ctx context.Context, email, testPassword string) (int, string, error) {
 	if email == "me@here.com" {
 		return 1, "", nil
 	}
 	return 0, "", errors.New("some error")
 }
 
-func (m *testDBRepo) AllReservations() ([]models.Reservation, error) {
+func (m *testDBRepo) SearchReservations(ctx context.Context, f models.ReservationFilter) ([]models.Reservation, int, error) {
 	var reservations []models.Reservation
 
-	return reservations, nil
+	return reservations, 0, nil
 }
 
-func (m *testDBRepo) DeleteReservation(id int) error {
+func (m *testDBRepo) EachReservation(ctx context.Context, f models.ReservationFilter, fn func(models.Reservation) error) error {
 	return nil
 }
 
-func (m *testDBRepo) AllNewReservations() ([]models.Reservation, error) {
-	var reservations []models.Reservation
+func (m *testDBRepo) DeleteReservation(ctx context.Context, id int) error {
+	return nil
+}
 
-	return reservations, nil
+func (m *testDBRepo) GetReservationById(ctx context.Context, id int) (models.Reservation, error) {
+	var res models.Reservation
+	if id > 1000 {
+		return res, sql.ErrNoRows
+	}
+
+	res.ID = id
+	res.RoomID = 1
+	res.StartDate = time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC)
+	res.EndDate = time.Date(2050, 1, 3, 0, 0, 0, 0, time.UTC)
+	// reservation 1000 is a stay that is over
+	if id == 1000 {
+		res.StartDate = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+		res.EndDate = time.Date(2020, 1, 3, 0, 0, 0, 0, time.UTC)
+	}
+	return res, nil
 }
 
-func (m *testDBRepo) GetReservationById(id int) (models.Reservation, error) {
+// GetReservationByCode knows the confirmation code "valid-code", and "past-code" for a stay that is over
+func (m *testDBRepo) GetReservationByCode(ctx context.Context, code string) (models.Reservation, error) {
 	var res models.Reservation
+	if code != "valid-code" && code != "past-code" {
+		return res, sql.ErrNoRows
+	}
 
+	res = models.Reservation{
+		ID:               1,
+		FirstName:        "John",
+		LastName:         "Smith",
+		Email:            "john@smith.com",
+		Phone:            "555-555-5555",
+		StartDate:        time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC),
+		EndDate:          time.Date(2050, 1, 3, 0, 0, 0, 0, time.UTC),
+		RoomID:           1,
+		ConfirmationCode: code,
+		Room:             models.Room{ID: 1, RoomName: "General's Quarters"},
+	}
+	if code == "past-code" {
+		res.ID = 2
+		res.StartDate = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+		res.EndDate = time.Date(2020, 1, 3, 0, 0, 0, 0, time.UTC)
+	}
 	return res, nil
 }
 
-func (m *testDBRepo) GetRestrictionsForRoomByDate(roomID int, start, end time.Time) ([]models.RoomRestriction, error) {
+// ChangeReservationDates reports the room as taken when the new stay starts on 2060-01-01
+func (m *testDBRepo) ChangeReservationDates(ctx context.Context, res models.Reservation) error {
+	if res.StartDate.Format("2006-01-02") == "2060-01-01" {
+		return repository.ErrRoomUnavailable
+	}
+	return nil
+}
+
+// GetRestrictionsForRoomByDate returns a reservation and an owner block for room 1
+func (m *testDBRepo) GetRestrictionsForRoomByDate(ctx context.Context, roomID int, start, end time.Time) ([]models.RoomRestriction, error) {
 	var restrictions []models.RoomRestriction
+	if roomID != 1 {
+		return restrictions, nil
+	}
+
+	day := start.AddDate(0, 0, 40)
+	restrictions = append(restrictions,
+		models.RoomRestriction{ID: 1, RoomID: 1, ReservationID: 1, RestrictionID: 1,
+			StartDate: day, EndDate: day.AddDate(0, 0, 2), Restriction: testRestrictions[0]},
+		models.RoomRestriction{ID: 2, RoomID: 1, RestrictionID: 4,
+			StartDate: day.AddDate(0, 0, 5), EndDate: day.AddDate(0, 0, 6), Restriction: testRestrictions[3]},
+	)
 	return restrictions, nil
 }
 
-// InsertBlockForRoom inserts a room restriction
-func (m *testDBRepo) InsertBlockForRoom(id int, startDate time.Time) error {
+func (m *testDBRepo) EachRoomRestriction(ctx context.Context, start, end time.Time, fn func(models.RoomRestriction) error) error {
+	restrictions, _ := m.GetRestrictionsForRoomByDate(ctx, 1, start, end)
+	for _, rr := range restrictions {
+		if err := fn(rr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *testDBRepo) AllRestrictions(ctx context.Context) ([]models.Restriction, error) {
+	return append([]models.Restriction(nil), testRestrictions...), nil
+}
+
+func (m *testDBRepo) GetRestrictionByID(ctx context.Context, id int) (models.Restriction, error) {
+	for _, r := range testRestrictions {
+		if r.ID == id {
+			return r, nil
+		}
+	}
+	return models.Restriction{}, sql.ErrNoRows
+}
+
+func (m *testDBRepo) InsertRestriction(ctx context.Context, r models.Restriction) (int, error) {
+	return len(testRestrictions) + 1, nil
+}
+
+func (m *testDBRepo) UpdateRestriction(ctx context.Context, r models.Restriction) error {
+	return nil
+}
+
+// DeleteRestriction refuses to delete the seeded types, which are always in use
+func (m *testDBRepo) DeleteRestriction(ctx context.Context, id int) error {
+	r, err := m.GetRestrictionByID(ctx, id)
+	if err != nil {
+		return err
+	}
+	if r.SystemKey != "" {
+		return repository.ErrRestrictionInUse
+	}
+	return nil
+}
+
+// GetBlockByID returns a maintenance block on room 1 for id 1
+func (m *testDBRepo) GetBlockByID(ctx context.Context, id int) (models.RoomRestriction, error) {
+	var b models.RoomRestriction
+	if id != 1 {
+		return b, sql.ErrNoRows
+	}
+	b = models.RoomRestriction{
+		ID:            1,
+		RoomID:        1,
+		RestrictionID: 2,
+		StartDate:     time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC),
+		EndDate:       time.Date(2050, 1, 4, 0, 0, 0, 0, time.UTC),
+		Note:          "Maintenance",
+	}
+	b.Room.ID = 1
+	b.Room.RoomName = "General's Quarters"
+	return b, nil
+}
+
+func (m *testDBRepo) InsertBlock(ctx context.Context, b models.RoomRestriction) (int, error) {
+	return 2, nil
+}
+
+func (m *testDBRepo) UpdateBlock(ctx context.Context, b models.RoomRestriction) error {
 	return nil
 }
 
 // DeleteBlockById deletes a room restriction
-func (m *testDBRepo) DeleteBlockById(id int) error {
+func (m *testDBRepo) DeleteBlockById(ctx context.Context, id int) error {
+	return nil
+
+}
+
+func (m *testDBRepo) AllAPITokens(ctx context.Context) ([]models.APIToken, error) {
+	var tokens []models.APIToken
+	return tokens, nil
+}
+
+func (m *testDBRepo) InsertAPIToken(ctx context.Context, t models.APIToken) (int, error) {
+	return 1, nil
+}
+
+func (m *testDBRepo) DeleteAPIToken(ctx context.Context, id int) error {
+	return nil
+}
+
+// GetUserByAPITokenHash accepts the token "valid-token", belonging to an owner, and "read-only-token"
+func (m *testDBRepo) GetUserByAPITokenHash(ctx context.Context, hash string) (models.User, error) {
+	var u models.User
+	sum := sha256.Sum256([]byte("valid-token"))
+	readOnly := sha256.Sum256([]byte("read-only-token"))
+	switch hash {
+	case hex.EncodeToString(sum[:]):
+		u.ID = 1
+		u.AccessLevel = 3
+	case hex.EncodeToString(readOnly[:]):
+		u.ID = 2
+		u.AccessLevel = 1
+	default:
+		return u, sql.ErrNoRows
+	}
+	return u, nil
+}
+
+func (m *testDBRepo) AllICalFeeds(ctx context.Context) ([]models.ICalFeed, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var feeds []models.ICalFeed
+	for _, f := range m.icalFeeds {
+		feeds = append(feeds, f)
+	}
+	return feeds, nil
+}
+
+func (m *testDBRepo) GetICalFeedsForRoom(ctx context.Context, roomID int) ([]models.ICalFeed, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var feeds []models.ICalFeed
+	for _, f := range m.icalFeeds {
+		if f.RoomID == roomID {
+			feeds = append(feeds, f)
+		}
+	}
+	return feeds, nil
+}
+
+func (m *testDBRepo) GetICalFeedByID(ctx context.Context, id int) (models.ICalFeed, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, ok := m.icalFeeds[id]
+	if !ok {
+		return f, sql.ErrNoRows
+	}
+	return f, nil
+}
+
+func (m *testDBRepo) InsertICalFeed(ctx context.Context, f models.ICalFeed) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f.ID = len(m.icalFeeds) + 1
+	m.icalFeeds[f.ID] = f
+	return f.ID, nil
+}
+
+func (m *testDBRepo) UpdateICalFeedStatus(ctx context.Context, f models.ICalFeed) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	existing, ok := m.icalFeeds[f.ID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	existing.LastSyncedAt = f.LastSyncedAt
+	existing.LastError = f.LastError
+	m.icalFeeds[f.ID] = existing
+	return nil
+}
+
+func (m *testDBRepo) DeleteICalFeed(ctx context.Context, id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.icalFeeds, id)
+	delete(m.icalRestrictions, id)
+	return nil
+}
+
+func (m *testDBRepo) GetICalFeedRestrictions(ctx context.Context, feedID int) ([]models.RoomRestriction, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]models.RoomRestriction(nil), m.icalRestrictions[feedID]...), nil
+}
+
+// ReplaceICalFeedRestrictions keeps the ids of events that were synced before, like the postgres upsert does
+func (m *testDBRepo) ReplaceICalFeedRestrictions(ctx context.Context, f models.ICalFeed, restrictions []models.RoomRestriction) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ids := make(map[string]int)
+	nextID := 1
+	for _, r := range m.icalRestrictions[f.ID] {
+		ids[r.ICalUID] = r.ID
+		if r.ID >= nextID {
+			nextID = r.ID + 1
+		}
+	}
+
+	var synced []models.RoomRestriction
+	for _, r := range restrictions {
+		r.RoomID = f.RoomID
+		r.RestrictionID = 3
+		r.ICalFeedID = f.ID
+		if id, ok := ids[r.ICalUID]; ok {
+			r.ID = id
+		} else {
+			r.ID = nextID
+			nextID++
+		}
+		synced = append(synced, r)
+	}
+	m.icalRestrictions[f.ID] = synced
 	return nil
+}
+
+func (m *testDBRepo) QueueMail(ctx context.Context, mail models.MailData) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	o := models.OutboxMessage{
+		ID:            len(m.outbox) + 1,
+		Mail:          mail,
+		Status:        models.MailPending,
+		NextAttemptAt: now,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+	m.outbox = append(m.outbox, o)
+	return o.ID, nil
+}
+
+func (m *testDBRepo) ClaimMail(ctx context.Context, now, leaseUntil time.Time) (models.OutboxMessage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	due := -1
+	for i, o := range m.outbox {
+		if o.Status == models.MailPending && !o.NextAttemptAt.After(now) &&
+			(due < 0 || o.NextAttemptAt.Before(m.outbox[due].NextAttemptAt)) {
+			due = i
+		}
+	}
+	if due < 0 {
+		return models.OutboxMessage{}, sql.ErrNoRows
+	}
+	m.outbox[due].NextAttemptAt = leaseUntil
+	return m.outbox[due], nil
+}
+
+func (m *testDBRepo) UpdateMailStatus(ctx context.Context, o models.OutboxMessage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if o.ID < 1 || o.ID > len(m.outbox) {
+		return sql.ErrNoRows
+	}
+	o.UpdatedAt = time.Now()
+	m.outbox[o.ID-1] = o
+	return nil
+}
+
+func (m *testDBRepo) GetUnsentMail(ctx context.Context) ([]models.OutboxMessage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var messages []models.OutboxMessage
+	for i := len(m.outbox) - 1; i >= 0; i-- {
+		if m.outbox[i].Status != models.MailSent {
+			messages = append(messages, m.outbox[i])
+		}
+	}
+	return messages, nil
+}
+
+func (m *testDBRepo) ResendMail(ctx context.Context, id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if id < 1 || id > len(m.outbox) || m.outbox[id-1].Status == models.MailSent {
+		return sql.ErrNoRows
+	}
+	o := &m.outbox[id-1]
+	o.Status = models.MailPending
+	o.Attempts = 0
+	o.NextAttemptAt = time.Now()
+	o.LastError = ""
+	return nil
+}
+
+// testStays are the reservations the scheduled emails are sent for
+var testStays = []models.Reservation{
+	{ID: 7, FirstName: "John", LastName: "Smith", Email: "john@smith.com", RoomID: 1,
+		StartDate:        time.Date(2050, 1, 10, 0, 0, 0, 0, time.UTC),
+		EndDate:          time.Date(2050, 1, 12, 0, 0, 0, 0, time.UTC),
+		ConfirmationCode: "valid-code",
+		CreatedAt:        time.Date(2049, 12, 1, 9, 0, 0, 0, time.UTC),
+		Room:             models.Room{ID: 1, RoomName: "General's Quarters"}},
+	// booked the day before arriving
+	{ID: 8, FirstName: "Jane", LastName: "Doe", Email: "jane@doe.com", RoomID: 2,
+		StartDate:        time.Date(2050, 1, 10, 0, 0, 0, 0, time.UTC),
+		EndDate:          time.Date(2050, 1, 11, 0, 0, 0, 0, time.UTC),
+		ConfirmationCode: "late-code",
+		CreatedAt:        time.Date(2050, 1, 9, 18, 0, 0, 0, time.UTC),
+		Room:             models.Room{ID: 2, RoomName: "Major's Suite"}},
+}
+
+func (m *testDBRepo) GetArrivalsWithoutEmail(ctx context.Context, kind string, from, to time.Time) ([]models.Reservation, error) {
+	return m.staysWithoutEmail(kind, from, to, func(r models.Reservation) time.Time { return r.StartDate })
+}
+
+func (m *testDBRepo) GetDeparturesWithoutEmail(ctx context.Context, kind string, from, to time.Time) ([]models.Reservation, error) {
+	return m.staysWithoutEmail(kind, from, to, func(r models.Reservation) time.Time { return r.EndDate })
+}
+
+func (m *testDBRepo) staysWithoutEmail(kind string, from, to time.Time,
+	date func(models.Reservation) time.Time) ([]models.Reservation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var reservations []models.Reservation
+	for _, r := range testStays {
+		if !date(r).Before(from) && !date(r).After(to) && !m.reservationEmails[fmt.Sprintf("%d/%s", r.ID, kind)] {
+			reservations = append(reservations, r)
+		}
+	}
+	return reservations, nil
+}
+
+func (m *testDBRepo) QueueReservationEmail(ctx context.Context, reservationID int, kind string, mail models.MailData) (bool, error) {
+	key := fmt.Sprintf("%d/%s", reservationID, kind)
+
+	m.mu.Lock()
+	if m.reservationEmails[key] {
+		m.mu.Unlock()
+		return false, nil
+	}
+	m.reservationEmails[key] = true
+	m.mu.Unlock()
 
+	_, err := m.QueueMail(ctx, mail)
+	return err == nil, err
 }
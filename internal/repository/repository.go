@@ -2,33 +2,113 @@ package repository
 
 import (
 	"bookings/internal/models"
+	"context"
+	"errors"
 	"time"
 )
 
+// ErrRoomUnavailable is returned when a room was booked or blocked for the requested dates
+// between the guest searching for availability and submitting the reservation
+var ErrRoomUnavailable = errors.New("room is no longer available for those dates")
+
+// ErrInvalidToken is returned when a password token does not exist, has expired or has already been used
+var ErrInvalidToken = errors.New("password link is invalid or has expired")
+
+// ErrRestrictionInUse is returned when deleting a restriction type that the application relies on, or that rooms
+// are still restricted by
+var ErrRestrictionInUse = errors.New("restriction type is in use")
+
+// ErrRoomHasReservations is returned when deleting a room that guests have been booked into, as its reservations
+// are the record of what was let and would be deleted with it
+var ErrRoomHasReservations = errors.New("room has reservations")
+
+// DatabaseRepo is everything the application stores. Every method takes the context of the request or job it is
+// for, and gives up once that is cancelled
 type DatabaseRepo interface {
-	AllUsers() bool
-	AllRooms() ([]models.Room, error)
+	AllUsers(ctx context.Context) ([]models.User, error)
+	AllRooms(ctx context.Context) ([]models.Room, error)
+
+	InsertReservation(ctx context.Context, res models.Reservation) (int, error)
+	InsertRoomRestriction(ctx context.Context, r models.RoomRestriction) error
+	BookRoom(ctx context.Context, res models.Reservation) (int, error)
+	SearchAvailabilityByDatesByRoomID(ctx context.Context, startDate, endDate time.Time, roomId int) (bool, error)
+	SearchAvailabilityForAllRooms(ctx context.Context, startDate, endDate time.Time) ([]models.Room, error)
+
+	GetRoomById(ctx context.Context, id int) (models.Room, error)
+	GetRoomBySlug(ctx context.Context, slug string) (models.Room, error)
+	InsertRoom(ctx context.Context, r models.Room) (int, error)
+	UpdateRoom(ctx context.Context, r models.Room) error
+	UpdateRoomICalToken(ctx context.Context, id int, token string) error
+	DeleteRoom(ctx context.Context, id int) error
+
+	GetSeasonalRatesForRoom(ctx context.Context, roomID int, start, end time.Time) ([]models.SeasonalRate, error)
+	InsertSeasonalRate(ctx context.Context, s models.SeasonalRate) (int, error)
+	DeleteSeasonalRate(ctx context.Context, id int) error
+
+	GetUserById(ctx context.Context, id int) (models.User, error)
+	GetUserByEmail(ctx context.Context, email string) (models.User, error)
+	InsertUser(ctx context.Context, u models.User) (int, error)
+	UpdateUser(ctx context.Context, u models.User) error
+	UpdatePassword(ctx context.Context, id int, hashedPassword string) error
+	SetUserDisabled(ctx context.Context, id int, disabled bool) error
+	LockUser(ctx context.Context, id int, until time.Time) error
+	UnlockUser(ctx context.Context, id int) error
+
+	InsertLoginAttempt(ctx context.Context, a models.LoginAttempt) error
+	GetLoginFailures(ctx context.Context, email, ip string, since time.Time) (models.LoginFailures, error)
+	RecentFailedLogins(ctx context.Context, limit int) ([]models.LoginAttempt, error)
+
+	InsertPasswordToken(ctx context.Context, t models.PasswordToken) error
+	GetPasswordToken(ctx context.Context, hash string) (models.PasswordToken, error)
+	ResetPassword(ctx context.Context, tokenHash, hashedPassword string) error
+
+	Authenticate(ctx context.Context, email, testPassword string) (int, string, error)
+
+	SearchReservations(ctx context.Context, f models.ReservationFilter) ([]models.Reservation, int, error)
+	EachReservation(ctx context.Context, f models.ReservationFilter, fn func(models.Reservation) error) error
+
+	GetReservationById(ctx context.Context, id int) (models.Reservation, error)
+	GetReservationByCode(ctx context.Context, code string) (models.Reservation, error)
+	ChangeReservationDates(ctx context.Context, res models.Reservation) error
+	UpdateReservation(ctx context.Context, u models.Reservation) error
+	UpdateProcessedForReservation(ctx context.Context, id, processed int) error
+	DeleteReservation(ctx context.Context, id int) error
 
-	InsertReservation(res models.Reservation) (int, error)
-	InsertRoomRestriction(r models.RoomRestriction) error
-	SearchAvailabilityByDatesByRoomID(startDate, endDate time.Time, roomId int) (bool, error)
-	SearchAvailabilityForAllRooms(startDate, endDate time.Time) ([]models.Room, error)
+	AllRestrictions(ctx context.Context) ([]models.Restriction, error)
+	GetRestrictionByID(ctx context.Context, id int) (models.Restriction, error)
+	InsertRestriction(ctx context.Context, r models.Restriction) (int, error)
+	UpdateRestriction(ctx context.Context, r models.Restriction) error
+	DeleteRestriction(ctx context.Context, id int) error
 
-	GetRoomById(id int) (models.Room, error)
-	UpdateUser(u models.User) error
+	GetBlockByID(ctx context.Context, id int) (models.RoomRestriction, error)
+	InsertBlock(ctx context.Context, b models.RoomRestriction) (int, error)
+	UpdateBlock(ctx context.Context, b models.RoomRestriction) error
+	DeleteBlockById(ctx context.Context, id int) error
 
-	Authenticate(email, testPassword string) (int, string, error)
+	GetRestrictionsForRoomByDate(ctx context.Context, roomID int, start, end time.Time) ([]models.RoomRestriction, error)
+	EachRoomRestriction(ctx context.Context, start, end time.Time, fn func(models.RoomRestriction) error) error
 
-	AllReservations() ([]models.Reservation, error)
-	AllNewReservations() ([]models.Reservation, error)
+	AllICalFeeds(ctx context.Context) ([]models.ICalFeed, error)
+	GetICalFeedsForRoom(ctx context.Context, roomID int) ([]models.ICalFeed, error)
+	GetICalFeedByID(ctx context.Context, id int) (models.ICalFeed, error)
+	InsertICalFeed(ctx context.Context, f models.ICalFeed) (int, error)
+	UpdateICalFeedStatus(ctx context.Context, f models.ICalFeed) error
+	DeleteICalFeed(ctx context.Context, id int) error
+	GetICalFeedRestrictions(ctx context.Context, feedID int) ([]models.RoomRestriction, error)
+	ReplaceICalFeedRestrictions(ctx context.Context, f models.ICalFeed, restrictions []models.RoomRestriction) error
 
-	GetReservationById(id int) (models.Reservation, error)
-	UpdateReservation(u models.Reservation) error
-	UpdateProcessedForReservation(id, processed int) error
-	DeleteReservation(id int) error
+	GetArrivalsWithoutEmail(ctx context.Context, kind string, from, to time.Time) ([]models.Reservation, error)
+	GetDeparturesWithoutEmail(ctx context.Context, kind string, from, to time.Time) ([]models.Reservation, error)
+	QueueReservationEmail(ctx context.Context, reservationID int, kind string, m models.MailData) (bool, error)
 
-	InsertBlockForRoom(id int, startDate time.Time) error
-	DeleteBlockById(id int) error
+	QueueMail(ctx context.Context, m models.MailData) (int, error)
+	ClaimMail(ctx context.Context, now, leaseUntil time.Time) (models.OutboxMessage, error)
+	UpdateMailStatus(ctx context.Context, m models.OutboxMessage) error
+	GetUnsentMail(ctx context.Context) ([]models.OutboxMessage, error)
+	ResendMail(ctx context.Context, id int) error
 
-	GetRestrictionsForRoomByDate(roomID int, start, end time.Time) ([]models.RoomRestriction, error)
+	AllAPITokens(ctx context.Context) ([]models.APIToken, error)
+	InsertAPIToken(ctx context.Context, t models.APIToken) (int, error)
+	DeleteAPIToken(ctx context.Context, id int) error
+	GetUserByAPITokenHash(ctx context.Context, hash string) (models.User, error)
 }
@@ -0,0 +1,139 @@
+// Package scheduler sends the emails that are due some time before or after a guest's stay, rather than when
+// something happens on the site
+package scheduler
+
+import (
+	"bookings/internal/config"
+	"bookings/internal/email"
+	"bookings/internal/models"
+	"bookings/internal/repository"
+	"context"
+	"log/slog"
+	"time"
+)
+
+// the kinds of scheduled email, as recorded against each reservation once sent
+const (
+	KindReminder = "reminder"
+	KindThankYou = "thank-you"
+)
+
+// catchUpDays is how long after it was due an email is still sent, for when the application has been down
+const catchUpDays = 7
+
+// Scheduler queues a reminder ReminderDays before a guest arrives and a thank you ThankYouDays after they leave.
+// Either is turned off by setting its days to zero. Each reservation gets each email at most once
+type Scheduler struct {
+	DB     repository.DatabaseRepo
+	Mail   config.Mailer
+	Logger *slog.Logger
+	// Now is the current time, which tests replace with a fake clock
+	Now func() time.Time
+
+	ReminderDays int
+	ThankYouDays int
+	BaseURL      string
+	ReviewURL    string
+	MailFrom     string
+}
+
+// New returns a scheduler set up from the application's configuration
+func New(app *config.AppConfig, db repository.DatabaseRepo) *Scheduler {
+	return &Scheduler{
+		DB:           db,
+		Mail:         app.Mail,
+		Logger:       app.Logger,
+		Now:          time.Now,
+		ReminderDays: app.ReminderDays,
+		ThankYouDays: app.ThankYouDays,
+		BaseURL:      app.BaseURL,
+		ReviewURL:    app.ReviewURL,
+		MailFrom:     app.MailFrom,
+	}
+}
+
+// Start queues whatever is due straight away and then once every interval, in the background until ctx is done.
+// The returned channel is closed once it has stopped, so that the database isn't closed under it
+func (s *Scheduler) Start(ctx context.Context, interval time.Duration) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			s.Run(ctx)
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return done
+}
+
+// Run queues every scheduled email that is due, and returns how many it queued
+func (s *Scheduler) Run(ctx context.Context) int {
+	now := s.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	queued := 0
+
+	if s.ReminderDays > 0 {
+		arrivals, err := s.DB.GetArrivalsWithoutEmail(ctx, KindReminder, today, today.AddDate(0, 0, s.ReminderDays))
+		if err != nil {
+			s.Logger.Error("listing arrivals", "error", err)
+		}
+		for _, r := range arrivals {
+			// a guest who booked this close to arriving has only just had their confirmation
+			if r.CreatedAt.After(r.StartDate.AddDate(0, 0, -s.ReminderDays)) {
+				continue
+			}
+			queued += s.queue(ctx, r, KindReminder, email.Reminder{
+				Reservation: r,
+				ManageURL:   s.BaseURL + "/reservations/" + r.ConfirmationCode,
+			})
+		}
+	}
+
+	if s.ThankYouDays > 0 {
+		last := today.AddDate(0, 0, -s.ThankYouDays)
+		departures, err := s.DB.GetDeparturesWithoutEmail(ctx, KindThankYou, last.AddDate(0, 0, -catchUpDays), last)
+		if err != nil {
+			s.Logger.Error("listing departures", "error", err)
+		}
+		for _, r := range departures {
+			queued += s.queue(ctx, r, KindThankYou, email.ThankYou{Reservation: r, ReviewURL: s.ReviewURL})
+		}
+	}
+
+	if queued > 0 {
+		s.Mail.Notify()
+	}
+	return queued
+}
+
+// queue renders a scheduled email and queues it, unless the reservation has already had one of its kind. Returns
+// the number of emails queued
+func (s *Scheduler) queue(ctx context.Context, r models.Reservation, kind string, d email.Data) int {
+	msg, err := email.Render(d)
+	if err != nil {
+		s.Logger.Error("rendering email", "kind", kind, "reservation_id", r.ID, "error", err)
+		return 0
+	}
+
+	ok, err := s.DB.QueueReservationEmail(ctx, r.ID, kind, models.MailData{
+		To:      r.Email,
+		From:    s.MailFrom,
+		Subject: msg.Subject,
+		Content: msg.HTML,
+		Text:    msg.Text,
+	})
+	if err != nil {
+		s.Logger.Error("queueing email", "kind", kind, "reservation_id", r.ID, "error", err)
+		return 0
+	}
+	if !ok {
+		return 0
+	}
+	return 1
+}
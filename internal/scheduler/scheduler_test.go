@@ -0,0 +1,118 @@
+package scheduler
+
+import (
+	"bookings/internal/config"
+	"bookings/internal/models"
+	"bookings/internal/repository/dbrepo"
+	"context"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+// nopMailer stands in for the mailer, which the test repository's outbox makes unnecessary
+type nopMailer struct {
+	notified int
+}
+
+func (m *nopMailer) Queue(context.Context, models.MailData) error { return nil }
+func (m *nopMailer) Notify()                                      { m.notified++ }
+
+// clock is a fake clock that only moves when told to
+type clock struct {
+	now time.Time
+}
+
+func (c *clock) Now() time.Time { return c.now }
+
+func newTestScheduler() (*Scheduler, *clock) {
+	app := &config.AppConfig{
+		Mail:         &nopMailer{},
+		Logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+		ReminderDays: 3,
+		ThankYouDays: 1,
+		BaseURL:      "https://example.com",
+		MailFrom:     "me@here.com",
+	}
+	s := New(app, dbrepo.NewTestingRepo(app))
+	c := &clock{}
+	s.Now = c.Now
+	return s, c
+}
+
+func at(day int) time.Time {
+	return time.Date(2050, 1, day, 9, 0, 0, 0, time.UTC)
+}
+
+// The test repository has John arriving on 10 January and leaving on the 12th, and Jane, who booked on the 9th,
+// staying the night of the 10th
+func TestScheduler_Run(t *testing.T) {
+	s, c := newTestScheduler()
+
+	tests := []struct {
+		name     string
+		now      time.Time
+		expected int
+	}{
+		{"too early for a reminder", at(6), 0},
+		{"reminder due", at(7), 1},
+		{"reminder already sent", at(8), 0},
+		{"restarted on arrival day", at(10), 0},
+		{"jane's thank you due", at(12), 1},
+		{"john's thank you due", at(13), 1},
+		{"thank yous already sent", at(14), 0},
+	}
+	for _, e := range tests {
+		c.now = e.now
+		if got := s.Run(context.Background()); got != e.expected {
+			t.Errorf("%s: expected %d emails but got %d", e.name, e.expected, got)
+		}
+	}
+
+	unsent, _ := s.DB.GetUnsentMail(context.Background())
+	if len(unsent) != 3 {
+		t.Fatalf("expected 3 emails in the outbox but got %d", len(unsent))
+	}
+	var reminders int
+	for _, m := range unsent {
+		if strings.HasPrefix(m.Mail.Subject, "Your stay starts") {
+			reminders++
+			if m.Mail.To != "john@smith.com" || !strings.Contains(m.Mail.Text, "https://example.com/reservations/valid-code") {
+				t.Errorf("expected John's reminder with a link to manage his reservation but got %+v", m.Mail)
+			}
+		}
+	}
+	if reminders != 1 {
+		t.Errorf("expected only John to get a reminder but %d were sent", reminders)
+	}
+	if n := s.Mail.(*nopMailer).notified; n != 3 {
+		t.Errorf("expected the mailer to be woken for each run that queued mail, but it was woken %d times", n)
+	}
+}
+
+func TestScheduler_CatchUpLimit(t *testing.T) {
+	s, c := newTestScheduler()
+	s.ReminderDays = 0
+
+	// a thank you is not sent weeks late
+	c.now = at(31)
+	if got := s.Run(context.Background()); got != 0 {
+		t.Errorf("expected no emails but got %d", got)
+	}
+}
+
+func TestScheduler_Start(t *testing.T) {
+	s, c := newTestScheduler()
+	c.now = at(1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := s.Start(ctx, time.Hour)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the scheduler to stop once its context was done")
+	}
+}
@@ -0,0 +1,225 @@
+// Package xlsx writes spreadsheets in the Office Open XML format Excel uses, a row at a time, so that large exports
+// can be streamed rather than built up in memory. It writes a single sheet of text, numbers and dates, and nothing
+// more
+package xlsx
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Money is an amount in cents, written as a number of whole units with two decimal places
+type Money int
+
+// Percent is a fraction, written as a percentage
+type Percent float64
+
+// the cell styles in styles.xml, by their index
+const (
+	styleDefault = iota
+	styleDate
+	styleMoney
+	stylePercent
+	styleHeader
+)
+
+// epoch is the day Excel counts dates from, so as to agree with Lotus 1-2-3's mistaken leap day in 1900
+var epoch = time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC)
+
+// Writer writes a workbook with one sheet. Rows go straight to the underlying writer, compressed, as they are written
+type Writer struct {
+	zw    *zip.Writer
+	sheet *bufio.Writer
+	rows  int
+}
+
+// NewWriter starts a workbook with one sheet, called name, on w
+func NewWriter(w io.Writer, name string) (*Writer, error) {
+	zw := zip.NewWriter(w)
+	var sheetName strings.Builder
+	if err := xml.EscapeText(&sheetName, []byte(sanitizeSheetName(name))); err != nil {
+		return nil, err
+	}
+
+	files := []struct{ name, content string }{
+		{"[Content_Types].xml", contentTypes},
+		{"_rels/.rels", rootRels},
+		{"xl/workbook.xml", fmt.Sprintf(workbook, sheetName.String())},
+		{"xl/_rels/workbook.xml.rels", workbookRels},
+		{"xl/styles.xml", styles},
+	}
+	for _, f := range files {
+		fw, err := zw.Create(f.name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.WriteString(fw, xml.Header+f.content); err != nil {
+			return nil, err
+		}
+	}
+
+	fw, err := zw.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return nil, err
+	}
+	x := &Writer{zw: zw, sheet: bufio.NewWriter(fw)}
+	_, err = x.sheet.WriteString(xml.Header + `<worksheet xmlns="` + mainNS + `"><sheetData>`)
+	if err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// WriteHeader writes a row of column headings, in bold
+func (x *Writer) WriteHeader(headings ...string) error {
+	cells := make([]interface{}, len(headings))
+	for i, h := range headings {
+		cells[i] = h
+	}
+	return x.writeRow(cells, styleHeader)
+}
+
+// Write writes a row. Cells may be strings, ints, floats, Money, Percent or times, which are written as dates; a
+// zero time or a nil leaves the cell empty
+func (x *Writer) Write(cells ...interface{}) error {
+	return x.writeRow(cells, styleDefault)
+}
+
+func (x *Writer) writeRow(cells []interface{}, style int) error {
+	// a row is checked before any of it is written, so that a bad cell can't leave the sheet half written
+	for _, cell := range cells {
+		switch cell.(type) {
+		case nil, string, int, float64, Money, Percent, time.Time:
+		default:
+			return fmt.Errorf("xlsx: cannot write a %T", cell)
+		}
+	}
+
+	x.rows++
+	fmt.Fprintf(x.sheet, `<row r="%d">`, x.rows)
+	for i, cell := range cells {
+		if err := x.writeCell(column(i)+strconv.Itoa(x.rows), cell, style); err != nil {
+			return err
+		}
+	}
+	_, err := x.sheet.WriteString(`</row>`)
+	return err
+}
+
+func (x *Writer) writeCell(ref string, cell interface{}, style int) error {
+	// numbers keep their own format, whatever the row's style
+	number := func(v string, s int) {
+		fmt.Fprintf(x.sheet, `<c r="%s" s="%d"><v>%s</v></c>`, ref, s, v)
+	}
+
+	switch v := cell.(type) {
+	case nil:
+	case string:
+		fmt.Fprintf(x.sheet, `<c r="%s" s="%d" t="inlineStr"><is><t xml:space="preserve">`, ref, style)
+		if err := xml.EscapeText(x.sheet, []byte(v)); err != nil {
+			return err
+		}
+		x.sheet.WriteString(`</t></is></c>`)
+	case int:
+		number(strconv.Itoa(v), styleDefault)
+	case float64:
+		number(strconv.FormatFloat(v, 'f', -1, 64), styleDefault)
+	case Money:
+		number(strconv.FormatFloat(float64(v)/100, 'f', 2, 64), styleMoney)
+	case Percent:
+		number(strconv.FormatFloat(float64(v), 'f', -1, 64), stylePercent)
+	case time.Time:
+		if v.IsZero() {
+			break
+		}
+		// dates are counted in days, and the time of day as a fraction of one
+		y, m, d := v.Date()
+		day := time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+		serial := day.Sub(epoch).Hours()/24 + v.Sub(time.Date(y, m, d, 0, 0, 0, 0, v.Location())).Hours()/24
+		number(strconv.FormatFloat(serial, 'f', -1, 64), styleDate)
+	}
+	return nil
+}
+
+// Close finishes the sheet and the workbook. It doesn't close the underlying writer
+func (x *Writer) Close() error {
+	if _, err := x.sheet.WriteString(`</sheetData></worksheet>`); err != nil {
+		return err
+	}
+	if err := x.sheet.Flush(); err != nil {
+		return err
+	}
+	return x.zw.Close()
+}
+
+// column returns the letters naming the i'th column, counting from 0: A to Z, then AA
+func column(i int) string {
+	name := ""
+	for i++; i > 0; i = (i - 1) / 26 {
+		name = string(rune('A'+(i-1)%26)) + name
+	}
+	return name
+}
+
+// sanitizeSheetName makes name acceptable to Excel, which refuses sheet names that are blank, longer than 31
+// characters, or contain any of []:*?/\
+func sanitizeSheetName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`[]:*?/\`, r) {
+			return '-'
+		}
+		return r
+	}, strings.TrimSpace(name))
+	if r := []rune(name); len(r) > 31 {
+		name = string(r[:31])
+	}
+	if name == "" {
+		name = "Sheet1"
+	}
+	return name
+}
+
+const mainNS = "http://schemas.openxmlformats.org/spreadsheetml/2006/main"
+
+const contentTypes = `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+	`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+	`<Default Extension="xml" ContentType="application/xml"/>` +
+	`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+	`<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+	`<Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>` +
+	`</Types>`
+
+const rootRels = `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+	`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+	`</Relationships>`
+
+const workbook = `<workbook xmlns="` + mainNS + `" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+	`<sheets><sheet name="%s" sheetId="1" r:id="rId1"/></sheets>` +
+	`</workbook>`
+
+const workbookRels = `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+	`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>` +
+	`<Relationship Id="rId2" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>` +
+	`</Relationships>`
+
+// styles holds, in the order of the style constants, plain cells, dates, money, percentages and headings. 14, 4
+// and 10 are Excel's own formats for dates, #,##0.00 and 0.00%
+const styles = `<styleSheet xmlns="` + mainNS + `">` +
+	`<fonts count="2"><font><sz val="11"/><name val="Calibri"/></font><font><b/><sz val="11"/><name val="Calibri"/></font></fonts>` +
+	`<fills count="2"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill></fills>` +
+	`<borders count="1"><border><left/><right/><top/><bottom/><diagonal/></border></borders>` +
+	`<cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs>` +
+	`<cellXfs count="5">` +
+	`<xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/>` +
+	`<xf numFmtId="14" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>` +
+	`<xf numFmtId="4" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>` +
+	`<xf numFmtId="10" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>` +
+	`<xf numFmtId="0" fontId="1" fillId="0" borderId="0" xfId="0" applyFont="1"/>` +
+	`</cellXfs>` +
+	`</styleSheet>`
@@ -0,0 +1,99 @@
+package xlsx
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readFile returns the contents of a file in the workbook
+func readFile(t *testing.T, b []byte, name string) string {
+	t.Helper()
+	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := zr.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	content, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+func TestWriter(t *testing.T) {
+	var b bytes.Buffer
+	x, err := NewWriter(&b, "Reservations: 2050/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := x.WriteHeader("Guest", "Arrival", "Nights", "Total", "Occupancy"); err != nil {
+		t.Fatal(err)
+	}
+	err = x.Write("Smith & <Sons>", time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC), 3, Money(30050), Percent(0.25))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := x.Write(nil, time.Time{}, 1.5); err != nil {
+		t.Fatal(err)
+	}
+	if err := x.Write(struct{}{}); err == nil {
+		t.Error("expected a cell of an unknown type to be refused")
+	}
+	if err := x.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	sheet := readFile(t, b.Bytes(), "xl/worksheets/sheet1.xml")
+	if err := xml.Unmarshal([]byte(sheet), new(struct{})); err != nil {
+		t.Fatalf("expected well formed xml but got %v in %s", err, sheet)
+	}
+	for _, want := range []string{
+		`<c r="A1" s="4" t="inlineStr"><is><t xml:space="preserve">Guest</t></is></c>`,
+		`<t xml:space="preserve">Smith &amp; &lt;Sons&gt;</t>`,
+		`<c r="B2" s="1"><v>54789</v></c>`,
+		`<c r="C2" s="0"><v>3</v></c>`,
+		`<c r="D2" s="2"><v>300.50</v></c>`,
+		`<c r="E2" s="3"><v>0.25</v></c>`,
+		`<row r="3"><c r="C3" s="0"><v>1.5</v></c></row>`,
+	} {
+		if !strings.Contains(sheet, want) {
+			t.Errorf("expected %s in %s", want, sheet)
+		}
+	}
+
+	if workbook := readFile(t, b.Bytes(), "xl/workbook.xml"); !strings.Contains(workbook, `name="Reservations- 2050-1"`) {
+		t.Errorf("expected the sheet name to be made acceptable to Excel but got %s", workbook)
+	}
+	readFile(t, b.Bytes(), "[Content_Types].xml")
+	readFile(t, b.Bytes(), "xl/styles.xml")
+}
+
+func TestColumn(t *testing.T) {
+	var tests = []struct {
+		index    int
+		expected string
+	}{
+		{0, "A"},
+		{25, "Z"},
+		{26, "AA"},
+		{51, "AZ"},
+		{52, "BA"},
+		{701, "ZZ"},
+		{702, "AAA"},
+	}
+
+	for _, e := range tests {
+		if got := column(e.index); got != e.expected {
+			t.Errorf("column %d: expected %s but got %s", e.index, e.expected, got)
+		}
+	}
+}
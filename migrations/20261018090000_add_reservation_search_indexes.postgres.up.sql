@@ -0,0 +1,9 @@
+create index reservations_start_date_idx on reservations (start_date);
+create index reservations_end_date_idx on reservations (end_date);
+create index reservations_created_at_idx on reservations (created_at);
+create index reservations_room_id_start_date_idx on reservations (room_id, start_date);
+create index reservations_processed_start_date_idx on reservations (processed, start_date);
+create index reservations_first_name_search_idx on reservations (lower(first_name) text_pattern_ops);
+create index reservations_last_name_search_idx on reservations (lower(last_name) text_pattern_ops);
+create index reservations_email_search_idx on reservations (lower(email) text_pattern_ops);
+create index reservations_phone_search_idx on reservations (lower(phone) text_pattern_ops);
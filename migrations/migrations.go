@@ -0,0 +1,10 @@
+// Package migrations embeds the database migrations in the binary, so that it can migrate a database without soda
+package migrations
+
+import "embed"
+
+// FS holds the fizz and sql migration files, named as soda names them. Postgres migrations are at the top, and
+// SQLite's, which start from a copy of the schema rather than its whole history, are in sqlite/
+//
+//go:embed *.fizz *.sql sqlite/*.sql
+var FS embed.FS
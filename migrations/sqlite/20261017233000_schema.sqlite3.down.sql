@@ -0,0 +1,12 @@
+drop table reservation_emails;
+drop table mail_outbox;
+drop table login_attempts;
+drop table password_tokens;
+drop table api_tokens;
+drop table seasonal_rates;
+drop table room_restrictions;
+drop table ical_feeds;
+drop table restrictions;
+drop table reservations;
+drop table rooms;
+drop table users;
@@ -0,0 +1,179 @@
+-- SQLite databases start from the schema as it stood at this version, because fizz cannot add foreign keys to
+-- SQLite tables. Later migrations need a .sqlite3.up.sql here as well as their fizz in migrations/
+
+create table users (
+    id integer primary key autoincrement,
+    first_name varchar(255) not null default '',
+    last_name varchar(255) not null default '',
+    email varchar(255) not null,
+    password varchar(60) not null,
+    access_level integer not null default 1,
+    disabled bool not null default false,
+    locked_until timestamp,
+    created_at timestamp not null,
+    updated_at timestamp not null
+);
+create unique index users_email_idx on users (email);
+
+create table rooms (
+    id integer primary key autoincrement,
+    room_name varchar(255) not null default '',
+    slug varchar(255) not null default '',
+    description text not null default '',
+    capacity integer not null default 2,
+    photos text not null default '',
+    base_rate integer not null default 0,
+    weekend_surcharge integer not null default 0,
+    min_stay integer not null default 1,
+    ical_token varchar(255) not null default '',
+    created_at timestamp not null,
+    updated_at timestamp not null
+);
+create unique index rooms_slug_idx on rooms (slug);
+
+create table reservations (
+    id integer primary key autoincrement,
+    first_name varchar(255) not null default '',
+    last_name varchar(255) not null default '',
+    phone varchar(255) not null default '',
+    email varchar(255) not null default '',
+    start_date date not null,
+    end_date date not null,
+    room_id integer not null references rooms (id) on update cascade on delete cascade,
+    processed integer not null default 0,
+    total_price integer not null default 0,
+    confirmation_code varchar(255) not null default '',
+    created_at timestamp not null,
+    updated_at timestamp not null
+);
+create unique index reservations_confirmation_code_idx on reservations (confirmation_code);
+
+create table restrictions (
+    id integer primary key autoincrement,
+    restriction_name varchar(255) not null default '',
+    system_key varchar(255) not null default '',
+    colour varchar(255) not null default '#6c757d',
+    blocks_booking bool not null default true,
+    guest_visible bool not null default false,
+    created_at timestamp not null,
+    updated_at timestamp not null
+);
+create unique index restrictions_system_key_idx on restrictions (system_key) where system_key <> '';
+
+create table ical_feeds (
+    id integer primary key autoincrement,
+    room_id integer not null references rooms (id) on update cascade on delete cascade,
+    name varchar(255) not null default '',
+    url varchar(255) not null default '',
+    contents text not null default '',
+    last_synced_at timestamp,
+    last_error varchar(255) not null default '',
+    created_at timestamp not null,
+    updated_at timestamp not null
+);
+
+create table room_restrictions (
+    id integer primary key autoincrement,
+    start_date date not null,
+    end_date date not null,
+    room_id integer not null references rooms (id) on update cascade on delete cascade,
+    reservation_id integer references reservations (id) on update cascade on delete cascade,
+    restriction_id integer not null references restrictions (id) on update cascade on delete cascade,
+    ical_feed_id integer references ical_feeds (id) on update cascade on delete cascade,
+    ical_uid varchar(255) not null default '',
+    note varchar(255) not null default '',
+    created_at timestamp not null,
+    updated_at timestamp not null
+);
+create index room_restrictions_start_date_end_date_idx on room_restrictions (start_date, end_date);
+create index room_restrictions_room_id_idx on room_restrictions (room_id);
+create index room_restrictions_reservation_id_idx on room_restrictions (reservation_id);
+create unique index room_restrictions_ical_feed_id_ical_uid_idx on room_restrictions (ical_feed_id, ical_uid);
+
+create table seasonal_rates (
+    id integer primary key autoincrement,
+    room_id integer not null references rooms (id) on update cascade on delete cascade,
+    name varchar(255) not null default '',
+    start_date date not null,
+    end_date date not null,
+    nightly_rate integer not null default 0,
+    min_stay integer not null default 0,
+    created_at timestamp not null,
+    updated_at timestamp not null
+);
+create index seasonal_rates_room_id_start_date_end_date_idx on seasonal_rates (room_id, start_date, end_date);
+
+create table api_tokens (
+    id integer primary key autoincrement,
+    user_id integer not null references users (id) on update cascade on delete cascade,
+    name varchar(255) not null default '',
+    token_hash varchar(64) not null,
+    last_used_at timestamp,
+    created_at timestamp not null,
+    updated_at timestamp not null
+);
+create unique index api_tokens_token_hash_idx on api_tokens (token_hash);
+
+create table password_tokens (
+    id integer primary key autoincrement,
+    user_id integer not null references users (id) on update cascade on delete cascade,
+    token_hash varchar(64) not null,
+    purpose varchar(255) not null default '',
+    expires_at timestamp not null,
+    used_at timestamp,
+    created_at timestamp not null,
+    updated_at timestamp not null
+);
+create unique index password_tokens_token_hash_idx on password_tokens (token_hash);
+
+create table login_attempts (
+    id integer primary key autoincrement,
+    email varchar(255) not null default '',
+    ip_address varchar(255) not null default '',
+    outcome varchar(255) not null default '',
+    created_at timestamp not null,
+    updated_at timestamp not null
+);
+create index login_attempts_email_created_at_idx on login_attempts (email, created_at);
+create index login_attempts_ip_address_created_at_idx on login_attempts (ip_address, created_at);
+
+create table mail_outbox (
+    id integer primary key autoincrement,
+    to_address varchar(255) not null,
+    from_address varchar(255) not null,
+    subject varchar(255) not null default '',
+    content text not null default '',
+    text_content text not null default '',
+    status varchar(255) not null default 'pending',
+    attempts integer not null default 0,
+    next_attempt_at timestamp not null,
+    last_error text not null default '',
+    sent_at timestamp,
+    created_at timestamp not null,
+    updated_at timestamp not null
+);
+create index mail_outbox_status_next_attempt_at_idx on mail_outbox (status, next_attempt_at);
+
+create table reservation_emails (
+    id integer primary key autoincrement,
+    reservation_id integer not null references reservations (id) on update cascade on delete cascade,
+    kind varchar(255) not null,
+    created_at timestamp not null,
+    updated_at timestamp not null
+);
+create unique index reservation_emails_reservation_id_kind_idx on reservation_emails (reservation_id, kind);
+
+insert into rooms (room_name, slug, description, photos, ical_token, created_at, updated_at) values
+('General''s Quarters', 'generals-quarters',
+    'Your home away from home, set on the majestic waters of the Atlantic Ocean.',
+    '/static/images/generals-quarters.png', lower(hex(randomblob(16))),
+    '2022-09-10 00:00:00+00:00', '2022-09-10 00:00:00+00:00'),
+('Colonel''s Suite', 'colonels-suite',
+    'Your home away from home, set on the majestic waters of the Atlantic Ocean, this will be a vacation to remember.',
+    '/static/images/colonels-suite.png', lower(hex(randomblob(16))),
+    '2022-09-10 00:00:00+00:00', '2022-09-10 00:00:00+00:00');
+
+insert into restrictions (id, restriction_name, system_key, colour, created_at, updated_at) values
+(1, 'Reservation', 'reservation', '#dc3545', '2022-09-10 00:00:00+00:00', '2022-09-10 00:00:00+00:00'),
+(2, 'Owner Block', 'owner_block', '#ffc107', '2022-09-10 00:00:00+00:00', '2022-09-10 00:00:00+00:00'),
+(3, 'External Booking', 'external', '#17a2b8', '2022-09-10 00:00:00+00:00', '2022-09-10 00:00:00+00:00');
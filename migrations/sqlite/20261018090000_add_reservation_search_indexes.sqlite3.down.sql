@@ -0,0 +1,5 @@
+drop index reservations_processed_start_date_idx;
+drop index reservations_room_id_start_date_idx;
+drop index reservations_created_at_idx;
+drop index reservations_end_date_idx;
+drop index reservations_start_date_idx;
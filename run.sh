@@ -1,4 +1,5 @@
 #!/bin/bash
 
 go build -o bookings cmd/web/*.go
-./bookings -dbname=bookings -dbuser=raymondjolly -cache=false -production=false
\ No newline at end of file
+./bookings -dbname=bookings -dbuser=raymondjolly -cache=false -production=false \
+  -mail-from=me@here.com -owner-email=me@here.com -auto-migrate